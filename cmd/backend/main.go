@@ -14,6 +14,7 @@ import (
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/cleanup"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/config"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/metrics"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/mrhid6/go-mongoose/mongoose"
@@ -59,6 +60,13 @@ func main() {
 		grpcBind = os.Getenv("GRPC_PORT")
 	}
 
+	// Metrics are served on a listener of their own, which is not published
+	// the way the API's is: the queue gauges name actions and accounts' load.
+	metricsBind := ":9090"
+	if os.Getenv("METRICS_PORT") != "" {
+		metricsBind = os.Getenv("METRICS_PORT")
+	}
+
 	srv := &http.Server{
 		Addr:    httpBind,
 		Handler: MainRouter,
@@ -70,6 +78,19 @@ func main() {
 		}
 	}()
 
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", metrics.Handler())
+	metricsSrv := &http.Server{
+		Addr:    metricsBind,
+		Handler: metricsMux,
+	}
+
+	go func() {
+		if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("metrics listen: %s\n", err)
+		}
+	}()
+
 	grpcServer := grpc.NewServer()
 
 	go func() {
@@ -98,6 +119,9 @@ func main() {
 		{Name: "gin", Op: func(ctx context.Context) error {
 			return srv.Shutdown(ctx)
 		}},
+		{Name: "metrics", Op: func(ctx context.Context) error {
+			return metricsSrv.Shutdown(ctx)
+		}},
 		{Name: "services", Op: func(ctx context.Context) error {
 			return services.ShutdownAllServices()
 		}},
@@ -270,3 +270,116 @@ func (h *Handler) SetUserActiveAccount(ctx context.Context, in *pb.AdminSetUserA
 
 	return &pbModels.SSMEmpty{}, nil
 }
+
+// ---- Dead-letter agent tasks ----
+
+func deadLetterFilterFromProto(in *pb.AdminDeadLetterFilter) admin.AdminDeadLetterFilter {
+	if in == nil {
+		return admin.AdminDeadLetterFilter{}
+	}
+	return admin.AdminDeadLetterFilter{
+		AccountId: in.AccountId,
+		AgentId:   in.AgentId,
+		Action:    in.Action,
+		ErrorText: in.ErrorText,
+		From:      in.From,
+		To:        in.To,
+	}
+}
+
+func (h *Handler) ListDeadLetterTasks(ctx context.Context, in *pb.AdminListDeadLetterTasksRequest) (*pb.AdminListDeadLetterTasksResponse, error) {
+	if err := h.validateAdminKey(ctx); err != nil {
+		return nil, err
+	}
+
+	tasks, total, err := admin.AdminListDeadLetterTasks(deadLetterFilterFromProto(in.Filter), in.Page, in.PageSize)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	out := make([]*pb.AdminDeadLetterTask, 0, len(tasks))
+	for i := range tasks {
+		t := &tasks[i]
+		view := &pb.AdminDeadLetterTask{
+			Id:        t.ID.Hex(),
+			AccountId: t.AccountID.Hex(),
+			AgentId:   t.AgentID.Hex(),
+			Action:    t.Action,
+			Data:      t.Data,
+			LastError: t.LastError,
+			Attempts:  int32(t.Attempts),
+			CreatedAt: t.CreatedAt.Unix(),
+		}
+		if t.FinishedAt != nil {
+			view.FinishedAt = t.FinishedAt.Unix()
+		}
+		out = append(out, view)
+	}
+
+	return &pb.AdminListDeadLetterTasksResponse{Tasks: out, Total: int32(total)}, nil
+}
+
+func (h *Handler) ReplayDeadLetterTasks(ctx context.Context, in *pb.AdminDeadLetterBulkRequest) (*pb.AdminReplayDeadLetterTasksResponse, error) {
+	if err := h.validateAdminKey(ctx); err != nil {
+		return nil, err
+	}
+
+	replayed, failures, err := admin.AdminReplayDeadLetterTasks(deadLetterFilterFromProto(in.Filter))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	res := &pb.AdminReplayDeadLetterTasksResponse{Replayed: int32(replayed)}
+	for _, f := range failures {
+		res.Failures = append(res.Failures, &pb.AdminDeadLetterFailure{TaskId: f.TaskID.Hex(), Error: f.Error})
+	}
+	return res, nil
+}
+
+func (h *Handler) DiscardDeadLetterTasks(ctx context.Context, in *pb.AdminDeadLetterBulkRequest) (*pb.AdminDiscardDeadLetterTasksResponse, error) {
+	if err := h.validateAdminKey(ctx); err != nil {
+		return nil, err
+	}
+
+	discarded, err := admin.AdminDiscardDeadLetterTasks(deadLetterFilterFromProto(in.Filter))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return &pb.AdminDiscardDeadLetterTasksResponse{Discarded: int32(discarded)}, nil
+}
+
+func (h *Handler) ExportDeadLetterTasks(ctx context.Context, in *pb.AdminDeadLetterBulkRequest) (*pb.AdminExportDeadLetterTasksResponse, error) {
+	if err := h.validateAdminKey(ctx); err != nil {
+		return nil, err
+	}
+
+	exported, err := admin.AdminExportDeadLetterTasks(deadLetterFilterFromProto(in.Filter))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.AdminExportDeadLetterTasksResponse{Exported: int32(exported)}, nil
+}
+
+func (h *Handler) ListAgentConnections(ctx context.Context, in *pb.AdminListAgentConnectionsRequest) (*pb.AdminListAgentConnectionsResponse, error) {
+	if err := h.validateAdminKey(ctx); err != nil {
+		return nil, err
+	}
+
+	conns, self, err := admin.AdminListAgentConnections(in.Replica)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	res := &pb.AdminListAgentConnectionsResponse{Replica: self}
+	for _, c := range conns {
+		res.Connections = append(res.Connections, &pb.AdminAgentConnection{
+			AgentId:      c.AgentID.Hex(),
+			AgentName:    c.AgentName,
+			Replica:      c.Replica,
+			ConnectionId: c.ConnectionID,
+		})
+	}
+	return res, nil
+}
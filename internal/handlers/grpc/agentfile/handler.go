@@ -10,8 +10,10 @@ import (
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/handlers/grpc/transfer"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agent"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agentmod"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/types"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
 	modelsv2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
 	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
 	pbModels "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated/models"
@@ -91,9 +93,11 @@ func (h *Handler) UploadFile(stream pb.AgentFileService_UploadFileServer) error
 	case pb.FileKind_FILE_KIND_SAVE:
 		err = agent.UploadedAgentSave(*apiKey, fileIdentity, false)
 	case pb.FileKind_FILE_KIND_BACKUP:
-		err = agent.UploadedAgentBackup(*apiKey, fileIdentity)
+		err = agent.UploadedAgentBackup(*apiKey, fileIdentity, backupMods(*apiKey))
 	case pb.FileKind_FILE_KIND_LOG:
 		err = agent.UploadedAgentLog(*apiKey, fileIdentity)
+	case pb.FileKind_FILE_KIND_TASK_ARTIFACT:
+		err = agent.UploadedTaskArtifact(*apiKey, init.TaskId, init.LeaseToken, fileIdentity)
 	default:
 		err = fmt.Errorf("unknown file kind %v", init.Kind)
 	}
@@ -106,12 +110,34 @@ func (h *Handler) UploadFile(stream pb.AgentFileService_UploadFileServer) error
 	return stream.SendAndClose(&pb.UploadFileResponse{Success: true})
 }
 
+// backupMods is the agent's mod selection, kept with a backup it uploads. A
+// failure only costs the restore its mod step, so it does not fail the upload.
+func backupMods(apiKey string) *modelsv2.Lockfile {
+	theAgent, err := agent.GetAgentByAPIKey(apiKey)
+	if err != nil {
+		return nil
+	}
+	mods, err := agentmod.Snapshot(theAgent.ID)
+	if err != nil {
+		logger.GetErrorLogger().Printf("error capturing mods for agent %s backup with error: %s", theAgent.ID.Hex(), err.Error())
+		return nil
+	}
+	return &mods
+}
+
 func (h *Handler) DownloadFile(in *pb.DownloadFileRequest, stream pb.AgentFileService_DownloadFileServer) error {
 	apiKey, err := utils.GetAPIKeyFromContext(stream.Context())
 	if err != nil {
 		return err
 	}
-	objectPath, err := agent.SaveObjectPathForAPIKey(*apiKey, in.Filename)
+	// Saves are all an older agent asks for, and it leaves Kind unset. A
+	// restore asks for a backup.
+	var objectPath string
+	if in.Kind == pb.FileKind_FILE_KIND_BACKUP {
+		objectPath, err = agent.BackupObjectPathForAPIKey(*apiKey, in.Filename)
+	} else {
+		objectPath, err = agent.SaveObjectPathForAPIKey(*apiKey, in.Filename)
+	}
 	if err != nil {
 		return err
 	}
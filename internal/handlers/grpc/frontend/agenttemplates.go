@@ -0,0 +1,135 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttemplate"
+	modelsV2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
+	pbModels "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated/models"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func mapAgentTemplateToProto(t *agenttemplate.AgentTemplate) *pb.AgentTemplate {
+	return &pb.AgentTemplate{
+		Name:            t.Name,
+		SourceAgentName: t.SourceAgentName,
+		ModCount:        int32(len(t.Mods.Mods)),
+		CreatedBy:       t.CreatedBy,
+		UpdatedAt:       t.UpdatedAt.Unix(),
+	}
+}
+
+// agentTemplateError maps the agent template service's refusals onto status
+// codes.
+func agentTemplateError(err error) error {
+	switch {
+	case errors.Is(err, agenttemplate.ErrTemplateNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, agenttemplate.ErrInvalidTemplate):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return err
+}
+
+func (s *Handler) ListAgentTemplates(ctx context.Context, in *pb.ListAgentTemplatesRequest) (*pb.ListAgentTemplatesResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAccount, err := s.activeAccountForUser(in.Eid)
+	if err != nil {
+		return nil, err
+	}
+
+	templates, err := agenttemplate.ListTemplates(theAccount.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.ListAgentTemplatesResponse{}
+	for idx := range templates {
+		res.Templates = append(res.Templates, mapAgentTemplateToProto(&templates[idx]))
+	}
+	return res, nil
+}
+
+// SaveAgentTemplate stores one of the caller's agents as a template, replacing
+// any of the same name.
+func (s *Handler) SaveAgentTemplate(ctx context.Context, in *pb.SaveAgentTemplateRequest) (*pb.AgentTemplateResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAgent, theAccount, err := s.resolveAgentForUser(in.Eid, in.AgentId)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := agenttemplate.SaveFromAgent(theAccount, theAgent, in.Name, in.Eid)
+	if err != nil {
+		return nil, agentTemplateError(err)
+	}
+
+	return &pb.AgentTemplateResponse{Template: mapAgentTemplateToProto(t)}, nil
+}
+
+func (s *Handler) DeleteAgentTemplate(ctx context.Context, in *pb.DeleteAgentTemplateRequest) (*pbModels.SSMEmpty, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAccount, err := s.activeAccountForUser(in.Eid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := agenttemplate.DeleteTemplate(theAccount.ID, in.Name); err != nil {
+		return nil, agentTemplateError(err)
+	}
+	return &pbModels.SSMEmpty{}, nil
+}
+
+// CloneAgent creates an agent as a copy of one of the caller's agents, or of
+// one of the account's agent templates when Template is set instead.
+func (s *Handler) CloneAgent(ctx context.Context, in *pb.CloneAgentRequest) (*pb.CreateAgentResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	newAgent := &modelsV2.CreateAgentWorkflowData{
+		AgentName:  in.AgentName,
+		Port:       int(in.Port),
+		Memory:     int64(in.Memory),
+		AdminPass:  in.AdminPass,
+		ClientPass: in.ClientPass,
+		APIKey:     in.ApiKey,
+	}
+
+	var workflowId string
+	if in.Template != "" {
+		theAccount, err := s.activeAccountForUser(in.Eid)
+		if err != nil {
+			return nil, err
+		}
+		workflowId, err = agenttemplate.CloneFromTemplate(theAccount, in.Template, newAgent, in.Eid)
+		if err != nil {
+			return nil, agentTemplateError(err)
+		}
+	} else {
+		source, theAccount, err := s.resolveAgentForUser(in.Eid, in.SourceAgentId)
+		if err != nil {
+			return nil, err
+		}
+		workflowId, err = agenttemplate.CloneFromAgent(theAccount, source, newAgent, in.LatestSave, in.Eid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &pb.CreateAgentResponse{
+		WorkflowId: workflowId,
+	}, nil
+}
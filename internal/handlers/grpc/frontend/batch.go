@@ -0,0 +1,194 @@
+package frontend
+
+import (
+	"context"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agent"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// resolveBatchForUser asserts the caller's active account owns the batch; "not
+// found" and "not yours" read the same.
+func (s *Handler) resolveBatchForUser(eid, batchID string) (*agenttask.BatchSummary, error) {
+	theAccount, err := s.activeAccountForUser(eid)
+	if err != nil {
+		return nil, err
+	}
+
+	theBatch, err := agenttask.GetBatch(batchID)
+	if err != nil || theBatch.AccountID != theAccount.ID {
+		return nil, status.Error(codes.NotFound, "batch not found")
+	}
+	return theBatch, nil
+}
+
+func mapBatchToProto(b *agenttask.BatchSummary) *pb.AgentTaskBatchView {
+	view := &pb.AgentTaskBatchView{
+		Id:        b.ID.Hex(),
+		Action:    b.Action,
+		Status:    b.Status,
+		CreatedAt: b.CreatedAt.Unix(),
+		Counts:    make(map[string]int32, len(b.Counts)),
+	}
+	for st, n := range b.Counts {
+		view.Counts[st] = int32(n)
+	}
+	for _, id := range b.AgentIDs {
+		view.AgentIds = append(view.AgentIds, id.Hex())
+	}
+	for _, id := range b.TaskIDs {
+		view.TaskIds = append(view.TaskIds, id.Hex())
+	}
+	for _, f := range b.Failures {
+		view.Failures = append(view.Failures, &pb.AgentTaskBatchFailure{AgentId: f.AgentID.Hex(), Error: f.Error})
+	}
+	return view
+}
+
+// StartAgentTaskBatch enqueues one action on every agent of the caller's active
+// account that passes the filter: the listed agents (all of them when none are
+// listed), narrowed to those carrying every tag and, if asked, to those online.
+func (s *Handler) StartAgentTaskBatch(ctx context.Context, in *pb.StartAgentTaskBatchRequest) (*pb.AgentTaskBatchResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAccount, err := s.activeAccountForUser(in.Eid)
+	if err != nil {
+		return nil, err
+	}
+
+	agents, err := agent.GetUserAccountAgents(theAccount, bson.ObjectID{})
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool, len(in.AgentIds))
+	for _, id := range in.AgentIds {
+		wanted[id] = true
+	}
+
+	candidates := make([]bson.ObjectID, 0, len(agents))
+	for _, theAgent := range agents {
+		if len(wanted) > 0 && !wanted[theAgent.ID.Hex()] {
+			continue
+		}
+		if in.OnlineOnly && !theAgent.Status.Online {
+			continue
+		}
+		candidates = append(candidates, theAgent.ID)
+	}
+
+	agentIDs := candidates
+	if len(in.Tags) > 0 {
+		tags, err := agent.GetAgentTags(candidates)
+		if err != nil {
+			return nil, err
+		}
+		agentIDs = make([]bson.ObjectID, 0, len(candidates))
+		for _, id := range candidates {
+			if agent.HasAllTags(tags[id], in.Tags) {
+				agentIDs = append(agentIDs, id)
+			}
+		}
+	}
+
+	theBatch, err := agenttask.StartBatch(theAccount.ID, in.Eid, in.Action, in.Data, agentIDs)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &pb.AgentTaskBatchResponse{Batch: mapBatchToProto(theBatch)}, nil
+}
+
+func (s *Handler) GetAgentTaskBatches(ctx context.Context, in *pb.GetAgentTaskBatchesRequest) (*pb.GetAgentTaskBatchesResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAccount, err := s.activeAccountForUser(in.Eid)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := in.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	batches, err := agenttask.ListBatchesForAccount(theAccount.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.GetAgentTaskBatchesResponse{}
+	for idx := range batches {
+		res.Batches = append(res.Batches, mapBatchToProto(&batches[idx]))
+	}
+	return res, nil
+}
+
+func (s *Handler) CancelAgentTaskBatch(ctx context.Context, in *pb.AgentTaskBatchRequest) (*pb.AgentTaskBatchResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.resolveBatchForUser(in.Eid, in.BatchId); err != nil {
+		return nil, err
+	}
+
+	if _, err := agenttask.CancelBatch(in.BatchId, in.Eid); err != nil {
+		return nil, err
+	}
+
+	theBatch, err := agenttask.GetBatch(in.BatchId)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.AgentTaskBatchResponse{Batch: mapBatchToProto(theBatch)}, nil
+}
+
+func (s *Handler) RetryAgentTaskBatch(ctx context.Context, in *pb.AgentTaskBatchRequest) (*pb.AgentTaskBatchResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.resolveBatchForUser(in.Eid, in.BatchId); err != nil {
+		return nil, err
+	}
+
+	if _, err := agenttask.RetryBatch(in.BatchId, in.Eid); err != nil {
+		return nil, err
+	}
+
+	theBatch, err := agenttask.GetBatch(in.BatchId)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.AgentTaskBatchResponse{Batch: mapBatchToProto(theBatch)}, nil
+}
+
+// SetAgentTags replaces the tags a batch filter selects the agent by.
+func (s *Handler) SetAgentTags(ctx context.Context, in *pb.SetAgentTagsRequest) (*pb.SetAgentTagsResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAgent, _, err := s.resolveAgentForUser(in.Eid, in.AgentId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := agent.SetAgentTags(theAgent.ID, in.Tags); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	tags, err := agent.GetAgentTags([]bson.ObjectID{theAgent.ID})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SetAgentTagsResponse{Tags: tags[theAgent.ID]}, nil
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
 	accountsvc "github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/account"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agent"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/user"
 	modelsV2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
 	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
@@ -75,6 +76,23 @@ func resolveDownload(in *pb.FrontendDownloadRequest) (string, string, error) {
 				break
 			}
 		}
+	case pb.FrontendDownloadKind_FRONTEND_DOWNLOAD_TASK_ARTIFACT:
+		// Artifacts carry their own object path: it is keyed by task and made
+		// unique per upload, so it cannot be rebuilt from the file name.
+		theTask, terr := agenttask.Get(in.TaskId)
+		if terr != nil || theTask.AgentID != theAgent.ID {
+			return "", "", fmt.Errorf("file not found")
+		}
+		output, oerr := agenttask.GetOutput(in.TaskId)
+		if oerr != nil {
+			return "", "", oerr
+		}
+		for i := range output.Artifacts {
+			if output.Artifacts[i].UUID == in.Uuid {
+				return output.Artifacts[i].ObjectPath, output.Artifacts[i].FileName, nil
+			}
+		}
+		return "", "", fmt.Errorf("file not found")
 	default:
 		return "", "", fmt.Errorf("unknown download kind")
 	}
@@ -486,7 +486,7 @@ func (s *Handler) CreateAgentTask(ctx context.Context, in *pb.CreateAgentTaskReq
 
 	id, err := agent.CreateAgentTask(theAgent, theAccount, in.Eid, in.Action, nil)
 	if err != nil {
-		return nil, err
+		return nil, taskActionError(err)
 	}
 
 	return &pb.CreateAgentTaskResponse{TaskId: id}, nil
@@ -512,6 +512,19 @@ func (s *Handler) GetAgentTasks(ctx context.Context, in *pb.GetAgentTasksRequest
 		return nil, err
 	}
 
+	taskIDs := make([]bson.ObjectID, 0, len(tasks))
+	for idx := range tasks {
+		taskIDs = append(taskIDs, tasks[idx].ID)
+	}
+	outputs, err := agenttask.OutputsFor(taskIDs)
+	if err != nil {
+		return nil, err
+	}
+	approvals, err := agenttask.PendingApprovals(taskIDs)
+	if err != nil {
+		return nil, err
+	}
+
 	res := &pb.GetAgentTasksResponse{}
 	for idx := range tasks {
 		t := &tasks[idx]
@@ -539,6 +552,21 @@ func (s *Handler) GetAgentTasks(ctx context.Context, in *pb.GetAgentTasksRequest
 		if t.FinishedAt != nil {
 			view.FinishedAt = t.FinishedAt.Unix()
 		}
+		if expiresAt, ok := approvals[t.ID]; ok {
+			view.AwaitingApproval = true
+			view.ApprovalExpiresAt = expiresAt.Unix()
+		}
+		if output, ok := outputs[t.ID]; ok {
+			view.Result = output.Result
+			for _, artifact := range output.Artifacts {
+				view.Artifacts = append(view.Artifacts, &pb.AgentTaskArtifact{
+					Uuid:      artifact.UUID,
+					FileName:  artifact.FileName,
+					Size:      artifact.Size,
+					CreatedAt: artifact.CreatedAt.Unix(),
+				})
+			}
+		}
 
 		res.Tasks = append(res.Tasks, view)
 	}
@@ -546,6 +574,45 @@ func (s *Handler) GetAgentTasks(ctx context.Context, in *pb.GetAgentTasksRequest
 	return res, nil
 }
 
+// GetAgentTaskEvents returns a task's timeline: every claim, renewal, progress
+// note, failure, reap and cascade it went through, oldest first.
+func (s *Handler) GetAgentTaskEvents(ctx context.Context, in *pb.GetAgentTaskEventsRequest) (*pb.GetAgentTaskEventsResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.resolveTaskForUser(in.Eid, in.TaskId); err != nil {
+		return nil, err
+	}
+
+	events, err := agenttask.ListEvents(in.TaskId)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.GetAgentTaskEventsResponse{}
+	for idx := range events {
+		ev := &events[idx]
+
+		view := &pb.AgentTaskEvent{
+			Type:       ev.Type,
+			Attempt:    int32(ev.Attempt),
+			Replica:    ev.Replica,
+			LeaseToken: ev.LeaseToken,
+			Message:    ev.Message,
+			Actor:      ev.Actor,
+			CreatedAt:  ev.CreatedAt.Unix(),
+		}
+		if ev.ParentID != nil {
+			view.ParentId = ev.ParentID.Hex()
+		}
+
+		res.Events = append(res.Events, view)
+	}
+
+	return res, nil
+}
+
 func (s *Handler) CancelAgentTask(ctx context.Context, in *pb.CancelAgentTaskRequest) (*pbModels.SSMEmpty, error) {
 	if err := s.validateAPIKey(ctx); err != nil {
 		return nil, err
@@ -555,7 +622,7 @@ func (s *Handler) CancelAgentTask(ctx context.Context, in *pb.CancelAgentTaskReq
 		return nil, err
 	}
 
-	if err := agenttask.Cancel(in.TaskId); err != nil {
+	if err := agenttask.Cancel(in.TaskId, in.Eid); err != nil {
 		return nil, err
 	}
 	return &pbModels.SSMEmpty{}, nil
@@ -570,12 +637,43 @@ func (s *Handler) RetryAgentTask(ctx context.Context, in *pb.RetryAgentTaskReque
 		return nil, err
 	}
 
-	if err := agenttask.Retry(in.TaskId); err != nil {
+	if err := agenttask.Retry(in.TaskId, in.Eid); err != nil {
 		return nil, err
 	}
 	return &pbModels.SSMEmpty{}, nil
 }
 
+// ApproveAgentTask lets a task awaiting approval run. The caller must be a
+// member of the task's account other than whoever asked for it.
+func (s *Handler) ApproveAgentTask(ctx context.Context, in *pb.ApproveAgentTaskRequest) (*pbModels.SSMEmpty, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.resolveTaskForUser(in.Eid, in.TaskId); err != nil {
+		return nil, err
+	}
+
+	if err := agenttask.Approve(in.TaskId, in.Eid); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &pbModels.SSMEmpty{}, nil
+}
+
+func (s *Handler) RejectAgentTask(ctx context.Context, in *pb.RejectAgentTaskRequest) (*pbModels.SSMEmpty, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.resolveTaskForUser(in.Eid, in.TaskId); err != nil {
+		return nil, err
+	}
+
+	if err := agenttask.Reject(in.TaskId, in.Eid, in.Reason); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &pbModels.SSMEmpty{}, nil
+}
 
 func (s *Handler) UpdateAgentSettings(ctx context.Context, in *pb.UpdateAgentSettingsRequest) (*pbModels.SSMEmpty, error) {
 	if err := s.validateAPIKey(ctx); err != nil {
@@ -802,7 +900,7 @@ func (s *Handler) CreateAgent(ctx context.Context, in *pb.CreateAgentRequest) (*
 		APIKey:     in.ApiKey,
 	}
 
-	workflowId, err := agent.NewWorkflow_CreateAgent(account.ID, workflowData)
+	workflowId, err := agent.NewWorkflow_CreateAgent(account.ID, workflowData, in.Eid)
 	if err != nil {
 		return nil, err
 	}
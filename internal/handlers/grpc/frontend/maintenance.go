@@ -0,0 +1,73 @@
+package frontend
+
+import (
+	"context"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agent"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func mapMaintenanceWindowsToProto(windows []agenttask.MaintenanceWindow) []*pb.MaintenanceWindow {
+	out := make([]*pb.MaintenanceWindow, 0, len(windows))
+	for _, w := range windows {
+		view := &pb.MaintenanceWindow{Start: w.Start, End: w.End, TimeZone: w.TimeZone}
+		for _, d := range w.Days {
+			view.Days = append(view.Days, int32(d))
+		}
+		out = append(out, view)
+	}
+	return out
+}
+
+func mapMaintenanceWindowsFromProto(in []*pb.MaintenanceWindow) []agenttask.MaintenanceWindow {
+	out := make([]agenttask.MaintenanceWindow, 0, len(in))
+	for _, w := range in {
+		window := agenttask.MaintenanceWindow{Start: w.Start, End: w.End, TimeZone: w.TimeZone}
+		for _, d := range w.Days {
+			window.Days = append(window.Days, time.Weekday(d))
+		}
+		out = append(out, window)
+	}
+	return out
+}
+
+func (s *Handler) GetAgentMaintenanceWindows(ctx context.Context, in *pb.AgentMaintenanceWindowsRequest) (*pb.AgentMaintenanceWindowsResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAgent, _, err := s.resolveAgentForUser(in.Eid, in.AgentId)
+	if err != nil {
+		return nil, err
+	}
+
+	windows, err := agenttask.MaintenanceWindows(theAgent.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.AgentMaintenanceWindowsResponse{Windows: mapMaintenanceWindowsToProto(windows)}, nil
+}
+
+// SetAgentMaintenanceWindows replaces the windows in which the agent's
+// window-gated tasks may run. Removing the last window leaves any such task
+// waiting until one is added or its deadline passes.
+func (s *Handler) SetAgentMaintenanceWindows(ctx context.Context, in *pb.SetAgentMaintenanceWindowsRequest) (*pb.AgentMaintenanceWindowsResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAgent, _, err := s.resolveAgentForUser(in.Eid, in.AgentId)
+	if err != nil {
+		return nil, err
+	}
+
+	windows := mapMaintenanceWindowsFromProto(in.Windows)
+	if err := agent.SetAgentMaintenanceWindows(theAgent.ID, windows); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &pb.AgentMaintenanceWindowsResponse{Windows: mapMaintenanceWindowsToProto(windows)}, nil
+}
@@ -0,0 +1,54 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agent"
+	modelsV2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MigrateAgentServer starts a workflow that moves the source agent's server to
+// the target agent, or to a new agent when NewAgent is given instead.
+func (s *Handler) MigrateAgentServer(ctx context.Context, in *pb.MigrateAgentServerRequest) (*pb.MigrateAgentServerResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	source, theAccount, err := s.resolveAgentForUser(in.Eid, in.SourceAgentId)
+	if err != nil {
+		return nil, err
+	}
+
+	var target *modelsV2.AgentSchema
+	var newTarget *modelsV2.CreateAgentWorkflowData
+
+	if in.NewAgent != nil {
+		newTarget = &modelsV2.CreateAgentWorkflowData{
+			AgentName:  in.NewAgent.AgentName,
+			Port:       int(in.NewAgent.Port),
+			Memory:     int64(in.NewAgent.Memory),
+			AdminPass:  in.NewAgent.AdminPass,
+			ClientPass: in.NewAgent.ClientPass,
+			APIKey:     in.NewAgent.ApiKey,
+		}
+	} else if in.TargetAgentId != "" {
+		target, _, err = s.resolveAgentForUser(in.Eid, in.TargetAgentId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	workflowId, err := agent.NewWorkflow_MigrateServer(theAccount, source, target, newTarget, in.Decommission, in.Eid)
+	if err != nil {
+		if errors.Is(err, agent.ErrInvalidMigration) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, err
+	}
+
+	return &pb.MigrateAgentServerResponse{WorkflowId: workflowId}, nil
+}
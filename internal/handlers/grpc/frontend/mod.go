@@ -209,6 +209,19 @@ func modChangeFromProto(in *pb.ModChangeRequest) agentmod.ModChange {
 	}
 }
 
+// applyModeFromProto picks the mode an apply request asked for. ApplyNow wins
+// over ApplyInWindow, so an older client that only knows ApplyNow is unchanged.
+func applyModeFromProto(in *pb.ApplyModChangeRequest) agentmod.ApplyMode {
+	switch {
+	case in.ApplyNow:
+		return agentmod.ApplyNow
+	case in.ApplyInWindow:
+		return agentmod.ApplyInWindow
+	default:
+		return agentmod.ApplyDeferred
+	}
+}
+
 func mapChangedMods(in []agentmod.ChangedMod) []*pb.ChangedMod {
 	out := make([]*pb.ChangedMod, 0, len(in))
 	for _, c := range in {
@@ -287,7 +300,7 @@ func (s *Handler) ApplyModChange(ctx context.Context, in *pb.ApplyModChangeReque
 			theAgent.ID,
 			account.ID,
 			modChangeFromProto(in.Change),
-			in.ApplyNow,
+			applyModeFromProto(in),
 			trigger,
 		)
 	}
@@ -324,7 +337,7 @@ func (s *Handler) UpdateAgentModConfigText(ctx context.Context, in *pb.UpdateAge
 		account.ID,
 		in.ModReference,
 		in.Config,
-		false,
+		agentmod.ApplyDeferred,
 		modelsV2.TaskTrigger{Type: modelsV2.TaskTriggerUser, ExternalID: in.Eid},
 	); err != nil {
 		return nil, err
@@ -0,0 +1,38 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agent"
+	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RestoreAgentBackup starts a workflow that puts one of the agent's stored
+// backups or saves back on it. The workflow's steps show the restore's
+// progress.
+func (s *Handler) RestoreAgentBackup(ctx context.Context, in *pb.RestoreAgentBackupRequest) (*pb.RestoreAgentBackupResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAgent, theAccount, err := s.resolveAgentForUser(in.Eid, in.AgentId)
+	if err != nil {
+		return nil, err
+	}
+
+	workflowId, err := agent.NewWorkflow_RestoreBackup(theAccount, theAgent, in.FileName, in.Kind, in.RestoreMods, in.Eid)
+	if err != nil {
+		switch {
+		case errors.Is(err, agent.ErrRestoreFileNotFound):
+			return nil, status.Error(codes.NotFound, err.Error())
+		case errors.Is(err, agent.ErrInvalidRestoreKind), errors.Is(err, agent.ErrNoBackupMods):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, taskActionError(err)
+	}
+
+	return &pb.RestoreAgentBackupResponse{WorkflowId: workflowId}, nil
+}
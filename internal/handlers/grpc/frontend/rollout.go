@@ -0,0 +1,150 @@
+package frontend
+
+import (
+	"context"
+
+	accountsvc "github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/account"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agent"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/user"
+	modelsV2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
+	pbModels "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Handler) activeAccountForUser(eid string) (*modelsV2.AccountSchema, error) {
+	theUser, err := user.GetUser(bson.ObjectID{}, eid, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return accountsvc.GetUserActiveAccount(theUser)
+}
+
+// resolveRolloutForUser asserts the caller's active account owns the rollout;
+// "not found" and "not yours" read the same.
+func (s *Handler) resolveRolloutForUser(eid, rolloutID string) (*agenttask.Rollout, error) {
+	theAccount, err := s.activeAccountForUser(eid)
+	if err != nil {
+		return nil, err
+	}
+
+	theRollout, err := agenttask.GetRollout(rolloutID)
+	if err != nil || theRollout.AccountID != theAccount.ID {
+		return nil, status.Error(codes.NotFound, "rollout not found")
+	}
+	return theRollout, nil
+}
+
+func mapRolloutToProto(r *agenttask.Rollout) *pb.AgentTaskRolloutView {
+	view := &pb.AgentTaskRolloutView{
+		Id:          r.ID.Hex(),
+		Action:      r.Action,
+		Status:      r.Status,
+		HaltReason:  r.HaltReason,
+		CurrentWave: int32(r.CurrentWave),
+		CreatedAt:   r.CreatedAt.Unix(),
+	}
+	if r.FinishedAt != nil {
+		view.FinishedAt = r.FinishedAt.Unix()
+	}
+
+	for _, wave := range r.Waves {
+		pbWave := &pb.AgentTaskRolloutWave{}
+		for _, id := range wave.AgentIDs {
+			pbWave.AgentIds = append(pbWave.AgentIds, id.Hex())
+		}
+		for _, id := range wave.TaskIDs {
+			pbWave.TaskIds = append(pbWave.TaskIds, id.Hex())
+		}
+		view.Waves = append(view.Waves, pbWave)
+	}
+	for _, f := range r.Failures {
+		view.Failures = append(view.Failures, &pb.AgentTaskBatchFailure{AgentId: f.AgentID.Hex(), Error: f.Error})
+	}
+	return view
+}
+
+func (s *Handler) StartAgentTaskRollout(ctx context.Context, in *pb.StartAgentTaskRolloutRequest) (*pb.AgentTaskRolloutResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAccount, err := s.activeAccountForUser(in.Eid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every agent must be the account's own: agenttask trusts the ids it is given.
+	agents, err := agent.GetUserAccountAgents(theAccount, bson.ObjectID{})
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[string]bson.ObjectID, len(agents))
+	for _, theAgent := range agents {
+		owned[theAgent.ID.Hex()] = theAgent.ID
+	}
+
+	input := agenttask.RolloutInput{Action: in.Action, Data: in.Data}
+	for _, agentID := range in.AgentIds {
+		oid, ok := owned[agentID]
+		if !ok {
+			return nil, status.Error(codes.NotFound, "agent not found")
+		}
+		input.AgentIDs = append(input.AgentIDs, oid)
+	}
+	for _, pct := range in.WavePercents {
+		input.WavePercents = append(input.WavePercents, int(pct))
+	}
+
+	theRollout, err := agenttask.StartRollout(theAccount.ID, in.Eid, input)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return &pb.AgentTaskRolloutResponse{Rollout: mapRolloutToProto(theRollout)}, nil
+}
+
+func (s *Handler) GetAgentTaskRollouts(ctx context.Context, in *pb.GetAgentTaskRolloutsRequest) (*pb.GetAgentTaskRolloutsResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAccount, err := s.activeAccountForUser(in.Eid)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := in.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	rollouts, err := agenttask.ListRolloutsForAccount(theAccount.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.GetAgentTaskRolloutsResponse{}
+	for idx := range rollouts {
+		res.Rollouts = append(res.Rollouts, mapRolloutToProto(&rollouts[idx]))
+	}
+	return res, nil
+}
+
+func (s *Handler) HaltAgentTaskRollout(ctx context.Context, in *pb.HaltAgentTaskRolloutRequest) (*pbModels.SSMEmpty, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.resolveRolloutForUser(in.Eid, in.RolloutId); err != nil {
+		return nil, err
+	}
+
+	if err := agenttask.HaltRollout(in.RolloutId, "halted by a user"); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &pbModels.SSMEmpty{}, nil
+}
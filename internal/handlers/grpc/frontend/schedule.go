@@ -0,0 +1,173 @@
+package frontend
+
+import (
+	"context"
+
+	accountsvc "github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/account"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/user"
+	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
+	pbModels "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// resolveScheduleForUser asserts the caller's active account owns the schedule.
+// Like the task collection, the schedule collection is cross-account, so this is
+// the authz boundary; "not found" and "not yours" read the same.
+func (s *Handler) resolveScheduleForUser(eid, scheduleID string) (*agenttask.Schedule, error) {
+	theUser, err := user.GetUser(bson.ObjectID{}, eid, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	theAccount, err := accountsvc.GetUserActiveAccount(theUser)
+	if err != nil {
+		return nil, err
+	}
+
+	theSchedule, err := agenttask.GetSchedule(scheduleID)
+	if err != nil || theSchedule.AccountID != theAccount.ID {
+		return nil, status.Error(codes.NotFound, "schedule not found")
+	}
+	return theSchedule, nil
+}
+
+func mapScheduleToProto(sched *agenttask.Schedule) *pb.AgentTaskScheduleView {
+	view := &pb.AgentTaskScheduleView{
+		Id:         sched.ID.Hex(),
+		AgentId:    sched.AgentID.Hex(),
+		Name:       sched.Name,
+		Action:     sched.Action,
+		Data:       sched.Data,
+		Cron:       sched.Cron,
+		TimeZone:   sched.TimeZone,
+		Enabled:    sched.Enabled,
+		LastTaskId: sched.LastTaskID,
+		LastError:  sched.LastError,
+		CreatedAt:  sched.CreatedAt.Unix(),
+	}
+	if sched.NextRunAt != nil {
+		view.NextRunAt = sched.NextRunAt.Unix()
+	}
+	if sched.LastRunAt != nil {
+		view.LastRunAt = sched.LastRunAt.Unix()
+	}
+	return view
+}
+
+func scheduleInputFromProto(in *pb.AgentTaskScheduleInput) (agenttask.ScheduleInput, error) {
+	if in == nil {
+		return agenttask.ScheduleInput{}, status.Error(codes.InvalidArgument, "missing schedule")
+	}
+	return agenttask.ScheduleInput{
+		Name:     in.Name,
+		Action:   in.Action,
+		Data:     in.Data,
+		Cron:     in.Cron,
+		TimeZone: in.TimeZone,
+		Enabled:  in.Enabled,
+	}, nil
+}
+
+func (s *Handler) CreateAgentTaskSchedule(ctx context.Context, in *pb.CreateAgentTaskScheduleRequest) (*pb.AgentTaskScheduleResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAgent, theAccount, err := s.resolveAgentForUser(in.Eid, in.AgentId)
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := scheduleInputFromProto(in.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	sched, err := agenttask.CreateSchedule(theAgent.ID, theAccount.ID, in.Eid, input)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return &pb.AgentTaskScheduleResponse{Schedule: mapScheduleToProto(sched)}, nil
+}
+
+func (s *Handler) GetAgentTaskSchedules(ctx context.Context, in *pb.GetAgentTaskSchedulesRequest) (*pb.GetAgentTaskSchedulesResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAgent, _, err := s.resolveAgentForUser(in.Eid, in.AgentId)
+	if err != nil {
+		return nil, err
+	}
+
+	schedules, err := agenttask.ListSchedulesForAgent(theAgent.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.GetAgentTaskSchedulesResponse{}
+	for idx := range schedules {
+		res.Schedules = append(res.Schedules, mapScheduleToProto(&schedules[idx]))
+	}
+	return res, nil
+}
+
+func (s *Handler) UpdateAgentTaskSchedule(ctx context.Context, in *pb.UpdateAgentTaskScheduleRequest) (*pb.AgentTaskScheduleResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.resolveScheduleForUser(in.Eid, in.ScheduleId); err != nil {
+		return nil, err
+	}
+
+	input, err := scheduleInputFromProto(in.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	sched, err := agenttask.UpdateSchedule(in.ScheduleId, input)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return &pb.AgentTaskScheduleResponse{Schedule: mapScheduleToProto(sched)}, nil
+}
+
+func (s *Handler) DeleteAgentTaskSchedule(ctx context.Context, in *pb.DeleteAgentTaskScheduleRequest) (*pbModels.SSMEmpty, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.resolveScheduleForUser(in.Eid, in.ScheduleId); err != nil {
+		return nil, err
+	}
+
+	if err := agenttask.DeleteSchedule(in.ScheduleId); err != nil {
+		return nil, err
+	}
+	return &pbModels.SSMEmpty{}, nil
+}
+
+// PreviewAgentTaskSchedule evaluates a cron expression without saving it. It
+// touches no account data, so the API key is the only check.
+func (s *Handler) PreviewAgentTaskSchedule(ctx context.Context, in *pb.PreviewAgentTaskScheduleRequest) (*pb.PreviewAgentTaskScheduleResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	runs, err := agenttask.PreviewSchedule(in.Cron, in.TimeZone, int(in.Count))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	res := &pb.PreviewAgentTaskScheduleResponse{}
+	for _, run := range runs {
+		res.RunAt = append(res.RunAt, run.Unix())
+	}
+	return res, nil
+}
@@ -0,0 +1,59 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func mapTaskActionToProto(spec agenttask.ActionSpec) *pb.AgentTaskAction {
+	view := &pb.AgentTaskAction{
+		Name:                      spec.Name,
+		Description:               spec.Description,
+		AcceptsOtherFields:        spec.Payload.Open,
+		Capabilities:              spec.Capabilities,
+		MinAgentVersion:           spec.MinAgentVersion,
+		Idempotency:               string(spec.Idempotency),
+		RequiresServerStopped:     spec.Gates.RequiresServerStopped,
+		RequiresMaintenanceWindow: spec.Gates.RequiresMaintenanceWindow,
+	}
+	for _, f := range spec.Payload.Fields {
+		view.Fields = append(view.Fields, &pb.AgentTaskActionField{
+			Name:        f.Name,
+			Type:        string(f.Type),
+			Required:    f.Required,
+			Description: f.Description,
+		})
+	}
+	return view
+}
+
+// ListAgentTaskActions is every action a task can be created with, and the data
+// each one takes.
+func (s *Handler) ListAgentTaskActions(ctx context.Context, in *pb.ListAgentTaskActionsRequest) (*pb.ListAgentTaskActionsResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	res := &pb.ListAgentTaskActionsResponse{}
+	for _, spec := range agenttask.ListActions() {
+		res.Actions = append(res.Actions, mapTaskActionToProto(spec))
+	}
+	return res, nil
+}
+
+// taskActionError maps the registry's refusals onto status codes, leaving any
+// other error as it is.
+func taskActionError(err error) error {
+	switch {
+	case errors.Is(err, agenttask.ErrUnknownAction), errors.Is(err, agenttask.ErrInvalidPayload):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, agenttask.ErrAgentTooOld), errors.Is(err, agenttask.ErrActionUnsupported):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package frontend
+
+import (
+	"context"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
+	pbModels "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated/models"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func mapTaskPolicyToProto(p *agenttask.AccountPolicy) *pb.AgentTaskPolicy {
+	return &pb.AgentTaskPolicy{
+		Action:             p.Action,
+		MaxAttempts:        int32(p.MaxAttempts),
+		BackoffBaseSeconds: int64(p.BackoffBase.Seconds()),
+		BackoffCapSeconds:  int64(p.BackoffCap.Seconds()),
+		Jitter:             p.Jitter,
+		DeadlineSeconds:    int64(p.Deadline.Seconds()),
+		LeaseSeconds:       int64(p.Lease.Seconds()),
+		RequiresApproval:   p.RequiresApproval,
+	}
+}
+
+func (s *Handler) GetAgentTaskPolicies(ctx context.Context, in *pb.GetAgentTaskPoliciesRequest) (*pb.GetAgentTaskPoliciesResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAccount, err := s.activeAccountForUser(in.Eid)
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := agenttask.ListAccountPolicies(theAccount.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.GetAgentTaskPoliciesResponse{}
+	for idx := range policies {
+		res.Policies = append(res.Policies, mapTaskPolicyToProto(&policies[idx]))
+	}
+	return res, nil
+}
+
+func (s *Handler) SetAgentTaskPolicy(ctx context.Context, in *pb.SetAgentTaskPolicyRequest) (*pbModels.SSMEmpty, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+	if in.Policy == nil {
+		return nil, status.Error(codes.InvalidArgument, "policy is required")
+	}
+
+	theAccount, err := s.activeAccountForUser(in.Eid)
+	if err != nil {
+		return nil, err
+	}
+
+	override := agenttask.PolicyOverride{
+		MaxAttempts: int(in.Policy.MaxAttempts),
+		BackoffBase: time.Duration(in.Policy.BackoffBaseSeconds) * time.Second,
+		BackoffCap:  time.Duration(in.Policy.BackoffCapSeconds) * time.Second,
+		Jitter:      in.Policy.Jitter,
+		Deadline:    time.Duration(in.Policy.DeadlineSeconds) * time.Second,
+		Lease:       time.Duration(in.Policy.LeaseSeconds) * time.Second,
+		// Optional in the proto, so "not set" inherits rather than turning
+		// approval off.
+		RequiresApproval: in.Policy.RequiresApproval,
+	}
+	if err := agenttask.SetAccountPolicy(theAccount.ID, in.Policy.Action, override); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &pbModels.SSMEmpty{}, nil
+}
+
+func (s *Handler) DeleteAgentTaskPolicy(ctx context.Context, in *pb.DeleteAgentTaskPolicyRequest) (*pbModels.SSMEmpty, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAccount, err := s.activeAccountForUser(in.Eid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := agenttask.DeleteAccountPolicy(theAccount.ID, in.Action); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &pbModels.SSMEmpty{}, nil
+}
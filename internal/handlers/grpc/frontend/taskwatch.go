@@ -0,0 +1,80 @@
+package frontend
+
+import (
+	"sync"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"google.golang.org/grpc/metadata"
+)
+
+// shutdown releases every open task watch, for the same reason the agent task
+// handler has one: GracefulStop waits on in-flight RPCs, and a watch never
+// returns on its own.
+var (
+	shutdown     = make(chan struct{})
+	shutdownOnce sync.Once
+)
+
+// ShutdownFrontendHandler closes every task watch so GracefulStop can
+// complete. The browsers reconnect to another replica.
+func ShutdownFrontendHandler() {
+	shutdownOnce.Do(func() { close(shutdown) })
+}
+
+// WatchAgentTasks streams the state transitions and progress of the tasks of
+// one agent, or of every agent in the caller's active account when no agent is
+// given. It only carries what happens after it opens; the client reads
+// GetAgentTasks for the state it starts from.
+func (s *Handler) WatchAgentTasks(in *pb.WatchAgentTasksRequest, stream pb.FrontendService_WatchAgentTasksServer) error {
+	if err := s.validateAPIKey(stream.Context()); err != nil {
+		return err
+	}
+
+	var accountID, agentID bson.ObjectID
+	if in.AgentId != "" {
+		theAgent, theAccount, err := s.resolveAgentForUser(in.Eid, in.AgentId)
+		if err != nil {
+			return err
+		}
+		accountID, agentID = theAccount.ID, theAgent.ID
+	} else {
+		theAccount, err := s.activeAccountForUser(in.Eid)
+		if err != nil {
+			return err
+		}
+		accountID = theAccount.ID
+	}
+
+	updates, unsubscribe := agenttask.SubscribeUpdates(accountID, agentID)
+	defer unsubscribe()
+
+	// The client's "you are watching" ack, as on the agent task stream.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case u := <-updates:
+			if err := stream.Send(&pb.AgentTaskUpdate{
+				TaskId:    u.TaskID.Hex(),
+				AgentId:   u.AgentID.Hex(),
+				Action:    u.Action,
+				Status:    u.Status,
+				Progress:  u.Progress,
+				Message:   u.Message,
+				UpdatedAt: u.UpdatedAt.Unix(),
+			}); err != nil {
+				return err
+			}
+
+		case <-stream.Context().Done():
+			return nil
+
+		case <-shutdown:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/workflow"
+	modelsV2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
+	"github.com/SatisfactoryServerManager/ssmcloud-resources/utils/mapper"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// workflowControlError maps the workflow service's refusals onto status codes.
+func workflowControlError(err error) error {
+	switch {
+	case errors.Is(err, workflow.ErrWorkflowNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, workflow.ErrWorkflowState):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return err
+}
+
+// controlWorkflow runs one of the workflow state changes for the caller's
+// active account, which the workflow service checks the workflow belongs to.
+func (s *Handler) controlWorkflow(ctx context.Context, eid, workflowID string, change func(*modelsV2.AccountSchema, bson.ObjectID) (*modelsV2.WorkflowSchema, error)) (*pb.GetAgentWorkflowResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	oid, err := bson.ObjectIDFromHex(workflowID)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid workflow id")
+	}
+
+	theAccount, err := s.activeAccountForUser(eid)
+	if err != nil {
+		return nil, err
+	}
+
+	theWorkflow, err := change(theAccount, oid)
+	if err != nil {
+		return nil, workflowControlError(err)
+	}
+
+	return &pb.GetAgentWorkflowResponse{
+		Workflow: mapper.MapWorkflowToProto(theWorkflow),
+	}, nil
+}
+
+// CancelAgentWorkflow stops a workflow and cancels the tasks of its unfinished
+// steps.
+func (s *Handler) CancelAgentWorkflow(ctx context.Context, in *pb.CancelAgentWorkflowRequest) (*pb.GetAgentWorkflowResponse, error) {
+	return s.controlWorkflow(ctx, in.Eid, in.WorkflowId, func(theAccount *modelsV2.AccountSchema, oid bson.ObjectID) (*modelsV2.WorkflowSchema, error) {
+		return workflow.Cancel(theAccount, oid, in.Eid, in.Reason)
+	})
+}
+
+func (s *Handler) PauseAgentWorkflow(ctx context.Context, in *pb.PauseAgentWorkflowRequest) (*pb.GetAgentWorkflowResponse, error) {
+	return s.controlWorkflow(ctx, in.Eid, in.WorkflowId, func(theAccount *modelsV2.AccountSchema, oid bson.ObjectID) (*modelsV2.WorkflowSchema, error) {
+		return workflow.Pause(theAccount, oid, in.Eid)
+	})
+}
+
+func (s *Handler) ResumeAgentWorkflow(ctx context.Context, in *pb.ResumeAgentWorkflowRequest) (*pb.GetAgentWorkflowResponse, error) {
+	return s.controlWorkflow(ctx, in.Eid, in.WorkflowId, func(theAccount *modelsV2.AccountSchema, oid bson.ObjectID) (*modelsV2.WorkflowSchema, error) {
+		return workflow.Resume(theAccount, oid, in.Eid)
+	})
+}
+
+// RetryAgentWorkflowStep runs a failed step of a failed workflow again.
+func (s *Handler) RetryAgentWorkflowStep(ctx context.Context, in *pb.RetryAgentWorkflowStepRequest) (*pb.GetAgentWorkflowResponse, error) {
+	return s.controlWorkflow(ctx, in.Eid, in.WorkflowId, func(theAccount *modelsV2.AccountSchema, oid bson.ObjectID) (*modelsV2.WorkflowSchema, error) {
+		return workflow.RetryStep(theAccount, oid, int(in.ActionIdx), in.Eid)
+	})
+}
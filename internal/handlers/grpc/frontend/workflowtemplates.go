@@ -0,0 +1,133 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/workflow"
+	pb "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated"
+	pbModels "github.com/SatisfactoryServerManager/ssmcloud-resources/proto/generated/models"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func mapWorkflowTemplateToProto(t workflow.TemplateSummary) *pb.WorkflowTemplate {
+	view := &pb.WorkflowTemplate{
+		Name:       t.Name,
+		Global:     t.Global,
+		Definition: t.Source,
+		Error:      t.Error,
+	}
+	if t.Definition == nil {
+		return view
+	}
+
+	view.Description = t.Definition.Description
+	view.StepCount = int32(len(t.Definition.Steps))
+	for _, p := range t.Definition.Params {
+		view.Params = append(view.Params, &pb.WorkflowTemplateParam{
+			Name:        p.Name,
+			Description: p.Description,
+			Required:    p.Required,
+			Default:     p.Default,
+		})
+	}
+	return view
+}
+
+// workflowTemplateError maps the template service's refusals onto status codes.
+func workflowTemplateError(err error) error {
+	switch {
+	case errors.Is(err, workflow.ErrTemplateNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, workflow.ErrInvalidTemplate), errors.Is(err, workflow.ErrInvalidParams):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return taskActionError(err)
+}
+
+// ListWorkflowTemplates is the account's own templates and the global ones it
+// has not replaced.
+func (s *Handler) ListWorkflowTemplates(ctx context.Context, in *pb.ListWorkflowTemplatesRequest) (*pb.ListWorkflowTemplatesResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAccount, err := s.activeAccountForUser(in.Eid)
+	if err != nil {
+		return nil, err
+	}
+
+	templates, err := workflow.ListTemplates(theAccount.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.ListWorkflowTemplatesResponse{}
+	for _, t := range templates {
+		res.Templates = append(res.Templates, mapWorkflowTemplateToProto(t))
+	}
+	return res, nil
+}
+
+// SaveWorkflowTemplate stores a template on the account, replacing any of the
+// same name.
+func (s *Handler) SaveWorkflowTemplate(ctx context.Context, in *pb.SaveWorkflowTemplateRequest) (*pb.WorkflowTemplateResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAccount, err := s.activeAccountForUser(in.Eid)
+	if err != nil {
+		return nil, err
+	}
+
+	def, err := workflow.SaveTemplate(theAccount.ID, in.Eid, in.Definition)
+	if err != nil {
+		return nil, workflowTemplateError(err)
+	}
+
+	return &pb.WorkflowTemplateResponse{
+		Template: mapWorkflowTemplateToProto(workflow.TemplateSummary{
+			Name:       def.Name,
+			Definition: def,
+			Source:     in.Definition,
+		}),
+	}, nil
+}
+
+func (s *Handler) DeleteWorkflowTemplate(ctx context.Context, in *pb.DeleteWorkflowTemplateRequest) (*pbModels.SSMEmpty, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAccount, err := s.activeAccountForUser(in.Eid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := workflow.DeleteTemplate(theAccount.ID, in.Name); err != nil {
+		return nil, workflowTemplateError(err)
+	}
+	return &pbModels.SSMEmpty{}, nil
+}
+
+// InstantiateWorkflowTemplate starts a workflow from a template on one of the
+// caller's agents.
+func (s *Handler) InstantiateWorkflowTemplate(ctx context.Context, in *pb.InstantiateWorkflowTemplateRequest) (*pb.InstantiateWorkflowTemplateResponse, error) {
+	if err := s.validateAPIKey(ctx); err != nil {
+		return nil, err
+	}
+
+	theAgent, theAccount, err := s.resolveAgentForUser(in.Eid, in.AgentId)
+	if err != nil {
+		return nil, err
+	}
+
+	workflowId, err := workflow.InstantiateTemplate(theAccount.ID, theAgent.ID, in.Name, in.Params, in.Eid)
+	if err != nil {
+		return nil, workflowTemplateError(err)
+	}
+
+	return &pb.InstantiateWorkflowTemplateResponse{WorkflowId: workflowId.Hex()}, nil
+}
@@ -33,5 +33,6 @@ func ShutdownGRPCServices() {
 	// Must run before GracefulStop: it waits on in-flight RPCs, and a task
 	// subscription is a stream that would never return.
 	task.ShutdownTaskHandler()
+	frontend.ShutdownFrontendHandler()
 	logger.GetDebugLogger().Println("Shutdown all gRPC handlers")
 }
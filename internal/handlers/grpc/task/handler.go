@@ -24,10 +24,6 @@ type Handler struct {
 	pb.UnimplementedAgentTaskServiceServer
 }
 
-// replicaID identifies this process in agent.connectedTo. It only needs to be
-// unique per running replica, not stable across restarts.
-var replicaID = bson.NewObjectID().Hex()
-
 // shutdown releases every open task stream. grpcServer.GracefulStop() waits for
 // in-flight RPCs to return, and a subscription never returns on its own, so
 // without this the backend hangs until the shutdown timeout force-exits it.
@@ -45,6 +41,10 @@ func ShutdownTaskHandler() {
 // SubscribeTasks holds the stream open for the agent's lifetime, forwarding
 // assignments the dispatcher claims for it.
 //
+// The request is also the agent's handshake: its version, platform and the
+// actions it can run are stored on the agent document, and the dispatcher only
+// claims tasks the agent has said it understands.
+//
 // Status.Online is deliberately not touched here: it is owned by the state RPC
 // pipeline, which fires integration events on transitions. This method only
 // records which replica can reach the agent.
@@ -68,9 +68,26 @@ func (s *Handler) SubscribeTasks(in *pb.SubscribeTasksRequest, stream pb.AgentTa
 		return err
 	}
 
-	enqueueBootUpdate(theAgent, in.SessionId)
+	// Before any task can be claimed for this stream, so the dispatcher never
+	// sends something the agent just said it cannot run.
+	if err := agent.RecordAgentHandshake(theAgent.ID, in.AgentVersion, in.Platform, in.SupportedActions, in.Capabilities); err != nil {
+		return err
+	}
+	if err := agenttask.FlagUnsupportedTasks(theAgent.ID); err != nil {
+		logger.GetErrorLogger().Printf("error flagging unsupported tasks for agent %s: %s", theAgent.ID.Hex(), err.Error())
+	}
 
-	ch, deregister := agenttask.GetRegistry().Add(theAgent.ID)
+	// Resolved once for both consumers. A failure is not fatal to the stream: the
+	// agent still gets its tasks, it just shares the dispatcher tick as an
+	// account of its own and skips the boot update.
+	accountID, err := agent.GetAccountIDForAgent(theAgent.ID)
+	if err != nil {
+		logger.GetErrorLogger().Printf("error resolving account for agent %s: %s", theAgent.ID.Hex(), err.Error())
+	}
+
+	enqueueBootUpdate(theAgent, accountID, in.SessionId)
+
+	ch, deregister := agenttask.GetRegistry().Add(theAgent.ID, accountID)
 	defer func() {
 		deregister()
 		clearConnection(theAgent.ID, streamID)
@@ -83,7 +100,7 @@ func (s *Handler) SubscribeTasks(in *pb.SubscribeTasksRequest, stream pb.AgentTa
 		return err
 	}
 
-	logger.GetInfoLogger().Printf("agent %s subscribed to tasks (session %s, stream %s)", theAgent.AgentName, in.SessionId, streamID)
+	logger.GetInfoLogger().Printf("agent %s subscribed to tasks (session %s, stream %s, version %q, %d actions)", theAgent.AgentName, in.SessionId, streamID, in.AgentVersion, len(in.SupportedActions))
 
 	for {
 		select {
@@ -131,7 +148,7 @@ func (s *Handler) ReportTaskStatus(ctx context.Context, in *pb.TaskStatusReport)
 			return nil, err
 		}
 	case pb.TaskStatus_COMPLETED:
-		if err := agenttask.Complete(in.TaskId, in.LeaseToken); err != nil {
+		if err := agenttask.Complete(in.TaskId, in.LeaseToken, in.Result); err != nil {
 			return nil, err
 		}
 	case pb.TaskStatus_FAILED:
@@ -202,14 +219,8 @@ func (s *Handler) RenewTaskLease(ctx context.Context, in *pb.TaskLeaseRequest) (
 // so a reconnect after the update finished does enqueue another; that one is a
 // cheap no-op, since UpdateSFServer returns early when already at the available
 // version.
-func enqueueBootUpdate(theAgent *v2.AgentSchema, sessionID string) {
-	if !theAgent.ServerConfig.UpdateOnStart || !theAgent.Status.Installed || sessionID == "" {
-		return
-	}
-
-	accountID, err := agent.GetAccountIDForAgent(theAgent.ID)
-	if err != nil {
-		logger.GetErrorLogger().Printf("error resolving account for agent %s: %s", theAgent.ID.Hex(), err.Error())
+func enqueueBootUpdate(theAgent *v2.AgentSchema, accountID bson.ObjectID, sessionID string) {
+	if !theAgent.ServerConfig.UpdateOnStart || !theAgent.Status.Installed || sessionID == "" || accountID.IsZero() {
 		return
 	}
 
@@ -230,7 +241,7 @@ func setConnection(agentID bson.ObjectID, streamID string) error {
 
 	_, err := col.UpdateOne(ctx,
 		bson.M{"_id": agentID},
-		bson.M{"$set": bson.M{"connectedTo": replicaID, "connectionId": streamID, "updatedAt": time.Now()}})
+		bson.M{"$set": bson.M{"connectedTo": agenttask.ReplicaID(), "connectionId": streamID, "updatedAt": time.Now()}})
 	return err
 }
 
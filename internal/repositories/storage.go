@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"mime"
+	"net/url"
 	"os"
 	"path/filepath"
 
@@ -176,6 +177,33 @@ func GetAgentFileRange(objectPath string, startOffset int64) (*s3.GetObjectOutpu
 	return client.GetObject(context.Background(), in)
 }
 
+// CopyAgentFile copies a stored file to another path in the bucket without it
+// passing through the backend, for a file that moves to another agent. It
+// returns the copy's URL, as UploadAgentFile does.
+func CopyAgentFile(fromPath, toPath string) (string, error) {
+	client, err := GetS3Client()
+	if err != nil {
+		return "", err
+	}
+
+	// CopySource is bucket/key, URL-encoded but for the slashes.
+	copySource := (&url.URL{Path: bucketName + "/" + fromPath}).EscapedPath()
+
+	_, err = client.CopyObject(context.Background(), &s3.CopyObjectInput{
+		Bucket:     aws.String(bucketName),
+		Key:        aws.String(toPath),
+		CopySource: aws.String(copySource),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := os.Getenv("STORAGE_S3_ENDPOINT")
+	objectURL := fmt.Sprintf("%s/%s/%s", endpoint, bucketName, toPath)
+
+	return objectURL, nil
+}
+
 func HasAgentFile(objectPath string) bool {
 	client, err := GetS3Client()
 	if err != nil {
@@ -191,6 +219,21 @@ func HasAgentFile(objectPath string) bool {
 	return err == nil
 }
 
+// DeleteAgentFile removes one stored file. A file that is already gone is not
+// an error.
+func DeleteAgentFile(objectPath string) error {
+	client, err := GetS3Client()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectPath),
+	})
+	return err
+}
+
 func DeleteAccountFolder(accountId string) error {
 	if accountId == "" {
 		return nil
@@ -0,0 +1,97 @@
+package admin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	models "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// ---- Dead-letter agent tasks ----
+
+// AdminDeadLetterFilter is the wire form of agenttask.DeadLetterFilter: ids as
+// hex and times as unix seconds, zero meaning "any".
+type AdminDeadLetterFilter struct {
+	AccountId string
+	AgentId   string
+	Action    string
+	ErrorText string
+	From      int64
+	To        int64
+}
+
+func (f AdminDeadLetterFilter) parse() (agenttask.DeadLetterFilter, error) {
+	out := agenttask.DeadLetterFilter{Action: f.Action, ErrorText: f.ErrorText}
+
+	if f.AccountId != "" {
+		oid, err := bson.ObjectIDFromHex(f.AccountId)
+		if err != nil {
+			return out, fmt.Errorf("invalid account_id")
+		}
+		out.AccountID = oid
+	}
+	if f.AgentId != "" {
+		oid, err := bson.ObjectIDFromHex(f.AgentId)
+		if err != nil {
+			return out, fmt.Errorf("invalid agent_id")
+		}
+		out.AgentID = oid
+	}
+	if f.From > 0 {
+		out.From = time.Unix(f.From, 0)
+	}
+	if f.To > 0 {
+		out.To = time.Unix(f.To, 0)
+	}
+	return out, nil
+}
+
+func AdminListDeadLetterTasks(filter AdminDeadLetterFilter, page, pageSize int32) ([]models.AgentTaskSchema, int, error) {
+	f, err := filter.parse()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	p, ps := normalizePaging(page, pageSize)
+	tasks, total, err := agenttask.ListDeadLetters(f, int64((p-1)*ps), int64(ps))
+	if err != nil {
+		return nil, 0, err
+	}
+	return tasks, int(total), nil
+}
+
+func AdminReplayDeadLetterTasks(filter AdminDeadLetterFilter) (int, []agenttask.DeadLetterFailure, error) {
+	f, err := filter.parse()
+	if err != nil {
+		return 0, nil, err
+	}
+	return agenttask.ReplayDeadLetters(f, "admin")
+}
+
+func AdminDiscardDeadLetterTasks(filter AdminDeadLetterFilter) (int64, error) {
+	f, err := filter.parse()
+	if err != nil {
+		return 0, err
+	}
+	return agenttask.DiscardDeadLetters(f)
+}
+
+func AdminExportDeadLetterTasks(filter AdminDeadLetterFilter) (int, error) {
+	f, err := filter.parse()
+	if err != nil {
+		return 0, err
+	}
+	return agenttask.ExportDeadLetters(f)
+}
+
+// ---- Agent task streams ----
+
+// AdminListAgentConnections lists which replica holds each connected agent's
+// task stream, narrowed to one replica unless replica is "". It also returns
+// the id of the replica answering, so an admin can tell which one they hit.
+func AdminListAgentConnections(replica string) ([]agenttask.AgentConnection, string, error) {
+	conns, err := agenttask.AgentConnections(replica)
+	return conns, agenttask.ReplicaID(), err
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/audit"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/integration"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/workflow"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/types"
 	models "github.com/SatisfactoryServerManager/ssmcloud-resources/models"
 	modelsv2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
@@ -54,18 +55,13 @@ func GetUserAccountAgents(theAccount *modelsv2.AccountSchema, agentId bson.Objec
 	return resArray, nil
 }
 
-func NewWorkflow_CreateAgent(accountId bson.ObjectID, PostData *modelsv2.CreateAgentWorkflowData) (string, error) {
+func NewWorkflow_CreateAgent(accountId bson.ObjectID, PostData *modelsv2.CreateAgentWorkflowData, createdBy string) (string, error) {
 
 	AccountModel, err := repositories.GetMongoClient().GetModel("Account")
 	if err != nil {
 		return "", fmt.Errorf("error getting account model with error: %s", err.Error())
 	}
 
-	WorkflowModel, err := repositories.GetMongoClient().GetModel("Workflow")
-	if err != nil {
-		return "", fmt.Errorf("error getting workflow model with error: %s", err.Error())
-	}
-
 	theAccount := &modelsv2.AccountSchema{}
 
 	if err := AccountModel.FindOneById(theAccount, accountId); err != nil {
@@ -114,24 +110,18 @@ func NewWorkflow_CreateAgent(accountId bson.ObjectID, PostData *modelsv2.CreateA
 		Timeout: 10 * time.Minute,
 	}
 
-	workflow := modelsv2.WorkflowSchema{
-		ID:   bson.NewObjectID(),
-		Type: modelsv2.WorkflowType_CreateAgent,
-		Data: PostData,
-		Actions: []modelsv2.WorkflowAction{
-			createAgentAction,
-			waitForOnlineAction,
-			installServerAction,
-			startServerAction,
-			claimServerAction,
-		},
-	}
-
-	if err := WorkflowModel.Create(workflow); err != nil {
+	workflowId, err := workflow.Create(modelsv2.WorkflowType_CreateAgent, PostData, []modelsv2.WorkflowAction{
+		createAgentAction,
+		waitForOnlineAction,
+		installServerAction,
+		startServerAction,
+		claimServerAction,
+	}, createdBy)
+	if err != nil {
 		return "", err
 	}
 
-	return workflow.ID.Hex(), nil
+	return workflowId.Hex(), nil
 }
 
 func DeleteAgent(theAccount *modelsv2.AccountSchema, agentId bson.ObjectID) error {
@@ -179,6 +169,16 @@ func DeleteAgent(theAccount *modelsv2.AccountSchema, agentId bson.ObjectID) erro
 		return fmt.Errorf("error deleting agent from db with error: %s", err.Error())
 	}
 
+	if err := agenttask.DeleteSchedulesForAgent(agentId); err != nil {
+		return fmt.Errorf("error deleting agent task schedules with error: %s", err.Error())
+	}
+
+	// A workflow waiting on the agent would otherwise poll for one that can
+	// never come online.
+	if err := workflow.CancelForAgent(theAccount, agentId, "the agent was deleted"); err != nil {
+		return fmt.Errorf("error cancelling agent workflows with error: %s", err.Error())
+	}
+
 	if err := audit.AddAccountAudit(theAccount,
 		modelsv2.AuditType_AgentRemoveFromAccount,
 		fmt.Sprintf("Agent (%s) was removed from the account", theAgent.AgentName),
@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// RecordAgentHandshake stores what the agent advertised when it subscribed to
+// tasks. Version and platform land where its config report puts them; an
+// agent too old to send them keeps whatever it reported there.
+//
+// An agent that advertises no actions predates the handshake, since every
+// agent that has one can run something. Its lists are removed, so it is
+// treated as before negotiation existed; that also covers an agent downgraded
+// to such a build. Otherwise both lists replace the previous ones outright,
+// and an empty capabilities list means the agent has none.
+func RecordAgentHandshake(agentID bson.ObjectID, version, platform string, supportedActions, capabilities []string) error {
+	set := bson.M{"updatedAt": time.Now()}
+	if version != "" {
+		set["config.version"] = version
+	}
+	if platform != "" {
+		set["config.platform"] = platform
+	}
+
+	update := bson.M{"$set": set}
+	if len(supportedActions) == 0 {
+		update["$unset"] = bson.M{"supportedActions": "", "capabilities": ""}
+	} else {
+		if capabilities == nil {
+			capabilities = []string{}
+		}
+		set["supportedActions"] = supportedActions
+		set["capabilities"] = capabilities
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := repositories.GetMongoClient().GetCollection("agents").UpdateOne(ctx, bson.M{"_id": agentID}, update)
+	return err
+}
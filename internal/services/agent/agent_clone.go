@@ -0,0 +1,249 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/workflow"
+	modelsv2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type CopySaveAction struct{}
+
+// CloneSpec is what a cloned agent inherits: from Source, the agent it is a
+// copy of, or from a saved agent template, named by Template.
+type CloneSpec struct {
+	Source           *modelsv2.AgentSchema
+	Template         string
+	ServerConfig     modelsv2.AgentServerConfig
+	BackupInterval   float32
+	BackupKeepAmount int
+	// Mods is the lockfile the clone's selection is restored from; nil or
+	// empty leaves it without mods.
+	Mods *modelsv2.Lockfile
+	// LatestSave copies Source's most recent save onto the clone.
+	LatestSave bool
+}
+
+// NewWorkflow_CloneAgent creates an agent the way NewWorkflow_CreateAgent does,
+// but already configured as spec describes: the server settings and backup
+// settings are set on it when it is created, the mods restored once it is
+// installed, and with LatestSave, the source's latest save pushed to it before
+// the server first starts. Integrations are the account's, so the clone is
+// covered by the same ones as its source from the start.
+func NewWorkflow_CloneAgent(theAccount *modelsv2.AccountSchema, newAgent *modelsv2.CreateAgentWorkflowData, spec CloneSpec, createdBy string) (string, error) {
+	AccountModel, err := repositories.GetMongoClient().GetModel("Account")
+	if err != nil {
+		return "", fmt.Errorf("error getting account model with error: %s", err.Error())
+	}
+
+	if err := AccountModel.PopulateField(theAccount, "Agents"); err != nil {
+		return "", fmt.Errorf("error populating account agents with error: %s", err.Error())
+	}
+
+	for _, agent := range theAccount.Agents {
+		if agent.AgentName == newAgent.AgentName {
+			return "", fmt.Errorf("error agent with same name %s already exists on your account", newAgent.AgentName)
+		}
+	}
+
+	newAgent.AccountId = theAccount.ID
+
+	data := workflow.CloneAgentData{
+		CreateAgentWorkflowData: *newAgent,
+		Template:                spec.Template,
+		ServerConfig:            spec.ServerConfig,
+		BackupInterval:          spec.BackupInterval,
+		BackupKeepAmount:        spec.BackupKeepAmount,
+	}
+
+	var latestSave *modelsv2.AgentSave
+	if spec.Source != nil {
+		data.SourceId = spec.Source.ID
+		if spec.LatestSave {
+			latestSave = LatestSave(spec.Source)
+		}
+	}
+
+	actions := cloneActions(newAgent, spec.Mods, latestSave)
+
+	workflowId, err := workflow.Create(workflow.CloneAgentWorkflowType, data, actions, createdBy)
+	if err != nil {
+		return "", err
+	}
+
+	return workflowId.Hex(), nil
+}
+
+// cloneActions are the steps that create newAgent with mods restored and,
+// when latestSave is set, that save pushed to it before it first starts.
+func cloneActions(newAgent *modelsv2.CreateAgentWorkflowData, mods *modelsv2.Lockfile, latestSave *modelsv2.AgentSave) []modelsv2.WorkflowAction {
+	actions := []modelsv2.WorkflowAction{
+		{
+			Name: "create",
+			Type: modelsv2.WorkflowActionType_CreateAgent,
+		},
+		{
+			Name: "online",
+			Type: modelsv2.WorkflowActionType_WaitForOnline,
+		},
+		{
+			Name:       "install",
+			Type:       modelsv2.WorkflowActionType_AgentTask,
+			TaskAction: "installsfserver",
+			Timeout:    30 * time.Minute,
+		},
+	}
+
+	if mods != nil && len(mods.Mods) > 0 {
+		actions = append(actions, modelsv2.WorkflowAction{
+			Name:     "mods",
+			Type:     workflow.ActionTypeRestoreMods,
+			TaskData: *mods,
+			Timeout:  30 * time.Minute,
+		})
+	}
+
+	if latestSave != nil {
+		payload := restorePayload{Kind: RestoreKindSave, FileName: latestSave.FileName, Size: latestSave.Size}
+		actions = append(actions,
+			modelsv2.WorkflowAction{
+				Name:     "copysave",
+				Type:     workflow.ActionTypeCopySave,
+				TaskData: CopySavePayload{FileName: latestSave.FileName},
+			},
+			modelsv2.WorkflowAction{
+				Name:       "download",
+				Type:       modelsv2.WorkflowActionType_AgentTask,
+				TaskAction: "restorebackup",
+				TaskData:   payload,
+				Timeout:    60 * time.Minute,
+				MaxRetries: 2,
+			},
+			modelsv2.WorkflowAction{
+				Name:       "verify",
+				Type:       modelsv2.WorkflowActionType_AgentTask,
+				TaskAction: "verifybackup",
+				TaskData:   payload,
+				Timeout:    10 * time.Minute,
+			},
+		)
+	}
+
+	actions = append(actions,
+		modelsv2.WorkflowAction{
+			Name:       "start",
+			Type:       modelsv2.WorkflowActionType_AgentTask,
+			TaskAction: "startsfserver",
+			Timeout:    10 * time.Minute,
+		},
+		modelsv2.WorkflowAction{
+			Name:       "claim",
+			Type:       modelsv2.WorkflowActionType_AgentTask,
+			TaskAction: "claimserver",
+			TaskData: modelsv2.ClaimServer_PostData{
+				AdminPass:  newAgent.AdminPass,
+				ClientPass: newAgent.ClientPass,
+			},
+			Timeout: 10 * time.Minute,
+		},
+	)
+
+	return actions
+}
+
+// CopySavePayload is the TaskData of a copysave step.
+type CopySavePayload struct {
+	FileName string `json:"fileName"`
+}
+
+// LatestSave is the agent's most recently modified save, or nil when it has
+// none.
+func LatestSave(theAgent *modelsv2.AgentSchema) *modelsv2.AgentSave {
+	var latest *modelsv2.AgentSave
+	for idx := range theAgent.Saves {
+		save := &theAgent.Saves[idx]
+		if latest == nil || save.ModTime.After(latest.ModTime) {
+			latest = save
+		}
+	}
+	return latest
+}
+
+// Execute copies one save of the source agent to the workflow's agent, in
+// storage and on the agent's record, so the agent can then download it. A copy
+// that is already there is replaced, so a re-run is harmless.
+func (a CopySaveAction) Execute(action *modelsv2.WorkflowAction, d interface{}, theAccount *modelsv2.AccountSchema, _ modelsv2.WorkflowContext) error {
+	roles, ok := d.(workflow.AgentRoles)
+	if !ok {
+		return errors.New("workflow has no source agent to copy from")
+	}
+
+	target, err := roles.Agent()
+	if err != nil {
+		return err
+	}
+	source, err := roles.AgentForRole(workflow.RoleSource)
+	if err != nil {
+		return err
+	}
+
+	// TaskData is whatever the driver decoded from Mongo.
+	payload := CopySavePayload{}
+	bodyBytes, err := json.Marshal(action.TaskData)
+	if err != nil {
+		return fmt.Errorf("error reading copy save data with error: %s", err.Error())
+	}
+	if err := json.Unmarshal(bodyBytes, &payload); err != nil {
+		return fmt.Errorf("error reading copy save data with error: %s", err.Error())
+	}
+
+	var save *modelsv2.AgentSave
+	for idx := range source.Saves {
+		if source.Saves[idx].FileName == payload.FileName {
+			save = &source.Saves[idx]
+			break
+		}
+	}
+	if save == nil {
+		return fmt.Errorf("%w: %s", ErrRestoreFileNotFound, payload.FileName)
+	}
+
+	objectURL, err := repositories.CopyAgentFile(
+		fmt.Sprintf("%s/%s/saves/%s", theAccount.ID.Hex(), source.ID.Hex(), save.FileName),
+		fmt.Sprintf("%s/%s/saves/%s", theAccount.ID.Hex(), target.ID.Hex(), save.FileName),
+	)
+	if err != nil {
+		return fmt.Errorf("error copying save %s with error: %s", save.FileName, err.Error())
+	}
+
+	copied := *save
+	copied.FileUrl = objectURL
+
+	saves := make([]modelsv2.AgentSave, 0, len(target.Saves)+1)
+	for _, existing := range target.Saves {
+		if existing.FileName != copied.FileName {
+			saves = append(saves, existing)
+		}
+	}
+	saves = append(saves, copied)
+
+	AgentModel, err := repositories.GetMongoClient().GetModel("Agent")
+	if err != nil {
+		return err
+	}
+
+	if err := AgentModel.UpdateData(target, bson.M{
+		"saves":     saves,
+		"updatedAt": time.Now(),
+	}); err != nil {
+		return fmt.Errorf("error updating agent saves with error: %s", err.Error())
+	}
+
+	action.Status = "completed"
+	return nil
+}
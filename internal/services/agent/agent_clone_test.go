@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/workflow"
+	modelsv2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+)
+
+func TestCloneActions(t *testing.T) {
+	mods := &modelsv2.Lockfile{Mods: []modelsv2.ModLock{{ModReference: "RefinedPower", Version: "3.3.0", Direct: true}}}
+	save := &modelsv2.AgentSave{FileName: "world.sav", Size: 1024}
+
+	tests := []struct {
+		name       string
+		mods       *modelsv2.Lockfile
+		latestSave *modelsv2.AgentSave
+		want       []string
+	}{
+		{
+			name: "settings only",
+			want: []string{"create", "online", "install", "start", "claim"},
+		},
+		{
+			name: "an empty lockfile restores nothing",
+			mods: &modelsv2.Lockfile{},
+			want: []string{"create", "online", "install", "start", "claim"},
+		},
+		{
+			name: "with mods",
+			mods: mods,
+			want: []string{"create", "online", "install", "mods", "start", "claim"},
+		},
+		{
+			name:       "with mods and the latest save",
+			mods:       mods,
+			latestSave: save,
+			want:       []string{"create", "online", "install", "mods", "copysave", "download", "verify", "start", "claim"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := stepNames(cloneActions(&modelsv2.CreateAgentWorkflowData{}, tt.mods, tt.latestSave))
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// The save is copied, downloaded and verified by name before the server
+// first starts, and the mods are restored from the lockfile given.
+func TestCloneActionsCarryTheirPayloads(t *testing.T) {
+	mods := &modelsv2.Lockfile{Mods: []modelsv2.ModLock{{ModReference: "RefinedPower", Version: "3.3.0", Direct: true}}}
+	save := &modelsv2.AgentSave{FileName: "world.sav", Size: 1024}
+	actions := cloneActions(&modelsv2.CreateAgentWorkflowData{AdminPass: "admin", ClientPass: "client"}, mods, save)
+
+	restore := stepNamed(t, actions, "mods")
+	if restore.Type != workflow.ActionTypeRestoreMods {
+		t.Fatalf("expected a restore mods step, got %s", restore.Type)
+	}
+	if lockfile, ok := restore.TaskData.(modelsv2.Lockfile); !ok || len(lockfile.Mods) != 1 {
+		t.Fatalf("expected the lockfile to be restored, got %+v", restore.TaskData)
+	}
+
+	if copied, ok := stepNamed(t, actions, "copysave").TaskData.(CopySavePayload); !ok || copied.FileName != "world.sav" {
+		t.Fatalf("expected the save to be copied by name, got %+v", copied)
+	}
+	for _, name := range []string{"download", "verify"} {
+		payload, ok := stepNamed(t, actions, name).TaskData.(restorePayload)
+		if !ok || payload.Kind != RestoreKindSave || payload.FileName != "world.sav" || payload.Size != 1024 {
+			t.Fatalf("expected %s to push the save, got %+v", name, payload)
+		}
+	}
+
+	claim, ok := stepNamed(t, actions, "claim").TaskData.(modelsv2.ClaimServer_PostData)
+	if !ok || claim.AdminPass != "admin" || claim.ClientPass != "client" {
+		t.Fatalf("expected the claim to carry the new agent's passwords, got %+v", claim)
+	}
+}
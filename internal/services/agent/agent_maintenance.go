@@ -0,0 +1,30 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// SetAgentMaintenanceWindows replaces the agent's maintenance windows. Like
+// tags, they live on the agent document without being part of the shared
+// AgentSchema; the task queue reads them back when it claims.
+func SetAgentMaintenanceWindows(agentID bson.ObjectID, windows []agenttask.MaintenanceWindow) error {
+	if err := agenttask.ValidateMaintenanceWindows(windows); err != nil {
+		return err
+	}
+	if windows == nil {
+		windows = []agenttask.MaintenanceWindow{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := repositories.GetMongoClient().GetCollection("agents").UpdateOne(ctx,
+		bson.M{"_id": agentID},
+		bson.M{"$set": bson.M{"maintenanceWindows": windows, "updatedAt": time.Now()}})
+	return err
+}
@@ -0,0 +1,328 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/workflow"
+	modelsv2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+var ErrInvalidMigration = errors.New("invalid migration")
+
+type CopyServerAction struct{}
+type DecommissionAction struct{}
+type PushSaveAction struct{}
+
+// NewWorkflow_MigrateServer moves the source agent's server to a target agent:
+// an existing one, or with newTarget set, one the workflow creates, waits for
+// and claims. The source is stopped so its files stop changing, its settings,
+// mods, saves and backups are copied to the target, its latest save is pushed
+// down to it and its server started. With decommission, the source agent is
+// then deleted.
+//
+// The source's stop is compensated by a start, so a migration that fails
+// leaves the source serving as before. Everything else is copied from the
+// database and storage, so a source that is offline can still be migrated.
+func NewWorkflow_MigrateServer(theAccount *modelsv2.AccountSchema, source, target *modelsv2.AgentSchema, newTarget *modelsv2.CreateAgentWorkflowData, decommission bool, createdBy string) (string, error) {
+	if (target == nil) == (newTarget == nil) {
+		return "", fmt.Errorf("%w: give either a target agent or a new one", ErrInvalidMigration)
+	}
+	if target != nil && target.ID == source.ID {
+		return "", fmt.Errorf("%w: an agent cannot be migrated to itself", ErrInvalidMigration)
+	}
+
+	if newTarget != nil {
+		AccountModel, err := repositories.GetMongoClient().GetModel("Account")
+		if err != nil {
+			return "", err
+		}
+		if err := AccountModel.PopulateField(theAccount, "Agents"); err != nil {
+			return "", fmt.Errorf("error populating account agents with error: %s", err.Error())
+		}
+		for _, agent := range theAccount.Agents {
+			if agent.AgentName == newTarget.AgentName {
+				return "", fmt.Errorf("error agent with same name %s already exists on your account", newTarget.AgentName)
+			}
+		}
+	}
+
+	data := workflow.MigrateServerData{
+		AccountId:    theAccount.ID,
+		SourceId:     source.ID,
+		NewTarget:    newTarget,
+		Decommission: decommission,
+	}
+
+	if newTarget != nil {
+		newTarget.AccountId = theAccount.ID
+	} else {
+		data.TargetId = target.ID
+	}
+
+	actions := migrateActions(newTarget, decommission)
+
+	workflowId, err := workflow.Create(workflow.MigrateServerWorkflowType, data, actions, createdBy)
+	if err != nil {
+		return "", err
+	}
+
+	return workflowId.Hex(), nil
+}
+
+// migrateActions are the steps of a migration to newTarget, or to an existing
+// target when it is nil.
+func migrateActions(newTarget *modelsv2.CreateAgentWorkflowData, decommission bool) []modelsv2.WorkflowAction {
+	actions := make([]modelsv2.WorkflowAction, 0)
+
+	if newTarget != nil {
+		actions = append(actions,
+			modelsv2.WorkflowAction{
+				Name: "create",
+				Type: modelsv2.WorkflowActionType_CreateAgent,
+			},
+			modelsv2.WorkflowAction{
+				Name: "online",
+				Type: modelsv2.WorkflowActionType_WaitForOnline,
+			},
+			modelsv2.WorkflowAction{
+				Name:       "install",
+				Type:       modelsv2.WorkflowActionType_AgentTask,
+				TaskAction: "installsfserver",
+				Timeout:    30 * time.Minute,
+			},
+		)
+	}
+
+	// A source whose host has died is not stopped; it can be migrated from
+	// what storage holds of it all the same.
+	actions = append(actions,
+		modelsv2.WorkflowAction{
+			Name:       "stopsource",
+			Role:       workflow.RoleSource,
+			When:       "agent.online",
+			Type:       modelsv2.WorkflowActionType_AgentTask,
+			TaskAction: "stopsfserver",
+			Timeout:    10 * time.Minute,
+			Compensation: &modelsv2.WorkflowAction{
+				Type:       modelsv2.WorkflowActionType_AgentTask,
+				TaskAction: "startsfserver",
+				Timeout:    10 * time.Minute,
+			},
+		},
+		modelsv2.WorkflowAction{
+			Name:       "stoptarget",
+			Type:       modelsv2.WorkflowActionType_AgentTask,
+			TaskAction: "stopsfserver",
+			Timeout:    10 * time.Minute,
+		},
+		modelsv2.WorkflowAction{
+			Name: "copy",
+			Type: workflow.ActionTypeCopyServer,
+		},
+		modelsv2.WorkflowAction{
+			Name:    "mods",
+			Type:    workflow.ActionTypeCopyMods,
+			Timeout: 30 * time.Minute,
+		},
+	)
+
+	// Which save is pushed is only known once the source has stopped and its
+	// saves are copied; see PushSaveAction.
+	actions = append(actions,
+		modelsv2.WorkflowAction{
+			Name:       "download",
+			Type:       workflow.ActionTypePushSave,
+			TaskAction: "restorebackup",
+			Timeout:    60 * time.Minute,
+			MaxRetries: 2,
+		},
+		modelsv2.WorkflowAction{
+			Name:       "verify",
+			Type:       workflow.ActionTypePushSave,
+			TaskAction: "verifybackup",
+			Timeout:    10 * time.Minute,
+		},
+		modelsv2.WorkflowAction{
+			Name:       "starttarget",
+			Type:       modelsv2.WorkflowActionType_AgentTask,
+			TaskAction: "startsfserver",
+			Timeout:    10 * time.Minute,
+		},
+	)
+
+	// A new target is claimed the way NewWorkflow_CreateAgent claims any new
+	// server, with the passwords it was created with.
+	if newTarget != nil {
+		actions = append(actions, modelsv2.WorkflowAction{
+			Name:       "claim",
+			Type:       modelsv2.WorkflowActionType_AgentTask,
+			TaskAction: "claimserver",
+			TaskData: modelsv2.ClaimServer_PostData{
+				AdminPass:  newTarget.AdminPass,
+				ClientPass: newTarget.ClientPass,
+			},
+			Timeout: 10 * time.Minute,
+		})
+	}
+
+	// The server has moved by now, so a failed decommission is left for the
+	// user to finish rather than rolling the migration back.
+	if decommission {
+		actions = append(actions, modelsv2.WorkflowAction{
+			Name:            "decommission",
+			Role:            workflow.RoleSource,
+			Type:            workflow.ActionTypeDecommission,
+			ContinueOnError: true,
+		})
+	}
+
+	return actions
+}
+
+// Execute copies the source's settings, saves and backups onto the workflow's
+// agent, the target. Files are copied within storage. A save or backup the
+// target already has by the same name is replaced, so a re-run is harmless.
+func (a CopyServerAction) Execute(action *modelsv2.WorkflowAction, d interface{}, theAccount *modelsv2.AccountSchema, _ modelsv2.WorkflowContext) error {
+	roles, ok := d.(workflow.AgentRoles)
+	if !ok {
+		return errors.New("workflow has no source agent to copy from")
+	}
+
+	target, err := roles.Agent()
+	if err != nil {
+		return err
+	}
+	source, err := roles.AgentForRole(workflow.RoleSource)
+	if err != nil {
+		return err
+	}
+
+	AgentModel, err := repositories.GetMongoClient().GetModel("Agent")
+	if err != nil {
+		return err
+	}
+
+	fromPrefix := fmt.Sprintf("%s/%s", theAccount.ID.Hex(), source.ID.Hex())
+	toPrefix := fmt.Sprintf("%s/%s", theAccount.ID.Hex(), target.ID.Hex())
+
+	saves := make([]modelsv2.AgentSave, 0, len(target.Saves)+len(source.Saves))
+	for _, save := range target.Saves {
+		if !hasSave(source.Saves, save.FileName) {
+			saves = append(saves, save)
+		}
+	}
+	for _, save := range source.Saves {
+		objectURL, err := repositories.CopyAgentFile(
+			fmt.Sprintf("%s/saves/%s", fromPrefix, save.FileName),
+			fmt.Sprintf("%s/saves/%s", toPrefix, save.FileName),
+		)
+		if err != nil {
+			return fmt.Errorf("error copying save %s with error: %s", save.FileName, err.Error())
+		}
+		save.FileUrl = objectURL
+		saves = append(saves, save)
+	}
+
+	backups := make([]modelsv2.AgentBackup, 0, len(target.Backups)+len(source.Backups))
+	for _, backup := range target.Backups {
+		if !hasBackup(source.Backups, backup.FileName) {
+			backups = append(backups, backup)
+		}
+	}
+	for _, backup := range source.Backups {
+		objectURL, err := repositories.CopyAgentFile(
+			fmt.Sprintf("%s/backups/%s", fromPrefix, backup.FileName),
+			fmt.Sprintf("%s/backups/%s", toPrefix, backup.FileName),
+		)
+		if err != nil {
+			return fmt.Errorf("error copying backup %s with error: %s", backup.FileName, err.Error())
+		}
+		backup.FileUrl = objectURL
+		backups = append(backups, backup)
+	}
+
+	// Config also carries what the agent reports about itself; only the
+	// settings a user chose move.
+	target.Config.BackupInterval = source.Config.BackupInterval
+	target.Config.BackupKeepAmount = source.Config.BackupKeepAmount
+
+	dbUpdate := bson.M{
+		"serverConfig": source.ServerConfig,
+		"config":       target.Config,
+		"saves":        saves,
+		"backups":      backups,
+		"updatedAt":    time.Now(),
+	}
+
+	if err := AgentModel.UpdateData(target, dbUpdate); err != nil {
+		return fmt.Errorf("error updating target agent with error: %s", err.Error())
+	}
+
+	action.Status = "completed"
+	return nil
+}
+
+func hasSave(saves []modelsv2.AgentSave, fileName string) bool {
+	for idx := range saves {
+		if saves[idx].FileName == fileName {
+			return true
+		}
+	}
+	return false
+}
+
+func hasBackup(backups []modelsv2.AgentBackup, fileName string) bool {
+	for idx := range backups {
+		if backups[idx].FileName == fileName {
+			return true
+		}
+	}
+	return false
+}
+
+// Execute pushes the source's latest save to the target with the step's
+// TaskAction, restorebackup or verifybackup. The save is chosen when the step
+// first runs: after the source has stopped and the copy step has run, so a save
+// the source wrote as it shut down is the one pushed. A source without saves
+// leaves nothing to push.
+func (a PushSaveAction) Execute(action *modelsv2.WorkflowAction, d interface{}, theAccount *modelsv2.AccountSchema, wctx modelsv2.WorkflowContext) error {
+	if action.TaskID == "" && action.TaskData == nil {
+		roles, ok := d.(workflow.AgentRoles)
+		if !ok {
+			return errors.New("workflow has no source agent to push a save from")
+		}
+
+		source, err := roles.AgentForRole(workflow.RoleSource)
+		if err != nil {
+			return err
+		}
+
+		save := LatestSave(source)
+		if save == nil {
+			action.Status = "completed"
+			return nil
+		}
+		action.TaskData = restorePayload{Kind: RestoreKindSave, FileName: save.FileName, Size: save.Size}
+	}
+
+	return workflow.AgentTaskAction{}.Execute(action, d, theAccount, wctx)
+}
+
+// Execute deletes the step's agent, the migration's source.
+func (a DecommissionAction) Execute(action *modelsv2.WorkflowAction, d interface{}, theAccount *modelsv2.AccountSchema, _ modelsv2.WorkflowContext) error {
+	theAgent, err := d.(workflow.WorkflowData).Agent()
+	if err != nil {
+		return err
+	}
+
+	if err := DeleteAgent(theAccount, theAgent.ID); err != nil {
+		return err
+	}
+
+	action.Status = "completed"
+	return nil
+}
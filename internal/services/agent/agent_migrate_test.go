@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/workflow"
+	modelsv2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+)
+
+func stepNames(actions []modelsv2.WorkflowAction) []string {
+	names := make([]string, 0, len(actions))
+	for _, action := range actions {
+		names = append(names, action.Name)
+	}
+	return names
+}
+
+func stepNamed(t *testing.T, actions []modelsv2.WorkflowAction, name string) modelsv2.WorkflowAction {
+	t.Helper()
+	for _, action := range actions {
+		if action.Name == name {
+			return action
+		}
+	}
+	t.Fatalf("expected a %s step in %v", name, stepNames(actions))
+	return modelsv2.WorkflowAction{}
+}
+
+func TestMigrateActions(t *testing.T) {
+	tests := []struct {
+		name         string
+		newTarget    *modelsv2.CreateAgentWorkflowData
+		decommission bool
+		want         []string
+	}{
+		{
+			name: "to an existing agent",
+			want: []string{"stopsource", "stoptarget", "copy", "mods", "download", "verify", "starttarget"},
+		},
+		{
+			name:         "to an existing agent, decommissioning the source",
+			decommission: true,
+			want:         []string{"stopsource", "stoptarget", "copy", "mods", "download", "verify", "starttarget", "decommission"},
+		},
+		{
+			name:      "to a new agent",
+			newTarget: &modelsv2.CreateAgentWorkflowData{AdminPass: "admin", ClientPass: "client"},
+			want:      []string{"create", "online", "install", "stopsource", "stoptarget", "copy", "mods", "download", "verify", "starttarget", "claim"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stepNames(migrateActions(tt.newTarget, tt.decommission)); !slices.Equal(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// Only the source's stop is undone, and only the source's steps act on it.
+func TestMigrateActionsRollBackTheSourceOnly(t *testing.T) {
+	actions := migrateActions(nil, true)
+
+	for _, action := range actions {
+		if action.Name != "stopsource" && action.Compensation != nil {
+			t.Fatalf("expected only stopsource to be compensated, %s is", action.Name)
+		}
+	}
+
+	stop := stepNamed(t, actions, "stopsource")
+	if stop.Role != workflow.RoleSource || stop.When != "agent.online" {
+		t.Fatalf("expected stopsource to act on an online source, got %+v", stop)
+	}
+	if stop.Compensation == nil || stop.Compensation.TaskAction != "startsfserver" {
+		t.Fatalf("expected stopsource to be undone by a start, got %+v", stop.Compensation)
+	}
+
+	decommission := stepNamed(t, actions, "decommission")
+	if decommission.Role != workflow.RoleSource || !decommission.ContinueOnError {
+		t.Fatalf("expected a decommission of the source that does not roll back, got %+v", decommission)
+	}
+}
+
+func TestMigrateActionsClaimANewTargetWithItsPasswords(t *testing.T) {
+	actions := migrateActions(&modelsv2.CreateAgentWorkflowData{AdminPass: "admin", ClientPass: "client"}, false)
+
+	claim := stepNamed(t, actions, "claim")
+	data, ok := claim.TaskData.(modelsv2.ClaimServer_PostData)
+	if !ok || data.AdminPass != "admin" || data.ClientPass != "client" {
+		t.Fatalf("expected the claim to carry the new target's passwords, got %+v", claim.TaskData)
+	}
+}
@@ -136,6 +136,29 @@ func SaveObjectPathForAPIKey(apiKey, saveFileName string) (string, error) {
 	return "", fmt.Errorf("save file not found")
 }
 
+// BackupObjectPathForAPIKey is SaveObjectPathForAPIKey for the agent's backups,
+// which a restore pushes back to it.
+func BackupObjectPathForAPIKey(apiKey, backupFileName string) (string, error) {
+	theAgent, err := GetAgentByAPIKey(apiKey)
+	if err != nil {
+		return "", err
+	}
+	AccountModel, err := repositories.GetMongoClient().GetModel("Account")
+	if err != nil {
+		return "", err
+	}
+	theAccount := &modelsv2.AccountSchema{}
+	if err := AccountModel.FindOne(theAccount, bson.M{"agents": theAgent.ID}); err != nil {
+		return "", err
+	}
+	for i := range theAgent.Backups {
+		if theAgent.Backups[i].FileName == backupFileName {
+			return fmt.Sprintf("%s/%s/backups/%s", theAccount.ID.Hex(), theAgent.ID.Hex(), backupFileName), nil
+		}
+	}
+	return "", fmt.Errorf("backup file not found")
+}
+
 func GetAgentByAPIKey(agentAPIKey string) (*modelsv2.AgentSchema, error) {
 
 	AgentModel, err := repositories.GetMongoClient().GetModel("Agent")
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/workflow"
+	modelsv2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+)
+
+const (
+	RestoreKindBackup = "backup"
+	RestoreKindSave   = "save"
+)
+
+var (
+	ErrRestoreFileNotFound = errors.New("file to restore not found")
+	ErrInvalidRestoreKind  = errors.New("invalid restore kind")
+	ErrNoBackupMods        = errors.New("backup kept no mods to restore")
+)
+
+// restorePayload is the data of the restorebackup and verifybackup tasks.
+type restorePayload struct {
+	Kind     string `json:"kind"`
+	FileName string `json:"fileName"`
+	Size     int64  `json:"size"`
+}
+
+// NewWorkflow_RestoreBackup puts one of the agent's stored backups or saves
+// back on it: the server is stopped, the file pushed down and checked before it
+// replaces what is there, and the server started again. With restoreMods, a
+// backup that kept the agent's mods when it was taken has them restored too,
+// before the start; asking for them from a save or a backup that kept none is
+// refused.
+//
+// The stop is compensated by a start, so a restore that fails part way leaves
+// the server running on the files it had. The mods step is compensated by
+// putting back the selection it replaced. An agent that cannot run the restore
+// tasks is refused before its server is stopped.
+func NewWorkflow_RestoreBackup(theAccount *modelsv2.AccountSchema, theAgent *modelsv2.AgentSchema, fileName, kind string, restoreMods bool, createdBy string) (string, error) {
+	payload := restorePayload{Kind: kind, FileName: fileName}
+	var mods *modelsv2.Lockfile
+	found := false
+
+	switch kind {
+	case RestoreKindBackup:
+		for idx := range theAgent.Backups {
+			if theAgent.Backups[idx].FileName == fileName {
+				payload.Size = theAgent.Backups[idx].Size
+				mods = theAgent.Backups[idx].Mods
+				found = true
+				break
+			}
+		}
+	case RestoreKindSave:
+		for idx := range theAgent.Saves {
+			if theAgent.Saves[idx].FileName == fileName {
+				payload.Size = theAgent.Saves[idx].Size
+				found = true
+				break
+			}
+		}
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidRestoreKind, kind)
+	}
+
+	if !found {
+		return "", fmt.Errorf("%w: %s", ErrRestoreFileNotFound, fileName)
+	}
+	if restoreMods && mods == nil {
+		return "", fmt.Errorf("%w: %s", ErrNoBackupMods, fileName)
+	}
+
+	capabilities, err := agenttask.Capabilities(context.Background(), theAgent.ID)
+	if err != nil {
+		return "", err
+	}
+	for _, taskAction := range []string{"restorebackup", "verifybackup"} {
+		if err := capabilities.Check(taskAction); err != nil {
+			return "", err
+		}
+	}
+
+	startServerAction := modelsv2.WorkflowAction{
+		Name:       "start",
+		Type:       modelsv2.WorkflowActionType_AgentTask,
+		TaskAction: "startsfserver",
+		Timeout:    10 * time.Minute,
+	}
+
+	stopServerAction := modelsv2.WorkflowAction{
+		Name:       "stop",
+		Type:       modelsv2.WorkflowActionType_AgentTask,
+		TaskAction: "stopsfserver",
+		Timeout:    10 * time.Minute,
+		Compensation: &modelsv2.WorkflowAction{
+			Type:       modelsv2.WorkflowActionType_AgentTask,
+			TaskAction: "startsfserver",
+			Timeout:    10 * time.Minute,
+		},
+	}
+
+	// The download resumes where a failed attempt left off, so it is worth
+	// retrying before the restore is given up on.
+	downloadAction := modelsv2.WorkflowAction{
+		Name:       "download",
+		Type:       modelsv2.WorkflowActionType_AgentTask,
+		TaskAction: "restorebackup",
+		TaskData:   payload,
+		Timeout:    60 * time.Minute,
+		MaxRetries: 2,
+	}
+
+	verifyAction := modelsv2.WorkflowAction{
+		Name:       "verify",
+		Type:       modelsv2.WorkflowActionType_AgentTask,
+		TaskAction: "verifybackup",
+		TaskData:   payload,
+		Timeout:    10 * time.Minute,
+	}
+
+	actions := []modelsv2.WorkflowAction{stopServerAction, downloadAction, verifyAction}
+
+	// The compensation's TaskData is the selection the step replaces, which
+	// RestoreModsAction records when it first runs.
+	if restoreMods {
+		actions = append(actions, modelsv2.WorkflowAction{
+			Name:     "mods",
+			Type:     workflow.ActionTypeRestoreMods,
+			TaskData: *mods,
+			Timeout:  30 * time.Minute,
+			Compensation: &modelsv2.WorkflowAction{
+				Type:    workflow.ActionTypeRestoreMods,
+				Timeout: 30 * time.Minute,
+			},
+		})
+	}
+
+	actions = append(actions, startServerAction)
+
+	workflowId, err := workflow.Create(workflow.RestoreBackupWorkflowType, workflow.RestoreBackupData{
+		AgentWorkflowData: workflow.AgentWorkflowData{
+			AccountId: theAccount.ID,
+			AgentId:   theAgent.ID,
+		},
+		FileName:    fileName,
+		Kind:        kind,
+		RestoreMods: restoreMods,
+	}, actions, createdBy)
+	if err != nil {
+		return "", err
+	}
+
+	return workflowId.Hex(), nil
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const maxAgentTags = 20
+
+// agentTags is the projection tags are read through. They are a backend-side
+// grouping for bulk operations, so they live on the agent document without
+// being part of the shared AgentSchema.
+type agentTags struct {
+	ID   bson.ObjectID `bson:"_id"`
+	Tags []string      `bson:"tags"`
+}
+
+// normaliseTags lower-cases, trims and de-duplicates tags, so "Prod" and
+// " prod" select the same agents.
+func normaliseTags(tags []string) []string {
+	out := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !slices.Contains(out, tag) {
+			out = append(out, tag)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// SetAgentTags replaces the agent's tags.
+func SetAgentTags(agentID bson.ObjectID, tags []string) error {
+	tags = normaliseTags(tags)
+	if len(tags) > maxAgentTags {
+		return fmt.Errorf("an agent can have at most %d tags", maxAgentTags)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := repositories.GetMongoClient().GetCollection("agents").UpdateOne(ctx,
+		bson.M{"_id": agentID},
+		bson.M{"$set": bson.M{"tags": tags, "updatedAt": time.Now()}})
+	return err
+}
+
+// GetAgentTags returns the tags of each agent, keyed by agent id. An agent with
+// no tags is absent.
+func GetAgentTags(agentIDs []bson.ObjectID) (map[bson.ObjectID][]string, error) {
+	out := make(map[bson.ObjectID][]string)
+	if len(agentIDs) == 0 {
+		return out, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := repositories.GetMongoClient().GetCollection("agents").Find(ctx,
+		bson.M{"_id": bson.M{"$in": agentIDs}, "tags.0": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"tags": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]agentTags, 0)
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		out[row.ID] = row.Tags
+	}
+	return out, nil
+}
+
+// HasAllTags reports whether an agent's tags include every wanted tag.
+func HasAllTags(have, want []string) bool {
+	for _, tag := range normaliseTags(want) {
+		if !slices.Contains(have, tag) {
+			return false
+		}
+	}
+	return true
+}
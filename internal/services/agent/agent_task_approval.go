@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/audit"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/integration"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	models "github.com/SatisfactoryServerManager/ssmcloud-resources/models"
+	modelsv2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+)
+
+// EventDataTaskApproval is the integration payload that tells approvers a task
+// is waiting for them.
+type EventDataTaskApproval struct {
+	models.EventData
+	AgentName string `json:"agentName"`
+	TaskID    string `json:"taskId"`
+	Action    string `json:"action"`
+}
+
+// onTaskApproval records each approval step on the account: an integration
+// event when a task starts waiting, so approvers hear about it, and an audit
+// entry for every decision. It runs after the step has happened, so a failure
+// here is logged rather than undoing it.
+func onTaskApproval(ev agenttask.ApprovalEvent) {
+	if err := recordTaskApproval(ev); err != nil {
+		logger.GetErrorLogger().Printf("error recording %s approval of task %s: %s", ev.Type, ev.TaskID.Hex(), err.Error())
+	}
+}
+
+func recordTaskApproval(ev agenttask.ApprovalEvent) error {
+	AccountModel, err := repositories.GetMongoClient().GetModel("Account")
+	if err != nil {
+		return err
+	}
+
+	theAccount := &modelsv2.AccountSchema{}
+	if err := AccountModel.FindOneById(theAccount, ev.AccountID); err != nil {
+		return fmt.Errorf("error finding account with error: %s", err.Error())
+	}
+
+	agentName := ev.AgentID.Hex()
+	if theAgent, err := GetAgentByIdNoAccount(ev.AgentID.Hex()); err == nil {
+		agentName = theAgent.AgentName
+	}
+
+	switch ev.Type {
+	case agenttask.ApprovalRequired:
+		return integration.AddIntegrationEvent(theAccount, modelsv2.IntegrationEventTypeAgentTaskApprovalRequired, EventDataTaskApproval{
+			EventData: models.EventData{
+				EventType: string(modelsv2.IntegrationEventTypeAgentTaskApprovalRequired),
+				EventTime: time.Now(),
+			},
+			AgentName: agentName,
+			TaskID:    ev.TaskID.Hex(),
+			Action:    ev.Action,
+		})
+	case agenttask.ApprovalApproved:
+		return audit.AddAccountAudit(theAccount,
+			modelsv2.AuditType_AgentTaskApproved,
+			fmt.Sprintf("Task %s (%s) on agent (%s) was approved", ev.TaskID.Hex(), ev.Action, agentName),
+		)
+	case agenttask.ApprovalRejected:
+		return audit.AddAccountAudit(theAccount,
+			modelsv2.AuditType_AgentTaskRejected,
+			fmt.Sprintf("Task %s (%s) on agent (%s) was rejected", ev.TaskID.Hex(), ev.Action, agentName),
+		)
+	case agenttask.ApprovalExpired:
+		return audit.AddAccountAudit(theAccount,
+			modelsv2.AuditType_AgentTaskApprovalExpired,
+			fmt.Sprintf("Task %s (%s) on agent (%s) expired without approval", ev.TaskID.Hex(), ev.Action, agentName),
+		)
+	}
+	return nil
+}
@@ -8,8 +8,11 @@ import (
 	"time"
 
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/types"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
 	modelsv2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
@@ -96,7 +99,10 @@ func UploadedAgentSave(agentAPIKey string, fileIdentity types.StorageFileIdentit
 	return nil
 }
 
-func UploadedAgentBackup(agentAPIKey string, fileIdentity types.StorageFileIdentity) error {
+// UploadedAgentBackup records a backup the agent uploaded. mods is the agent's
+// mod selection at the time, for a restore to put back; nil when it could not
+// be read, and the backup then restores without touching mods.
+func UploadedAgentBackup(agentAPIKey string, fileIdentity types.StorageFileIdentity, mods *modelsv2.Lockfile) error {
 	theAgent, err := GetAgentByAPIKey(agentAPIKey)
 	if err != nil {
 		return fmt.Errorf("error finding agent with error: %s", err.Error())
@@ -131,6 +137,7 @@ func UploadedAgentBackup(agentAPIKey string, fileIdentity types.StorageFileIdent
 		FileName:  fileIdentity.FileName,
 		Size:      fileIdentity.Filesize,
 		FileUrl:   objectUrl,
+		Mods:      mods,
 		CreatedAt: time.Now(),
 	}
 
@@ -268,3 +275,55 @@ func UploadedAgentLog(agentAPIKey string, fileIdentity types.StorageFileIdentity
 
 	return nil
 }
+
+// UploadedTaskArtifact stores a file the agent produced while running a task
+// and attaches it to that task. The lease is checked before the upload, so a
+// zombie agent that has lost the task cannot write to the bucket; the attach is
+// fenced again, since the lease can still be lost while the file uploads.
+func UploadedTaskArtifact(agentAPIKey, taskID, leaseToken string, fileIdentity types.StorageFileIdentity) error {
+	theAgent, err := GetAgentByAPIKey(agentAPIKey)
+	if err != nil {
+		return fmt.Errorf("error finding agent with error: %s", err.Error())
+	}
+
+	if err := agenttask.CheckArtifactUpload(taskID, leaseToken, theAgent.ID); err != nil {
+		return err
+	}
+
+	accountID, err := GetAccountIDForAgent(theAgent.ID)
+	if err != nil {
+		return fmt.Errorf("error finding agent account with error: %s", err.Error())
+	}
+
+	info, err := os.Stat(fileIdentity.LocalFilePath)
+	if err != nil {
+		return err
+	}
+	fileIdentity.Filesize = info.Size()
+
+	artifactUUID := uuid.NewString()
+	objectPath := fmt.Sprintf("%s/%s/tasks/%s/%s-%s", accountID.Hex(), theAgent.ID.Hex(), taskID, artifactUUID, fileIdentity.FileName)
+
+	objectUrl, err := repositories.UploadAgentFile(fileIdentity, objectPath)
+	if err != nil {
+		return fmt.Errorf("error uploading file to minio with error: %s", err)
+	}
+
+	err = agenttask.AttachArtifact(taskID, leaseToken, theAgent.ID, agenttask.TaskArtifact{
+		UUID:       artifactUUID,
+		FileName:   fileIdentity.FileName,
+		Size:       fileIdentity.Filesize,
+		ObjectPath: objectPath,
+		FileURL:    objectUrl,
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		// Lost the lease or the last slot since the check: nothing will ever
+		// point at the file, so it goes.
+		if derr := repositories.DeleteAgentFile(objectPath); derr != nil {
+			logger.GetErrorLogger().Printf("error deleting unattached artifact %s: %s", objectPath, derr.Error())
+		}
+		return err
+	}
+	return nil
+}
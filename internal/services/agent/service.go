@@ -7,7 +7,9 @@ import (
 	"time"
 
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/integration"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/workflow"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
 	models "github.com/SatisfactoryServerManager/ssmcloud-resources/models"
 	modelsv2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
@@ -23,6 +25,14 @@ var (
 
 func InitAgentService() {
 
+	agenttask.RegisterApprovalHook(onTaskApproval)
+
+	// The migration and clone steps that work on agents in the database.
+	workflow.RegisterWorkflowAction(workflow.ActionTypeCopyServer, CopyServerAction{})
+	workflow.RegisterWorkflowAction(workflow.ActionTypePushSave, PushSaveAction{})
+	workflow.RegisterWorkflowAction(workflow.ActionTypeDecommission, DecommissionAction{})
+	workflow.RegisterWorkflowAction(workflow.ActionTypeCopySave, CopySaveAction{})
+
 	checkAllAgentsLastCommsJob, _ = joblock.NewJobLockTask(
 		repositories.GetMongoClient(),
 		"checkAllAgentsLastCommsJob", func() {
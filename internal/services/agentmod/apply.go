@@ -30,6 +30,22 @@ const (
 	OpApplyPending = "applyPending"
 )
 
+// ApplyMode is when a change lands on a running server. A stopped server needs
+// no chain and no gate, so every mode syncs it immediately.
+type ApplyMode int
+
+const (
+	// ApplyDeferred syncs whenever the server next stops for any reason.
+	ApplyDeferred ApplyMode = iota
+	// ApplyNow stops the server, syncs and starts it again straight away.
+	ApplyNow
+	// ApplyInWindow runs the same stop -> sync -> start chain, with the stop
+	// held until the agent's next maintenance window.
+	ApplyInWindow
+)
+
+var errNoMaintenanceWindow = errors.New("the agent has no maintenance window to apply the change in")
+
 // ModChange is one user action on the mod selection.
 type ModChange struct {
 	Op           string
@@ -101,9 +117,17 @@ func Preview(agentID bson.ObjectID, ch ModChange) (Change, error) {
 
 // Apply resolves the change, persists it, and enqueues the work.
 //
-// applyNow is only consulted when the server is running: a stopped server needs
-// no chain and no gate.
-func Apply(agentID, accountID bson.ObjectID, ch ModChange, applyNow bool, trigger v2.TaskTrigger) ([]string, error) {
+// mode is only consulted when the server is running: a stopped server needs no
+// chain and no gate.
+func Apply(agentID, accountID bson.ObjectID, ch ModChange, mode ApplyMode, trigger v2.TaskTrigger) ([]string, error) {
+	// Checked before anything is persisted: a chain held for a window that never
+	// opens leaves the change saved but owed forever.
+	if mode == ApplyInWindow {
+		if err := requireMaintenanceWindow(agentID); err != nil {
+			return nil, err
+		}
+	}
+
 	current, err := ListForAgent(agentID)
 	if err != nil {
 		return nil, err
@@ -114,7 +138,8 @@ func Apply(agentID, accountID bson.ObjectID, ch ModChange, applyNow bool, trigge
 		return nil, err
 	}
 
-	if Diff(current, lf).IsEmpty() {
+	change := Diff(current, lf)
+	if change.IsEmpty() {
 		return []string{}, nil
 	}
 
@@ -122,7 +147,18 @@ func Apply(agentID, accountID bson.ObjectID, ch ModChange, applyNow bool, trigge
 		return nil, err
 	}
 
-	return enqueueSync(agentID, accountID, lf, applyNow, trigger)
+	return enqueueSync(agentID, accountID, lf, mode, trigger, change.Downgrades())
+}
+
+func requireMaintenanceWindow(agentID bson.ObjectID) error {
+	windows, err := agenttask.MaintenanceWindows(agentID)
+	if err != nil {
+		return err
+	}
+	if len(windows) == 0 {
+		return errNoMaintenanceWindow
+	}
+	return nil
 }
 
 // ApplyPendingNow escalates an already-deferred change to run immediately.
@@ -134,7 +170,7 @@ func Apply(agentID, accountID bson.ObjectID, ch ModChange, applyNow bool, trigge
 // nothing about whether a sync is still owed.
 //
 // Nothing is persisted here either; there is nothing new to persist. planFor sees
-// the pending sync id plus applyNow and RE-POINTS that same sync onto a fresh
+// the pending sync id plus ApplyNow and RE-POINTS that same sync onto a fresh
 // stop -> sync -> start chain rather than adding a second one.
 func ApplyPendingNow(agentID, accountID bson.ObjectID, trigger v2.TaskTrigger) ([]string, error) {
 	lf, err := Resolve(agentID)
@@ -152,7 +188,7 @@ func applyPendingNowWith(q taskQueue, agentID, accountID bson.ObjectID, lf v2.Lo
 	// There must actually BE a deferred sync to escalate. Without this, an "Apply
 	// now" click on a banner that has gone stale — the sync already ran, or the user
 	// cancelled it, and the tasks poll has not caught up — reaches planFor with an
-	// empty pendingSyncID and (running && applyNow) builds a WHOLE NEW chain: a
+	// empty pendingSyncID and (running, ApplyNow) builds a WHOLE NEW chain: a
 	// healthy running server is stopped, synced to a state it is already in, and
 	// restarted, kicking every player, with no preview and no confirmation in the
 	// way. The diff check that would normally catch a no-op change is deliberately
@@ -165,7 +201,7 @@ func applyPendingNowWith(q taskQueue, agentID, accountID bson.ObjectID, lf v2.Lo
 		return []string{}, nil
 	}
 
-	return enqueueSyncWith(q, agentID, accountID, lf, true, trigger)
+	return enqueueSyncWith(q, agentID, accountID, lf, ApplyNow, trigger, false)
 }
 
 // ApplyConfigOnly persists an edit to a mod's .cfg text and enqueues a sync.
@@ -177,7 +213,13 @@ func applyPendingNowWith(q taskQueue, agentID, accountID bson.ObjectID, lf v2.Lo
 // indefinitely. The diff check is therefore skipped deliberately, not an
 // oversight: for a config-only change, "the lockfile didn't change" says
 // nothing about whether the agent needs to re-sync.
-func ApplyConfigOnly(agentID, accountID bson.ObjectID, modReference, config string, applyNow bool, trigger v2.TaskTrigger) ([]string, error) {
+func ApplyConfigOnly(agentID, accountID bson.ObjectID, modReference, config string, mode ApplyMode, trigger v2.TaskTrigger) ([]string, error) {
+	if mode == ApplyInWindow {
+		if err := requireMaintenanceWindow(agentID); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := SetConfig(agentID, modReference, config); err != nil {
 		return nil, err
 	}
@@ -187,7 +229,7 @@ func ApplyConfigOnly(agentID, accountID bson.ObjectID, modReference, config stri
 		return nil, err
 	}
 
-	return enqueueSync(agentID, accountID, lf, applyNow, trigger)
+	return enqueueSync(agentID, accountID, lf, mode, trigger, false)
 }
 
 // persist writes the resolved lockfile back as the agent's selection.
@@ -264,10 +306,12 @@ const (
 // syncPlan is the whole decision. The executor does nothing this does not say.
 type syncPlan struct {
 	NeedStop       bool     // enqueue (or adopt) the chain's stopsfserver
+	StopInWindow   bool     // hold that stop for the agent's next maintenance window
 	ReuseSyncID    string   // "" => insert a fresh syncmods; else re-gate this pending one
 	Gate           syncGate // the gate the sync ends up carrying, whether reused or fresh
 	EnsureStart    bool     // enqueue (or adopt) a startsfserver trailing the sync
 	RepointStartID string   // "" => none; else the pending start to drag onto the sync
+	Approval       bool     // hold the chain's first task, the stop or else the sync, for approval
 }
 
 // planFor is the whole of enqueueSync's correctness, as a pure function of the
@@ -289,12 +333,18 @@ type syncPlan struct {
 // stopped) is still right: that start is already pending and already ungated, so
 // it is going to boot the server regardless — refusing to re-point does not
 // prevent the boot, it only lets it happen BEFORE the sync instead of after.
-func planFor(running, applyNow bool, pendingSyncID, pendingStartID string) syncPlan {
+//
+// ApplyInWindow is ApplyNow with only the stop held for the window. The window
+// gate goes on the stop and nowhere else: the sync and start are already
+// behind it, and a start held for a window that closed mid-chain would leave
+// the server down until the next one.
+func planFor(running bool, mode ApplyMode, pendingSyncID, pendingStartID string) syncPlan {
 	p := syncPlan{ReuseSyncID: pendingSyncID, RepointStartID: pendingStartID}
 
 	switch {
-	case running && applyNow:
+	case running && mode != ApplyDeferred:
 		p.NeedStop = true
+		p.StopInWindow = mode == ApplyInWindow
 		p.Gate = gateAfterStop
 		p.EnsureStart = true
 	case running:
@@ -371,8 +421,8 @@ var errStartClaimed = errors.New("the pending startsfserver was claimed while th
 // through to inserting an ungated sync.
 const maxPlanAttempts = 3
 
-func enqueueSync(agentID, accountID bson.ObjectID, lf v2.Lockfile, applyNow bool, trigger v2.TaskTrigger) ([]string, error) {
-	return enqueueSyncWith(liveQueue{}, agentID, accountID, lf, applyNow, trigger)
+func enqueueSync(agentID, accountID bson.ObjectID, lf v2.Lockfile, mode ApplyMode, trigger v2.TaskTrigger, approval bool) ([]string, error) {
+	return enqueueSyncWith(liveQueue{}, agentID, accountID, lf, mode, trigger, approval)
 }
 
 // enqueueSyncWith gathers the four facts planFor needs, then executes its plan.
@@ -383,7 +433,10 @@ func enqueueSync(agentID, accountID bson.ObjectID, lf v2.Lockfile, applyNow bool
 // executePlan detects exactly that (errStartClaimed) and this loop re-reads — the
 // new plan then sees a running server and gates the sync instead of leaving it
 // claimable over a live one.
-func enqueueSyncWith(q taskQueue, agentID, accountID bson.ObjectID, lf v2.Lockfile, applyNow bool, trigger v2.TaskTrigger) ([]string, error) {
+//
+// approval holds the chain for a second account member: a downgrade takes the
+// mods back to releases the user moved off, so it is not one person's call.
+func enqueueSyncWith(q taskQueue, agentID, accountID bson.ObjectID, lf v2.Lockfile, mode ApplyMode, trigger v2.TaskTrigger, approval bool) ([]string, error) {
 	for attempt := 0; attempt < maxPlanAttempts; attempt++ {
 		running, err := planRunning(q, agentID)
 		if err != nil {
@@ -403,7 +456,10 @@ func enqueueSyncWith(q taskQueue, agentID, accountID bson.ObjectID, lf v2.Lockfi
 			return nil, err
 		}
 
-		ids, err := executePlan(q, agentID, accountID, lf, trigger, planFor(running, applyNow, pendingSync, pendingStart))
+		p := planFor(running, mode, pendingSync, pendingStart)
+		p.Approval = approval
+
+		ids, err := executePlan(q, agentID, accountID, lf, trigger, p)
 		if errors.Is(err, errStartClaimed) {
 			continue
 		}
@@ -501,7 +557,17 @@ func executePlan(q taskQueue, agentID, accountID bson.ObjectID, lf v2.Lockfile,
 		gate.DependsOn = &stopOID
 	case gateServerStopped:
 		gate.RequiresServerStopped = true
-	}
+	case gateNone:
+		// The server is already stopped, so the sync is claimable now, not
+		// held behind syncmods' default gate; the re-check below gates it
+		// if a start turns up.
+		gate.Ungated = true
+	}
+	// Approval holds the first task of the chain. On the stop, a rejection
+	// cancels the sync and start behind it and the server never goes down for a
+	// change nobody approved; on the sync of a chain with no stop, there is
+	// nothing in front of it to hold.
+	gate.RequiresApproval = p.Approval && !p.NeedStop
 
 	if p.ReuseSyncID != "" {
 		// A no-op here is safe to ignore: the sync being claimed means it is running
@@ -565,7 +631,7 @@ func executePlan(q taskQueue, agentID, accountID bson.ObjectID, lf v2.Lockfile,
 		// is already down; a sync gated on a parent that will never cascade leaves the
 		// server down forever.
 		if _, err := q.Enqueue(agentID, accountID, ActionStop, nil, "", trigger,
-			agenttask.EnqueueOpts{ID: &stopOID}); err != nil {
+			agenttask.EnqueueOpts{ID: &stopOID, RequiresMaintenanceWindow: p.StopInWindow, RequiresApproval: p.Approval}); err != nil {
 			// The sync is gated on an _id that will never exist. Move it onto
 			// requiresServerStopped rather than releasing it: released, it would be claimable
 			// NOW, over a live game (invariant 1). Gated this way it waits for the next stop,
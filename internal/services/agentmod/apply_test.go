@@ -159,7 +159,7 @@ func TestEnqueueSyncGatesTheSyncWhileAStartIsStillBooting(t *testing.T) {
 		runningStartID: "652f000000000000000000c3",
 	} // ... but its startsfserver is RUNNING right now
 
-	if _, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, false, v2.TaskTrigger{Type: v2.TaskTriggerUser}); err != nil {
+	if _, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, ApplyDeferred, v2.TaskTrigger{Type: v2.TaskTriggerUser}, false); err != nil {
 		t.Fatal(err)
 	}
 
@@ -183,7 +183,7 @@ func TestEnqueueSyncNeverAdoptsARunningStartAsItsOwnTail(t *testing.T) {
 	agentID := bson.NewObjectID()
 	q := &fakeQueue{running: false, runningStartID: runningStart}
 
-	ids, err := enqueueSyncWith(q, agentID, bson.NewObjectID(), v2.Lockfile{}, true, v2.TaskTrigger{Type: v2.TaskTriggerUser})
+	ids, err := enqueueSyncWith(q, agentID, bson.NewObjectID(), v2.Lockfile{}, ApplyNow, v2.TaskTrigger{Type: v2.TaskTriggerUser}, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -212,6 +212,29 @@ func TestEnqueueSyncNeverAdoptsARunningStartAsItsOwnTail(t *testing.T) {
 	}
 }
 
+// Only the stop waits for the window. The sync and start behind it must carry
+// no window gate, or a window closing mid-chain leaves the server down until
+// the next one opens.
+func TestEnqueueSyncInWindowHoldsOnlyTheStop(t *testing.T) {
+	q := &fakeQueue{running: true}
+
+	if _, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, ApplyInWindow, v2.TaskTrigger{Type: v2.TaskTriggerUser}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	stops := q.enqueuesOf(ActionStop)
+	if len(stops) != 1 || !stops[0].opts.RequiresMaintenanceWindow {
+		t.Fatalf("expected one stop held for the maintenance window, got %+v", stops)
+	}
+	for _, action := range []string{ActionSyncMods, ActionStart} {
+		for _, call := range q.enqueuesOf(action) {
+			if call.opts.RequiresMaintenanceWindow {
+				t.Fatalf("expected %s to wait on the chain, not on the window", action)
+			}
+		}
+	}
+}
+
 // FINDING 3. An aborted attempt must leave NOTHING behind. Parents go in last, so
 // the only step that can abort — the re-point of a pre-existing pending start, which
 // is an UPDATE — runs before any insert. A stopsfserver written before it would
@@ -223,7 +246,7 @@ func TestEnqueueSyncNeverAdoptsARunningStartAsItsOwnTail(t *testing.T) {
 func TestEnqueueSyncLeavesNoTasksBehindWhenTheAttemptIsAborted(t *testing.T) {
 	q := &alwaysClaimedQueue{fakeQueue{running: true}}
 
-	_, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, true, v2.TaskTrigger{Type: v2.TaskTriggerUser})
+	_, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, ApplyNow, v2.TaskTrigger{Type: v2.TaskTriggerUser}, false)
 	if err == nil {
 		t.Fatal("expected an error once the plan attempts were exhausted")
 	}
@@ -255,7 +278,7 @@ func TestEnqueueSyncNeverInsertsAnUngatedSyncWhenTheStartWasClaimedMidPlan(t *te
 		startClaimedOnRepoint: true, // ... and it gets claimed before our re-point lands
 	}
 
-	ids, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, false, v2.TaskTrigger{Type: v2.TaskTriggerUser})
+	ids, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, ApplyDeferred, v2.TaskTrigger{Type: v2.TaskTriggerUser}, false)
 	if err != nil {
 		t.Fatalf("expected the re-plan to succeed, got %v", err)
 	}
@@ -288,7 +311,7 @@ func TestEnqueueSyncReGatesTheSyncWhenAStartAppearsAfterItIsInserted(t *testing.
 		startAppearsAfterSyncInsert: true,   // ... but one is claimed the instant the sync exists
 	}
 
-	ids, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, false, v2.TaskTrigger{Type: v2.TaskTriggerUser})
+	ids, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, ApplyDeferred, v2.TaskTrigger{Type: v2.TaskTriggerUser}, false)
 	if err != nil {
 		t.Fatalf("expected the plan to succeed, got %v", err)
 	}
@@ -297,7 +320,7 @@ func TestEnqueueSyncReGatesTheSyncWhenAStartAppearsAfterItIsInserted(t *testing.
 	}
 
 	sync := q.syncEnqueue(t)
-	if sync.opts.DependsOn != nil || sync.opts.RequiresServerStopped {
+	if sync.opts.DependsOn != nil || sync.opts.RequiresServerStopped || !sync.opts.Ungated {
 		t.Fatalf("expected the sync to be inserted with gateNone before the post-insert check, got %+v", sync.opts)
 	}
 
@@ -319,7 +342,7 @@ func TestExecutePlanGatesThePendingStartBeforeInsertingTheSync(t *testing.T) {
 	const pendingStart = "652f000000000000000000b2"
 	q := &fakeQueue{pendingStart: pendingStart}
 
-	if _, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, false, v2.TaskTrigger{Type: v2.TaskTriggerUser}); err != nil {
+	if _, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, ApplyDeferred, v2.TaskTrigger{Type: v2.TaskTriggerUser}, false); err != nil {
 		t.Fatal(err)
 	}
 
@@ -340,7 +363,7 @@ func TestExecutePlanGatesThePendingStartBeforeInsertingTheSync(t *testing.T) {
 func TestEnqueueSyncGivesUpRatherThanInsertingASyncItCannotOrder(t *testing.T) {
 	q := &alwaysClaimedQueue{}
 
-	_, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, false, v2.TaskTrigger{Type: v2.TaskTriggerUser})
+	_, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, ApplyDeferred, v2.TaskTrigger{Type: v2.TaskTriggerUser}, false)
 	if err == nil {
 		t.Fatal("expected an error once the plan attempts were exhausted")
 	}
@@ -417,7 +440,7 @@ func TestApplyPendingNowBuildsAChainForAnAlreadyPersistedChange(t *testing.T) {
 // Apply-now button are still on screen. Clicking it must do NOTHING.
 //
 // Without the pending-sync guard, planFor gets an empty pendingSyncID plus
-// (running && applyNow) and builds a WHOLE NEW chain: a healthy running server is
+// (running, ApplyNow) and builds a WHOLE NEW chain: a healthy running server is
 // stopped, synced to the state it is already in, and restarted - every player
 // kicked, with no preview and no confirmation in the way. The diff check that
 // normally catches a no-op change is deliberately skipped on this path, so this
@@ -525,7 +548,7 @@ func TestPlanFor(t *testing.T) {
 	cases := []struct {
 		name           string
 		running        bool
-		applyNow       bool
+		mode           ApplyMode
 		pendingSyncID  string
 		pendingStartID string
 		want           syncPlan
@@ -536,13 +559,13 @@ func TestPlanFor(t *testing.T) {
 			// not yet been observed to have cleared, so gating on it would deadlock the
 			// chain against a stale status write.
 			name:    "A running, apply now, nothing pending -> stop -> sync -> start",
-			running: true, applyNow: true,
+			running: true, mode: ApplyNow,
 			want: syncPlan{NeedStop: true, Gate: gateAfterStop, EnsureStart: true},
 		},
 		{
 			// B. Deferred: no chain to build, so the sync must gate itself.
 			name:    "B running, deferred, nothing pending -> one requiresServerStopped sync",
-			running: true, applyNow: false,
+			running: true, mode: ApplyDeferred,
 			want: syncPlan{Gate: gateServerStopped},
 		},
 		{
@@ -551,12 +574,12 @@ func TestPlanFor(t *testing.T) {
 			// stop. If that gate survived, the stop would run, the game would go down,
 			// the sync would never be claimable, and the server would stay down forever.
 			name:    "C escalation: pending deferred sync is reused, re-gated onto the stop, requiresServerStopped cleared",
-			running: true, applyNow: true, pendingSyncID: pendingSync,
+			running: true, mode: ApplyNow, pendingSyncID: pendingSync,
 			want: syncPlan{NeedStop: true, ReuseSyncID: pendingSync, Gate: gateAfterStop, EnsureStart: true},
 		},
 		{
 			name:    "D stopped, nothing pending -> one ungated sync",
-			running: false, applyNow: false,
+			running: false, mode: ApplyDeferred,
 			want: syncPlan{Gate: gateNone},
 		},
 		{
@@ -566,7 +589,7 @@ func TestPlanFor(t *testing.T) {
 			// oldest-first — without the re-point the start is claimed FIRST, the game
 			// boots, and the new sync then rewrites Mods underneath it.
 			name:    "E stopped mid-chain, sync running, start pending -> new sync, start re-pointed onto it",
-			running: false, applyNow: true, pendingStartID: pendingStart,
+			running: false, mode: ApplyNow, pendingStartID: pendingStart,
 			want: syncPlan{Gate: gateNone, RepointStartID: pendingStart},
 		},
 		{
@@ -576,24 +599,37 @@ func TestPlanFor(t *testing.T) {
 			// Declining to re-point would not prevent the boot — it would only let the
 			// boot happen BEFORE the sync, which is exactly invariant 2's failure.
 			name:    "F stopped, leftover pending start from a cancelled chain -> still re-pointed, never left ahead of the sync",
-			running: false, applyNow: false, pendingStartID: pendingStart,
+			running: false, mode: ApplyDeferred, pendingStartID: pendingStart,
 			want: syncPlan{Gate: gateNone, RepointStartID: pendingStart},
 		},
 		{
 			// Deferred escalation's mirror: reuse the pending sync but leave it on its
 			// own gate, and never ensure a start the user did not ask for.
 			name:    "running, deferred, pending sync -> reused, still requiresServerStopped, no start",
-			running: true, applyNow: false, pendingSyncID: pendingSync, pendingStartID: pendingStart,
+			running: true, mode: ApplyDeferred, pendingSyncID: pendingSync, pendingStartID: pendingStart,
 			want: syncPlan{ReuseSyncID: pendingSync, Gate: gateServerStopped, RepointStartID: pendingStart},
 		},
+		{
+			// The window chain is the plain chain with only its stop held.
+			name:    "running, in window, nothing pending -> windowed stop -> sync -> start",
+			running: true, mode: ApplyInWindow,
+			want: syncPlan{NeedStop: true, StopInWindow: true, Gate: gateAfterStop, EnsureStart: true},
+		},
+		{
+			// A stopped server is not disrupted by a sync, so there is nothing to
+			// wait for.
+			name:    "stopped, in window -> one ungated sync, no window",
+			running: false, mode: ApplyInWindow,
+			want: syncPlan{Gate: gateNone},
+		},
 	}
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			got := planFor(c.running, c.applyNow, c.pendingSyncID, c.pendingStartID)
+			got := planFor(c.running, c.mode, c.pendingSyncID, c.pendingStartID)
 			if got != c.want {
-				t.Fatalf("planFor(running=%v, applyNow=%v, sync=%q, start=%q)\n got: %+v\nwant: %+v",
-					c.running, c.applyNow, c.pendingSyncID, c.pendingStartID, got, c.want)
+				t.Fatalf("planFor(running=%v, mode=%v, sync=%q, start=%q)\n got: %+v\nwant: %+v",
+					c.running, c.mode, c.pendingSyncID, c.pendingStartID, got, c.want)
 			}
 		})
 	}
@@ -603,14 +639,14 @@ func TestPlanFor(t *testing.T) {
 // running-server plan must therefore carry one — invariant 1, stated where it can
 // actually fail rather than in a comment.
 func TestPlanForNeverLeavesASyncUngatedWhileTheServerRuns(t *testing.T) {
-	for _, applyNow := range []bool{true, false} {
+	for _, mode := range []ApplyMode{ApplyNow, ApplyDeferred, ApplyInWindow} {
 		for _, sync := range []string{"", "652f000000000000000000a1"} {
-			p := planFor(true, applyNow, sync, "")
+			p := planFor(true, mode, sync, "")
 			if p.Gate == gateNone {
-				t.Fatalf("planFor(running=true, applyNow=%v, sync=%q) left the sync ungated", applyNow, sync)
+				t.Fatalf("planFor(running=true, mode=%v, sync=%q) left the sync ungated", mode, sync)
 			}
 			if p.Gate == gateAfterStop && !p.NeedStop {
-				t.Fatalf("planFor(running=true, applyNow=%v, sync=%q) gated the sync on a stop it never enqueues", applyNow, sync)
+				t.Fatalf("planFor(running=true, mode=%v, sync=%q) gated the sync on a stop it never enqueues", mode, sync)
 			}
 		}
 	}
@@ -642,3 +678,34 @@ func TestNextSelectionUpdateAllBumpsOnlyDirectModsWithUpdates(t *testing.T) {
 		t.Fatal("expected update-all to leave dependencies to the resolver")
 	}
 }
+
+// A downgrade on a running server holds the stop, not the sync: held on the
+// sync, the server would go down and stay down waiting for a second member.
+func TestEnqueueSyncHoldsTheStopOfADowngradeForApproval(t *testing.T) {
+	q := &fakeQueue{running: true}
+
+	if _, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, ApplyNow, v2.TaskTrigger{Type: v2.TaskTriggerUser}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	stops := q.enqueuesOf(ActionStop)
+	if len(stops) != 1 || !stops[0].opts.RequiresApproval {
+		t.Fatal("expected the chain's stop to be held for approval")
+	}
+	if q.syncEnqueue(t).opts.RequiresApproval {
+		t.Fatal("the sync is already behind the held stop and must not be held twice")
+	}
+}
+
+func TestEnqueueSyncHoldsTheSyncOfADowngradeWithNoStop(t *testing.T) {
+	for _, running := range []bool{false, true} {
+		q := &fakeQueue{running: running}
+
+		if _, err := enqueueSyncWith(q, bson.NewObjectID(), bson.NewObjectID(), v2.Lockfile{}, ApplyDeferred, v2.TaskTrigger{Type: v2.TaskTriggerUser}, true); err != nil {
+			t.Fatal(err)
+		}
+		if !q.syncEnqueue(t).opts.RequiresApproval {
+			t.Fatalf("running=%v: expected the sync to be held for approval", running)
+		}
+	}
+}
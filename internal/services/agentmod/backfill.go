@@ -6,6 +6,7 @@ import (
 
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agent"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/workflow"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
 	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -195,7 +196,8 @@ func modReferenceFor(ctx context.Context, modID bson.ObjectID) (string, error) {
 // this once during boot, next to agenttask.EnsureIndexes() and before
 // agenttask.StartDispatcher() - the migration must finish before any task can be
 // dispatched against a lockfile that assumes agentmods already holds the
-// agent's selection.
+// agent's selection. It also registers the workflow steps that restore and copy
+// mods, which the workflow package cannot reach agentmod to run itself.
 func Init() error {
 	if err := EnsureIndexes(); err != nil {
 		return err
@@ -203,5 +205,7 @@ func Init() error {
 	if err := Backfill(); err != nil {
 		return err
 	}
+	workflow.RegisterWorkflowAction(workflow.ActionTypeRestoreMods, RestoreModsAction{})
+	workflow.RegisterWorkflowAction(workflow.ActionTypeCopyMods, CopyModsAction{})
 	return nil
 }
@@ -39,6 +39,17 @@ func (c Change) IsEmpty() bool {
 	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Changed) == 0
 }
 
+// Downgrades reports whether the change moves any mod, dependency or not, to an
+// older version than the one it replaces.
+func (c Change) Downgrades() bool {
+	for _, m := range c.Changed {
+		if m.From != "" && semver.Compare(withV(m.To), withV(m.From)) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // Diff compares the agent's current selection against a freshly resolved
 // lockfile. It is pure, and it is what both Preview (which renders it) and Apply
 // (which acts on it) are built from.
@@ -156,3 +156,25 @@ func TestServerTargetErrorsWhenPlatformHasNoBuild(t *testing.T) {
 		t.Fatal("expected an error when the platform has no build, not a silent skip")
 	}
 }
+
+func TestChangeDowngradesOnlyWhenAVersionGoesBack(t *testing.T) {
+	cases := []struct {
+		name    string
+		changed []ChangedMod
+		want    bool
+	}{
+		{"upgrade", []ChangedMod{{ModReference: "RefinedPower", From: "3.2.0", To: "3.3.0"}}, false},
+		{"downgrade", []ChangedMod{{ModReference: "RefinedPower", From: "3.3.0", To: "3.2.0"}}, true},
+		{"dependency downgrade", []ChangedMod{{ModReference: "SML", From: "v3.10.0", To: "3.9.0", Dependency: true}}, true},
+		{"unpinned before", []ChangedMod{{ModReference: "RefinedPower", From: "", To: "3.2.0"}}, false},
+		{"no changes", nil, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := (Change{Changed: c.changed}).Downgrades(); got != c.want {
+				t.Fatalf("Downgrades() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
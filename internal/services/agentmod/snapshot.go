@@ -0,0 +1,167 @@
+package agentmod
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/workflow"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Snapshot is the agent's selection as it stands, kept with a backup so a
+// restore can put the mods back the way the save last ran with them. It is
+// the selection, not the resolution: download links and hashes are looked up
+// again when it is restored, since the catalogue's may have moved since.
+func Snapshot(agentID bson.ObjectID) (v2.Lockfile, error) {
+	mods, err := ListForAgent(agentID)
+	if err != nil {
+		return v2.Lockfile{}, err
+	}
+
+	lf := v2.Lockfile{Mods: make([]v2.ModLock, 0, len(mods))}
+	for _, m := range mods {
+		lf.Mods = append(lf.Mods, v2.ModLock{
+			ModReference: m.ModReference,
+			Version:      m.DesiredVersion,
+			Direct:       m.Direct,
+			Config:       m.Config,
+		})
+	}
+	return lf, nil
+}
+
+// RestoreSnapshot makes a snapshot the agent's selection again and returns the
+// lockfile a syncmods should carry to put it on disk. The direct mods are pinned
+// to the snapshot's versions and their dependencies resolved afresh; each mod's
+// config is the one the snapshot kept.
+//
+// Nothing is enqueued: the caller owns the sync and decides when it runs.
+func RestoreSnapshot(agentID, accountID bson.ObjectID, snap v2.Lockfile) (v2.Lockfile, error) {
+	direct := make(map[string]string)
+	configs := make(map[string]string, len(snap.Mods))
+	for _, m := range snap.Mods {
+		if m.Direct {
+			direct[m.ModReference] = m.Version
+		}
+		configs[m.ModReference] = m.Config
+	}
+
+	lf, err := ResolveSelection(agentID, direct)
+	if err != nil {
+		return v2.Lockfile{}, fmt.Errorf("cannot restore the backup's mods: %w", err)
+	}
+
+	for idx := range lf.Mods {
+		if config, ok := configs[lf.Mods[idx].ModReference]; ok && config != "" {
+			lf.Mods[idx].Config = config
+		}
+	}
+
+	if err := persist(agentID, accountID, lf); err != nil {
+		return v2.Lockfile{}, err
+	}
+	return lf, nil
+}
+
+// RestoreModsAction is the workflow step that puts a backup's mods back. Its
+// TaskData starts as the snapshot; the first run restores it and swaps in the
+// lockfile, then the step is a syncmods task like any other, so a re-run
+// adopts the task rather than restoring again.
+//
+// A step with a compensation has the selection it replaces recorded there
+// first, so the compensation, a RestoreModsAction itself, puts it back. A sync
+// that fails for good puts it back at once: the step is not compensated,
+// having not completed.
+type RestoreModsAction struct{}
+
+func (a RestoreModsAction) Execute(action *v2.WorkflowAction, d interface{}, theAccount *v2.AccountSchema, wctx v2.WorkflowContext) error {
+	if action.TaskID == "" && action.TaskAction != ActionSyncMods {
+		theAgent, err := d.(workflow.WorkflowData).Agent()
+		if err != nil {
+			return err
+		}
+
+		if action.Compensation != nil && action.Compensation.TaskData == nil {
+			previous, err := Snapshot(theAgent.ID)
+			if err != nil {
+				return err
+			}
+			action.Compensation.TaskData = previous
+		}
+
+		// TaskData is whatever the driver decoded from Mongo.
+		snap := v2.Lockfile{}
+		bodyBytes, err := json.Marshal(action.TaskData)
+		if err != nil {
+			return fmt.Errorf("error reading the backup's mods with error: %s", err.Error())
+		}
+		if err := json.Unmarshal(bodyBytes, &snap); err != nil {
+			return fmt.Errorf("error reading the backup's mods with error: %s", err.Error())
+		}
+
+		lf, err := RestoreSnapshot(theAgent.ID, theAccount.ID, snap)
+		if err != nil {
+			return err
+		}
+		action.TaskAction = ActionSyncMods
+		action.TaskData = lf
+	}
+
+	err := workflow.AgentTaskAction{}.Execute(action, d, theAccount, wctx)
+	failed := err != nil && action.Attempts >= action.MaxRetries
+	if failed && action.Compensation != nil && action.Compensation.TaskData != nil {
+		restorePrevious(action, d, theAccount)
+	}
+	return err
+}
+
+// restorePrevious makes the selection the step replaced the agent's again,
+// without a sync: the failed one left the disk in no state worth matching.
+func restorePrevious(action *v2.WorkflowAction, d interface{}, theAccount *v2.AccountSchema) {
+	theAgent, err := d.(workflow.WorkflowData).Agent()
+	if err != nil {
+		return
+	}
+
+	previous := v2.Lockfile{}
+	bodyBytes, err := json.Marshal(action.Compensation.TaskData)
+	if err == nil {
+		err = json.Unmarshal(bodyBytes, &previous)
+	}
+	if err == nil {
+		_, err = RestoreSnapshot(theAgent.ID, theAccount.ID, previous)
+	}
+	if err != nil {
+		logger.GetErrorLogger().Printf("error putting back the mods agent %s had before a failed restore: %s", theAgent.ID.Hex(), err.Error())
+	}
+}
+
+// CopyModsAction is the migration step that gives the target the source's mods.
+// The source's selection is taken when the step first runs, after the source
+// has stopped; from there it is a RestoreModsAction onto the target.
+type CopyModsAction struct{}
+
+func (a CopyModsAction) Execute(action *v2.WorkflowAction, d interface{}, theAccount *v2.AccountSchema, wctx v2.WorkflowContext) error {
+	if action.TaskID == "" && action.TaskAction != ActionSyncMods {
+		roles, ok := d.(workflow.AgentRoles)
+		if !ok {
+			return errors.New("workflow has no source agent to copy mods from")
+		}
+
+		source, err := roles.AgentForRole(workflow.RoleSource)
+		if err != nil {
+			return err
+		}
+
+		snap, err := Snapshot(source.ID)
+		if err != nil {
+			return err
+		}
+		action.TaskData = snap
+	}
+
+	return RestoreModsAction{}.Execute(action, d, theAccount, wctx)
+}
@@ -0,0 +1,400 @@
+package agenttask
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownAction  = errors.New("unknown task action")
+	ErrInvalidPayload = errors.New("invalid task payload")
+	ErrAgentTooOld    = errors.New("agent is too old for this task action")
+)
+
+// Idempotency is what running an action twice does, which decides whether the
+// queue may run it again when it cannot tell whether the first run happened.
+type Idempotency string
+
+const (
+	// Idempotent actions reconcile to a state, so a second run is harmless:
+	// starting a running server or syncing mods that are already in place.
+	Idempotent Idempotency = "idempotent"
+	// AtMostOnce actions must not be re-run once they may have started. A lease
+	// that expires on one finishes it dead instead of retrying; see
+	// reapExpiredLeases.
+	AtMostOnce Idempotency = "atMostOnce"
+)
+
+// FieldType is the JSON type of one payload field.
+type FieldType string
+
+const (
+	FieldString  FieldType = "string"
+	FieldNumber  FieldType = "number"
+	FieldBoolean FieldType = "boolean"
+	FieldObject  FieldType = "object"
+	FieldArray   FieldType = "array"
+)
+
+// PayloadField is one key of an object payload.
+type PayloadField struct {
+	Name        string
+	Type        FieldType
+	Required    bool
+	Description string
+}
+
+// PayloadSchema is the shape of an action's data.
+//
+// An action with no Fields and not Open takes no payload: empty, null and {}
+// are accepted, anything else is a mistake. Otherwise the payload must be a
+// JSON object whose keys are among Fields, unless Open lets others through
+// for a payload another package builds and checks (syncmods' lockfile is
+// agentmod's). Keys match case-insensitively, as encoding/json on the agent
+// does.
+type PayloadSchema struct {
+	Fields []PayloadField
+	Open   bool
+}
+
+func (s PayloadSchema) takesPayload() bool {
+	return len(s.Fields) > 0 || s.Open
+}
+
+func (s PayloadSchema) field(key string) (PayloadField, bool) {
+	for _, f := range s.Fields {
+		if strings.EqualFold(f.Name, key) {
+			return f, true
+		}
+	}
+	return PayloadField{}, false
+}
+
+func jsonType(v interface{}) FieldType {
+	switch v.(type) {
+	case string:
+		return FieldString
+	case float64:
+		return FieldNumber
+	case bool:
+		return FieldBoolean
+	case map[string]interface{}:
+		return FieldObject
+	case []interface{}:
+		return FieldArray
+	}
+	return ""
+}
+
+// validate checks a payload as Enqueue stores it: JSON text, "" for none.
+func (s PayloadSchema) validate(payload string) error {
+	payload = strings.TrimSpace(payload)
+	empty := payload == "" || payload == "null"
+
+	if !s.takesPayload() {
+		if empty || payload == "{}" {
+			return nil
+		}
+		return errors.New("the action takes no data")
+	}
+
+	var obj map[string]interface{}
+	if !empty {
+		if err := json.Unmarshal([]byte(payload), &obj); err != nil {
+			return errors.New("data must be a JSON object")
+		}
+	}
+
+	seen := make(map[string]bool, len(obj))
+	for key, value := range obj {
+		f, ok := s.field(key)
+		if !ok {
+			if s.Open {
+				continue
+			}
+			return fmt.Errorf("unexpected field %q", key)
+		}
+		seen[f.Name] = true
+		if value == nil {
+			continue
+		}
+		if got := jsonType(value); got != f.Type {
+			return fmt.Errorf("field %q must be a %s, got a %s", f.Name, f.Type, got)
+		}
+	}
+
+	for _, f := range s.Fields {
+		if f.Required && !seen[f.Name] {
+			return fmt.Errorf("field %q is required", f.Name)
+		}
+	}
+	if empty && s.Open && len(s.Fields) == 0 {
+		return errors.New("the action needs data")
+	}
+	return nil
+}
+
+// ActionGates are the gates an action's tasks carry when the caller sets none.
+// A caller that gates the task itself (agentmod's stop -> sync -> start chain
+// gates its syncmods on the stop) knows better, and its gate stands alone. So
+// does one that enqueues with Ungated, having checked the task needs no gate
+// (the same chain, for a server it found stopped).
+type ActionGates struct {
+	RequiresServerStopped     bool
+	RequiresMaintenanceWindow bool
+}
+
+// ActionSpec declares one action the agent can run.
+//
+// Capabilities are what the agent must advertise to run the action, and
+// MinAgentVersion the oldest agent that understands it ("" for any). Both are
+// checked against what the agent last advertised (see AgentCapabilities), at
+// Enqueue and again at claim; an agent that has not said is given the benefit
+// of the doubt.
+type ActionSpec struct {
+	Name            string
+	Description     string
+	Payload         PayloadSchema
+	Capabilities    []string
+	MinAgentVersion string
+	Idempotency     Idempotency
+	Gates           ActionGates
+}
+
+var (
+	actionsMu sync.RWMutex
+	actions   = map[string]ActionSpec{}
+)
+
+// RegisterAction adds an action to the registry. Registering a name twice is a
+// programming error and panics, as does a spec without a name.
+func RegisterAction(spec ActionSpec) {
+	if spec.Name == "" {
+		panic("agenttask: an action needs a name")
+	}
+	if spec.Idempotency == "" {
+		spec.Idempotency = Idempotent
+	}
+
+	actionsMu.Lock()
+	defer actionsMu.Unlock()
+
+	if _, ok := actions[spec.Name]; ok {
+		panic("agenttask: action " + spec.Name + " registered twice")
+	}
+	actions[spec.Name] = spec
+}
+
+// LookupAction returns the spec registered for action.
+func LookupAction(action string) (ActionSpec, bool) {
+	actionsMu.RLock()
+	defer actionsMu.RUnlock()
+
+	spec, ok := actions[action]
+	return spec, ok
+}
+
+// ListActions returns every registered action, sorted by name.
+func ListActions() []ActionSpec {
+	actionsMu.RLock()
+	defer actionsMu.RUnlock()
+
+	out := make([]ActionSpec, 0, len(actions))
+	for _, spec := range actions {
+		out = append(out, spec)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func init() {
+	RegisterAction(ActionSpec{
+		Name:        "installsfserver",
+		Description: "Download and install the Satisfactory dedicated server.",
+	})
+	RegisterAction(ActionSpec{
+		Name:        "updatesfserver",
+		Description: "Update the Satisfactory dedicated server to the latest build.",
+	})
+	RegisterAction(ActionSpec{
+		Name:        "startsfserver",
+		Description: "Start the game server.",
+	})
+	RegisterAction(ActionSpec{
+		Name:        "stopsfserver",
+		Description: "Stop the game server.",
+	})
+	RegisterAction(ActionSpec{
+		Name:        syncModsAction,
+		Description: "Make the Mods directory match the agent's lockfile.",
+		Payload:     PayloadSchema{Open: true},
+		// The sync rewrites the Mods directory unconditionally, so it never
+		// runs under a live game unless the caller chains it behind a stop.
+		Gates: ActionGates{RequiresServerStopped: true},
+	})
+	RegisterAction(ActionSpec{
+		Name:        "claimserver",
+		Description: "Claim a freshly installed server and set its passwords.",
+		Payload: PayloadSchema{Fields: []PayloadField{
+			{Name: "adminPass", Type: FieldString, Required: true, Description: "Admin password"},
+			{Name: "clientPass", Type: FieldString, Description: "Client password; empty leaves the server open"},
+		}},
+		// A server can only be claimed once: a second attempt after a run that
+		// did land fails, and hides that the first succeeded.
+		Idempotency: AtMostOnce,
+	})
+	RegisterAction(ActionSpec{
+		Name:        "restorebackup",
+		Description: "Download a stored backup or save into the agent's restore staging area.",
+		Payload: PayloadSchema{Fields: []PayloadField{
+			{Name: "kind", Type: FieldString, Required: true, Description: "\"backup\" or \"save\""},
+			{Name: "fileName", Type: FieldString, Required: true, Description: "File to restore"},
+			{Name: "size", Type: FieldNumber, Description: "Size in bytes the download should reach"},
+		}},
+		// The download resumes from what is already staged, so running it
+		// again after a lost lease picks up where it left off.
+		Capabilities: []string{"backuprestore"},
+		Gates:        ActionGates{RequiresServerStopped: true},
+	})
+	RegisterAction(ActionSpec{
+		Name:        "verifybackup",
+		Description: "Check a staged backup or save and swap it into place.",
+		Payload: PayloadSchema{Fields: []PayloadField{
+			{Name: "kind", Type: FieldString, Required: true, Description: "\"backup\" or \"save\""},
+			{Name: "fileName", Type: FieldString, Required: true, Description: "File that was staged"},
+			{Name: "size", Type: FieldNumber, Description: "Size in bytes the staged file must have"},
+		}},
+		Capabilities: []string{"backuprestore"},
+		Gates:        ActionGates{RequiresServerStopped: true},
+	})
+	// The two destructive actions: nothing brings back what they remove, so
+	// their policies hold them for a second member (see actionPolicies).
+	RegisterAction(ActionSpec{
+		Name:        "deletesave",
+		Description: "Delete a save file from the server.",
+		Payload: PayloadSchema{Fields: []PayloadField{
+			{Name: "fileName", Type: FieldString, Required: true, Description: "Save to delete"},
+		}},
+		Capabilities: []string{"savemanagement"},
+	})
+	RegisterAction(ActionSpec{
+		Name:         "wipesfserver",
+		Description:  "Remove the dedicated server install, leaving saves and backups.",
+		Capabilities: []string{"serverwipe"},
+		Gates:        ActionGates{RequiresServerStopped: true},
+	})
+}
+
+// retriesLostLease reports whether a task whose lease expired may simply be
+// run again. An unregistered action predates the registry and keeps the
+// queue's old behaviour.
+func retriesLostLease(action string) bool {
+	spec, ok := LookupAction(action)
+	return !ok || spec.Idempotency != AtMostOnce
+}
+
+// checkAction is the part of Enqueue's validation that needs no database: the
+// action exists and the payload fits it. Batches, rollouts and schedules run
+// it when they are saved, so a typo is refused then rather than at every run.
+func checkAction(action, payload string) (ActionSpec, error) {
+	spec, ok := LookupAction(action)
+	if !ok {
+		return ActionSpec{}, fmt.Errorf("%w %q", ErrUnknownAction, action)
+	}
+	if err := spec.Payload.validate(payload); err != nil {
+		return ActionSpec{}, fmt.Errorf("%w for %s: %s", ErrInvalidPayload, action, err.Error())
+	}
+	return spec, nil
+}
+
+// acceptUnregisteredActions lets Enqueue take an action the registry does not
+// know, as it did before there was one. The frontend's CreateAgentTask passes
+// the action through from the UI, which may still send actions that predate
+// the registry; the warning Enqueue logs says which. Remove this, and the
+// fallback in enqueueSpec, once a release has gone by without one.
+const acceptUnregisteredActions = true
+
+// enqueueSpec is checkAction for Enqueue. While acceptUnregisteredActions
+// holds, an unregistered action is let through, with registered false; it gets
+// no payload check, capability check or default gates. Batches, rollouts,
+// schedules and templates still refuse one when they are saved.
+func enqueueSpec(action, payload string) (spec ActionSpec, registered bool, err error) {
+	spec, err = checkAction(action, payload)
+	if errors.Is(err, ErrUnknownAction) && acceptUnregisteredActions && action != "" {
+		return ActionSpec{Name: action}, false, nil
+	}
+	return spec, err == nil, err
+}
+
+// ValidateAction is checkAction for packages that build tasks ahead of
+// enqueueing them, such as workflow templates.
+func ValidateAction(action, payload string) error {
+	_, err := checkAction(action, payload)
+	return err
+}
+
+// applyDefaultGates lays the action's gates over opts when opts carries none.
+func (spec ActionSpec) applyDefaultGates(opts EnqueueOpts) EnqueueOpts {
+	if opts.Ungated {
+		return opts
+	}
+	gated := opts.DependsOn != nil || len(opts.DependsOnAll) > 0 || len(opts.DependsOnAny) > 0 ||
+		opts.RequiresServerStopped || opts.RequiresMaintenanceWindow
+	if gated {
+		return opts
+	}
+	opts.RequiresServerStopped = spec.Gates.RequiresServerStopped
+	opts.RequiresMaintenanceWindow = spec.Gates.RequiresMaintenanceWindow
+	return opts
+}
+
+// parseVersion reads "1.2.3" or "v1.2.3", ignoring any pre-release or build
+// suffix. ok is false for anything else.
+func parseVersion(s string) (parts []int, ok bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	if s == "" {
+		return nil, false
+	}
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, true
+}
+
+// versionAtLeast reports whether have is min or newer. A version that does not
+// parse is not known to be too old.
+func versionAtLeast(have, min string) bool {
+	h, ok := parseVersion(have)
+	if !ok {
+		return true
+	}
+	m, ok := parseVersion(min)
+	if !ok {
+		return true
+	}
+	for i := 0; i < len(h) || i < len(m); i++ {
+		var a, b int
+		if i < len(h) {
+			a = h[i]
+		}
+		if i < len(m) {
+			b = m[i]
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return true
+}
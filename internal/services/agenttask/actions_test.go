@@ -0,0 +1,126 @@
+package agenttask
+
+import (
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestCheckActionRejectsUnknownActions(t *testing.T) {
+	if _, err := checkAction("stopsfservr", ""); !errors.Is(err, ErrUnknownAction) {
+		t.Fatalf("expected a typo to be an unknown action, got %v", err)
+	}
+	if _, err := checkAction("stopsfserver", ""); err != nil {
+		t.Fatalf("expected stopsfserver to be known, got %s", err)
+	}
+}
+
+func TestPayloadlessActionsRefuseData(t *testing.T) {
+	for _, payload := range []string{"", "null", "{}"} {
+		if _, err := checkAction("startsfserver", payload); err != nil {
+			t.Fatalf("%q: expected no data to be accepted, got %s", payload, err)
+		}
+	}
+	if _, err := checkAction("startsfserver", `{"force":true}`); !errors.Is(err, ErrInvalidPayload) {
+		t.Fatalf("expected data on a payloadless action to be rejected, got %v", err)
+	}
+}
+
+func TestPayloadFieldsAreChecked(t *testing.T) {
+	cases := map[string]bool{
+		`{"adminPass":"a","clientPass":"b"}`: true,
+		`{"adminPass":"a"}`:                  true,
+		`{"AdminPass":"a"}`:                  true, // the agent decodes case-insensitively
+		`{"clientPass":"b"}`:                 false,
+		`{"adminPass":1}`:                    false,
+		`{"adminPass":"a","admin":"b"}`:      false,
+		`["a"]`:                              false,
+		``:                                   false,
+	}
+	for payload, ok := range cases {
+		_, err := checkAction("claimserver", payload)
+		if ok && err != nil {
+			t.Fatalf("%s: expected it to be accepted, got %s", payload, err)
+		}
+		if !ok && !errors.Is(err, ErrInvalidPayload) {
+			t.Fatalf("%s: expected an invalid payload, got %v", payload, err)
+		}
+	}
+}
+
+func TestOpenPayloadNeedsAnObject(t *testing.T) {
+	if _, err := checkAction(syncModsAction, `{"mods":[]}`); err != nil {
+		t.Fatalf("expected a lockfile to be accepted, got %s", err)
+	}
+	if _, err := checkAction(syncModsAction, ""); !errors.Is(err, ErrInvalidPayload) {
+		t.Fatalf("expected a syncmods without a lockfile to be rejected, got %v", err)
+	}
+}
+
+// The default gate only fills in for a caller that set none: agentmod's
+// syncmods chained behind its stop keeps that one gate, which is what the
+// chain's tests pin down.
+func TestDefaultGatesOnlyApplyToUngatedTasks(t *testing.T) {
+	spec, _ := LookupAction(syncModsAction)
+
+	if opts := spec.applyDefaultGates(EnqueueOpts{}); !opts.RequiresServerStopped {
+		t.Fatal("expected an ungated syncmods to wait for the server to stop")
+	}
+
+	parent := bson.NewObjectID()
+	if opts := spec.applyDefaultGates(EnqueueOpts{DependsOn: &parent}); opts.RequiresServerStopped {
+		t.Fatal("expected a syncmods chained behind a stop to keep only that gate")
+	}
+
+	if opts := spec.applyDefaultGates(EnqueueOpts{Ungated: true}); opts.RequiresServerStopped {
+		t.Fatal("expected a syncmods the caller left ungated to stay ungated")
+	}
+}
+
+// Enqueue still takes an action from before the registry, for now; the saved
+// definitions that go through checkAction do not.
+func TestEnqueueSpecLetsUnregisteredActionsThrough(t *testing.T) {
+	spec, registered, err := enqueueSpec("killsfserver", `{"force": true}`)
+	if err != nil || registered {
+		t.Fatalf("expected an unregistered action to be let through and flagged, got %v", err)
+	}
+	if spec.Name != "killsfserver" || spec.Gates != (ActionGates{}) || len(spec.Capabilities) != 0 {
+		t.Fatalf("expected a bare spec for an unregistered action, got %+v", spec)
+	}
+
+	if _, _, err := enqueueSpec("", ""); !errors.Is(err, ErrUnknownAction) {
+		t.Fatalf("expected an empty action to be refused, got %v", err)
+	}
+	if _, _, err := enqueueSpec("claimserver", `{}`); !errors.Is(err, ErrInvalidPayload) {
+		t.Fatalf("expected a registered action's payload to still be checked, got %v", err)
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	cases := []struct {
+		have, min string
+		want      bool
+	}{
+		{"1.2.3", "1.2.3", true},
+		{"v1.10.0", "1.9.9", true},
+		{"1.2", "1.2.1", false},
+		{"0.9.0-beta", "1.0.0", false},
+		{"", "1.0.0", true},
+		{"dev", "1.0.0", true},
+	}
+	for _, c := range cases {
+		if got := versionAtLeast(c.have, c.min); got != c.want {
+			t.Fatalf("%q >= %q: expected %v, got %v", c.have, c.min, c.want, got)
+		}
+	}
+}
+
+func TestOnlyAtMostOnceActionsKeepALostLease(t *testing.T) {
+	if retriesLostLease("claimserver") {
+		t.Fatal("expected a claim whose lease expired not to be run again")
+	}
+	if !retriesLostLease("startsfserver") {
+		t.Fatal("expected a start whose lease expired to be retried")
+	}
+}
@@ -0,0 +1,287 @@
+package agenttask
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// approvalTTL is how long a task waits for a second member before it expires.
+// An approval given days later is approving a server state nobody looked at.
+const approvalTTL = 24 * time.Hour
+
+// Approval event types, passed to the hooks registered with
+// RegisterApprovalHook.
+const (
+	ApprovalRequired = "required"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+	ApprovalExpired  = "expired"
+)
+
+var (
+	errNotAwaitingApproval = errors.New("task is not awaiting approval")
+	errSelfApproval        = errors.New("a task must be approved by someone other than whoever asked for it")
+)
+
+// ApprovalEvent is one step of a task's approval. Actor is the account member
+// who approved or rejected it; it is empty for the system's own steps.
+type ApprovalEvent struct {
+	Type      string
+	TaskID    bson.ObjectID
+	AgentID   bson.ObjectID
+	AccountID bson.ObjectID
+	Action    string
+	Actor     string
+}
+
+var (
+	approvalHooksMu sync.RWMutex
+	approvalHooks   []func(ApprovalEvent)
+)
+
+// RegisterApprovalHook adds fn to the hooks run on every approval step. It is
+// how the account side (audits, integration events) hears about approvals
+// without this package depending on it.
+func RegisterApprovalHook(fn func(ApprovalEvent)) {
+	approvalHooksMu.Lock()
+	defer approvalHooksMu.Unlock()
+	approvalHooks = append(approvalHooks, fn)
+}
+
+func runApprovalHooks(ev ApprovalEvent) {
+	approvalHooksMu.RLock()
+	hooks := approvalHooks
+	approvalHooksMu.RUnlock()
+
+	for _, fn := range hooks {
+		fn(ev)
+	}
+}
+
+// PendingApprovals returns, for each of taskIDs still awaiting approval, when
+// that approval expires. Like TaskOutput, the gate is a queue field the shared
+// schema does not carry.
+func PendingApprovals(taskIDs []bson.ObjectID) (map[bson.ObjectID]time.Time, error) {
+	out := make(map[bson.ObjectID]time.Time)
+	if len(taskIDs) == 0 {
+		return out, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := collection().Find(ctx,
+		bson.M{"_id": bson.M{"$in": taskIDs}, "requiresApproval": true},
+		options.Find().SetProjection(bson.M{"approvalExpiresAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		ID        bson.ObjectID `bson:"_id"`
+		ExpiresAt time.Time     `bson:"approvalExpiresAt"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		out[row.ID] = row.ExpiresAt
+	}
+	return out, nil
+}
+
+// requesterFor resolves the member a task is enqueued on behalf of. An explicit
+// RequestedBy wins; otherwise only a user trigger names a person. A batch or
+// rollout trigger is a user trigger too, but its ExternalID is the batch's, so
+// those callers always pass their creator.
+func requesterFor(trigger v2.TaskTrigger, opts EnqueueOpts) string {
+	if opts.RequestedBy != "" {
+		return opts.RequestedBy
+	}
+	if trigger.Type == v2.TaskTriggerUser {
+		return trigger.ExternalID
+	}
+	return ""
+}
+
+// checkApprover refuses an approval by the member who asked for the task. A
+// task nobody in particular asked for may be approved by anyone.
+func checkApprover(requestedBy, approver string) error {
+	if requestedBy != "" && requestedBy == approver {
+		return errSelfApproval
+	}
+	return nil
+}
+
+// approvalTask is the slice of a task Approve reads. Who asked for it is not on
+// v2.AgentTaskSchema (see taskDoc), so it decodes its own.
+type approvalTask struct {
+	AgentID     bson.ObjectID  `bson:"agentId"`
+	AccountID   bson.ObjectID  `bson:"accountId"`
+	Action      string         `bson:"action"`
+	TriggeredBy v2.TaskTrigger `bson:"triggeredBy"`
+	RequestedBy string         `bson:"requestedBy"`
+}
+
+// requester is who asked for the task. A row enqueued before requestedBy was
+// stored falls back to what its trigger says.
+func (t approvalTask) requester() string {
+	if t.RequestedBy != "" {
+		return t.RequestedBy
+	}
+	return requesterFor(t.TriggeredBy, EnqueueOpts{})
+}
+
+// announceApproval tells the hooks a task SetGate put on hold needs approving,
+// as Enqueue does for a task held from the start.
+func announceApproval(ctx context.Context, oid bson.ObjectID) {
+	task := approvalTask{}
+	if err := collection().FindOne(ctx, bson.M{"_id": oid}).Decode(&task); err != nil {
+		logger.GetErrorLogger().Printf("error reading task %s to announce its approval: %s", oid.Hex(), err.Error())
+		return
+	}
+
+	recordEvent(TaskEvent{TaskID: oid, Type: EventAwaitingApproval})
+	runApprovalHooks(ApprovalEvent{Type: ApprovalRequired, TaskID: oid, AgentID: task.AgentID, AccountID: task.AccountID, Action: task.Action, Actor: task.requester()})
+}
+
+// Approve lifts the approval gate. The approver must not be whoever asked for
+// the task: the point of the gate is a second pair of eyes.
+func Approve(taskID, approver string) error {
+	oid, err := bson.ObjectIDFromHex(taskID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	task := approvalTask{}
+	if err := collection().FindOne(ctx, bson.M{"_id": oid, "status": v2.TaskStatusPending, "requiresApproval": true}).Decode(&task); err != nil {
+		return errNotAwaitingApproval
+	}
+	if err := checkApprover(task.requester(), approver); err != nil {
+		return err
+	}
+
+	// The task's deadline has not started; startDeadlines starts it once
+	// nothing else holds the task either.
+	now := time.Now()
+	res, err := collection().UpdateOne(ctx,
+		bson.M{"_id": oid, "status": v2.TaskStatusPending, "requiresApproval": true},
+		bson.M{
+			"$set":   bson.M{"approvedBy": approver, "approvedAt": now, "updatedAt": now},
+			"$unset": bson.M{"requiresApproval": "", "approvalExpiresAt": ""},
+		})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errNotAwaitingApproval
+	}
+
+	recordEvent(TaskEvent{TaskID: oid, Type: EventApproved, Actor: approver})
+	runApprovalHooks(ApprovalEvent{Type: ApprovalApproved, TaskID: oid, AgentID: task.AgentID, AccountID: task.AccountID, Action: task.Action, Actor: approver})
+	notifyEnqueued(task.AgentID)
+	return nil
+}
+
+// Reject cancels a task awaiting approval, and everything gated behind it with
+// it. Anyone may reject, including whoever asked: withdrawing a request is
+// rejecting it.
+func Reject(taskID, actor, reason string) error {
+	oid, err := bson.ObjectIDFromHex(taskID)
+	if err != nil {
+		return err
+	}
+
+	msg := "rejected"
+	if reason != "" {
+		msg = "rejected: " + reason
+	}
+
+	task, err := endUnapproved(oid, msg)
+	if err != nil {
+		return err
+	}
+	if task == nil {
+		return errNotAwaitingApproval
+	}
+
+	recordEvent(TaskEvent{TaskID: oid, Type: EventRejected, Actor: actor, Message: reason})
+	runApprovalHooks(ApprovalEvent{Type: ApprovalRejected, TaskID: oid, AgentID: task.AgentID, AccountID: task.AccountID, Action: task.Action, Actor: actor})
+	return nil
+}
+
+// endUnapproved cancels a task still awaiting approval and cascades the
+// cancellation to its children. It returns nil when the task was not (or no
+// longer) awaiting approval.
+func endUnapproved(oid bson.ObjectID, lastError string) (*v2.AgentTaskSchema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	task := &v2.AgentTaskSchema{}
+	err := collection().FindOneAndUpdate(ctx,
+		bson.M{"_id": oid, "status": v2.TaskStatusPending, "requiresApproval": true},
+		bson.M{
+			"$set":   bson.M{"status": v2.TaskStatusCancelled, "finishedAt": now, "updatedAt": now, "lastError": lastError},
+			"$unset": bson.M{"active": "", "requiresApproval": "", "approvalExpiresAt": ""},
+		}).Decode(task)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if err := cascadeChildren(ctx, oid, v2.TaskStatusCancelled, task.AgentID); err != nil {
+		logger.GetErrorLogger().Printf("error cascading children of unapproved task %s: %s", oid.Hex(), err.Error())
+	}
+	return task, nil
+}
+
+// expireApprovals cancels the tasks nobody approved within approvalTTL.
+func expireApprovals() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cur, err := collection().Find(ctx, bson.M{
+		"status":            v2.TaskStatusPending,
+		"requiresApproval":  true,
+		"approvalExpiresAt": bson.M{"$lt": time.Now()},
+	}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+
+	var expired []struct {
+		ID bson.ObjectID `bson:"_id"`
+	}
+	if err := cur.All(ctx, &expired); err != nil {
+		return err
+	}
+
+	for _, row := range expired {
+		task, err := endUnapproved(row.ID, fmt.Sprintf("not approved within %s", approvalTTL))
+		if err != nil {
+			return err
+		}
+		if task == nil {
+			continue // approved or rejected since the Find
+		}
+
+		recordEvent(TaskEvent{TaskID: row.ID, Type: EventApprovalExpired})
+		runApprovalHooks(ApprovalEvent{Type: ApprovalExpired, TaskID: row.ID, AgentID: task.AgentID, AccountID: task.AccountID, Action: task.Action})
+	}
+	return nil
+}
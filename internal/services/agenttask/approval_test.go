@@ -0,0 +1,90 @@
+package agenttask
+
+import (
+	"errors"
+	"testing"
+
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestApproveRefusesTheUserWhoAsked(t *testing.T) {
+	trigger := v2.TaskTrigger{Type: v2.TaskTriggerUser, ExternalID: "auth0|alice"}
+	requestedBy := requesterFor(trigger, EnqueueOpts{})
+
+	if err := checkApprover(requestedBy, "auth0|alice"); !errors.Is(err, errSelfApproval) {
+		t.Fatalf("expected the requester to be refused, got %v", err)
+	}
+	if err := checkApprover(requestedBy, "auth0|bob"); err != nil {
+		t.Fatalf("expected another member to approve, got %v", err)
+	}
+}
+
+func TestApproveRefusesTheBatchCreator(t *testing.T) {
+	b := &Batch{ID: bson.NewObjectID(), CreatedBy: "auth0|alice"}
+	requestedBy := requesterFor(BatchTrigger(b.ID), b.enqueueOpts())
+
+	if err := checkApprover(requestedBy, "auth0|alice"); !errors.Is(err, errSelfApproval) {
+		t.Fatalf("expected the batch's creator to be refused, got %v", err)
+	}
+	if err := checkApprover(requestedBy, "auth0|bob"); err != nil {
+		t.Fatalf("expected another member to approve, got %v", err)
+	}
+}
+
+func TestApproveRefusesTheRolloutCreator(t *testing.T) {
+	r := &Rollout{ID: bson.NewObjectID(), CreatedBy: "auth0|alice"}
+	requestedBy := requesterFor(RolloutTrigger(r.ID), r.enqueueOpts())
+
+	if err := checkApprover(requestedBy, "auth0|alice"); !errors.Is(err, errSelfApproval) {
+		t.Fatalf("expected the rollout's creator to be refused, got %v", err)
+	}
+	if err := checkApprover(requestedBy, "auth0|bob"); err != nil {
+		t.Fatalf("expected another member to approve, got %v", err)
+	}
+}
+
+func TestApproveRefusesTheScheduleCreator(t *testing.T) {
+	s := &Schedule{ID: bson.NewObjectID(), CreatedBy: "auth0|alice"}
+	requestedBy := requesterFor(ScheduleTrigger(s.ID), s.enqueueOpts())
+
+	if err := checkApprover(requestedBy, "auth0|alice"); !errors.Is(err, errSelfApproval) {
+		t.Fatalf("expected the schedule's creator to be refused, got %v", err)
+	}
+	if err := checkApprover(requestedBy, "auth0|bob"); err != nil {
+		t.Fatalf("expected another member to approve, got %v", err)
+	}
+}
+
+func TestApproveRefusesTheWorkflowCreator(t *testing.T) {
+	workflowID := bson.NewObjectID()
+	trigger := v2.TaskTrigger{Type: v2.TaskTriggerWorkflow, WorkflowID: &workflowID}
+	requestedBy := requesterFor(trigger, EnqueueOpts{RequestedBy: "auth0|alice"})
+
+	if err := checkApprover(requestedBy, "auth0|alice"); !errors.Is(err, errSelfApproval) {
+		t.Fatalf("expected the workflow's creator to be refused, got %v", err)
+	}
+	if err := checkApprover(requestedBy, "auth0|bob"); err != nil {
+		t.Fatalf("expected another member to approve, got %v", err)
+	}
+}
+
+// A system trigger names no member, so nobody is barred from approving its
+// task.
+func TestRequesterIgnoresSystemTriggers(t *testing.T) {
+	trigger := v2.TaskTrigger{Type: v2.TaskTriggerSystem, ExternalID: "housekeeping"}
+	if got := requesterFor(trigger, EnqueueOpts{}); got != "" {
+		t.Fatalf("expected no requester for a system trigger, got %q", got)
+	}
+	if err := checkApprover("", "auth0|bob"); err != nil {
+		t.Fatalf("expected anyone to approve a task nobody asked for, got %v", err)
+	}
+}
+
+// A row enqueued before requestedBy was stored still bars the user it names.
+func TestApprovalTaskFallsBackToTheTrigger(t *testing.T) {
+	task := approvalTask{TriggeredBy: v2.TaskTrigger{Type: v2.TaskTriggerUser, ExternalID: "auth0|alice"}}
+	if got := task.requester(); got != "auth0|alice" {
+		t.Fatalf("expected the trigger's user, got %q", got)
+	}
+}
@@ -7,28 +7,6 @@ import (
 	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
-const (
-	baseBackoff = 5 * time.Second
-	maxBackoff  = 5 * time.Minute
-)
-
-// BackoffFor returns the delay before a task that has consumed `attempts`
-// attempts may be claimed again: 5s, 10s, 20s, 40s, ... capped at 5m.
-func BackoffFor(attempts int) time.Duration {
-	if attempts < 1 {
-		return baseBackoff
-	}
-
-	d := baseBackoff
-	for i := 1; i < attempts; i++ {
-		d *= 2
-		if d >= maxBackoff {
-			return maxBackoff
-		}
-	}
-	return d
-}
-
 // WorkflowDedupeKey makes a workflow step's enqueue idempotent. Re-running the
 // step produces the same key, and the unique partial index rejects the second
 // insert.
@@ -36,6 +14,16 @@ func WorkflowDedupeKey(workflowID bson.ObjectID, actionIdx int) string {
 	return fmt.Sprintf("workflow:%s:%d", workflowID.Hex(), actionIdx)
 }
 
+// WorkflowAttemptDedupeKey is WorkflowDedupeKey for a step that is being
+// retried: each attempt needs its own task, where a re-run of the same attempt
+// must still find the one it already made. Attempt 0 keeps the original key.
+func WorkflowAttemptDedupeKey(workflowID bson.ObjectID, actionIdx, attempt int) string {
+	if attempt == 0 {
+		return WorkflowDedupeKey(workflowID, actionIdx)
+	}
+	return fmt.Sprintf("%s:attempt%d", WorkflowDedupeKey(workflowID, actionIdx), attempt)
+}
+
 // BootUpdateDedupeKey scopes the UpdateOnStart task to one agent process, so a
 // reconnect loop cannot queue a stack of update tasks while one is still active.
 // It keys on the agent's session id, which survives reconnects, and not on the
@@ -43,3 +31,23 @@ func WorkflowDedupeKey(workflowID bson.ObjectID, actionIdx int) string {
 func BootUpdateDedupeKey(sessionID string) string {
 	return "boot-update:" + sessionID
 }
+
+// ScheduleDedupeKey makes a schedule slot fire once. The slot's instant is part
+// of the key, so every slot of a recurring schedule is distinct while two
+// materializer runs racing the same slot collide.
+func ScheduleDedupeKey(scheduleID bson.ObjectID, slot time.Time) string {
+	return fmt.Sprintf("schedule:%s:%d", scheduleID.Hex(), slot.Unix())
+}
+
+// RolloutDedupeKey makes a rollout's task on an agent idempotent. An agent is in
+// exactly one wave, so the rollout id alone is unique per agent, and a wave
+// re-launched after a crash adopts the tasks it already enqueued.
+func RolloutDedupeKey(rolloutID bson.ObjectID) string {
+	return "rollout:" + rolloutID.Hex()
+}
+
+// BatchDedupeKey keeps a batch to one task per agent, the same way
+// RolloutDedupeKey does for a rollout.
+func BatchDedupeKey(batchID bson.ObjectID) string {
+	return "batch:" + batchID.Hex()
+}
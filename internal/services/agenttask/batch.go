@@ -0,0 +1,321 @@
+package agenttask
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const batchCollectionName = "agenttaskbatches"
+
+// Batch states, derived from the tasks rather than stored: a batch has no
+// lifecycle of its own beyond the tasks it enqueued.
+const (
+	BatchStatusActive    = "active"
+	BatchStatusCompleted = "completed"
+	BatchStatusFailed    = "failed"
+)
+
+// maxBatchAgents bounds one batch. Enqueueing is sequential, so this also
+// bounds how long StartBatch holds its caller.
+const maxBatchAgents = 500
+
+// Batch is one action enqueued on many agents at once. Unlike a rollout it
+// launches everything immediately; it exists so the tasks can be watched,
+// cancelled and retried as one.
+//
+// AgentIDs is what the batch was asked to cover. TaskIDs and Failures fill in
+// as each enqueue lands, so a batch interrupted mid-launch still accounts for
+// every task it did create.
+type Batch struct {
+	ID        bson.ObjectID   `bson:"_id"`
+	AccountID bson.ObjectID   `bson:"accountId"`
+	Action    string          `bson:"action"`
+	AgentIDs  []bson.ObjectID `bson:"agentIds"`
+	TaskIDs   []bson.ObjectID `bson:"taskIds"`
+	Failures  []BatchFailure  `bson:"failures,omitempty"`
+	CreatedBy string          `bson:"createdBy"`
+	CreatedAt time.Time       `bson:"createdAt"`
+}
+
+// BatchFailure is an agent the batch could not enqueue on.
+type BatchFailure struct {
+	AgentID bson.ObjectID `bson:"agentId"`
+	Error   string        `bson:"error"`
+}
+
+// BatchSummary is a batch with its tasks' states counted.
+type BatchSummary struct {
+	Batch
+	Counts map[string]int
+	Status string
+}
+
+func batchCollection() *mongo.Collection {
+	return repositories.GetMongoClient().GetCollection(batchCollectionName)
+}
+
+// BatchTrigger is the TaskTrigger every task of a batch is enqueued with.
+func BatchTrigger(batchID bson.ObjectID) v2.TaskTrigger {
+	return v2.TaskTrigger{Type: v2.TaskTriggerUser, ExternalID: "batch:" + batchID.Hex()}
+}
+
+// enqueueOpts are the options each of the batch's tasks is enqueued with: on
+// behalf of whoever started the batch.
+func (b *Batch) enqueueOpts() EnqueueOpts {
+	return EnqueueOpts{RequestedBy: b.CreatedBy}
+}
+
+// EnsureBatchIndexes creates the index the account's batch list reads.
+func EnsureBatchIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "accountId", Value: 1}, {Key: "createdAt", Value: -1}},
+			Options: options.Index().SetName("by_account"),
+		},
+		{
+			Keys: bson.D{{Key: "createdAt", Value: 1}},
+			Options: options.Index().
+				SetName("batches_ttl").
+				SetExpireAfterSeconds(int32(finishedTTL.Seconds())),
+		},
+	}
+
+	if _, err := batchCollection().Indexes().CreateMany(ctx, indexes); err != nil {
+		return err
+	}
+
+	logger.GetDebugLogger().Println("Ensured agenttaskbatches indexes")
+	return nil
+}
+
+// batchStatus reduces a batch's task counts to one state: active while any
+// task can still run, completed when every task completed, failed otherwise.
+// A batch that could not enqueue on some agent is failed, even if every task it
+// did create completed.
+func batchStatus(counts map[string]int, failures int) string {
+	if counts[v2.TaskStatusPending]+counts[v2.TaskStatusRunning] > 0 {
+		return BatchStatusActive
+	}
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if failures == 0 && counts[v2.TaskStatusCompleted] == total {
+		return BatchStatusCompleted
+	}
+	return BatchStatusFailed
+}
+
+// StartBatch enqueues action on every agent in agentIDs. The caller has already
+// resolved its filter to agents the account owns. An agent the enqueue fails on
+// is recorded on the batch rather than failing the batch: "restart every server"
+// should restart every server it can.
+func StartBatch(accountID bson.ObjectID, createdBy, action, data string, agentIDs []bson.ObjectID) (*BatchSummary, error) {
+	agentIDs = uniqueAgents(agentIDs)
+	switch {
+	case action == "":
+		return nil, errors.New("batch action is required")
+	case data != "" && !json.Valid([]byte(data)):
+		return nil, errors.New("batch data must be valid JSON")
+	case len(agentIDs) == 0:
+		return nil, errors.New("batch matches no agents")
+	case len(agentIDs) > maxBatchAgents:
+		return nil, fmt.Errorf("batch matches %d agents, over the limit of %d", len(agentIDs), maxBatchAgents)
+	}
+	if _, err := checkAction(action, data); err != nil {
+		return nil, err
+	}
+
+	b := &Batch{
+		ID:        bson.NewObjectID(),
+		AccountID: accountID,
+		Action:    action,
+		AgentIDs:  agentIDs,
+		TaskIDs:   []bson.ObjectID{},
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	if _, err := batchCollection().InsertOne(ctx, b); err != nil {
+		return nil, err
+	}
+
+	var payload interface{}
+	if data != "" {
+		payload = json.RawMessage(data)
+	}
+
+	dedupeKey := BatchDedupeKey(b.ID)
+	for _, agentID := range agentIDs {
+		var update bson.M
+
+		id, err := Enqueue(agentID, accountID, action, payload, dedupeKey, BatchTrigger(b.ID), b.enqueueOpts())
+		if err == nil {
+			var oid bson.ObjectID
+			if oid, err = bson.ObjectIDFromHex(id); err == nil {
+				update = bson.M{"$push": bson.M{"taskIds": oid}}
+			}
+		}
+		if err != nil {
+			update = bson.M{"$push": bson.M{"failures": BatchFailure{AgentID: agentID, Error: err.Error()}}}
+		}
+
+		if _, err := batchCollection().UpdateOne(ctx, bson.M{"_id": b.ID}, update); err != nil {
+			logger.GetErrorLogger().Printf("error recording agent %s on batch %s: %s", agentID.Hex(), b.ID.Hex(), err.Error())
+		}
+	}
+
+	return GetBatch(b.ID.Hex())
+}
+
+// summarize counts the batch's tasks by status. A task the finishedTTL has
+// already removed counts as nothing at all.
+func summarize(ctx context.Context, b *Batch) (*BatchSummary, error) {
+	s := &BatchSummary{Batch: *b, Counts: map[string]int{}}
+
+	if len(b.TaskIDs) > 0 {
+		cur, err := collection().Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"_id": bson.M{"$in": b.TaskIDs}}}},
+			{{Key: "$group", Value: bson.M{"_id": "$status", "n": bson.M{"$sum": 1}}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var groups []struct {
+			Status string `bson:"_id"`
+			N      int    `bson:"n"`
+		}
+		if err := cur.All(ctx, &groups); err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			s.Counts[g.Status] = g.N
+		}
+	}
+
+	s.Status = batchStatus(s.Counts, len(b.Failures))
+	return s, nil
+}
+
+func GetBatch(batchID string) (*BatchSummary, error) {
+	oid, err := bson.ObjectIDFromHex(batchID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	b := &Batch{}
+	if err := batchCollection().FindOne(ctx, bson.M{"_id": oid}).Decode(b); err != nil {
+		return nil, err
+	}
+	return summarize(ctx, b)
+}
+
+func ListBatchesForAccount(accountID bson.ObjectID, limit int64) ([]BatchSummary, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetLimit(limit)
+	cur, err := batchCollection().Find(ctx, bson.M{"accountId": accountID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	batches := make([]Batch, 0)
+	if err := cur.All(ctx, &batches); err != nil {
+		return nil, err
+	}
+
+	summaries := make([]BatchSummary, 0, len(batches))
+	for idx := range batches {
+		s, err := summarize(ctx, &batches[idx])
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, *s)
+	}
+	return summaries, nil
+}
+
+// CancelBatch cancels every task of the batch that can still be cancelled,
+// with the same per-task semantics as Cancel: pending tasks end now, running
+// ones are asked to stop. It returns how many it reached; tasks already
+// finished are not an error.
+func CancelBatch(batchID, actor string) (int, error) {
+	return eachBatchTask(batchID, bson.A{v2.TaskStatusPending, v2.TaskStatusRunning}, func(taskID string) error {
+		return Cancel(taskID, actor)
+	})
+}
+
+// RetryBatch retries every dead task of the batch, with the same semantics as
+// Retry. It returns how many it put back.
+func RetryBatch(batchID, actor string) (int, error) {
+	return eachBatchTask(batchID, bson.A{v2.TaskStatusDead}, func(taskID string) error {
+		return Retry(taskID, actor)
+	})
+}
+
+// eachBatchTask applies fn to the batch's tasks currently in one of statuses.
+// A task that moved on between the read and fn (it finished, or someone else
+// cancelled it) is skipped rather than failing the rest of the batch.
+func eachBatchTask(batchID string, statuses bson.A, fn func(taskID string) error) (int, error) {
+	oid, err := bson.ObjectIDFromHex(batchID)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	b := &Batch{}
+	if err := batchCollection().FindOne(ctx, bson.M{"_id": oid}).Decode(b); err != nil {
+		return 0, err
+	}
+	if len(b.TaskIDs) == 0 {
+		return 0, nil
+	}
+
+	cur, err := collection().Find(ctx,
+		bson.M{"_id": bson.M{"$in": b.TaskIDs}, "status": bson.M{"$in": statuses}},
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+
+	var tasks []struct {
+		ID bson.ObjectID `bson:"_id"`
+	}
+	if err := cur.All(ctx, &tasks); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, t := range tasks {
+		if err := fn(t.ID.Hex()); err != nil {
+			logger.GetDebugLogger().Printf("skipped task %s of batch %s: %s", t.ID.Hex(), batchID, err.Error())
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
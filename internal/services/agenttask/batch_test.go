@@ -0,0 +1,26 @@
+package agenttask
+
+import "testing"
+
+func TestBatchStatusActiveWhileAnyTaskCanRun(t *testing.T) {
+	counts := map[string]int{"completed": 9, "running": 1}
+	if got := batchStatus(counts, 0); got != BatchStatusActive {
+		t.Fatalf("expected active, got %s", got)
+	}
+}
+
+func TestBatchStatusCompletedOnlyWhenEveryTaskCompleted(t *testing.T) {
+	if got := batchStatus(map[string]int{"completed": 10}, 0); got != BatchStatusCompleted {
+		t.Fatalf("expected completed, got %s", got)
+	}
+	if got := batchStatus(map[string]int{"completed": 9, "dead": 1}, 0); got != BatchStatusFailed {
+		t.Fatalf("expected one dead task to fail the batch, got %s", got)
+	}
+}
+
+// An agent the batch never reached is a failure the task counts cannot show.
+func TestBatchStatusCountsEnqueueFailures(t *testing.T) {
+	if got := batchStatus(map[string]int{"completed": 9}, 1); got != BatchStatusFailed {
+		t.Fatalf("expected an enqueue failure to fail the batch, got %s", got)
+	}
+}
@@ -0,0 +1,233 @@
+package agenttask
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+var ErrActionUnsupported = errors.New("agent does not support this task action")
+
+// unsupportedGrace is how long a task its agent said it cannot run waits for
+// the agent to be upgraded before it is finished dead. Left pending, it would
+// hold its children's gates, and its workflow step, forever.
+const unsupportedGrace = 24 * time.Hour
+
+// AgentCapabilities is what an agent told the backend about itself when it
+// last subscribed. Version and Platform come from the config it reports as
+// well.
+//
+// SupportedActions and Capabilities are nil for an agent that predates the
+// handshake: it is assumed to run whatever its version allows, which is how
+// every agent was treated before it could say.
+type AgentCapabilities struct {
+	Version          string
+	Platform         string
+	SupportedActions []string
+	Capabilities     []string
+}
+
+// cannotRun says why the agent cannot run the action, or "" when it can.
+func (c AgentCapabilities) cannotRun(spec ActionSpec) string {
+	if c.SupportedActions != nil && !slices.Contains(c.SupportedActions, spec.Name) {
+		return fmt.Sprintf("the agent does not support %s", spec.Name)
+	}
+	if c.Capabilities != nil {
+		missing := make([]string, 0)
+		for _, capability := range spec.Capabilities {
+			if !slices.Contains(c.Capabilities, capability) {
+				missing = append(missing, capability)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Sprintf("%s needs %s, which the agent does not advertise", spec.Name, strings.Join(missing, ", "))
+		}
+	}
+	if spec.MinAgentVersion != "" && !versionAtLeast(c.Version, spec.MinAgentVersion) {
+		return fmt.Sprintf("%s needs agent %s or newer, the agent runs %s", spec.Name, spec.MinAgentVersion, c.Version)
+	}
+	return ""
+}
+
+// blockedActions lists the registered actions the agent cannot run, which is
+// what claimFilter keeps it from claiming.
+func (c AgentCapabilities) blockedActions() []string {
+	blocked := make([]string, 0)
+	for _, spec := range ListActions() {
+		if c.cannotRun(spec) != "" {
+			blocked = append(blocked, spec.Name)
+		}
+	}
+	return blocked
+}
+
+// check is Enqueue's refusal for a task the agent is known not to be able to
+// run.
+func (c AgentCapabilities) check(spec ActionSpec) error {
+	reason := c.cannotRun(spec)
+	if reason == "" {
+		return nil
+	}
+	if spec.MinAgentVersion != "" && !versionAtLeast(c.Version, spec.MinAgentVersion) {
+		return fmt.Errorf("%w: %s", ErrAgentTooOld, reason)
+	}
+	return fmt.Errorf("%w: %s", ErrActionUnsupported, reason)
+}
+
+// Check refuses an action the agent is known not to be able to run, as Enqueue
+// would. It is for callers that start a chain of tasks and would rather know
+// before the first one than midway.
+func (c AgentCapabilities) Check(action string) error {
+	spec, ok := LookupAction(action)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownAction, action)
+	}
+	return c.check(spec)
+}
+
+// agentCapabilitiesDoc is the slice of the agent document the handshake
+// writes. Like agentState, it is read straight from the collection.
+type agentCapabilitiesDoc struct {
+	Config struct {
+		Version  string `bson:"version"`
+		Platform string `bson:"platform"`
+	} `bson:"config"`
+	SupportedActions []string `bson:"supportedActions"`
+	Capabilities     []string `bson:"capabilities"`
+}
+
+var capabilitiesProjection = bson.M{
+	"config.version": 1, "config.platform": 1, "supportedActions": 1, "capabilities": 1,
+}
+
+// Capabilities returns what the agent last advertised.
+func Capabilities(ctx context.Context, agentID bson.ObjectID) (AgentCapabilities, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var doc agentCapabilitiesDoc
+	err := repositories.GetMongoClient().
+		GetCollection("agents").
+		FindOne(ctx, bson.M{"_id": agentID}, options.FindOne().SetProjection(capabilitiesProjection)).
+		Decode(&doc)
+	if err != nil {
+		return AgentCapabilities{}, err
+	}
+	return doc.capabilities(), nil
+}
+
+func (doc agentCapabilitiesDoc) capabilities() AgentCapabilities {
+	return AgentCapabilities{
+		Version:          doc.Config.Version,
+		Platform:         doc.Config.Platform,
+		SupportedActions: doc.SupportedActions,
+		Capabilities:     doc.Capabilities,
+	}
+}
+
+// FlagUnsupportedTasks runs after an agent's handshake. Each pending task the
+// agent cannot run is told why in its message, where the UI shows it, since
+// the dispatcher will pass it over without a word; a task flagged earlier that
+// the agent can run now has the note taken off again. A task still flagged
+// unsupportedGrace after it was first is given up on; see
+// expireUnsupportedTasks.
+func FlagUnsupportedTasks(agentID bson.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := Capabilities(ctx, agentID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, spec := range ListActions() {
+		filter := bson.M{"agentId": agentID, "action": spec.Name, "status": v2.TaskStatusPending}
+
+		reason := c.cannotRun(spec)
+		if reason == "" {
+			filter["unsupportedReason"] = bson.M{"$exists": true}
+			if _, err := collection().UpdateMany(ctx, filter, bson.M{
+				"$set":   bson.M{"updatedAt": now},
+				"$unset": bson.M{"unsupportedReason": "", "unsupportedSince": "", "message": ""},
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		filter["unsupportedReason"] = bson.M{"$ne": reason}
+		message := "waiting for an agent that can run it: " + reason
+		// A changed reason keeps the time the task was first flagged.
+		if _, err := collection().UpdateMany(ctx, filter, mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"unsupportedReason": reason,
+			"unsupportedSince":  bson.M{"$ifNull": bson.A{"$unsupportedSince", now}},
+			"message":           message,
+			"updatedAt":         now,
+		}}}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireUnsupportedTasks finishes dead each pending task its agent has said for
+// unsupportedGrace that it cannot run.
+func expireUnsupportedTasks() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	cur, err := collection().Find(ctx, bson.M{
+		"status":           v2.TaskStatusPending,
+		"unsupportedSince": bson.M{"$lt": now.Add(-unsupportedGrace)},
+	}, options.Find().SetProjection(bson.M{"agentId": 1, "attempts": 1, "unsupportedReason": 1}))
+	if err != nil {
+		return err
+	}
+
+	var tasks []struct {
+		ID                bson.ObjectID `bson:"_id"`
+		AgentID           bson.ObjectID `bson:"agentId"`
+		Attempts          int           `bson:"attempts"`
+		UnsupportedReason string        `bson:"unsupportedReason"`
+	}
+	if err := cur.All(ctx, &tasks); err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+		lastError := "the agent cannot run it: " + task.UnsupportedReason
+
+		// Fenced on the flag too: an agent upgraded since our Find has had it
+		// taken off.
+		res, err := collection().UpdateOne(ctx,
+			bson.M{"_id": task.ID, "status": v2.TaskStatusPending, "unsupportedSince": bson.M{"$exists": true}},
+			bson.M{
+				"$set":   bson.M{"status": v2.TaskStatusDead, "finishedAt": now, "updatedAt": now, "lastError": lastError},
+				"$unset": bson.M{"active": "", "dependsOn": "", "dependsOnAll": "", "dependsOnAny": ""},
+			})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			continue
+		}
+
+		recordEvent(TaskEvent{TaskID: task.ID, Type: EventDead, Attempt: task.Attempts, Message: lastError})
+		if err := cascadeChildren(ctx, task.ID, v2.TaskStatusDead, task.AgentID); err != nil {
+			logger.GetErrorLogger().Printf("error cascading children of unsupported task %s: %s", task.ID.Hex(), err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package agenttask
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestAgentWithoutHandshakeRunsEverything(t *testing.T) {
+	if blocked := (AgentCapabilities{}).blockedActions(); len(blocked) != 0 {
+		t.Fatalf("expected an agent that never advertised to be blocked from nothing, got %v", blocked)
+	}
+}
+
+func TestAgentOnlyRunsWhatItAdvertises(t *testing.T) {
+	c := AgentCapabilities{Version: "1.4.0", SupportedActions: []string{"startsfserver", "stopsfserver"}}
+
+	blocked := c.blockedActions()
+	if !slices.Contains(blocked, syncModsAction) {
+		t.Fatalf("expected syncmods to be blocked on an agent that does not list it, got %v", blocked)
+	}
+	if slices.Contains(blocked, "startsfserver") {
+		t.Fatal("expected an advertised action not to be blocked")
+	}
+
+	spec, _ := LookupAction(syncModsAction)
+	if err := c.check(spec); !errors.Is(err, ErrActionUnsupported) {
+		t.Fatalf("expected enqueueing syncmods to be refused, got %v", err)
+	}
+}
+
+func TestMissingCapabilitiesAndOldVersionsAreExplained(t *testing.T) {
+	spec := ActionSpec{Name: "restoresave", Capabilities: []string{"saves"}, MinAgentVersion: "2.0.0"}
+
+	if reason := (AgentCapabilities{Version: "2.1.0", Capabilities: []string{}}).cannotRun(spec); reason == "" {
+		t.Fatal("expected an agent without the saves capability to be refused")
+	}
+	if reason := (AgentCapabilities{Version: "2.1.0", Capabilities: []string{"saves"}}).cannotRun(spec); reason != "" {
+		t.Fatalf("expected a capable agent to run it, got %q", reason)
+	}
+
+	old := AgentCapabilities{Version: "1.9.0"}
+	if err := old.check(spec); !errors.Is(err, ErrAgentTooOld) {
+		t.Fatalf("expected an old agent to be refused as too old, got %v", err)
+	}
+}
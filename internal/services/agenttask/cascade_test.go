@@ -38,13 +38,45 @@ func updateManyUpdate(t *testing.T, w mongo.WriteModel) bson.M {
 	return u
 }
 
+func updateManyPipeline(t *testing.T, w mongo.WriteModel) mongo.Pipeline {
+	t.Helper()
+	m, ok := w.(*mongo.UpdateManyModel)
+	if !ok {
+		t.Fatalf("expected *mongo.UpdateManyModel, got %T", w)
+	}
+	p, ok := m.Update.(mongo.Pipeline)
+	if !ok {
+		t.Fatalf("expected update to be a mongo.Pipeline, got %T", m.Update)
+	}
+	return p
+}
+
+// gateFields lists the gate fields a filter's $or matches parentID through.
+func gateFields(t *testing.T, filter bson.M, parentID bson.ObjectID) []string {
+	t.Helper()
+	or, ok := filter["$or"].(bson.A)
+	if !ok {
+		t.Fatalf("expected the filter to match gate fields via $or, got %v", filter)
+	}
+	fields := make([]string, 0, len(or))
+	for _, clause := range or {
+		for field, value := range clause.(bson.M) {
+			if value != parentID {
+				t.Fatalf("expected %s to match %v, got %v", field, parentID, value)
+			}
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
 func TestCascadeWritesCompletedParentReleasesEveryChild(t *testing.T) {
 	parentID := bson.NewObjectID()
 	now := time.Now()
 
 	writes := cascadeWrites(parentID, v2.TaskStatusCompleted, now)
-	if len(writes) != 1 {
-		t.Fatalf("expected exactly one write for a completed parent, got %d", len(writes))
+	if len(writes) != 3 {
+		t.Fatalf("expected one write per gate field for a completed parent, got %d", len(writes))
 	}
 
 	filter := updateManyFilter(t, writes[0])
@@ -63,6 +95,26 @@ func TestCascadeWritesCompletedParentReleasesEveryChild(t *testing.T) {
 	if _, cancelled := update["$set"].(bson.M)["status"]; cancelled {
 		t.Fatalf("a completed parent must not set a status on its children, got update %v", update)
 	}
+
+	// All-of children only lose this parent; the rest of the set still gates them.
+	if updateManyFilter(t, writes[1])["dependsOnAll"] != parentID {
+		t.Fatalf("expected write[1] to target all-of children, got %v", updateManyFilter(t, writes[1]))
+	}
+	pull := updateManyPipeline(t, writes[1])
+	if len(pull) != 1 || pull[0][0].Key != "$set" {
+		t.Fatalf("expected a single $set stage, got %v", pull)
+	}
+	if _, ok := pull[0][0].Value.(bson.M)["status"]; ok {
+		t.Fatalf("a completed parent must not set a status on its children, got %v", pull)
+	}
+
+	// Any-of children are released by the first parent to complete.
+	if updateManyFilter(t, writes[2])["dependsOnAny"] != parentID {
+		t.Fatalf("expected write[2] to target any-of children, got %v", updateManyFilter(t, writes[2]))
+	}
+	if unset, ok := updateManyUpdate(t, writes[2])["$unset"].(bson.M); !ok || unset["dependsOnAny"] != "" {
+		t.Fatalf("expected dependsOnAny to be lifted, got %v", updateManyUpdate(t, writes[2]))
+	}
 }
 
 // This is the invariant the whole cascade design revolves around: a
@@ -78,8 +130,8 @@ func TestCascadeWritesDeadOrCancelledParentExemptsRecoveryStart(t *testing.T) {
 		now := time.Now()
 
 		writes := cascadeWrites(parentID, parentStatus, now)
-		if len(writes) != 2 {
-			t.Fatalf("[%s] expected exactly two writes (release then cancel), got %d", parentStatus, len(writes))
+		if len(writes) != 4 {
+			t.Fatalf("[%s] expected exactly four writes (two releases, then two cancels), got %d", parentStatus, len(writes))
 		}
 
 		// Write [0]: the recovery release, and it must run first.
@@ -98,18 +150,45 @@ func TestCascadeWritesDeadOrCancelledParentExemptsRecoveryStart(t *testing.T) {
 			if _, hasStatus := set["status"]; hasStatus {
 				t.Fatalf("[%s] the recovery release must not set a terminal status, got %v", parentStatus, releaseUpdate)
 			}
+			if set["priority"] != PrioritySystemRecovery {
+				t.Fatalf("[%s] expected the recovery start to jump the queue, got %v", parentStatus, releaseUpdate)
+			}
+		}
+
+		// Write [1]: a recovery start waiting on a set loses this parent but is
+		// never cancelled, and it must also run before any cancellation.
+		setReleaseFilter := updateManyFilter(t, writes[1])
+		if fields := gateFields(t, setReleaseFilter, parentID); len(fields) != 2 {
+			t.Fatalf("[%s] expected write[1] to cover both parent sets, got %v", parentStatus, fields)
+		}
+		if setReleaseFilter["action"] != recoveryExemptAction {
+			t.Fatalf("[%s] expected write[1] to target only %q, got filter %v", parentStatus, recoveryExemptAction, setReleaseFilter)
+		}
+		stage := updateManyPipeline(t, writes[1])[0][0].Value.(bson.M)
+		if _, hasStatus := stage["status"]; hasStatus {
+			t.Fatalf("[%s] the recovery release must not set a terminal status, got %v", parentStatus, stage)
+		}
+		if stage["priority"] != PrioritySystemRecovery {
+			t.Fatalf("[%s] expected the recovery start to jump the queue, got %v", parentStatus, stage)
 		}
 
-		// Write [1]: cancels everyone else, and it must exclude the recovery action.
-		cancelFilter := updateManyFilter(t, writes[1])
-		if cancelFilter["dependsOn"] != parentID {
-			t.Fatalf("[%s] cancel write not scoped to this parent: %v", parentStatus, cancelFilter)
+		// Writes [2] and [3]: cancel everyone else, and they must exclude the
+		// recovery action.
+		cancelFilter := updateManyFilter(t, writes[2])
+		if fields := gateFields(t, cancelFilter, parentID); len(fields) != 2 {
+			t.Fatalf("[%s] expected the cancellation to cover dependsOn and dependsOnAll, got %v", parentStatus, fields)
 		}
-		actionExclusion, ok := cancelFilter["action"].(bson.M)
-		if !ok || actionExclusion["$ne"] != recoveryExemptAction {
-			t.Fatalf("[%s] expected the cancellation filter to exclude %q via $ne, got %v", parentStatus, recoveryExemptAction, cancelFilter)
+		anyFilter := updateManyFilter(t, writes[3])
+		if anyFilter["dependsOnAny"] != parentID {
+			t.Fatalf("[%s] expected write[3] to target any-of children, got %v", parentStatus, anyFilter)
 		}
-		cancelUpdate := updateManyUpdate(t, writes[1])
+		for _, filter := range []bson.M{cancelFilter, anyFilter} {
+			actionExclusion, ok := filter["action"].(bson.M)
+			if !ok || actionExclusion["$ne"] != recoveryExemptAction {
+				t.Fatalf("[%s] expected the cancellation filter to exclude %q via $ne, got %v", parentStatus, recoveryExemptAction, filter)
+			}
+		}
+		cancelUpdate := updateManyUpdate(t, writes[2])
 		set, ok := cancelUpdate["$set"].(bson.M)
 		if !ok || set["status"] != v2.TaskStatusCancelled {
 			t.Fatalf("[%s] expected the non-exempt children to be cancelled, got %v", parentStatus, cancelUpdate)
@@ -117,14 +196,33 @@ func TestCascadeWritesDeadOrCancelledParentExemptsRecoveryStart(t *testing.T) {
 	}
 }
 
+// An any-of child must survive one parent failing while another may still
+// complete: it is only cancelled once the failed parent was its last.
+func TestCascadeWritesAnyOfChildIsCancelledOnlyWhenExhausted(t *testing.T) {
+	writes := cascadeWrites(bson.NewObjectID(), v2.TaskStatusDead, time.Now())
+	pipeline := updateManyPipeline(t, writes[3])
+	if len(pipeline) != 2 {
+		t.Fatalf("expected a pull stage then a conditional cancel stage, got %v", pipeline)
+	}
+
+	status, ok := pipeline[1][0].Value.(bson.M)["status"].(bson.M)
+	if !ok {
+		t.Fatalf("expected the status to be conditional, got %v", pipeline[1])
+	}
+	branches, ok := status["$cond"].(bson.A)
+	if !ok || len(branches) != 3 || branches[1] != v2.TaskStatusCancelled || branches[2] != "$status" {
+		t.Fatalf("expected cancelled only when no parent is left, otherwise unchanged, got %v", status)
+	}
+}
+
 func TestCascadeWritesDeadOrCancelledParentCancelUpdateUnsetsLeaseFields(t *testing.T) {
 	writes := cascadeWrites(bson.NewObjectID(), v2.TaskStatusDead, time.Now())
-	update := updateManyUpdate(t, writes[1])
+	update := updateManyUpdate(t, writes[2])
 	unset, ok := update["$unset"].(bson.M)
 	if !ok {
 		t.Fatalf("expected an $unset clause, got %v", update)
 	}
-	for _, field := range []string{"active", "dependsOn", "leaseToken", "leaseExpiresAt", "message"} {
+	for _, field := range []string{"active", "dependsOn", "dependsOnAll", "leaseToken", "leaseExpiresAt", "message"} {
 		if _, present := unset[field]; !present {
 			t.Fatalf("expected cancellation to unset %q, got %v", field, unset)
 		}
@@ -0,0 +1,167 @@
+package agenttask
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	// changeStreamEnv opts a deployment into change-stream dispatch. It is off
+	// by default because change streams need a replica set, and a standalone
+	// Mongo would only ever log the fallback.
+	changeStreamEnv = "AGENT_TASK_CHANGE_STREAMS"
+
+	// streamSweepInterval is how often the dispatcher still walks every
+	// connected agent while the change stream is healthy. The stream only sees
+	// the task collection, so this is what notices the rest: an agent reporting
+	// its server stopped under a requiresServerStopped task, a maintenance
+	// window opening under a requiresMaintenanceWindow one, or an event lost
+	// between a stream failure and its resume.
+	streamSweepInterval = 10 * time.Second
+
+	// streamRetryInterval is how long a failed stream waits before reopening.
+	// The dispatcher is back on the full tick in the meantime.
+	streamRetryInterval = 30 * time.Second
+)
+
+// streamHealthy is true while the change stream is open and delivering. The
+// dispatcher reads it on every tick to decide between a full walk and waiting
+// for the next sweep.
+var streamHealthy atomic.Bool
+
+func changeStreamsEnabled() bool {
+	return os.Getenv(changeStreamEnv) == "true"
+}
+
+// taskChange is the part of a change event the dispatcher needs: which agent
+// may now have something to claim, and from when.
+type taskChange struct {
+	FullDocument *changedTask `bson:"fullDocument"`
+}
+
+type changedTask struct {
+	AgentID       bson.ObjectID `bson:"agentId"`
+	NextAttemptAt *time.Time    `bson:"nextAttemptAt"`
+}
+
+// releasedGateFields are the holds whose removal can make a task claimable.
+var releasedGateFields = bson.A{"dependsOn", "dependsOnAll", "dependsOnAny", "requiresApproval"}
+
+// changeStreamPipeline selects the writes after which an agent may be able to
+// claim: a new task; any status change other than a claim, since a retry puts a
+// task back and a finished task frees its agent; and a parent gate or an
+// approval hold coming off. Approve wakes the agent itself, but only on its own
+// replica; the agent's stream may be held by another.
+func changeStreamPipeline() mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"operationType": "insert"},
+			bson.M{
+				"operationType": "update",
+				"updateDescription.updatedFields.status": bson.M{
+					"$exists": true,
+					"$ne":     v2.TaskStatusRunning,
+				},
+			},
+			bson.M{
+				"operationType":                   "update",
+				"updateDescription.removedFields": bson.M{"$in": releasedGateFields},
+			},
+		}}}},
+		{{Key: "$project", Value: bson.M{
+			"fullDocument.agentId":       1,
+			"fullDocument.nextAttemptAt": 1,
+		}}},
+	}
+}
+
+// wake returns the agent to wake for a change, and how long to wait first: a
+// task put back with a backoff is not claimable until its nextAttemptAt, and
+// waking the agent now would only find nothing due.
+func (c taskChange) wake(now time.Time) (bson.ObjectID, time.Duration, bool) {
+	if c.FullDocument == nil || c.FullDocument.AgentID.IsZero() {
+		return bson.ObjectID{}, 0, false
+	}
+
+	var delay time.Duration
+	if next := c.FullDocument.NextAttemptAt; next != nil && next.After(now) {
+		delay = next.Sub(now)
+	}
+	return c.FullDocument.AgentID, delay, true
+}
+
+// watchTasks drives the dispatcher from the agenttasks change stream until done
+// closes. Every replica runs its own watch and acts only on the agents whose
+// stream it holds (see wakeLocal), so a task enqueued on
+// one replica wakes its agent on another without waiting for a tick.
+//
+// When the stream cannot be opened (a standalone Mongo) or breaks, the
+// dispatcher is back on the full tick until it reopens, resuming where it left
+// off if it can.
+func watchTasks(done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	var resumeToken bson.Raw
+	for {
+		opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+		if resumeToken != nil {
+			opts.SetResumeAfter(resumeToken)
+		}
+
+		cs, err := collection().Watch(ctx, changeStreamPipeline(), opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.GetErrorLogger().Printf("agent task change stream unavailable, dispatching on the tick: %s", err.Error())
+			// A token the oplog has rolled past can never be resumed from.
+			resumeToken = nil
+		} else {
+			streamHealthy.Store(true)
+			logger.GetDebugLogger().Println("Dispatching agent tasks from the change stream")
+
+			for cs.Next(ctx) {
+				var change taskChange
+				if err := cs.Decode(&change); err != nil {
+					logger.GetErrorLogger().Printf("error decoding agent task change: %s", err.Error())
+					continue
+				}
+				agentID, delay, ok := change.wake(time.Now())
+				if !ok {
+					continue
+				}
+				if delay > 0 {
+					time.AfterFunc(delay, func() { wakeLocal(agentID) })
+				} else {
+					wakeLocal(agentID)
+				}
+			}
+
+			streamHealthy.Store(false)
+			resumeToken = cs.ResumeToken()
+			if err := cs.Err(); err != nil && ctx.Err() == nil {
+				logger.GetErrorLogger().Printf("agent task change stream failed, dispatching on the tick: %s", err.Error())
+			}
+			_ = cs.Close(context.Background())
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(streamRetryInterval):
+		}
+	}
+}
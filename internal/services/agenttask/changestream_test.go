@@ -0,0 +1,52 @@
+package agenttask
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestTaskChangeWakesTheAgentNow(t *testing.T) {
+	agentID := bson.NewObjectID()
+	now := time.Now()
+
+	c := taskChange{FullDocument: &changedTask{AgentID: agentID, NextAttemptAt: &now}}
+
+	got, delay, ok := c.wake(now)
+	if !ok || got != agentID || delay != 0 {
+		t.Fatalf("expected an immediate wake of %s, got %s after %s (ok=%v)", agentID.Hex(), got.Hex(), delay, ok)
+	}
+}
+
+// A retry put back with a backoff is not claimable yet; waking the agent now
+// would find nothing due, and nothing would wake it again.
+func TestTaskChangeWaitsOutTheBackoff(t *testing.T) {
+	now := time.Now()
+	next := now.Add(20 * time.Second)
+
+	c := taskChange{FullDocument: &changedTask{AgentID: bson.NewObjectID(), NextAttemptAt: &next}}
+
+	if _, delay, ok := c.wake(now); !ok || delay != 20*time.Second {
+		t.Fatalf("expected a wake after the backoff, got %s (ok=%v)", delay, ok)
+	}
+}
+
+// With updateLookup, a task deleted before the lookup (the TTL) has no full
+// document, and there is no agent to wake.
+func TestTaskChangeWithoutADocumentWakesNothing(t *testing.T) {
+	if _, _, ok := (taskChange{}).wake(time.Now()); ok {
+		t.Fatal("expected no wake without a full document")
+	}
+}
+
+// An approval unsets requiresApproval, and the task's agent may be on another
+// replica's stream: the removal must reach it like a parent gate's does.
+func TestChangeStreamSeesAnApprovalComeOff(t *testing.T) {
+	for _, field := range []string{"dependsOn", "dependsOnAll", "dependsOnAny", "requiresApproval"} {
+		if !slices.Contains(releasedGateFields, interface{}(field)) {
+			t.Fatalf("expected the stream to match %s being removed", field)
+		}
+	}
+}
@@ -9,21 +9,39 @@ import (
 
 // claimFilter builds the predicate for the atomic claim.
 //
-// It is a pure function so the two gates can be tested without a database. Both
-// gates are claim predicates and nothing more: dependsOn is cleared by the
-// parent's terminal transition, and requiresServerStopped is evaluated against
-// the agent status the state pipeline already maintains.
-func claimFilter(agentID bson.ObjectID, now time.Time, serverRunning bool) bson.M {
+// It is a pure function so the gates can be tested without a database. They are
+// claim predicates and nothing more: the parent gates (dependsOn, dependsOnAll,
+// dependsOnAny) are cleared by the parents' terminal transitions, and
+// requiresServerStopped is evaluated against the agent status the state pipeline
+// already maintains. requiresMaintenanceWindow is evaluated against the agent's
+// maintenance windows at now. requiresApproval is cleared by Approve. A task
+// past its policy deadline is never claimed again; the reaper's deadline sweep
+// finishes it. blocked are the actions the agent cannot run (see
+// AgentCapabilities); their tasks wait for an agent that can.
+func claimFilter(agentID bson.ObjectID, now time.Time, serverRunning, inWindow bool, blocked []string) bson.M {
 	f := bson.M{
-		"agentId":       agentID,
-		"status":        v2.TaskStatusPending,
-		"nextAttemptAt": bson.M{"$lte": now},
-		"dependsOn":     bson.M{"$exists": false},
+		"agentId":          agentID,
+		"status":           v2.TaskStatusPending,
+		"nextAttemptAt":    bson.M{"$lte": now},
+		"dependsOn":        bson.M{"$exists": false},
+		"dependsOnAll":     bson.M{"$exists": false},
+		"dependsOnAny":     bson.M{"$exists": false},
+		"requiresApproval": bson.M{"$ne": true},
+		"$or": bson.A{
+			bson.M{"deadlineAt": bson.M{"$exists": false}},
+			bson.M{"deadlineAt": bson.M{"$gt": now}},
+		},
 	}
 
 	if serverRunning {
 		f["requiresServerStopped"] = bson.M{"$ne": true}
 	}
+	if !inWindow {
+		f["requiresMaintenanceWindow"] = bson.M{"$ne": true}
+	}
+	if len(blocked) > 0 {
+		f["action"] = bson.M{"$nin": blocked}
+	}
 
 	return f
 }
@@ -4,11 +4,12 @@ import (
 	"testing"
 	"time"
 
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
 	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 func TestClaimFilterAlwaysExcludesGatedDependencies(t *testing.T) {
-	f := claimFilter(bson.NewObjectID(), time.Now(), false)
+	f := claimFilter(bson.NewObjectID(), time.Now(), false, false, nil)
 
 	got, ok := f["dependsOn"]
 	if !ok {
@@ -22,7 +23,7 @@ func TestClaimFilterAlwaysExcludesGatedDependencies(t *testing.T) {
 // The whole point of the gate: while the agent reports the server running, a
 // requiresServerStopped task must not be claimable.
 func TestClaimFilterExcludesServerStoppedTasksWhileRunning(t *testing.T) {
-	f := claimFilter(bson.NewObjectID(), time.Now(), true)
+	f := claimFilter(bson.NewObjectID(), time.Now(), true, false, nil)
 
 	got, ok := f["requiresServerStopped"]
 	if !ok {
@@ -34,7 +35,7 @@ func TestClaimFilterExcludesServerStoppedTasksWhileRunning(t *testing.T) {
 }
 
 func TestClaimFilterAllowsServerStoppedTasksOnceStopped(t *testing.T) {
-	f := claimFilter(bson.NewObjectID(), time.Now(), false)
+	f := claimFilter(bson.NewObjectID(), time.Now(), false, false, nil)
 
 	if _, ok := f["requiresServerStopped"]; ok {
 		t.Fatal("expected no gate on requiresServerStopped once the server is stopped")
@@ -45,7 +46,7 @@ func TestClaimFilterKeepsTheExistingPredicates(t *testing.T) {
 	agentID := bson.NewObjectID()
 	now := time.Now()
 
-	f := claimFilter(agentID, now, false)
+	f := claimFilter(agentID, now, false, false, nil)
 
 	if f["agentId"] != agentID {
 		t.Fatal("expected the claim to be scoped to the agent")
@@ -57,3 +58,111 @@ func TestClaimFilterKeepsTheExistingPredicates(t *testing.T) {
 		t.Fatal("expected the claim to honour the backoff schedule")
 	}
 }
+
+func TestClaimSortTakesHighestPriorityThenOldest(t *testing.T) {
+	sort := claimSort()
+
+	if len(sort) != 2 || sort[0].Key != "priority" || sort[0].Value != -1 {
+		t.Fatalf("expected priority descending first, got %v", sort)
+	}
+	if sort[1].Key != "createdAt" || sort[1].Value != 1 {
+		t.Fatalf("expected FIFO within a priority level, got %v", sort)
+	}
+}
+
+func TestPriorityForDerivesFromTrigger(t *testing.T) {
+	cases := []struct {
+		trigger v2.TaskTrigger
+		want    TaskPriority
+	}{
+		{v2.TaskTrigger{Type: v2.TaskTriggerUser}, PriorityUser},
+		{v2.TaskTrigger{Type: v2.TaskTriggerWorkflow}, PriorityUser},
+		{v2.TaskTrigger{Type: v2.TaskTriggerSystem}, PriorityMaintenance},
+	}
+
+	for _, c := range cases {
+		if got := priorityFor(PriorityDefault, c.trigger); got != c.want {
+			t.Errorf("trigger %v: got priority %d, want %d", c.trigger.Type, got, c.want)
+		}
+	}
+}
+
+func TestPriorityForKeepsAnExplicitLevel(t *testing.T) {
+	got := priorityFor(PriorityScheduled, v2.TaskTrigger{Type: v2.TaskTriggerUser})
+	if got != PriorityScheduled {
+		t.Fatalf("expected an explicit priority to win over the trigger, got %d", got)
+	}
+}
+
+func TestClaimFilterExcludesTasksWaitingOnAParentSet(t *testing.T) {
+	f := claimFilter(bson.NewObjectID(), time.Now(), false, false, nil)
+
+	for _, field := range []string{"dependsOnAll", "dependsOnAny"} {
+		got, ok := f[field].(bson.M)
+		if !ok || got["$exists"] != false {
+			t.Fatalf("expected %s: {$exists: false}, got %v", field, f[field])
+		}
+	}
+}
+
+func TestValidateGateRejectsMixedParentGates(t *testing.T) {
+	parentID := bson.NewObjectID()
+
+	mixed := EnqueueOpts{DependsOn: &parentID, DependsOnAny: []bson.ObjectID{bson.NewObjectID()}}
+	if err := mixed.validateGate(); err == nil {
+		t.Fatal("expected a task gated through two fields to be rejected")
+	}
+
+	set := EnqueueOpts{DependsOnAll: []bson.ObjectID{parentID, bson.NewObjectID()}}
+	if err := set.validateGate(); err != nil {
+		t.Fatalf("expected a single parent set to be accepted, got %s", err)
+	}
+	if got := set.parents(); len(got) != 2 {
+		t.Fatalf("expected both parents to be reported, got %v", got)
+	}
+}
+
+// A task awaiting approval is never claimable, whatever else is true of it.
+func TestClaimFilterHoldsTasksAwaitingApproval(t *testing.T) {
+	f := claimFilter(bson.NewObjectID(), time.Now(), false, false, nil)
+
+	got, ok := f["requiresApproval"]
+	if !ok {
+		t.Fatal("expected the claim to exclude tasks awaiting approval")
+	}
+	if got.(bson.M)["$ne"] != true {
+		t.Fatalf("expected requiresApproval: {$ne: true}, got %v", got)
+	}
+}
+
+func TestClaimFilterHoldsWindowedTasksOutsideAWindow(t *testing.T) {
+	f := claimFilter(bson.NewObjectID(), time.Now(), false, false, nil)
+
+	got, ok := f["requiresMaintenanceWindow"]
+	if !ok {
+		t.Fatal("expected the claim to exclude windowed tasks outside a maintenance window")
+	}
+	if got.(bson.M)["$ne"] != true {
+		t.Fatalf("expected requiresMaintenanceWindow: {$ne: true}, got %v", got)
+	}
+
+	if _, ok := claimFilter(bson.NewObjectID(), time.Now(), false, true, nil)["requiresMaintenanceWindow"]; ok {
+		t.Fatal("expected no gate on requiresMaintenanceWindow inside a window")
+	}
+}
+
+func TestClaimFilterSkipsActionsTheAgentCannotRun(t *testing.T) {
+	f := claimFilter(bson.NewObjectID(), time.Now(), false, false, []string{"syncmods"})
+
+	got, ok := f["action"]
+	if !ok {
+		t.Fatal("expected the claim to pass over actions the agent cannot run")
+	}
+	if nin := got.(bson.M)["$nin"].([]string); len(nin) != 1 || nin[0] != "syncmods" {
+		t.Fatalf("expected action: {$nin: [syncmods]}, got %v", got)
+	}
+
+	if _, ok := claimFilter(bson.NewObjectID(), time.Now(), false, false, nil)["action"]; ok {
+		t.Fatal("expected no action filter for an agent that can run everything")
+	}
+}
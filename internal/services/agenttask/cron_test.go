@@ -0,0 +1,155 @@
+package agenttask
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func mustParseCron(t *testing.T, expr, tz string) *CronSpec {
+	t.Helper()
+	spec, err := ParseCron(expr, tz)
+	if err != nil {
+		t.Fatalf("ParseCron(%q, %q): %s", expr, tz, err)
+	}
+	return spec
+}
+
+func TestCronNextIsStrictlyAfter(t *testing.T) {
+	spec := mustParseCron(t, "0 3 * * *", "")
+	at := time.Date(2026, 3, 1, 3, 0, 0, 0, time.UTC)
+
+	got := spec.Next(at)
+	want := time.Date(2026, 3, 2, 3, 0, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Fatalf("expected a slot exactly at `after` to be skipped: got %s want %s", got, want)
+	}
+}
+
+func TestCronNextHonoursTimeZone(t *testing.T) {
+	spec := mustParseCron(t, "0 3 * * *", "Europe/London")
+	// 02:30 UTC on a summer day is 03:30 BST, so today's 03:00 local has passed.
+	at := time.Date(2026, 7, 1, 2, 30, 0, 0, time.UTC)
+
+	got := spec.Next(at)
+	want := time.Date(2026, 7, 2, 2, 0, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Fatalf("got %s want %s", got.UTC(), want)
+	}
+}
+
+// A nightly slot must stay at the same wall-clock time across a DST change,
+// not drift by the offset as a fixed 24h step would.
+func TestCronNextKeepsWallClockAcrossDST(t *testing.T) {
+	spec := mustParseCron(t, "0 3 * * *", "Europe/London")
+	// Clocks go forward at 01:00 UTC on 29 March 2026.
+	at := time.Date(2026, 3, 27, 12, 0, 0, 0, time.UTC)
+
+	first := spec.Next(at)
+	second := spec.Next(first)
+
+	if first.UTC().Hour() != 3 || second.UTC().Hour() != 2 {
+		t.Fatalf("expected 03:00 GMT then 03:00 BST, got %s then %s", first.UTC(), second.UTC())
+	}
+}
+
+func TestCronStepsRangesAndNames(t *testing.T) {
+	spec := mustParseCron(t, "*/15 9-17 * * mon-fri", "")
+	// Saturday.
+	at := time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC)
+
+	got := spec.Next(at)
+	want := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Fatalf("got %s want %s", got, want)
+	}
+
+	if next := spec.Next(got); !next.Equal(want.Add(15 * time.Minute)) {
+		t.Fatalf("expected a 15 minute step, got %s", next)
+	}
+}
+
+// Classic cron: with both day fields restricted, either one matching is enough.
+func TestCronDayOfMonthOrDayOfWeek(t *testing.T) {
+	spec := mustParseCron(t, "0 0 1 * sun", "")
+	// Thursday 1 October 2026.
+	at := time.Date(2026, 9, 30, 12, 0, 0, 0, time.UTC)
+
+	first := spec.Next(at)
+	second := spec.Next(first)
+
+	if first.Day() != 1 || second.Day() != 4 {
+		t.Fatalf("expected the 1st then Sunday the 4th, got %s then %s", first, second)
+	}
+}
+
+func TestCronMacrosAndSundayAsSeven(t *testing.T) {
+	daily := mustParseCron(t, "@daily", "")
+	if daily.minute != 1 || daily.hour != 1 {
+		t.Fatal("expected @daily to expand to midnight")
+	}
+
+	weekly := mustParseCron(t, "0 0 * * 7", "")
+	if weekly.dow != 1 {
+		t.Fatalf("expected 7 to fold onto Sunday (bit 0), got %b", weekly.dow)
+	}
+}
+
+func TestCronRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"1,,2 * * * *",
+		"* * * foo *",
+	} {
+		if _, err := ParseCron(expr, ""); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+
+	if _, err := ParseCron("* * * * *", "Not/AZone"); err == nil {
+		t.Error("expected an unknown time zone to be rejected")
+	}
+}
+
+func TestCronNextGivesUpOnAnImpossibleDate(t *testing.T) {
+	spec := mustParseCron(t, "0 0 31 2 *", "")
+	if got := spec.Next(time.Now()); !got.IsZero() {
+		t.Fatalf("expected no slot for 31 February, got %s", got)
+	}
+}
+
+func TestScheduleDedupeKeyIsPerSlot(t *testing.T) {
+	id := bson.NewObjectID()
+	slot := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+
+	if ScheduleDedupeKey(id, slot) != ScheduleDedupeKey(id, slot.In(time.FixedZone("x", 3600))) {
+		t.Fatal("expected the same instant to produce the same key whatever its zone")
+	}
+	if ScheduleDedupeKey(id, slot) == ScheduleDedupeKey(id, slot.Add(24*time.Hour)) {
+		t.Fatal("expected successive slots to produce distinct keys")
+	}
+}
+
+// Misses in a row keep the error that kept the first slot from firing, not one
+// "missed ..." per slot.
+func TestMissedSlotErrorKeepsOnlyTheRootCause(t *testing.T) {
+	first := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	second := first.Add(24 * time.Hour)
+
+	lastError := missedSlotError(first, "agent not found")
+	lastError = missedSlotError(second, lastError)
+	if want := "missed the run due at 2026-01-02T03:00:00Z: agent not found"; lastError != want {
+		t.Fatalf("expected %q, got %q", want, lastError)
+	}
+
+	if got := missedSlotError(second, missedSlotError(first, "")); got != "missed the run due at 2026-01-02T03:00:00Z" {
+		t.Fatalf("expected a bare miss to stay bare, got %q", got)
+	}
+}
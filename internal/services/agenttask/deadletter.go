@@ -0,0 +1,362 @@
+package agenttask
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/types"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	// deadLetterExportEnv opts a deployment into exporting every dead task to
+	// object storage before finishedTTL removes it.
+	deadLetterExportEnv = "AGENT_TASK_DEADLETTER_EXPORT"
+
+	// deadLetterExportLead is how long before expiry the export sweep picks a
+	// dead task up: long enough for a few failed sweeps to be retried.
+	deadLetterExportLead = 24 * time.Hour
+
+	// maxDeadLetterBulk bounds one bulk replay, discard or export. An admin
+	// working through more repeats the call.
+	maxDeadLetterBulk = 500
+
+	// storageSweepBatch and storageSweepBudget bound one run of each storage
+	// sweep, the dead-letter export and the artifact cleanup, which write to
+	// the bucket for every task: a backlog is worked off over several runs
+	// instead of holding the job for hundreds of calls. Their leads leave
+	// them hours to get through it.
+	storageSweepBatch  = 25
+	storageSweepBudget = 20 * time.Second
+)
+
+var errEmptyDeadLetterFilter = errors.New("a bulk dead-letter operation needs at least one filter")
+
+// DeadLetterFilter selects dead tasks. Zero fields do not filter. ErrorText
+// matches anywhere in lastError, case-insensitively and literally; From and To
+// bound when the task died.
+type DeadLetterFilter struct {
+	AccountID bson.ObjectID
+	AgentID   bson.ObjectID
+	Action    string
+	ErrorText string
+	From      time.Time
+	To        time.Time
+}
+
+func (f DeadLetterFilter) isEmpty() bool {
+	return f.AccountID.IsZero() && f.AgentID.IsZero() && f.Action == "" &&
+		f.ErrorText == "" && f.From.IsZero() && f.To.IsZero()
+}
+
+func (f DeadLetterFilter) query() bson.M {
+	q := bson.M{"status": v2.TaskStatusDead}
+
+	if !f.AccountID.IsZero() {
+		q["accountId"] = f.AccountID
+	}
+	if !f.AgentID.IsZero() {
+		q["agentId"] = f.AgentID
+	}
+	if f.Action != "" {
+		q["action"] = f.Action
+	}
+	if f.ErrorText != "" {
+		q["lastError"] = bson.M{"$regex": regexp.QuoteMeta(f.ErrorText), "$options": "i"}
+	}
+
+	finished := bson.M{}
+	if !f.From.IsZero() {
+		finished["$gte"] = f.From
+	}
+	if !f.To.IsZero() {
+		finished["$lt"] = f.To
+	}
+	if len(finished) > 0 {
+		q["finishedAt"] = finished
+	}
+	return q
+}
+
+// ListDeadLetters returns one page of the dead tasks the filter selects, most
+// recently dead first, and how many it selects in all.
+func ListDeadLetters(f DeadLetterFilter, skip, limit int64) ([]v2.AgentTaskSchema, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	q := f.query()
+
+	total, err := collection().CountDocuments(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cur, err := collection().Find(ctx, q, options.Find().
+		SetSort(bson.D{{Key: "finishedAt", Value: -1}}).
+		SetSkip(skip).
+		SetLimit(limit))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tasks := make([]v2.AgentTaskSchema, 0)
+	if err := cur.All(ctx, &tasks); err != nil {
+		return nil, 0, err
+	}
+	return tasks, total, nil
+}
+
+func deadLetterIDs(ctx context.Context, q bson.M, limit int64) ([]bson.ObjectID, error) {
+	cur, err := collection().Find(ctx, q, options.Find().
+		SetProjection(bson.M{"_id": 1}).
+		SetSort(bson.D{{Key: "finishedAt", Value: 1}}).
+		SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		ID bson.ObjectID `bson:"_id"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	ids := make([]bson.ObjectID, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+	}
+	return ids, nil
+}
+
+// DeadLetterFailure is one task a bulk replay could not put back.
+type DeadLetterFailure struct {
+	TaskID bson.ObjectID
+	Error  string
+}
+
+// ReplayDeadLetters retries up to maxDeadLetterBulk of the selected tasks,
+// oldest first, each with a fresh attempt budget. A task whose action is
+// already queued again on its agent stays dead and is reported, exactly as a
+// single Retry would refuse it.
+func ReplayDeadLetters(f DeadLetterFilter, actor string) (int, []DeadLetterFailure, error) {
+	if f.isEmpty() {
+		return 0, nil, errEmptyDeadLetterFilter
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ids, err := deadLetterIDs(ctx, f.query(), maxDeadLetterBulk)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	replayed := 0
+	failures := make([]DeadLetterFailure, 0)
+	for _, id := range ids {
+		if err := Retry(id.Hex(), actor); err != nil {
+			failures = append(failures, DeadLetterFailure{TaskID: id, Error: err.Error()})
+			continue
+		}
+		replayed++
+	}
+	return replayed, failures, nil
+}
+
+// DiscardDeadLetters deletes up to maxDeadLetterBulk of the selected tasks and
+// their timelines now, rather than when finishedTTL would.
+func DiscardDeadLetters(f DeadLetterFilter) (int64, error) {
+	if f.isEmpty() {
+		return 0, errEmptyDeadLetterFilter
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	ids, err := deadLetterIDs(ctx, f.query(), maxDeadLetterBulk)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// Still matched on status: a task replayed since the Find is live again.
+	res, err := collection().DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}, "status": v2.TaskStatusDead})
+	if err != nil {
+		return 0, err
+	}
+
+	// Only the tasks that went keep their timelines from going with them; a
+	// replayed one is still there, and still needs its history.
+	remaining, err := existingIDs(ctx, ids)
+	if err != nil {
+		return res.DeletedCount, err
+	}
+	if removed := removedIDs(ids, remaining); len(removed) > 0 {
+		if _, err := eventCollection().DeleteMany(ctx, bson.M{"taskId": bson.M{"$in": removed}}); err != nil {
+			logger.GetErrorLogger().Printf("error discarding the timelines of dead tasks: %s", err.Error())
+		}
+	}
+	return res.DeletedCount, nil
+}
+
+func existingIDs(ctx context.Context, ids []bson.ObjectID) ([]bson.ObjectID, error) {
+	cur, err := collection().Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		ID bson.ObjectID `bson:"_id"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	existing := make([]bson.ObjectID, 0, len(rows))
+	for _, row := range rows {
+		existing = append(existing, row.ID)
+	}
+	return existing, nil
+}
+
+// removedIDs is the selected ids that are no longer among remaining.
+func removedIDs(selected, remaining []bson.ObjectID) []bson.ObjectID {
+	left := make(map[bson.ObjectID]bool, len(remaining))
+	for _, id := range remaining {
+		left[id] = true
+	}
+
+	removed := make([]bson.ObjectID, 0, len(selected))
+	for _, id := range selected {
+		if !left[id] {
+			removed = append(removed, id)
+		}
+	}
+	return removed
+}
+
+// deadLetterExport is what a post-mortem reads: the task as it died, and
+// everything that happened to it on the way.
+type deadLetterExport struct {
+	Task       v2.AgentTaskSchema `json:"task"`
+	Events     []TaskEvent        `json:"events"`
+	ExportedAt time.Time          `json:"exportedAt"`
+}
+
+func deadLetterObjectPath(task *v2.AgentTaskSchema) string {
+	return fmt.Sprintf("%s/deadletters/%s/%s.json", task.AccountID.Hex(), task.Action, task.ID.Hex())
+}
+
+// ExportDeadLetters writes up to maxDeadLetterBulk of the selected tasks that
+// have not been exported yet to object storage, one JSON document per task,
+// and returns how many it wrote.
+func ExportDeadLetters(f DeadLetterFilter) (int, error) {
+	if f.isEmpty() {
+		return 0, errEmptyDeadLetterFilter
+	}
+	return exportDeadLetters(f.query(), maxDeadLetterBulk, time.Time{})
+}
+
+// exportDeadLetters exports up to limit of the tasks q selects, stopping early
+// once deadline has passed; a zero deadline never stops it.
+func exportDeadLetters(q bson.M, limit int64, deadline time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	q["exportedAt"] = bson.M{"$exists": false}
+
+	cur, err := collection().Find(ctx, q, options.Find().
+		SetSort(bson.D{{Key: "finishedAt", Value: 1}}).
+		SetLimit(limit))
+	if err != nil {
+		return 0, err
+	}
+
+	tasks := make([]v2.AgentTaskSchema, 0)
+	if err := cur.All(ctx, &tasks); err != nil {
+		return 0, err
+	}
+
+	exported := 0
+	for idx := range tasks {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			break
+		}
+		if err := exportDeadLetter(&tasks[idx]); err != nil {
+			return exported, fmt.Errorf("error exporting dead task %s: %w", tasks[idx].ID.Hex(), err)
+		}
+		exported++
+	}
+	return exported, nil
+}
+
+func exportDeadLetter(task *v2.AgentTaskSchema) error {
+	events, err := ListEvents(task.ID.Hex())
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(deadLetterExport{Task: *task, Events: events, ExportedAt: time.Now()}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp("", "ssm-deadletter-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(b); err != nil {
+		tempFile.Close()
+		return err
+	}
+	tempFile.Close()
+
+	fileIdentity := types.StorageFileIdentity{
+		UUID:          bson.NewObjectID().Hex(),
+		FileName:      task.ID.Hex() + ".json",
+		LocalFilePath: tempFile.Name(),
+	}
+
+	objectURL, err := repositories.UploadAgentFile(fileIdentity, deadLetterObjectPath(task))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = collection().UpdateOne(ctx,
+		bson.M{"_id": task.ID},
+		bson.M{"$set": bson.M{"exportedAt": time.Now(), "exportUrl": objectURL}})
+	return err
+}
+
+// exportExpiringDeadLetters is the export sweep, run on a job of its own (see
+// InitAgentTaskService): when the deployment has opted in, every dead task is
+// exported within deadLetterExportLead of finishedTTL removing it, a small
+// batch per run.
+func exportExpiringDeadLetters() error {
+	if os.Getenv(deadLetterExportEnv) != "true" {
+		return nil
+	}
+
+	_, err := exportDeadLetters(bson.M{
+		"status":     v2.TaskStatusDead,
+		"finishedAt": bson.M{"$lt": time.Now().Add(deadLetterExportLead - finishedTTL)},
+	}, storageSweepBatch, time.Now().Add(storageSweepBudget))
+	return err
+}
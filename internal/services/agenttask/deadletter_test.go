@@ -0,0 +1,62 @@
+package agenttask
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestDeadLetterFilterOnlyEverSelectsDeadTasks(t *testing.T) {
+	q := DeadLetterFilter{}.query()
+	if q["status"] != "dead" {
+		t.Fatalf("expected the filter to select dead tasks, got %v", q["status"])
+	}
+	if len(q) != 1 {
+		t.Fatalf("expected an empty filter to add nothing else, got %v", q)
+	}
+}
+
+func TestDeadLetterFilterMatchesErrorTextLiterally(t *testing.T) {
+	q := DeadLetterFilter{ErrorText: "exit code (1)"}.query()
+
+	got := q["lastError"].(bson.M)
+	if got["$regex"] != `exit code \(1\)` || got["$options"] != "i" {
+		t.Fatalf("expected a quoted, case-insensitive match, got %v", got)
+	}
+}
+
+func TestDeadLetterFilterBoundsWhenTheTaskDied(t *testing.T) {
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	got := DeadLetterFilter{From: from, To: to}.query()["finishedAt"].(bson.M)
+	if got["$gte"] != from || got["$lt"] != to {
+		t.Fatalf("expected [from, to), got %v", got)
+	}
+}
+
+// A bulk operation with no filter would replay or delete every dead task in
+// the deployment.
+func TestBulkDeadLetterOperationsNeedAFilter(t *testing.T) {
+	if _, _, err := ReplayDeadLetters(DeadLetterFilter{}, "admin"); err != errEmptyDeadLetterFilter {
+		t.Fatalf("expected replay to refuse an empty filter, got %v", err)
+	}
+	if _, err := DiscardDeadLetters(DeadLetterFilter{}); err != errEmptyDeadLetterFilter {
+		t.Fatalf("expected discard to refuse an empty filter, got %v", err)
+	}
+	if _, err := ExportDeadLetters(DeadLetterFilter{}); err != errEmptyDeadLetterFilter {
+		t.Fatalf("expected export to refuse an empty filter, got %v", err)
+	}
+}
+
+// A task replayed between the Find and the delete is live again: it is not
+// deleted, and its timeline must not be either.
+func TestDiscardKeepsTheTimelineOfAReplayedTask(t *testing.T) {
+	deleted, replayed := bson.NewObjectID(), bson.NewObjectID()
+
+	removed := removedIDs([]bson.ObjectID{deleted, replayed}, []bson.ObjectID{replayed})
+	if len(removed) != 1 || removed[0] != deleted {
+		t.Fatalf("expected only the deleted task's timeline to go, got %v", removed)
+	}
+}
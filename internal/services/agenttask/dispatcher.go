@@ -2,12 +2,14 @@ package agenttask
 
 import (
 	"context"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
 const dispatchTick = 500 * time.Millisecond
@@ -25,11 +27,23 @@ var (
 	lifecycleMu sync.Mutex
 )
 
-// notifyEnqueued wakes the dispatcher immediately when the target agent's stream
-// lives on this replica. Otherwise the owning replica's tick picks the task up
-// within dispatchTick. The fast path is an optimization; the tick is what makes
-// it correct.
+// notifyEnqueued wakes whichever replica holds the target agent's stream: this
+// one directly, another through its change stream (see watchTasks) or, while
+// that is not running here, a signal (see signalOwner). The fast path is an
+// optimization; the owner's tick is what makes it correct.
 func notifyEnqueued(agentID bson.ObjectID) {
+	if registry.Has(agentID) {
+		wakeLocal(agentID)
+		return
+	}
+	if !streamHealthy.Load() {
+		signalOwner(agentID)
+	}
+}
+
+// wakeLocal wakes the dispatcher for an agent whose stream lives on this
+// replica, and does nothing for any other.
+func wakeLocal(agentID bson.ObjectID) {
 	if !registry.Has(agentID) {
 		return
 	}
@@ -66,20 +80,38 @@ func StartDispatcher() {
 		ticker := time.NewTicker(dispatchTick)
 		defer ticker.Stop()
 
+		// round only ever advances, so every account and every agent within it
+		// takes its turn at the head of a tick.
+		round := 0
+		var lastSweep time.Time
+
 		for {
 			select {
 			case agentID := <-w:
 				dispatchFor(agentID)
-			case <-ticker.C:
-				for _, agentID := range registry.ConnectedAgents() {
+			case now := <-ticker.C:
+				// With a healthy change stream the wakes arrive on w, and the walk
+				// is only a safety net; see streamSweepInterval.
+				if streamHealthy.Load() && now.Sub(lastSweep) < streamSweepInterval {
+					continue
+				}
+				lastSweep = now
+
+				for _, agentID := range fairOrder(registry.ConnectedByAccount(), round) {
 					dispatchFor(agentID)
 				}
+				round++
 			case <-done:
 				return
 			}
 		}
 	}()
 
+	if changeStreamsEnabled() {
+		go watchTasks(done)
+	}
+	go listenForSignals(done)
+
 	logger.GetDebugLogger().Println("Started agent task dispatcher")
 }
 
@@ -93,38 +125,136 @@ func StopDispatcher() {
 	logger.GetDebugLogger().Println("Stopped agent task dispatcher")
 }
 
-// serverRunning reports the agent's last-known SF process state. It is read
-// straight from the agent document rather than through the agent service, which
-// would be an import cycle.
-func serverRunning(agentID bson.ObjectID) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// fairOrder is the order one tick walks the connected agents in.
+//
+// A tick dispatches sequentially, two queries per agent, so with one account
+// owning hundreds of agents the agents walked last wait most of a tick behind
+// it. Map order made that arbitrary and let the big account land in front
+// every time. Instead the accounts take turns, one agent each, and the starting
+// account and each account's starting agent rotate with round, so no account
+// and no agent is permanently at the back.
+//
+// It is pure so the interleaving can be tested without a registry.
+func fairOrder(byAccount map[bson.ObjectID][]bson.ObjectID, round int) []bson.ObjectID {
+	if len(byAccount) == 0 {
+		return nil
+	}
+
+	accounts := make([]bson.ObjectID, 0, len(byAccount))
+	total := 0
+	for accountID, agents := range byAccount {
+		accounts = append(accounts, accountID)
+		total += len(agents)
+	}
+	slices.SortFunc(accounts, compareObjectIDs)
+
+	// The head account advances every round; each account's own starting agent
+	// advances once per full cycle of accounts, so over enough rounds every
+	// agent leads a tick.
+	queues := make([][]bson.ObjectID, len(accounts))
+	for idx := range accounts {
+		queues[idx] = rotate(byAccount[accounts[(idx+round)%len(accounts)]], round/len(accounts))
+	}
+
+	out := make([]bson.ObjectID, 0, total)
+	for len(out) < total {
+		for idx := range queues {
+			if len(queues[idx]) == 0 {
+				continue
+			}
+			out = append(out, queues[idx][0])
+			queues[idx] = queues[idx][1:]
+		}
+	}
+	return out
+}
+
+// rotate returns a sorted copy of ids started at position k (mod len).
+func rotate(ids []bson.ObjectID, k int) []bson.ObjectID {
+	sorted := slices.Clone(ids)
+	slices.SortFunc(sorted, compareObjectIDs)
 
-	var doc struct {
-		Status struct {
-			Running bool `bson:"running"`
-		} `bson:"status"`
+	if len(sorted) == 0 {
+		return sorted
 	}
+	k %= len(sorted)
+	return append(sorted[k:], sorted[:k]...)
+}
+
+func compareObjectIDs(a, b bson.ObjectID) int {
+	return slices.Compare(a[:], b[:])
+}
+
+// agentState is what claiming for an agent needs to know about it: whether its
+// server is running, its maintenance windows and what it can run. It is read
+// from the agent document in one go, straight from the collection rather than
+// through the agent service, which would be an import cycle.
+type agentState struct {
+	ServerRunning bool
+	Windows       []MaintenanceWindow
+	// Capabilities is nil when they could not be read.
+	Capabilities *AgentCapabilities
+}
+
+type agentStateDoc struct {
+	agentCapabilitiesDoc `bson:",inline"`
+	Status               struct {
+		Running bool `bson:"running"`
+	} `bson:"status"`
+	Windows []MaintenanceWindow `bson:"maintenanceWindows"`
+}
+
+var agentStateProjection = bson.M{
+	"status.running": 1, "maintenanceWindows": 1,
+	"config.version": 1, "config.platform": 1, "supportedActions": 1, "capabilities": 1,
+}
 
+// readAgentState reads the agent's state. An agent that cannot be read is
+// taken to have its server running and no window open, the conservative
+// answers: a gated task waits rather than running against a live server or at
+// a time nobody chose. Its capabilities are unknown, so it claims as it did
+// before the handshake existed and fails what it cannot run.
+func readAgentState(agentID bson.ObjectID) agentState {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var doc agentStateDoc
 	err := repositories.GetMongoClient().
 		GetCollection("agents").
-		FindOne(ctx, bson.M{"_id": agentID}).
+		FindOne(ctx, bson.M{"_id": agentID}, options.FindOne().SetProjection(agentStateProjection)).
 		Decode(&doc)
 	if err != nil {
-		// Unknown state. Assume running, which is the conservative answer: a gated
-		// task waits rather than running against a live server.
-		logger.GetErrorLogger().Printf("error reading server state for agent %s: %s", agentID.Hex(), err.Error())
-		return true
+		logger.GetErrorLogger().Printf("error reading state for agent %s: %s", agentID.Hex(), err.Error())
+		return agentState{ServerRunning: true}
+	}
+
+	capabilities := doc.agentCapabilitiesDoc.capabilities()
+	return agentState{
+		ServerRunning: doc.Status.Running,
+		Windows:       doc.Windows,
+		Capabilities:  &capabilities,
 	}
+}
 
-	return doc.Status.Running
+// inWindow is the claim input for requiresMaintenanceWindow.
+func (s agentState) inWindow(now time.Time) bool {
+	return inAnyWindow(s.Windows, now)
+}
+
+// blockedActions is the claim input for the agent's capabilities.
+func (s agentState) blockedActions() []string {
+	if s.Capabilities == nil {
+		return nil
+	}
+	return s.Capabilities.blockedActions()
 }
 
 // dispatchFor claims at most one task for the agent and pushes it. Claim returns
 // (nil, nil) when the agent is busy or nothing is due, so this is safe to call
 // as often as we like.
 func dispatchFor(agentID bson.ObjectID) {
-	task, err := Claim(agentID, serverRunning(agentID))
+	state := readAgentState(agentID)
+	task, err := Claim(agentID, state.ServerRunning, state.inWindow(time.Now()), state.blockedActions())
 	if err != nil {
 		logger.GetErrorLogger().Printf("error claiming task for agent %s: %s", agentID.Hex(), err.Error())
 		return
@@ -142,6 +272,10 @@ func dispatchFor(agentID bson.ObjectID) {
 		MaxAttempts:  int32(task.MaxAttempts),
 		LeaseSeconds: int32(LeaseDuration.Seconds()),
 	}
+	// Claim set the lease from the task's policy; tell the agent the same.
+	if task.LeaseExpiresAt != nil && task.StartedAt != nil {
+		a.LeaseSeconds = int32(task.LeaseExpiresAt.Sub(*task.StartedAt).Seconds())
+	}
 
 	if registry.send(agentID, a) {
 		logger.GetDebugLogger().Printf("dispatched task %s (%s) to agent %s", a.TaskID, a.Action, agentID.Hex())
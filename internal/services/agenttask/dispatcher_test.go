@@ -0,0 +1,99 @@
+package agenttask
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestFairOrderInterleavesAccounts(t *testing.T) {
+	big, small := bson.NewObjectID(), bson.NewObjectID()
+	bigAgents := []bson.ObjectID{bson.NewObjectID(), bson.NewObjectID(), bson.NewObjectID(), bson.NewObjectID()}
+	smallAgent := bson.NewObjectID()
+
+	order := fairOrder(map[bson.ObjectID][]bson.ObjectID{
+		big:   bigAgents,
+		small: {smallAgent},
+	}, 0)
+
+	if len(order) != 5 {
+		t.Fatalf("expected every connected agent exactly once, got %d", len(order))
+	}
+
+	pos := -1
+	for idx, id := range order {
+		if id == smallAgent {
+			pos = idx
+		}
+	}
+	if pos > 1 {
+		t.Fatalf("expected the small account's agent within the first round, got position %d", pos)
+	}
+}
+
+func TestFairOrderRotatesTheHeadOfTheTick(t *testing.T) {
+	a, b := bson.NewObjectID(), bson.NewObjectID()
+	byAccount := map[bson.ObjectID][]bson.ObjectID{
+		a: {bson.NewObjectID(), bson.NewObjectID()},
+		b: {bson.NewObjectID(), bson.NewObjectID()},
+	}
+
+	heads := map[bson.ObjectID]bool{}
+	for round := 0; round < 4; round++ {
+		heads[fairOrder(byAccount, round)[0]] = true
+	}
+
+	if len(heads) != 4 {
+		t.Fatalf("expected every agent to lead a tick within four rounds, got %d distinct heads", len(heads))
+	}
+}
+
+func TestFairOrderEmpty(t *testing.T) {
+	if got := fairOrder(nil, 3); len(got) != 0 {
+		t.Fatalf("expected nothing to dispatch, got %v", got)
+	}
+}
+
+// A signal or change for an agent whose stream another replica holds must not
+// queue a dispatch here: only the owner can deliver to it.
+func TestWakeLocalIgnoresAgentsOnOtherReplicas(t *testing.T) {
+	lifecycleMu.Lock()
+	saved := wake
+	wake = make(chan bson.ObjectID, 1)
+	w := wake
+	lifecycleMu.Unlock()
+	defer func() {
+		lifecycleMu.Lock()
+		wake = saved
+		lifecycleMu.Unlock()
+	}()
+
+	wakeLocal(bson.NewObjectID())
+
+	select {
+	case id := <-w:
+		t.Fatalf("expected no wake for a remote agent, got %s", id.Hex())
+	default:
+	}
+
+	agentID := bson.NewObjectID()
+	registry.mu.Lock()
+	registry.streams[agentID] = &streamEntry{ch: make(chan Assignment, 1)}
+	registry.mu.Unlock()
+	defer func() {
+		registry.mu.Lock()
+		delete(registry.streams, agentID)
+		registry.mu.Unlock()
+	}()
+
+	wakeLocal(agentID)
+
+	select {
+	case id := <-w:
+		if id != agentID {
+			t.Fatalf("expected a wake for %s, got %s", agentID.Hex(), id.Hex())
+		}
+	default:
+		t.Fatal("expected a wake for an agent whose stream is held here")
+	}
+}
@@ -0,0 +1,284 @@
+package agenttask
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const eventCollectionName = "agenttaskevents"
+
+const (
+	// timelineSettle is how long after a task finishes its timeline is given
+	// an expiry. The events of the transition that finished it are recorded
+	// just after it, so they are in by then.
+	timelineSettle = time.Minute
+
+	// timelineExpiryBatch bounds how many tasks' timelines one reaper run
+	// stamps.
+	timelineExpiryBatch = 200
+
+	// timelineFallbackTTL is how long an event is kept when its task is never
+	// stamped: one whose row finishedTTL removed before the reaper got to it,
+	// or that is still unfinished this long after the event.
+	timelineFallbackTTL = 90 * 24 * time.Hour
+)
+
+// Task event types, in roughly the order a task's timeline reads.
+const (
+	EventEnqueued         = "enqueued"
+	EventClaimed          = "claimed"
+	EventLeaseRenewed     = "lease_renewed"
+	EventProgress         = "progress"
+	EventCompleted        = "completed"
+	EventFailed           = "failed"
+	EventDead             = "dead"
+	EventReleased         = "released"
+	EventReaped           = "reaped"
+	EventCancelRequested  = "cancel_requested"
+	EventCancelled        = "cancelled"
+	EventCascaded         = "cascaded"
+	EventOrphanReleased   = "orphan_released"
+	EventRetried          = "retried"
+	EventAwaitingApproval = "awaiting_approval"
+	EventApproved         = "approved"
+	EventRejected         = "rejected"
+	EventApprovalExpired  = "approval_expired"
+)
+
+// replicaName identifies this process in the timeline, so "which replica
+// claimed it" has an answer a human can match against the deployment.
+var replicaName, _ = os.Hostname()
+
+// TaskEvent is one entry in a task's append-only timeline. The task row keeps
+// only its current state; this is what happened on the way there, including on
+// attempts whose lastError has since been overwritten.
+//
+// Attempt is the task's attempt count when the event happened, where the writer
+// knows it. Actor is who asked, for the events a person causes (cancel, retry);
+// ParentID is the parent whose terminal transition caused a cascaded event.
+// ExpiresAt is a fallback until the task finishes; see eventExpiry.
+type TaskEvent struct {
+	ID         bson.ObjectID  `bson:"_id"`
+	TaskID     bson.ObjectID  `bson:"taskId"`
+	Type       string         `bson:"type"`
+	Attempt    int            `bson:"attempt,omitempty"`
+	Replica    string         `bson:"replica"`
+	LeaseToken string         `bson:"leaseToken,omitempty"`
+	Message    string         `bson:"message,omitempty"`
+	Actor      string         `bson:"actor,omitempty"`
+	ParentID   *bson.ObjectID `bson:"parentId,omitempty"`
+	CreatedAt  time.Time      `bson:"createdAt"`
+	ExpiresAt  *time.Time     `bson:"expiresAt,omitempty"`
+}
+
+func eventCollection() *mongo.Collection {
+	return repositories.GetMongoClient().GetCollection(eventCollectionName)
+}
+
+// EnsureEventIndexes creates the timeline's read index and its expiry. Events
+// expire with the task they describe, finishedTTL after it finished, so a task
+// that took longer than that to finish keeps its whole timeline. Events
+// written before they carried an expiry are given the fallback one.
+func EnsureEventIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// events_ttl expired events finishedTTL after they were written, which
+	// took the start of a long task's timeline before the task had finished.
+	// The events it covered keep that expiry, so the timelines of tasks that
+	// are already gone still go.
+	var cmdErr mongo.CommandError
+	err := eventCollection().Indexes().DropOne(ctx, "events_ttl")
+	switch {
+	case err == nil:
+		if _, err := eventCollection().UpdateMany(ctx,
+			bson.M{"expiresAt": bson.M{"$exists": false}},
+			mongo.Pipeline{{{Key: "$set", Value: bson.M{
+				"expiresAt": bson.M{"$add": bson.A{"$createdAt", finishedTTL.Milliseconds()}},
+			}}}}); err != nil {
+			return err
+		}
+	case errors.As(err, &cmdErr) && (cmdErr.Name == "IndexNotFound" || cmdErr.Name == "NamespaceNotFound"):
+	default:
+		return err
+	}
+	if _, err := eventCollection().UpdateMany(ctx,
+		bson.M{"expiresAt": bson.M{"$exists": false}},
+		fallbackExpiry()); err != nil {
+		return err
+	}
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "taskId", Value: 1}, {Key: "createdAt", Value: 1}},
+			Options: options.Index().SetName("by_task"),
+		},
+		{
+			Keys: bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().
+				SetName("events_expiry").
+				SetExpireAfterSeconds(0),
+		},
+	}
+
+	if _, err := eventCollection().Indexes().CreateMany(ctx, indexes); err != nil {
+		return err
+	}
+
+	logger.GetDebugLogger().Println("Ensured agenttaskevents indexes")
+	return nil
+}
+
+// recordEvent appends ev to its task's timeline.
+//
+// It is best effort and never fails the caller: the timeline is a diagnostic
+// record of transitions that have ALREADY happened, so a lost event must not
+// turn a completed claim or a landed cascade into an error the caller retries.
+func recordEvent(ev TaskEvent) {
+	ev.ID = bson.NewObjectID()
+	ev.Replica = replicaName
+	if ev.CreatedAt.IsZero() {
+		ev.CreatedAt = time.Now()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// An event recorded after its task's timeline was stamped takes the same
+	// expiry; the stamp has already been and will not come back for it.
+	var task struct {
+		EventsExpireAt *time.Time `bson:"eventsExpireAt"`
+	}
+	if err := collection().FindOne(ctx, bson.M{"_id": ev.TaskID},
+		options.FindOne().SetProjection(bson.M{"eventsExpireAt": 1})).Decode(&task); err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		logger.GetErrorLogger().Printf("error reading the timeline expiry of task %s: %s", ev.TaskID.Hex(), err.Error())
+	}
+	expiresAt := eventExpiry(ev.CreatedAt, task.EventsExpireAt)
+	ev.ExpiresAt = &expiresAt
+
+	if _, err := eventCollection().InsertOne(ctx, ev); err != nil {
+		logger.GetErrorLogger().Printf("error recording %s event for task %s: %s", ev.Type, ev.TaskID.Hex(), err.Error())
+	}
+}
+
+// eventExpiry is when an event written at createdAt expires: with its task's
+// timeline once that has been stamped, and timelineFallbackTTL after it was
+// written until then.
+func eventExpiry(createdAt time.Time, stamped *time.Time) time.Time {
+	if stamped != nil {
+		return *stamped
+	}
+	return createdAt.Add(timelineFallbackTTL)
+}
+
+// fallbackExpiry is the pipeline update that puts events back on
+// timelineFallbackTTL.
+func fallbackExpiry() mongo.Pipeline {
+	return mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"expiresAt": bson.M{"$add": bson.A{"$createdAt", timelineFallbackTTL.Milliseconds()}},
+	}}}}
+}
+
+// expireFinishedTimelines gives each finished task's timeline the task's own
+// expiry, finishedTTL after it finished, a batch of tasks per run. The task is
+// marked with it so it is not stamped again, and so events written after it
+// take the same expiry. A task the reaper falls too far behind on for this to
+// happen before finishedTTL removes it leaves its events on the fallback.
+func expireFinishedTimelines() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cur, err := collection().Find(ctx, bson.M{
+		"finishedAt":     bson.M{"$lt": time.Now().Add(-timelineSettle)},
+		"eventsExpireAt": bson.M{"$exists": false},
+	}, options.Find().
+		SetProjection(bson.M{"finishedAt": 1}).
+		SetSort(bson.D{{Key: "finishedAt", Value: 1}}).
+		SetLimit(timelineExpiryBatch))
+	if err != nil {
+		return err
+	}
+
+	var finished []struct {
+		ID         bson.ObjectID `bson:"_id"`
+		FinishedAt time.Time     `bson:"finishedAt"`
+	}
+	if err := cur.All(ctx, &finished); err != nil {
+		return err
+	}
+
+	for _, task := range finished {
+		expiresAt := task.FinishedAt.Add(finishedTTL)
+
+		// Fenced on finishedAt: a task retried since the Find is live again
+		// and its timeline must stay.
+		res, err := collection().UpdateOne(ctx,
+			bson.M{"_id": task.ID, "finishedAt": task.FinishedAt},
+			bson.M{"$set": bson.M{"eventsExpireAt": expiresAt}})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			continue
+		}
+		if _, err := eventCollection().UpdateMany(ctx,
+			bson.M{"taskId": task.ID},
+			bson.M{"$set": bson.M{"expiresAt": expiresAt}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepTimeline puts a retried task's timeline back on the fallback expiry; it
+// is given the task's own when the task finishes again. Like recordEvent it is
+// best effort.
+func keepTimeline(ctx context.Context, taskID bson.ObjectID) {
+	if _, err := eventCollection().UpdateMany(ctx,
+		bson.M{"taskId": taskID},
+		fallbackExpiry()); err != nil {
+		logger.GetErrorLogger().Printf("error keeping the timeline of retried task %s: %s", taskID.Hex(), err.Error())
+	}
+}
+
+// recordEventHex is recordEvent for the callers that only hold the task's hex
+// id, as every agent-facing entry point does.
+func recordEventHex(taskID string, ev TaskEvent) {
+	oid, err := bson.ObjectIDFromHex(taskID)
+	if err != nil {
+		return
+	}
+	ev.TaskID = oid
+	recordEvent(ev)
+}
+
+// ListEvents returns a task's timeline, oldest first.
+func ListEvents(taskID string) ([]TaskEvent, error) {
+	oid, err := bson.ObjectIDFromHex(taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}})
+	cur, err := eventCollection().Find(ctx, bson.M{"taskId": oid}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]TaskEvent, 0)
+	if err := cur.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,21 @@
+package agenttask
+
+import (
+	"testing"
+	"time"
+)
+
+// An event written after its task's timeline was stamped takes the stamp; one
+// written before falls back to its own expiry, so it goes even if the stamp
+// never comes.
+func TestEventExpiryFollowsTheStamp(t *testing.T) {
+	createdAt := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	stamped := createdAt.Add(-time.Hour).Add(finishedTTL)
+
+	if got := eventExpiry(createdAt, &stamped); !got.Equal(stamped) {
+		t.Fatalf("expected the task's expiry %s, got %s", stamped, got)
+	}
+	if got := eventExpiry(createdAt, nil); !got.Equal(createdAt.Add(timelineFallbackTTL)) {
+		t.Fatalf("expected the fallback expiry, got %s", got)
+	}
+}
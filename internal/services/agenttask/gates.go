@@ -0,0 +1,173 @@
+package agenttask
+
+import (
+	"context"
+	"errors"
+
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// A task waits on its parents through exactly one of three fields:
+//
+//   - dependsOn:    one parent. The original gate, and still what agentmod's
+//     stop -> sync -> start chain uses.
+//   - dependsOnAll: a set; claimable once EVERY parent has completed. Each
+//     completion takes its parent out of the set and the last one removes the
+//     field.
+//   - dependsOnAny: a set; claimable as soon as ANY parent completes, which
+//     removes the field outright.
+//
+// claimFilter requires all three to be absent, so "gated" is always "one of
+// these fields exists" and a released task carries none of them. Mixing kinds on
+// one task is rejected rather than given a meaning: the cascade rule stays one
+// rule per field.
+var errMixedGates = errors.New("a task can depend on dependsOn, dependsOnAll or dependsOnAny, not a mix")
+
+func (o EnqueueOpts) validateGate() error {
+	kinds := 0
+	if o.DependsOn != nil {
+		kinds++
+	}
+	if len(o.DependsOnAll) > 0 {
+		kinds++
+	}
+	if len(o.DependsOnAny) > 0 {
+		kinds++
+	}
+	if kinds > 1 {
+		return errMixedGates
+	}
+	return nil
+}
+
+// Parents are matched by _id alone, so a gate may point at a task on ANOTHER
+// agent ("copy the save off A, then load it on B"). Nothing in the cascade is
+// scoped to one agent's queue; only the account is a boundary, and
+// checkParentAccount enforces it.
+var errForeignParent = errors.New("a task can only depend on tasks in its own account")
+
+// parents is every task this gate waits on, whichever field carries it.
+func (o EnqueueOpts) parents() []bson.ObjectID {
+	out := make([]bson.ObjectID, 0, len(o.DependsOnAll)+len(o.DependsOnAny)+1)
+	if o.DependsOn != nil {
+		out = append(out, *o.DependsOn)
+	}
+	out = append(out, o.DependsOnAll...)
+	return append(out, o.DependsOnAny...)
+}
+
+// gatedOn matches the tasks waiting on parentID through any of the given gate
+// fields.
+func gatedOn(parentID bson.ObjectID, fields ...string) bson.A {
+	or := make(bson.A, 0, len(fields))
+	for _, field := range fields {
+		or = append(or, bson.M{field: parentID})
+	}
+	return or
+}
+
+// withoutParent is the aggregation expression for a parent set with parentID
+// taken out: the parents that are left, or $$REMOVE once there are none, so the
+// emptied gate disappears instead of lingering as [] and failing claimFilter's
+// $exists. A task that never had the field gets $$REMOVE too, which leaves it
+// without one.
+func withoutParent(field string, parentID bson.ObjectID) bson.M {
+	rest := bson.M{"$filter": bson.M{
+		"input": "$" + field,
+		"cond":  bson.M{"$ne": bson.A{"$$this", parentID}},
+	}}
+	return bson.M{"$cond": bson.A{
+		bson.M{"$gt": bson.A{bson.M{"$size": bson.M{"$ifNull": bson.A{rest, bson.A{}}}}, 0}},
+		rest,
+		"$$REMOVE",
+	}}
+}
+
+// checkParentAccount rejects a gate onto an existing task that belongs to
+// another account. A parent that does not exist yet passes: a pre-assigned _id
+// (see EnqueueOpts) is gated onto before it is inserted, and the caller that
+// inserts it is the one deciding its account.
+func checkParentAccount(ctx context.Context, accountID bson.ObjectID, parents []bson.ObjectID) error {
+	if len(parents) == 0 {
+		return nil
+	}
+
+	n, err := collection().CountDocuments(ctx, bson.M{
+		"_id":       bson.M{"$in": parents},
+		"accountId": bson.M{"$ne": accountID},
+	}, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errForeignParent
+	}
+	return nil
+}
+
+// gatedChild is a task waiting on a parent, as much of it as a cascade needs.
+type gatedChild struct {
+	ID      bson.ObjectID `bson:"_id"`
+	AgentID bson.ObjectID `bson:"agentId"`
+}
+
+// gatedChildren is every active task waiting on parentID. A cascade must wake
+// all of their agents, not just the parent's own, once gates can cross agents,
+// and records the cascade on each child's timeline.
+func gatedChildren(ctx context.Context, parentID bson.ObjectID) ([]gatedChild, error) {
+	cur, err := collection().Find(ctx, bson.M{
+		"$or":    gatedOn(parentID, "dependsOn", "dependsOnAll", "dependsOnAny"),
+		"active": bson.M{"$exists": true},
+	}, options.Find().SetProjection(bson.M{"_id": 1, "agentId": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	children := make([]gatedChild, 0)
+	if err := cur.All(ctx, &children); err != nil {
+		return nil, err
+	}
+	return children, nil
+}
+
+// settleFinishedParents re-runs the cascade for any of the parents that had
+// already finished when a child was gated onto them.
+//
+// A parent cascades its children at the moment it goes terminal, so a child
+// inserted after that moment would wait on it forever. Checking AFTER the
+// child's write closes the gap from both sides: a parent that finishes later
+// sees the child in its own cascade, and one that finished earlier is found
+// here. The cascade is idempotent, so both happening is harmless.
+func settleFinishedParents(ctx context.Context, parents []bson.ObjectID) error {
+	if len(parents) == 0 {
+		return nil
+	}
+
+	cur, err := collection().Find(ctx, bson.M{
+		"_id": bson.M{"$in": parents},
+		"status": bson.M{"$in": bson.A{
+			v2.TaskStatusCompleted, v2.TaskStatusDead, v2.TaskStatusCancelled,
+		}},
+	}, options.Find().SetProjection(bson.M{"_id": 1, "agentId": 1, "status": 1}))
+	if err != nil {
+		return err
+	}
+
+	var finished []struct {
+		ID      bson.ObjectID `bson:"_id"`
+		AgentID bson.ObjectID `bson:"agentId"`
+		Status  string        `bson:"status"`
+	}
+	if err := cur.All(ctx, &finished); err != nil {
+		return err
+	}
+
+	for _, parent := range finished {
+		if err := cascadeChildren(ctx, parent.ID, parent.Status, parent.AgentID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package agenttask
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const maxMaintenanceWindows = 14
+
+// MaintenanceWindow is a daily stretch of local time in which disruptive work
+// may run on an agent: a task carrying requiresMaintenanceWindow is only
+// claimed inside one.
+//
+// Start and End are "HH:MM" in TimeZone (UTC when empty). A window whose End
+// is not after its Start runs past midnight, and Days are the days it OPENS on,
+// so {Days: [Sat], Start: 23:00, End: 02:00} covers Saturday night into Sunday
+// morning. No Days means every day.
+type MaintenanceWindow struct {
+	Days     []time.Weekday `bson:"days,omitempty" json:"days,omitempty"`
+	Start    string         `bson:"start" json:"start"`
+	End      string         `bson:"end" json:"end"`
+	TimeZone string         `bson:"timeZone,omitempty" json:"timeZone,omitempty"`
+}
+
+// clockMinutes parses "HH:MM" into minutes past midnight.
+func clockMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w MaintenanceWindow) location() (*time.Location, error) {
+	if w.TimeZone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", w.TimeZone)
+	}
+	return loc, nil
+}
+
+func (w MaintenanceWindow) validate() error {
+	start, err := clockMinutes(w.Start)
+	if err != nil {
+		return err
+	}
+	end, err := clockMinutes(w.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return errors.New("a maintenance window must not start and end at the same time")
+	}
+	for _, d := range w.Days {
+		if d < time.Sunday || d > time.Saturday {
+			return fmt.Errorf("invalid day %d", d)
+		}
+	}
+	_, err = w.location()
+	return err
+}
+
+// ValidateMaintenanceWindows checks a whole set before it is stored on an
+// agent.
+func ValidateMaintenanceWindows(windows []MaintenanceWindow) error {
+	if len(windows) > maxMaintenanceWindows {
+		return fmt.Errorf("an agent can have at most %d maintenance windows", maxMaintenanceWindows)
+	}
+	for _, w := range windows {
+		if err := w.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w MaintenanceWindow) opensOn(d time.Weekday) bool {
+	return len(w.Days) == 0 || slices.Contains(w.Days, d)
+}
+
+// contains reports whether t falls inside the window. A window that does not
+// validate contains nothing.
+func (w MaintenanceWindow) contains(t time.Time) bool {
+	start, err := clockMinutes(w.Start)
+	if err != nil {
+		return false
+	}
+	end, err := clockMinutes(w.End)
+	if err != nil {
+		return false
+	}
+	loc, err := w.location()
+	if err != nil {
+		return false
+	}
+
+	local := t.In(loc)
+	now := local.Hour()*60 + local.Minute()
+
+	if start < end {
+		return w.opensOn(local.Weekday()) && now >= start && now < end
+	}
+
+	// Past midnight: the evening half belongs to today's opening, the morning
+	// half to yesterday's.
+	if now >= start {
+		return w.opensOn(local.Weekday())
+	}
+	return now < end && w.opensOn(local.AddDate(0, 0, -1).Weekday())
+}
+
+// inAnyWindow reports whether t falls inside any of windows. No windows at all
+// is never inside one: a task waiting for a window on an agent that has none
+// waits until it is given one, and its deadline does not start until then.
+func inAnyWindow(windows []MaintenanceWindow, t time.Time) bool {
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaintenanceWindows returns the agent's windows. Like the rest of agentState,
+// they are read straight from the agent document.
+func MaintenanceWindows(agentID bson.ObjectID) ([]MaintenanceWindow, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var doc struct {
+		Windows []MaintenanceWindow `bson:"maintenanceWindows"`
+	}
+
+	err := repositories.GetMongoClient().
+		GetCollection("agents").
+		FindOne(ctx, bson.M{"_id": agentID}, options.FindOne().SetProjection(bson.M{"maintenanceWindows": 1})).
+		Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Windows, nil
+}
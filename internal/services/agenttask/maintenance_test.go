@@ -0,0 +1,90 @@
+package agenttask
+
+import (
+	"testing"
+	"time"
+)
+
+func at(day, clock string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", day+" "+clock)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestMaintenanceWindowContainsItsStretchOfTheDay(t *testing.T) {
+	w := MaintenanceWindow{Start: "03:00", End: "05:00"}
+
+	cases := map[string]bool{
+		"02:59": false,
+		"03:00": true,
+		"04:30": true,
+		"05:00": false,
+	}
+	for clock, want := range cases {
+		if got := w.contains(at("2026-10-14", clock)); got != want {
+			t.Fatalf("%s: expected %v, got %v", clock, want, got)
+		}
+	}
+}
+
+// Days are the days a window opens on, so the morning half of an overnight
+// window belongs to the day before.
+func TestOvernightWindowBelongsToTheDayItOpens(t *testing.T) {
+	w := MaintenanceWindow{Days: []time.Weekday{time.Saturday}, Start: "23:00", End: "02:00"}
+
+	// 2026-10-17 is a Saturday.
+	if !w.contains(at("2026-10-17", "23:30")) {
+		t.Fatal("expected Saturday night to be inside the window")
+	}
+	if !w.contains(at("2026-10-18", "01:30")) {
+		t.Fatal("expected early Sunday to be inside Saturday's window")
+	}
+	if w.contains(at("2026-10-18", "23:30")) {
+		t.Fatal("expected Sunday night to be outside the window")
+	}
+	if w.contains(at("2026-10-17", "01:30")) {
+		t.Fatal("expected early Saturday to belong to Friday, which has no window")
+	}
+}
+
+func TestMaintenanceWindowIsReadInItsTimeZone(t *testing.T) {
+	w := MaintenanceWindow{Start: "03:00", End: "05:00", TimeZone: "America/New_York"}
+
+	// 03:30 in New York is 07:30 UTC in October.
+	if !w.contains(at("2026-10-14", "07:30")) {
+		t.Fatal("expected 07:30 UTC to be 03:30 in New York")
+	}
+	if w.contains(at("2026-10-14", "03:30")) {
+		t.Fatal("expected 03:30 UTC to be outside a New York window")
+	}
+}
+
+func TestNoWindowsIsNeverInside(t *testing.T) {
+	if inAnyWindow(nil, time.Now()) {
+		t.Fatal("expected an agent without windows never to be in one")
+	}
+}
+
+func TestValidateMaintenanceWindows(t *testing.T) {
+	ok := []MaintenanceWindow{
+		{Start: "03:00", End: "05:00"},
+		{Days: []time.Weekday{time.Monday}, Start: "22:00", End: "01:00", TimeZone: "Europe/London"},
+	}
+	if err := ValidateMaintenanceWindows(ok); err != nil {
+		t.Fatalf("expected the windows to be accepted, got %s", err)
+	}
+
+	bad := []MaintenanceWindow{
+		{Start: "3am", End: "05:00"},
+		{Start: "03:00", End: "03:00"},
+		{Start: "03:00", End: "05:00", TimeZone: "Mars/Olympus"},
+		{Days: []time.Weekday{7}, Start: "03:00", End: "05:00"},
+	}
+	for _, w := range bad {
+		if err := ValidateMaintenanceWindows([]MaintenanceWindow{w}); err == nil {
+			t.Fatalf("expected %+v to be rejected", w)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package agenttask
+
+import (
+	"context"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/metrics"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// The queue's metrics. Counters and histograms count what THIS replica did;
+// the gauges read the whole collection, so every replica reports the same
+// depth and an alert should take the max rather than the sum.
+var (
+	enqueuedTotal = metrics.NewCounterVec("agenttask_enqueued_total",
+		"Tasks inserted by Enqueue.", "action")
+	claimedTotal = metrics.NewCounterVec("agenttask_claimed_total",
+		"Tasks claimed for an agent.", "action")
+	claimLatency = metrics.NewHistogramVec("agenttask_claim_latency_seconds",
+		"Time from a task becoming claimable to its claim. Tasks gated on a stopped server or a maintenance window are not counted.", nil, "action")
+	completedTotal = metrics.NewCounterVec("agenttask_completed_total",
+		"Tasks the agent reported completed.", "action")
+	runDuration = metrics.NewHistogramVec("agenttask_run_duration_seconds",
+		"Time from claim to completion of a completed task.", nil, "action")
+	failedTotal = metrics.NewCounterVec("agenttask_failed_total",
+		"Failures the agent reported, by what became of the task.", "action", "outcome")
+	leasesReapedTotal = metrics.NewCounterVec("agenttask_leases_reaped_total",
+		"Running tasks whose lease expired, by what became of the task.", "action", "outcome")
+	orphanedGatesTotal = metrics.NewCounterVec("agenttask_orphaned_gates_released_total",
+		"Pending tasks whose parents resolved to no task.", "action")
+
+	_ = metrics.NewGaugeFunc("agenttask_queue_depth",
+		"Active tasks, by action and status.", collectQueueDepth, "action", "status")
+	_ = metrics.NewGaugeFunc("agenttask_oldest_due_seconds",
+		"Age of the longest-waiting pending task that is due, by action. A value that only grows is a stuck agent.",
+		collectOldestDue, "action")
+)
+
+// Outcome labels for failedTotal and leasesReapedTotal.
+const (
+	outcomeRetried   = "retried"
+	outcomeDead      = "dead"
+	outcomeCancelled = "cancelled"
+)
+
+func collectQueueDepth() ([]metrics.Sample, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cur, err := collection().Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": bson.M{"$in": bson.A{v2.TaskStatusPending, v2.TaskStatusRunning}}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"action": "$action", "status": "$status"},
+			"n":   bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		ID struct {
+			Action string `bson:"action"`
+			Status string `bson:"status"`
+		} `bson:"_id"`
+		N int `bson:"n"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	out := make([]metrics.Sample, 0, len(rows))
+	for _, row := range rows {
+		out = append(out, metrics.Sample{Labels: []string{row.ID.Action, row.ID.Status}, Value: float64(row.N)})
+	}
+	return out, nil
+}
+
+// collectOldestDue only counts ungated tasks: one waiting on a parent, a
+// stopped server, a window or an approval is waiting on purpose.
+func collectOldestDue() ([]metrics.Sample, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	cur, err := collection().Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"status":                    v2.TaskStatusPending,
+			"nextAttemptAt":             bson.M{"$lte": now},
+			"dependsOn":                 bson.M{"$exists": false},
+			"dependsOnAll":              bson.M{"$exists": false},
+			"dependsOnAny":              bson.M{"$exists": false},
+			"requiresServerStopped":     bson.M{"$ne": true},
+			"requiresMaintenanceWindow": bson.M{"$ne": true},
+			"requiresApproval":          bson.M{"$ne": true},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    "$action",
+			"oldest": bson.M{"$min": "$nextAttemptAt"},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Action string    `bson:"_id"`
+		Oldest time.Time `bson:"oldest"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	out := make([]metrics.Sample, 0, len(rows))
+	for _, row := range rows {
+		out = append(out, metrics.Sample{Labels: []string{row.Action}, Value: now.Sub(row.Oldest).Seconds()})
+	}
+	return out, nil
+}
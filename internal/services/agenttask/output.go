@@ -0,0 +1,233 @@
+package agenttask
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	// maxTaskResultBytes caps the JSON result an agent may complete a task
+	// with. A result is a summary for callers to branch on ("installed
+	// version 1.0.1"), not a transport for files: those are artifacts.
+	maxTaskResultBytes = 64 * 1024
+
+	// maxTaskArtifacts caps how many files one task may attach.
+	maxTaskArtifacts = 20
+
+	// artifactDeleteLead is how long before finishedTTL removes a task that
+	// its artifacts are deleted from storage, which the TTL index cannot do.
+	// It is shorter than deadLetterExportLead, so a dead task is exported
+	// while its artifacts are still there.
+	artifactDeleteLead = 12 * time.Hour
+)
+
+var (
+	errNotLeaseHolder   = errors.New("task is not running under this lease")
+	errTooManyArtifacts = fmt.Errorf("task already has %d artifacts", maxTaskArtifacts)
+)
+
+// TaskArtifact is a file an agent uploaded while running a task, through the
+// same AgentFileService transfer path as saves and backups.
+type TaskArtifact struct {
+	UUID       string    `bson:"uuid"`
+	FileName   string    `bson:"fileName"`
+	Size       int64     `bson:"size"`
+	ObjectPath string    `bson:"objectPath"`
+	FileURL    string    `bson:"fileUrl"`
+	CreatedAt  time.Time `bson:"createdAt"`
+}
+
+// TaskOutput is what a task produced: the JSON result it completed with and the
+// artifacts it attached. Like priority, these live with the queue rather than on
+// v2.AgentTaskSchema, so they are read through here.
+type TaskOutput struct {
+	ID        bson.ObjectID  `bson:"_id"`
+	Result    string         `bson:"result,omitempty"`
+	Artifacts []TaskArtifact `bson:"artifacts,omitempty"`
+}
+
+// validateResult accepts an empty result (a task with nothing to report) or a
+// JSON document within maxTaskResultBytes.
+func validateResult(result string) error {
+	if result == "" {
+		return nil
+	}
+	if len(result) > maxTaskResultBytes {
+		return fmt.Errorf("task result is %d bytes, over the %d byte limit", len(result), maxTaskResultBytes)
+	}
+	if !json.Valid([]byte(result)) {
+		return errors.New("task result must be valid JSON")
+	}
+	return nil
+}
+
+// GetOutput returns the result and artifacts of one task.
+func GetOutput(taskID string) (*TaskOutput, error) {
+	oid, err := bson.ObjectIDFromHex(taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	out := &TaskOutput{}
+	err = collection().FindOne(ctx, bson.M{"_id": oid},
+		options.FindOne().SetProjection(bson.M{"result": 1, "artifacts": 1})).Decode(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OutputsFor returns the outputs of many tasks at once, keyed by task id, for a
+// caller listing tasks. A task that produced nothing is simply absent.
+func OutputsFor(taskIDs []bson.ObjectID) (map[bson.ObjectID]TaskOutput, error) {
+	out := make(map[bson.ObjectID]TaskOutput)
+	if len(taskIDs) == 0 {
+		return out, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := collection().Find(ctx, bson.M{
+		"_id": bson.M{"$in": taskIDs},
+		"$or": bson.A{
+			bson.M{"result": bson.M{"$exists": true}},
+			bson.M{"artifacts": bson.M{"$exists": true}},
+		},
+	}, options.Find().SetProjection(bson.M{"result": 1, "artifacts": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := make([]TaskOutput, 0)
+	if err := cur.All(ctx, &outputs); err != nil {
+		return nil, err
+	}
+	for _, o := range outputs {
+		out[o.ID] = o
+	}
+	return out, nil
+}
+
+// CheckArtifactUpload reports whether agentID is running taskID under
+// leaseToken and the task has room for another artifact. The upload checks it
+// before storing anything, so a zombie agent's upload, or one over
+// maxTaskArtifacts, is refused before it costs a write to the bucket.
+// AttachArtifact checks both again, for an upload that raced another.
+func CheckArtifactUpload(taskID, leaseToken string, agentID bson.ObjectID) error {
+	filter, err := fenced(taskID, leaseToken)
+	if err != nil {
+		return err
+	}
+	filter["agentId"] = agentID
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var doc struct {
+		Artifacts []struct {
+			UUID string `bson:"uuid"`
+		} `bson:"artifacts"`
+	}
+	err = collection().FindOne(ctx, filter, options.FindOne().SetProjection(bson.M{"artifacts.uuid": 1})).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errNotLeaseHolder
+	}
+	if err != nil {
+		return err
+	}
+	if len(doc.Artifacts) >= maxTaskArtifacts {
+		return errTooManyArtifacts
+	}
+	return nil
+}
+
+// AttachArtifact records an uploaded file on the task. It is fenced like every
+// other lease-holding write, and refuses a task already at maxTaskArtifacts.
+func AttachArtifact(taskID, leaseToken string, agentID bson.ObjectID, artifact TaskArtifact) error {
+	filter, err := fenced(taskID, leaseToken)
+	if err != nil {
+		return err
+	}
+	filter["agentId"] = agentID
+	filter[fmt.Sprintf("artifacts.%d", maxTaskArtifacts-1)] = bson.M{"$exists": false}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := collection().UpdateOne(ctx, filter, bson.M{
+		"$push": bson.M{"artifacts": artifact},
+		"$set":  bson.M{"updatedAt": time.Now()},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("cannot attach artifact: %w, or it already has %d artifacts", errNotLeaseHolder, maxTaskArtifacts)
+	}
+	return nil
+}
+
+// deleteExpiringArtifacts deletes from storage the artifacts of tasks finishedTTL
+// is about to remove, and takes them off the task, a small batch per run. It
+// runs after the dead-letter export on the storage job.
+func deleteExpiringArtifacts() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := collection().Find(ctx, bson.M{
+		"finishedAt":  bson.M{"$lt": time.Now().Add(artifactDeleteLead - finishedTTL)},
+		"artifacts.0": bson.M{"$exists": true},
+	}, options.Find().
+		SetProjection(bson.M{"artifacts": 1}).
+		SetSort(bson.D{{Key: "finishedAt", Value: 1}}).
+		SetLimit(storageSweepBatch))
+	if err != nil {
+		return err
+	}
+
+	outputs := make([]TaskOutput, 0)
+	if err := cur.All(ctx, &outputs); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(storageSweepBudget)
+	for _, o := range outputs {
+		if time.Now().After(deadline) {
+			break
+		}
+
+		// A file that fails to delete keeps the task's record of it, so the
+		// next run tries again.
+		failed := false
+		for _, artifact := range o.Artifacts {
+			if err := repositories.DeleteAgentFile(artifact.ObjectPath); err != nil {
+				logger.GetErrorLogger().Printf("error deleting artifact %s of task %s: %s", artifact.ObjectPath, o.ID.Hex(), err.Error())
+				failed = true
+			}
+		}
+		if failed {
+			continue
+		}
+
+		updateCtx, updateCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := collection().UpdateOne(updateCtx, bson.M{"_id": o.ID}, bson.M{"$unset": bson.M{"artifacts": ""}})
+		updateCancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package agenttask
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateResult(t *testing.T) {
+	if err := validateResult(""); err != nil {
+		t.Fatalf("expected an empty result to mean 'nothing to report', got %s", err)
+	}
+	if err := validateResult(`{"installedVersion":"1.0.1"}`); err != nil {
+		t.Fatalf("expected a JSON document to be accepted, got %s", err)
+	}
+	if err := validateResult(`installed 1.0.1`); err == nil {
+		t.Fatal("expected a result that is not JSON to be rejected")
+	}
+
+	big := `"` + strings.Repeat("x", maxTaskResultBytes) + `"`
+	if err := validateResult(big); err == nil {
+		t.Fatal("expected a result over the size limit to be rejected")
+	}
+}
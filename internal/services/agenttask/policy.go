@@ -0,0 +1,305 @@
+package agenttask
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	policyCollectionName = "agenttaskpolicies"
+
+	baseBackoff = 5 * time.Second
+	maxBackoff  = 5 * time.Minute
+)
+
+// TaskPolicy is how the queue treats one action: how often it is retried, how
+// long it waits between attempts, how long a lease lasts and how long the task
+// may live in total.
+//
+// MaxAttempts and Lease are stamped on the task when it is enqueued, so a
+// policy change never alters a task already in flight. The backoff is read when
+// an attempt fails, and Deadline becomes the task's deadlineAt: past it the task
+// is no longer claimable and the reaper finishes it off.
+type TaskPolicy struct {
+	MaxAttempts int
+	BackoffBase time.Duration
+	BackoffCap  time.Duration
+	// Jitter spreads each backoff by up to this fraction either way, so a fleet
+	// of agents failing together does not retry together. 0 is exact.
+	Jitter float64
+	// Deadline is measured from when the task can first be claimed: enqueue
+	// for an ungated task, otherwise once its gates lift and the conditions
+	// it waits on hold. 0 means no deadline.
+	Deadline time.Duration
+	Lease    time.Duration
+	// RequiresApproval holds every task of the action for a second account
+	// member; see approval.go.
+	RequiresApproval bool
+}
+
+// DefaultPolicy is what every action gets unless actionPolicies or the account
+// says otherwise. It matches the queue's behaviour before policies existed.
+var DefaultPolicy = TaskPolicy{
+	MaxAttempts: 5,
+	BackoffBase: baseBackoff,
+	BackoffCap:  maxBackoff,
+	Lease:       LeaseDuration,
+}
+
+// actionPolicies are the built-in exceptions to DefaultPolicy, as overrides:
+// a zero field inherits the default.
+var actionPolicies = map[string]PolicyOverride{
+	// A game update downloads and installs the whole server; the agent renews
+	// between steps, not during them, so a 60s lease reaps a healthy update.
+	"installsfserver": {Lease: 5 * time.Minute, Deadline: time.Hour},
+	"updatesfserver":  {Lease: 5 * time.Minute, Deadline: time.Hour},
+	// A start that failed twice is not going to succeed a third time, and a
+	// start retried long after the user asked for it is a surprise.
+	"startsfserver": {MaxAttempts: 2, Deadline: 15 * time.Minute},
+	// Nothing brings back a deleted save or a wiped install.
+	"deletesave":   {RequiresApproval: &requireApproval},
+	"wipesfserver": {RequiresApproval: &requireApproval},
+}
+
+var requireApproval = true
+
+// PolicyOverride is a partial TaskPolicy: zero fields inherit. It is what the
+// built-in table and a per-account override are written as.
+type PolicyOverride struct {
+	MaxAttempts int           `bson:"maxAttempts,omitempty"`
+	BackoffBase time.Duration `bson:"backoffBase,omitempty"`
+	BackoffCap  time.Duration `bson:"backoffCap,omitempty"`
+	Jitter      float64       `bson:"jitter,omitempty"`
+	Deadline    time.Duration `bson:"deadline,omitempty"`
+	Lease       time.Duration `bson:"lease,omitempty"`
+	// RequiresApproval is a pointer so an override can turn approval off as
+	// well as on.
+	RequiresApproval *bool `bson:"requiresApproval,omitempty"`
+}
+
+// AccountPolicy is an account's override for one action.
+type AccountPolicy struct {
+	ID             bson.ObjectID `bson:"_id"`
+	AccountID      bson.ObjectID `bson:"accountId"`
+	Action         string        `bson:"action"`
+	PolicyOverride `bson:",inline"`
+	UpdatedAt      time.Time `bson:"updatedAt"`
+}
+
+func policyCollection() *mongo.Collection {
+	return repositories.GetMongoClient().GetCollection(policyCollectionName)
+}
+
+// EnsurePolicyIndexes makes (account, action) unique, so SetAccountPolicy's
+// upsert is the only override an action can have.
+func EnsurePolicyIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "accountId", Value: 1}, {Key: "action", Value: 1}},
+			Options: options.Index().SetName("uniq_account_action").SetUnique(true),
+		},
+	}
+
+	if _, err := policyCollection().Indexes().CreateMany(ctx, indexes); err != nil {
+		return err
+	}
+
+	logger.GetDebugLogger().Println("Ensured agenttaskpolicies indexes")
+	return nil
+}
+
+// apply returns p with every non-zero field of o laid over it.
+func (p TaskPolicy) apply(o PolicyOverride) TaskPolicy {
+	if o.MaxAttempts > 0 {
+		p.MaxAttempts = o.MaxAttempts
+	}
+	if o.BackoffBase > 0 {
+		p.BackoffBase = o.BackoffBase
+	}
+	if o.BackoffCap > 0 {
+		p.BackoffCap = o.BackoffCap
+	}
+	if o.Jitter > 0 {
+		p.Jitter = o.Jitter
+	}
+	if o.Deadline > 0 {
+		p.Deadline = o.Deadline
+	}
+	if o.Lease > 0 {
+		p.Lease = o.Lease
+	}
+	if o.RequiresApproval != nil {
+		p.RequiresApproval = *o.RequiresApproval
+	}
+	return p
+}
+
+// validate bounds what an account may ask for. The floors matter more than the
+// ceilings: a lease shorter than the agent's renewal interval reaps every task,
+// and a zero backoff turns a failing task into a hot loop.
+func (o PolicyOverride) validate() error {
+	switch {
+	case o.MaxAttempts < 0 || o.MaxAttempts > 20:
+		return errors.New("max attempts must be between 0 and 20")
+	case o.BackoffBase != 0 && o.BackoffBase < time.Second:
+		return errors.New("backoff base must be at least 1s")
+	case o.BackoffCap != 0 && o.BackoffCap > time.Hour:
+		return errors.New("backoff cap must be at most 1h")
+	case o.BackoffBase != 0 && o.BackoffCap != 0 && o.BackoffCap < o.BackoffBase:
+		return errors.New("backoff cap must not be below the backoff base")
+	case o.Jitter < 0 || o.Jitter >= 1:
+		// A jitter of 1 can roll the delay down to nothing, the hot loop the
+		// backoff floor exists to prevent.
+		return errors.New("jitter must be at least 0 and below 1")
+	case o.Lease != 0 && (o.Lease < 30*time.Second || o.Lease > time.Hour):
+		return errors.New("lease must be between 30s and 1h")
+	case o.Deadline != 0 && o.Deadline < time.Minute:
+		return errors.New("deadline must be at least 1m")
+	}
+	return nil
+}
+
+// Backoff returns the delay before a task that has consumed `attempts`
+// attempts may be claimed again: base, 2*base, 4*base, ... capped at
+// BackoffCap, then spread by Jitter. roll is a uniform [0,1) draw, passed in so
+// the curve is testable.
+func (p TaskPolicy) Backoff(attempts int, roll float64) time.Duration {
+	d := p.BackoffBase
+	for i := 1; i < attempts && d < p.BackoffCap; i++ {
+		d *= 2
+	}
+	if d > p.BackoffCap {
+		d = p.BackoffCap
+	}
+
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*roll - 1))
+	}
+	return d
+}
+
+// leaseExpiry is the aggregation expression for "now plus this task's lease",
+// for the pipeline updates that start or extend one. A task enqueued before
+// policies existed has no leaseSeconds and keeps LeaseDuration.
+func leaseExpiry(now time.Time) bson.M {
+	leaseMillis := bson.M{"$multiply": bson.A{
+		bson.M{"$ifNull": bson.A{"$leaseSeconds", int32(LeaseDuration.Seconds())}},
+		1000,
+	}}
+	return bson.M{"$add": bson.A{now, leaseMillis}}
+}
+
+// builtinPolicy is an action's policy before any account override.
+func builtinPolicy(action string) TaskPolicy {
+	return DefaultPolicy.apply(actionPolicies[action])
+}
+
+// PolicyFor resolves the policy a task of this action on this account runs
+// under: the default, the action's built-in exception, then the account's
+// override. A failed override lookup falls back to the built-in policy rather
+// than failing the enqueue or the retry it was asked for.
+func PolicyFor(accountID bson.ObjectID, action string) TaskPolicy {
+	policy := builtinPolicy(action)
+	if accountID.IsZero() {
+		return policy
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	override := &AccountPolicy{}
+	err := policyCollection().FindOne(ctx, bson.M{"accountId": accountID, "action": action}).Decode(override)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			logger.GetErrorLogger().Printf("error reading the %s task policy for account %s: %s", action, accountID.Hex(), err.Error())
+		}
+		return policy
+	}
+	return policy.apply(override.PolicyOverride)
+}
+
+// backoffFor is the retry delay the queue actually uses: the task's policy with
+// a fresh jitter roll.
+func backoffFor(accountID bson.ObjectID, action string, attempts int) time.Duration {
+	return PolicyFor(accountID, action).Backoff(attempts, rand.Float64())
+}
+
+// ListAccountPolicies returns the account's overrides.
+func ListAccountPolicies(accountID bson.ObjectID) ([]AccountPolicy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := policyCollection().Find(ctx, bson.M{"accountId": accountID},
+		options.Find().SetSort(bson.D{{Key: "action", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make([]AccountPolicy, 0)
+	if err := cur.All(ctx, &policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// SetAccountPolicy replaces the account's override for an action. It affects
+// tasks enqueued from now on (MaxAttempts, Lease, Deadline) and retries
+// scheduled from now on (backoff).
+func SetAccountPolicy(accountID bson.ObjectID, action string, override PolicyOverride) error {
+	if action == "" {
+		return errors.New("policy action is required")
+	}
+	if _, ok := LookupAction(action); !ok {
+		return fmt.Errorf("%w %q", ErrUnknownAction, action)
+	}
+	if err := override.validate(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := policyCollection().UpdateOne(ctx,
+		bson.M{"accountId": accountID, "action": action},
+		bson.M{
+			"$set": bson.M{
+				"maxAttempts":      override.MaxAttempts,
+				"backoffBase":      override.BackoffBase,
+				"backoffCap":       override.BackoffCap,
+				"jitter":           override.Jitter,
+				"deadline":         override.Deadline,
+				"lease":            override.Lease,
+				"requiresApproval": override.RequiresApproval,
+				"updatedAt":        time.Now(),
+			},
+			"$setOnInsert": bson.M{"_id": bson.NewObjectID()},
+		},
+		options.UpdateOne().SetUpsert(true))
+	return err
+}
+
+func DeleteAccountPolicy(accountID bson.ObjectID, action string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := policyCollection().DeleteOne(ctx, bson.M{"accountId": accountID, "action": action})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("no %s policy override to delete", action)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package agenttask
+
+import (
+	"testing"
+	"time"
+)
+
+// The default policy must reproduce the queue's behaviour before policies
+// existed: 5s, 10s, 20s, ... capped at 5m, with no jitter.
+func TestDefaultPolicyBackoffMatchesTheOldCurve(t *testing.T) {
+	cases := map[int]time.Duration{
+		0:  5 * time.Second,
+		1:  5 * time.Second,
+		2:  10 * time.Second,
+		3:  20 * time.Second,
+		4:  40 * time.Second,
+		7:  5 * time.Minute,
+		50: 5 * time.Minute,
+	}
+	for attempts, want := range cases {
+		if got := DefaultPolicy.Backoff(attempts, 0.9); got != want {
+			t.Fatalf("attempts=%d: expected %s, got %s", attempts, want, got)
+		}
+	}
+}
+
+func TestBackoffJitterStaysWithinItsFraction(t *testing.T) {
+	p := DefaultPolicy
+	p.Jitter = 0.5
+
+	if got := p.Backoff(2, 0); got != 5*time.Second {
+		t.Fatalf("expected the lowest roll to take off half, got %s", got)
+	}
+	if got := p.Backoff(2, 0.5); got != 10*time.Second {
+		t.Fatalf("expected the middle roll to be exact, got %s", got)
+	}
+	if got := p.Backoff(2, 0.999); got <= 14*time.Second || got >= 15*time.Second {
+		t.Fatalf("expected the highest roll to add just under half, got %s", got)
+	}
+}
+
+// An override only replaces what it sets; everything else comes from the layer
+// beneath it.
+func TestPolicyOverrideInheritsZeroFields(t *testing.T) {
+	p := builtinPolicy("updatesfserver").apply(PolicyOverride{MaxAttempts: 3})
+
+	if p.MaxAttempts != 3 {
+		t.Fatalf("expected the account's attempts, got %d", p.MaxAttempts)
+	}
+	if p.Lease != 5*time.Minute || p.Deadline != time.Hour {
+		t.Fatalf("expected the action's lease and deadline to survive, got %s and %s", p.Lease, p.Deadline)
+	}
+	if p.BackoffBase != DefaultPolicy.BackoffBase {
+		t.Fatalf("expected the default backoff to survive, got %s", p.BackoffBase)
+	}
+}
+
+func TestUnknownActionGetsTheDefaultPolicy(t *testing.T) {
+	if got := builtinPolicy("somethingnew"); got != DefaultPolicy {
+		t.Fatalf("expected the default policy, got %+v", got)
+	}
+}
+
+func TestPolicyOverrideValidation(t *testing.T) {
+	ok := []PolicyOverride{
+		{},
+		{MaxAttempts: 1},
+		{Lease: 10 * time.Minute, Deadline: 2 * time.Hour, Jitter: 0.2},
+		{MaxAttempts: 20, Jitter: 0.99},
+	}
+	for _, o := range ok {
+		if err := o.validate(); err != nil {
+			t.Fatalf("expected %+v to be accepted, got %s", o, err)
+		}
+	}
+
+	bad := []PolicyOverride{
+		{MaxAttempts: 21},
+		{MaxAttempts: -1},
+		{BackoffBase: 100 * time.Millisecond},
+		{Jitter: 1},
+		{Jitter: 1.5},
+		{Jitter: -0.1},
+		{Lease: 5 * time.Second},
+		{Deadline: 10 * time.Second},
+	}
+	for _, o := range bad {
+		if err := o.validate(); err == nil {
+			t.Fatalf("expected %+v to be rejected", o)
+		}
+	}
+}
+
+// RequiresApproval must be overridable both ways, which a zero-inherits bool
+// could not do.
+func TestPolicyOverrideTurnsApprovalOnAndOff(t *testing.T) {
+	on, off := true, false
+
+	p := DefaultPolicy.apply(PolicyOverride{RequiresApproval: &on})
+	if !p.RequiresApproval {
+		t.Fatal("expected the override to require approval")
+	}
+	if p = p.apply(PolicyOverride{RequiresApproval: &off}); p.RequiresApproval {
+		t.Fatal("expected the override to lift the approval requirement")
+	}
+	if p = p.apply(PolicyOverride{}); p.RequiresApproval {
+		t.Fatal("expected an unset override to inherit")
+	}
+}
+
+func TestDestructiveActionsRequireApproval(t *testing.T) {
+	for _, action := range []string{"deletesave", "wipesfserver"} {
+		if _, ok := LookupAction(action); !ok {
+			t.Fatalf("expected %s to be registered", action)
+		}
+		if !builtinPolicy(action).RequiresApproval {
+			t.Fatalf("expected %s to require approval", action)
+		}
+	}
+	if builtinPolicy("stopsfserver").RequiresApproval {
+		t.Fatal("expected an everyday action not to require approval")
+	}
+}
@@ -0,0 +1,101 @@
+package agenttask
+
+import (
+	"time"
+
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// TaskPriority orders the claimable tasks on one agent. Higher claims first;
+// within a level the queue stays FIFO.
+//
+// Priority only reorders tasks that are ALREADY claimable. It is not a gate and
+// never overrides one: a chain that must run in order (stop -> sync -> start)
+// is ordered by dependsOn, and uniq_running_per_agent still serializes the
+// agent whatever the priorities are.
+type TaskPriority int32
+
+const (
+	// PriorityDefault is the zero value: Enqueue derives the level from the
+	// trigger. It is never stored.
+	PriorityDefault TaskPriority = iota
+	PriorityMaintenance
+	PriorityScheduled
+	PriorityUser
+	PrioritySystemRecovery
+)
+
+// taskDoc is the row Enqueue inserts: the shared schema plus the fields only
+// the queue reads. They are claim inputs the frontend never renders, so they
+// live with the queue rather than on v2.AgentTaskSchema.
+type taskDoc struct {
+	*v2.AgentTaskSchema `bson:",inline"`
+	Priority            TaskPriority    `bson:"priority"`
+	DependsOnAll        []bson.ObjectID `bson:"dependsOnAll,omitempty"`
+	DependsOnAny        []bson.ObjectID `bson:"dependsOnAny,omitempty"`
+	// LeaseSeconds and DeadlineSeconds are stamped from the task's TaskPolicy.
+	// DeadlineAt is DeadlineSeconds from when the task could first be claimed;
+	// until then it is unset (see startDeadlines).
+	LeaseSeconds    int32      `bson:"leaseSeconds,omitempty"`
+	DeadlineSeconds int32      `bson:"deadlineSeconds,omitempty"`
+	DeadlineAt      *time.Time `bson:"deadlineAt,omitempty"`
+	// RequiresMaintenanceWindow holds the task until the agent is inside one
+	// of its maintenance windows.
+	RequiresMaintenanceWindow bool `bson:"requiresMaintenanceWindow,omitempty"`
+	// RequiresApproval holds the task until a second account member approves
+	// it (see approval.go); ApprovalExpiresAt is when it stops waiting.
+	RequiresApproval  bool       `bson:"requiresApproval,omitempty"`
+	ApprovalExpiresAt *time.Time `bson:"approvalExpiresAt,omitempty"`
+	// RequestedBy is the account member the task runs on behalf of, whom
+	// Approve refuses as the approver; see requesterFor.
+	RequestedBy string `bson:"requestedBy,omitempty"`
+}
+
+// held reports whether anything but the agent being busy keeps the task from
+// being claimed: a parent gate, the approval gate or a condition on the agent.
+func (t taskDoc) held() bool {
+	return t.DependsOn != nil || len(t.DependsOnAll) > 0 || len(t.DependsOnAny) > 0 ||
+		t.RequiresApproval || t.RequiresServerStopped || t.RequiresMaintenanceWindow
+}
+
+// applyDeadline stamps the policy deadline. A held task could wait out its
+// whole deadline before it is ever allowed to run, so its clock is left for
+// startDeadlines to start once it can be claimed.
+func (t *taskDoc) applyDeadline(deadline time.Duration) {
+	if deadline <= 0 {
+		return
+	}
+	t.DeadlineSeconds = int32(deadline.Seconds())
+	if !t.held() {
+		at := t.CreatedAt.Add(deadline)
+		t.DeadlineAt = &at
+	}
+}
+
+// priorityFor resolves the level a task is stored with. An explicit level wins;
+// otherwise a person asking (directly or through a workflow they started) beats
+// the backend's own housekeeping, which is exactly the "stop server waits
+// behind a queue of boot updates" case this exists for.
+func priorityFor(explicit TaskPriority, trigger v2.TaskTrigger) TaskPriority {
+	if explicit != PriorityDefault {
+		return explicit
+	}
+
+	switch trigger.Type {
+	case v2.TaskTriggerUser, v2.TaskTriggerWorkflow:
+		return PriorityUser
+	default:
+		return PriorityMaintenance
+	}
+}
+
+// claimSort is the order Claim takes the agent's claimable tasks in: highest
+// priority first, oldest first within a level.
+//
+// A row written before priorities existed has no priority field, which sorts
+// below every stored level. Those rows drain at maintenance precedence, which
+// is the conservative reading of "we don't know who asked".
+func claimSort() bson.D {
+	return bson.D{{Key: "priority", Value: -1}, {Key: "createdAt", Value: 1}}
+}
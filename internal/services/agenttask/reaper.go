@@ -10,8 +10,8 @@ import (
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
-// orphanGracePeriod is how stale a pending task's dependsOn must be before the
-// sweep is willing to call its parent non-existent.
+// orphanGracePeriod is how stale a pending task's parent gate must be before the
+// sweep is willing to call any of its parents non-existent.
 //
 // It is a correctness guard, not a tuning knob. A caller may deliberately gate a
 // pending task onto a PRE-ASSIGNED _id and insert that parent a moment later
@@ -21,8 +21,10 @@ import (
 // off any gate young enough for its parent to still be in flight.
 const orphanGracePeriod = 5 * time.Minute
 
-// ReapExpiredLeases returns abandoned tasks to the queue, then releases tasks
-// gated behind a parent that does not exist.
+// ReapExpiredLeases returns abandoned tasks to the queue, finishes tasks past
+// their policy deadline, unapproved past approvalTTL or that their agent cannot
+// run, gives finished tasks' timelines their expiry, then releases tasks gated
+// behind a parent that does not exist.
 //
 // The attempt was already spent at claim time, so a crash-looping agent is
 // bounded by MaxAttempts rather than retrying forever.
@@ -30,6 +32,21 @@ func ReapExpiredLeases() error {
 	if err := reapExpiredLeases(); err != nil {
 		return err
 	}
+	if err := startDeadlines(); err != nil {
+		return err
+	}
+	if err := expireDeadlines(); err != nil {
+		return err
+	}
+	if err := expireApprovals(); err != nil {
+		return err
+	}
+	if err := expireUnsupportedTasks(); err != nil {
+		return err
+	}
+	if err := expireFinishedTimelines(); err != nil {
+		return err
+	}
 	return releaseOrphanedGates()
 }
 
@@ -65,8 +82,48 @@ func orphanGateUpdate(action string, now time.Time) bson.M {
 	return bson.M{"$unset": bson.M{"dependsOn": ""}, "$set": set}
 }
 
-// releaseOrphanedGates makes a pending task whose dependsOn resolves to no
-// document claimable again.
+// orphanSetUpdate is orphanGateUpdate for a task waiting on a parent set: the
+// update that drops the parents missing from alive, or nil when none are.
+//
+// An orphaned parent can never complete, so it is taken out of the set whether
+// the set is all-of or any-of. If live parents remain, the task keeps waiting
+// on them and their own cascades finish the job. If none remain, the gate goes
+// as a whole and the task is released exactly as a single orphaned dependsOn
+// would be, including the syncmods re-gate.
+func orphanSetUpdate(field string, parents []bson.ObjectID, alive map[bson.ObjectID]struct{}, action string, now time.Time) bson.M {
+	rest := make([]bson.ObjectID, 0, len(parents))
+	for _, parentID := range parents {
+		if _, ok := alive[parentID]; ok {
+			rest = append(rest, parentID)
+		}
+	}
+
+	if len(rest) == len(parents) {
+		return nil
+	}
+	if len(rest) > 0 {
+		return bson.M{"$set": bson.M{field: rest, "updatedAt": now}}
+	}
+
+	update := orphanGateUpdate(action, now)
+	update["$unset"] = bson.M{field: ""}
+	return update
+}
+
+// gatedTask is the slice of a pending task the orphan sweep reads. The set
+// gates are not on v2.AgentTaskSchema (see taskDoc), so it decodes its own.
+type gatedTask struct {
+	ID           bson.ObjectID   `bson:"_id"`
+	AgentID      bson.ObjectID   `bson:"agentId"`
+	Action       string          `bson:"action"`
+	DependsOn    *bson.ObjectID  `bson:"dependsOn"`
+	DependsOnAll []bson.ObjectID `bson:"dependsOnAll"`
+	DependsOnAny []bson.ObjectID `bson:"dependsOnAny"`
+}
+
+// releaseOrphanedGates makes a pending task whose parents resolve to no
+// document claimable again. Orphans are found per parent: a task waiting on a
+// set loses only the parents that are missing (see orphanSetUpdate).
 //
 // Nothing else can recover one. cascadeChildren only fires from a real parent
 // row's terminal transition and reapExpiredLeases only touches RUNNING tasks, so
@@ -80,15 +137,21 @@ func releaseOrphanedGates() error {
 	defer cancel()
 
 	cur, err := collection().Find(ctx, bson.M{
-		"status":    v2.TaskStatusPending,
-		"dependsOn": bson.M{"$exists": true},
+		"status": v2.TaskStatusPending,
+		"$or": bson.A{
+			bson.M{"dependsOn": bson.M{"$exists": true}},
+			bson.M{"dependsOnAll": bson.M{"$exists": true}},
+			bson.M{"dependsOnAny": bson.M{"$exists": true}},
+		},
 		"updatedAt": bson.M{"$lt": time.Now().Add(-orphanGracePeriod)},
-	})
+	}, options.Find().SetProjection(bson.M{
+		"agentId": 1, "action": 1, "dependsOn": 1, "dependsOnAll": 1, "dependsOnAny": 1,
+	}))
 	if err != nil {
 		return err
 	}
 
-	gated := make([]v2.AgentTaskSchema, 0)
+	gated := make([]gatedTask, 0)
 	if err := cur.All(ctx, &gated); err != nil {
 		return err
 	}
@@ -101,6 +164,8 @@ func releaseOrphanedGates() error {
 		if gated[idx].DependsOn != nil {
 			parentIDs = append(parentIDs, *gated[idx].DependsOn)
 		}
+		parentIDs = append(parentIDs, gated[idx].DependsOnAll...)
+		parentIDs = append(parentIDs, gated[idx].DependsOnAny...)
 	}
 
 	// One $in over _id: the parents that DO exist. Anything left is orphaned by
@@ -127,19 +192,32 @@ func releaseOrphanedGates() error {
 	now := time.Now()
 	for idx := range gated {
 		task := &gated[idx]
-		if task.DependsOn == nil {
-			continue
-		}
-		if _, ok := alive[*task.DependsOn]; ok {
-			continue
-		}
 
 		// Fenced on the gate we read: if the real parent completed and cascaded the
 		// gate off in the meantime, this matches nothing rather than clobbering a
 		// gate that has since been re-pointed at a newer parent.
-		res, err := collection().UpdateOne(ctx,
-			bson.M{"_id": task.ID, "status": v2.TaskStatusPending, "dependsOn": *task.DependsOn},
-			orphanGateUpdate(task.Action, now))
+		fence := bson.M{"_id": task.ID, "status": v2.TaskStatusPending}
+		var update bson.M
+
+		switch {
+		case task.DependsOn != nil:
+			if _, ok := alive[*task.DependsOn]; ok {
+				continue
+			}
+			fence["dependsOn"] = *task.DependsOn
+			update = orphanGateUpdate(task.Action, now)
+		case len(task.DependsOnAll) > 0:
+			fence["dependsOnAll"] = task.DependsOnAll
+			update = orphanSetUpdate("dependsOnAll", task.DependsOnAll, alive, task.Action, now)
+		case len(task.DependsOnAny) > 0:
+			fence["dependsOnAny"] = task.DependsOnAny
+			update = orphanSetUpdate("dependsOnAny", task.DependsOnAny, alive, task.Action, now)
+		}
+		if update == nil {
+			continue
+		}
+
+		res, err := collection().UpdateOne(ctx, fence, update)
 		if err != nil {
 			return err
 		}
@@ -147,7 +225,9 @@ func releaseOrphanedGates() error {
 			continue
 		}
 
-		logger.GetErrorLogger().Printf("released task %s: its dependsOn %s resolves to no task", task.ID.Hex(), task.DependsOn.Hex())
+		logger.GetErrorLogger().Printf("dropped the orphaned parents of task %s: they resolve to no task", task.ID.Hex())
+		recordEvent(TaskEvent{TaskID: task.ID, Type: EventOrphanReleased, Message: "dropped parents that resolve to no task"})
+		orphanedGatesTotal.Inc(task.Action)
 		notifyEnqueued(task.AgentID)
 	}
 
@@ -196,11 +276,19 @@ func reapExpiredLeases() error {
 				"$set":   bson.M{"status": v2.TaskStatusDead, "finishedAt": now, "updatedAt": now, "lastError": "lease expired"},
 				"$unset": bson.M{"active": "", "leaseToken": "", "leaseExpiresAt": ""},
 			}
+		case !retriesLostLease(task.Action):
+			// The agent may have run it before vanishing, and running it again
+			// is not safe. Someone has to look; Retry is there when they have.
+			terminalStatus = v2.TaskStatusDead
+			update = bson.M{
+				"$set":   bson.M{"status": v2.TaskStatusDead, "finishedAt": now, "updatedAt": now, "lastError": "lease expired; not retried because the action may already have run"},
+				"$unset": bson.M{"active": "", "leaseToken": "", "leaseExpiresAt": ""},
+			}
 		default:
 			update = bson.M{
 				"$set": bson.M{
 					"status":        v2.TaskStatusPending,
-					"nextAttemptAt": now.Add(BackoffFor(task.Attempts)),
+					"nextAttemptAt": now.Add(backoffFor(task.AccountID, task.Action, task.Attempts)),
 					"updatedAt":     now,
 					"lastError":     "lease expired",
 				},
@@ -225,6 +313,22 @@ func reapExpiredLeases() error {
 		if err != nil {
 			return err
 		}
+		if res.MatchedCount > 0 {
+			outcome := "returned to the queue"
+			if terminalStatus != "" {
+				outcome = terminalStatus
+				leasesReapedTotal.Inc(task.Action, terminalStatus)
+			} else {
+				leasesReapedTotal.Inc(task.Action, outcomeRetried)
+			}
+			recordEvent(TaskEvent{
+				TaskID:     task.ID,
+				Type:       EventReaped,
+				Attempt:    task.Attempts,
+				LeaseToken: task.LeaseToken,
+				Message:    "lease expired; " + outcome,
+			})
+		}
 
 		// A task that won the renewal race in the fencing window is still alive:
 		// cascading its children away here would sever a chain that has not actually
@@ -238,3 +342,157 @@ func reapExpiredLeases() error {
 
 	return nil
 }
+
+// heldTask is the slice of a pending task startDeadlines reads.
+type heldTask struct {
+	ID                        bson.ObjectID `bson:"_id"`
+	AgentID                   bson.ObjectID `bson:"agentId"`
+	DeadlineSeconds           int32         `bson:"deadlineSeconds"`
+	RequiresServerStopped     bool          `bson:"requiresServerStopped"`
+	RequiresMaintenanceWindow bool          `bson:"requiresMaintenanceWindow"`
+}
+
+// unstartedDeadlineFilter matches the pending tasks whose deadline has not
+// started and whose gates have all lifted. Whether the conditions they wait on
+// hold is per agent; see heldTask.claimable.
+func unstartedDeadlineFilter() bson.M {
+	return bson.M{
+		"status":           v2.TaskStatusPending,
+		"deadlineSeconds":  bson.M{"$gt": 0},
+		"deadlineAt":       bson.M{"$exists": false},
+		"dependsOn":        bson.M{"$exists": false},
+		"dependsOnAll":     bson.M{"$exists": false},
+		"dependsOnAny":     bson.M{"$exists": false},
+		"requiresApproval": bson.M{"$ne": true},
+	}
+}
+
+// claimable reports whether the agent's state lets the task be claimed, the
+// same conditions claimFilter applies.
+func (t heldTask) claimable(serverRunning, inWindow bool) bool {
+	if t.RequiresServerStopped && serverRunning {
+		return false
+	}
+	if t.RequiresMaintenanceWindow && !inWindow {
+		return false
+	}
+	return true
+}
+
+// deadlineFrom is the task's deadline when its clock starts at now.
+func (t heldTask) deadlineFrom(now time.Time) time.Time {
+	return now.Add(time.Duration(t.DeadlineSeconds) * time.Second)
+}
+
+// startDeadlines starts the policy deadline of every task that has become
+// claimable since it was enqueued or re-gated. A start chained behind a stop
+// held for a maintenance window gets its fifteen minutes from when the window
+// opens and the chain reaches it, not from when the user asked.
+func startDeadlines() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cur, err := collection().Find(ctx, unstartedDeadlineFilter(), options.Find().SetProjection(bson.M{
+		"agentId": 1, "deadlineSeconds": 1, "requiresServerStopped": 1, "requiresMaintenanceWindow": 1,
+	}))
+	if err != nil {
+		return err
+	}
+
+	var tasks []heldTask
+	if err := cur.All(ctx, &tasks); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	states := make(map[bson.ObjectID]agentState)
+
+	for _, task := range tasks {
+		if task.RequiresServerStopped || task.RequiresMaintenanceWindow {
+			state, ok := states[task.AgentID]
+			if !ok {
+				state = readAgentState(task.AgentID)
+				states[task.AgentID] = state
+			}
+			if !task.claimable(state.ServerRunning, state.inWindow(now)) {
+				continue
+			}
+		}
+
+		_, err := collection().UpdateOne(ctx,
+			bson.M{"_id": task.ID, "status": v2.TaskStatusPending, "deadlineAt": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"deadlineAt": task.deadlineFrom(now)}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireDeadlines enforces the deadlines TaskPolicy stamps on tasks. A pending
+// task past its deadline is dead: claimFilter already refuses it, and leaving it
+// pending would hold its children's gates forever. A running one cannot be
+// yanked from its agent, so it is asked to cancel the same way a user cancel
+// is; the agent sees the flag on its next renewal, and an agent that never
+// renews is cancelled by the lease reaper above.
+func expireDeadlines() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	cur, err := collection().Find(ctx, bson.M{
+		"status":     bson.M{"$in": bson.A{v2.TaskStatusPending, v2.TaskStatusRunning}},
+		"deadlineAt": bson.M{"$lt": now},
+	})
+	if err != nil {
+		return err
+	}
+
+	overdue := make([]v2.AgentTaskSchema, 0)
+	if err := cur.All(ctx, &overdue); err != nil {
+		return err
+	}
+
+	for idx := range overdue {
+		task := &overdue[idx]
+
+		if task.Status == v2.TaskStatusRunning {
+			if task.CancelRequested {
+				continue
+			}
+			res, err := collection().UpdateOne(ctx,
+				bson.M{"_id": task.ID, "status": v2.TaskStatusRunning, "leaseToken": task.LeaseToken},
+				bson.M{"$set": bson.M{"cancelRequested": true, "updatedAt": now}})
+			if err != nil {
+				return err
+			}
+			if res.MatchedCount > 0 {
+				recordEvent(TaskEvent{TaskID: task.ID, Type: EventCancelRequested, Attempt: task.Attempts, Message: "deadline passed"})
+			}
+			continue
+		}
+
+		// Fenced on still being pending: a task claimed in the window since our
+		// Find is the running branch's business on the next sweep.
+		res, err := collection().UpdateOne(ctx,
+			bson.M{"_id": task.ID, "status": v2.TaskStatusPending},
+			bson.M{
+				"$set":   bson.M{"status": v2.TaskStatusDead, "finishedAt": now, "updatedAt": now, "lastError": "deadline passed before the task could run"},
+				"$unset": bson.M{"active": "", "dependsOn": "", "dependsOnAll": "", "dependsOnAny": ""},
+			})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			continue
+		}
+
+		recordEvent(TaskEvent{TaskID: task.ID, Type: EventDead, Attempt: task.Attempts, Message: "deadline passed"})
+		if err := cascadeChildren(ctx, task.ID, v2.TaskStatusDead, task.AgentID); err != nil {
+			logger.GetErrorLogger().Printf("error cascading children of expired task %s: %s", task.ID.Hex(), err.Error())
+		}
+	}
+
+	return nil
+}
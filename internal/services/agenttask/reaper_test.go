@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
 	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
@@ -68,3 +69,115 @@ func TestOrphanGateUpdateSyncModsIsRegatedNotReleased(t *testing.T) {
 		t.Fatalf("expected updatedAt to be stamped, got %v", set)
 	}
 }
+
+// A set gate is orphaned per parent: losing one parent of several must not
+// release the task, only take that parent out of the set.
+func TestOrphanSetUpdateDropsOnlyMissingParents(t *testing.T) {
+	live, gone := bson.NewObjectID(), bson.NewObjectID()
+	alive := map[bson.ObjectID]struct{}{live: {}}
+	now := time.Now()
+
+	update := orphanSetUpdate("dependsOnAll", []bson.ObjectID{live, gone}, alive, "startsfserver", now)
+
+	set, ok := update["$set"].(bson.M)
+	if !ok {
+		t.Fatalf("expected a $set clause, got %v", update)
+	}
+	rest, ok := set["dependsOnAll"].([]bson.ObjectID)
+	if !ok || len(rest) != 1 || rest[0] != live {
+		t.Fatalf("expected only the live parent to remain, got %v", set)
+	}
+	if _, present := update["$unset"]; present {
+		t.Fatalf("a task with a live parent left must stay gated, got %v", update)
+	}
+}
+
+func TestOrphanSetUpdateReleasesOnceEveryParentIsMissing(t *testing.T) {
+	now := time.Now()
+	parents := []bson.ObjectID{bson.NewObjectID(), bson.NewObjectID()}
+
+	update := orphanSetUpdate("dependsOnAny", parents, map[bson.ObjectID]struct{}{}, "syncmods", now)
+
+	unset, ok := update["$unset"].(bson.M)
+	if !ok {
+		t.Fatalf("expected an $unset clause, got %v", update)
+	}
+	if _, present := unset["dependsOnAny"]; !present {
+		t.Fatalf("expected dependsOnAny to be unset, got %v", unset)
+	}
+	if _, present := unset["dependsOn"]; present {
+		t.Fatalf("expected only the set's own field to be unset, got %v", unset)
+	}
+
+	// The same syncmods rule as a single orphaned parent: re-gated, not released.
+	set := update["$set"].(bson.M)
+	if set["requiresServerStopped"] != true {
+		t.Fatalf("expected a released syncmods to be re-gated with requiresServerStopped, got %v", set)
+	}
+}
+
+func TestOrphanSetUpdateIgnoresAFullyLiveSet(t *testing.T) {
+	parentID := bson.NewObjectID()
+	alive := map[bson.ObjectID]struct{}{parentID: {}}
+
+	if update := orphanSetUpdate("dependsOnAll", []bson.ObjectID{parentID}, alive, "startsfserver", time.Now()); update != nil {
+		t.Fatalf("expected no update while every parent exists, got %v", update)
+	}
+}
+
+// The ApplyInWindow chain: stop (held for the window) -> sync -> start. The
+// window opens two hours after the user asked; the start's fifteen minutes run
+// from when the chain reaches it, not from enqueue.
+func TestStartDeadlineRunsFromTheWindowNotFromEnqueue(t *testing.T) {
+	enqueuedAt := time.Date(2026, 3, 1, 22, 0, 0, 0, time.UTC)
+	syncID := bson.NewObjectID()
+
+	start := taskDoc{AgentTaskSchema: &v2.AgentTaskSchema{CreatedAt: enqueuedAt, DependsOn: &syncID}}
+	start.applyDeadline(builtinPolicy("startsfserver").Deadline)
+	if start.DeadlineAt != nil {
+		t.Fatalf("a start gated on its sync must not have its deadline running, got %v", start.DeadlineAt)
+	}
+	if start.DeadlineSeconds != int32((15 * time.Minute).Seconds()) {
+		t.Fatalf("expected the policy's span to be kept for later, got %ds", start.DeadlineSeconds)
+	}
+
+	stop := heldTask{RequiresMaintenanceWindow: true, DeadlineSeconds: 600}
+	if stop.claimable(true, false) {
+		t.Fatal("a stop held for a window that has not opened must not start its deadline")
+	}
+
+	// The window opens, the stop and sync run and the cascade releases the
+	// start; the next sweep starts its clock.
+	releasedAt := enqueuedAt.Add(2*time.Hour + 5*time.Minute)
+	released := heldTask{DeadlineSeconds: start.DeadlineSeconds}
+	if !released.claimable(false, true) {
+		t.Fatal("expected the released start to be claimable")
+	}
+	if got, want := released.deadlineFrom(releasedAt), releasedAt.Add(15*time.Minute); !got.Equal(want) {
+		t.Fatalf("expected the deadline %v, got %v", want, got)
+	}
+}
+
+func TestUngatedTaskDeadlineRunsFromEnqueue(t *testing.T) {
+	enqueuedAt := time.Date(2026, 3, 1, 22, 0, 0, 0, time.UTC)
+
+	start := taskDoc{AgentTaskSchema: &v2.AgentTaskSchema{CreatedAt: enqueuedAt}}
+	start.applyDeadline(15 * time.Minute)
+	if start.DeadlineAt == nil || !start.DeadlineAt.Equal(enqueuedAt.Add(15*time.Minute)) {
+		t.Fatalf("expected the deadline 15m after enqueue, got %v", start.DeadlineAt)
+	}
+}
+
+// Gated and unapproved tasks are never picked up by the sweep: their clock
+// starts only once every gate has lifted.
+func TestUnstartedDeadlineFilterSkipsGatedTasks(t *testing.T) {
+	f := unstartedDeadlineFilter()
+	for _, field := range []string{"dependsOn", "dependsOnAll", "dependsOnAny", "deadlineAt"} {
+		if cond, ok := f[field].(bson.M); !ok || cond["$exists"] != false {
+			t.Fatalf("expected the sweep to require %s to be unset, got %v", field, f[field])
+		}
+	}
+	if cond, ok := f["requiresApproval"].(bson.M); !ok || cond["$ne"] != true {
+		t.Fatalf("expected the sweep to skip tasks awaiting approval, got %v", f["requiresApproval"])
+	}
+}
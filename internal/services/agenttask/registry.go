@@ -18,7 +18,8 @@ type Assignment struct {
 }
 
 type streamEntry struct {
-	ch chan Assignment
+	ch        chan Assignment
+	accountID bson.ObjectID
 }
 
 // Registry tracks which agents have a live task stream on *this* replica.
@@ -32,18 +33,24 @@ var registry = &Registry{streams: map[bson.ObjectID]*streamEntry{}}
 func GetRegistry() *Registry { return registry }
 
 // Add registers a stream and returns the receive channel plus a deregister func.
+// accountID is recorded only so the dispatcher can share its tick fairly between
+// accounts; see fairOrder.
 //
 // The deregister func removes the entry only if it is still *this* entry, using
 // pointer identity rather than any id the agent supplies. An agent that
 // reconnects before its old server-side stream has torn down would otherwise
 // have the old teardown evict and close the new, healthy stream.
-func (r *Registry) Add(agentID bson.ObjectID) (<-chan Assignment, func()) {
-	entry := &streamEntry{ch: make(chan Assignment, 1)}
+func (r *Registry) Add(agentID, accountID bson.ObjectID) (<-chan Assignment, func()) {
+	entry := &streamEntry{ch: make(chan Assignment, 1), accountID: accountID}
 
 	r.mu.Lock()
 	r.streams[agentID] = entry
 	r.mu.Unlock()
 
+	// Whatever queued up while the agent was away is claimable now. The tick
+	// would find it too, but on change-stream dispatch that is a sweep away.
+	notifyEnqueued(agentID)
+
 	remove := func() {
 		r.mu.Lock()
 		defer r.mu.Unlock()
@@ -75,6 +82,18 @@ func (r *Registry) ConnectedAgents() []bson.ObjectID {
 	return ids
 }
 
+// ConnectedByAccount groups the locally connected agents by owning account.
+func (r *Registry) ConnectedByAccount() map[bson.ObjectID][]bson.ObjectID {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make(map[bson.ObjectID][]bson.ObjectID)
+	for id, e := range r.streams {
+		out[e.accountID] = append(out[e.accountID], id)
+	}
+	return out
+}
+
 // send delivers an assignment, reporting false if the agent vanished or its
 // buffer is full (which means it already has work in flight).
 //
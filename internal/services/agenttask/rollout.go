@@ -0,0 +1,562 @@
+package agenttask
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	rolloutCollectionName = "agenttaskrollouts"
+
+	RolloutStatusRunning   = "running"
+	RolloutStatusCompleted = "completed"
+	RolloutStatusHalted    = "halted"
+
+	// rolloutStaleAfter is how long a running rollout may go without a write
+	// before ReconcileRollouts looks at it anyway. Waves normally advance on
+	// the sweep after their last task's cascade nudges the rollout; this is
+	// for a nudge that was lost.
+	rolloutStaleAfter = time.Minute
+)
+
+// DefaultRolloutWaves is the wave plan when the caller gives none: a one-agent
+// canary, then up to 25% of the fleet, then the rest.
+var DefaultRolloutWaves = []int{25}
+
+// RolloutWave is one batch of agents. TaskIDs is filled in as the wave is
+// launched; a wave whose TaskIDs is shorter than its AgentIDs was interrupted
+// mid-launch and is finished by the next reconcile.
+type RolloutWave struct {
+	AgentIDs []bson.ObjectID `bson:"agentIds"`
+	TaskIDs  []bson.ObjectID `bson:"taskIds,omitempty"`
+}
+
+// Rollout runs one action across many agents in waves. Each wave is launched
+// only once every task of the wave before it has completed; the first task to
+// end dead or cancelled halts the rollout, and no later wave is launched. So
+// does an agent Enqueue refuses the task for, which is kept in Failures.
+//
+// Every task a rollout enqueues carries TriggeredBy.ExternalID "rollout:<id>",
+// which is how a task in the agent's history says which rollout produced it.
+type Rollout struct {
+	ID          bson.ObjectID  `bson:"_id"`
+	AccountID   bson.ObjectID  `bson:"accountId"`
+	Action      string         `bson:"action"`
+	Data        string         `bson:"data,omitempty"`
+	Waves       []RolloutWave  `bson:"waves"`
+	CurrentWave int            `bson:"currentWave"`
+	Status      string         `bson:"status"`
+	HaltReason  string         `bson:"haltReason,omitempty"`
+	Failures    []BatchFailure `bson:"failures,omitempty"`
+	CreatedBy   string         `bson:"createdBy,omitempty"`
+	CreatedAt   time.Time      `bson:"createdAt"`
+	UpdatedAt   time.Time      `bson:"updatedAt"`
+	FinishedAt  *time.Time     `bson:"finishedAt,omitempty"`
+	// NudgedAt is set when one of the rollout's tasks finishes, and cleared
+	// by the sweep that takes the rollout's next step; see nudgeRollout.
+	NudgedAt *time.Time `bson:"nudgedAt,omitempty"`
+}
+
+// RolloutInput is what a caller starts a rollout with. WavePercents are the
+// cumulative fleet percentages each wave after the canary grows to; nil means
+// DefaultRolloutWaves. The last wave always takes whatever is left.
+type RolloutInput struct {
+	Action       string
+	Data         string
+	AgentIDs     []bson.ObjectID
+	WavePercents []int
+}
+
+func rolloutCollection() *mongo.Collection {
+	return repositories.GetMongoClient().GetCollection(rolloutCollectionName)
+}
+
+// RolloutTrigger is the TaskTrigger every task of a rollout is enqueued with.
+func RolloutTrigger(rolloutID bson.ObjectID) v2.TaskTrigger {
+	return v2.TaskTrigger{Type: v2.TaskTriggerUser, ExternalID: "rollout:" + rolloutID.Hex()}
+}
+
+// enqueueOpts are the options each of the rollout's tasks is enqueued with: on
+// behalf of whoever started the rollout.
+func (r *Rollout) enqueueOpts() EnqueueOpts {
+	return EnqueueOpts{RequestedBy: r.CreatedBy}
+}
+
+// EnsureRolloutIndexes creates the indexes the cascade hook and the reconcile
+// sweep look rollouts up by.
+func EnsureRolloutIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	indexes := []mongo.IndexModel{
+		{
+			// Every terminal task transition asks "am I in a running rollout?".
+			Keys:    bson.D{{Key: "waves.taskIds", Value: 1}},
+			Options: options.Index().SetName("by_task"),
+		},
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "updatedAt", Value: 1}},
+			Options: options.Index().SetName("stale_rollouts"),
+		},
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "nudgedAt", Value: 1}},
+			Options: options.Index().SetName("nudged_rollouts"),
+		},
+		{
+			Keys:    bson.D{{Key: "accountId", Value: 1}, {Key: "createdAt", Value: -1}},
+			Options: options.Index().SetName("by_account"),
+		},
+	}
+
+	if _, err := rolloutCollection().Indexes().CreateMany(ctx, indexes); err != nil {
+		return err
+	}
+
+	logger.GetDebugLogger().Println("Ensured agenttaskrollouts indexes")
+	return nil
+}
+
+func (in RolloutInput) validate() error {
+	if in.Action == "" {
+		return errors.New("rollout action is required")
+	}
+	if len(in.AgentIDs) == 0 {
+		return errors.New("rollout needs at least one agent")
+	}
+	if in.Data != "" && !json.Valid([]byte(in.Data)) {
+		return errors.New("rollout data must be valid JSON")
+	}
+	if _, err := checkAction(in.Action, in.Data); err != nil {
+		return err
+	}
+
+	last := 0
+	for _, pct := range in.WavePercents {
+		if pct <= last || pct > 100 {
+			return fmt.Errorf("wave percentages must rise strictly within 1-100, got %v", in.WavePercents)
+		}
+		last = pct
+	}
+	return nil
+}
+
+// planWaves splits agentIDs into a one-agent canary followed by waves that
+// grow to each of percents of the fleet, rounding up, and a final wave with the
+// rest. A percentage too small to add an agent produces no wave rather than an
+// empty one. Agents keep the caller's order, so the caller picks the canary.
+func planWaves(agentIDs []bson.ObjectID, percents []int) []RolloutWave {
+	waves := []RolloutWave{{AgentIDs: agentIDs[:1]}}
+	done := 1
+
+	for _, pct := range append(append([]int{}, percents...), 100) {
+		upto := (len(agentIDs)*pct + 99) / 100
+		if upto <= done {
+			continue
+		}
+		waves = append(waves, RolloutWave{AgentIDs: agentIDs[done:upto]})
+		done = upto
+	}
+	return waves
+}
+
+// uniqueAgents drops repeats, keeping the first occurrence: an agent in two
+// waves would collide with itself on RolloutDedupeKey.
+func uniqueAgents(agentIDs []bson.ObjectID) []bson.ObjectID {
+	seen := make(map[bson.ObjectID]struct{}, len(agentIDs))
+	out := make([]bson.ObjectID, 0, len(agentIDs))
+	for _, id := range agentIDs {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		out = append(out, id)
+	}
+	return out
+}
+
+// StartRollout saves the rollout and launches its canary. The caller is
+// responsible for every agent in the input belonging to accountID.
+func StartRollout(accountID bson.ObjectID, createdBy string, in RolloutInput) (*Rollout, error) {
+	if err := in.validate(); err != nil {
+		return nil, err
+	}
+
+	percents := in.WavePercents
+	if percents == nil {
+		percents = DefaultRolloutWaves
+	}
+
+	now := time.Now()
+	r := &Rollout{
+		ID:        bson.NewObjectID(),
+		AccountID: accountID,
+		Action:    in.Action,
+		Data:      in.Data,
+		Waves:     planWaves(uniqueAgents(in.AgentIDs), percents),
+		Status:    RolloutStatusRunning,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := rolloutCollection().InsertOne(ctx, r); err != nil {
+		return nil, err
+	}
+
+	if err := launchWave(ctx, r, 0); err != nil {
+		// A refusal has already halted the rollout; anything else leaves the
+		// row for the reconcile sweep to finish the launch.
+		logger.GetErrorLogger().Printf("error launching the canary of rollout %s: %s", r.ID.Hex(), err.Error())
+	}
+	return GetRollout(r.ID.Hex())
+}
+
+func GetRollout(rolloutID string) (*Rollout, error) {
+	oid, err := bson.ObjectIDFromHex(rolloutID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	r := &Rollout{}
+	if err := rolloutCollection().FindOne(ctx, bson.M{"_id": oid}).Decode(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func ListRolloutsForAccount(accountID bson.ObjectID, limit int64) ([]Rollout, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetLimit(limit)
+	cur, err := rolloutCollection().Find(ctx, bson.M{"accountId": accountID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	rollouts := make([]Rollout, 0)
+	if err := cur.All(ctx, &rollouts); err != nil {
+		return nil, err
+	}
+	return rollouts, nil
+}
+
+// HaltRollout stops a running rollout from launching any further wave. Tasks
+// already enqueued are left alone; cancelling them is the caller's choice.
+func HaltRollout(rolloutID, reason string) error {
+	oid, err := bson.ObjectIDFromHex(rolloutID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := rolloutCollection().UpdateOne(ctx,
+		bson.M{"_id": oid, "status": RolloutStatusRunning},
+		haltUpdate(reason, time.Now()))
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("rollout %s is not running", rolloutID)
+	}
+	return nil
+}
+
+func haltUpdate(reason string, now time.Time) bson.M {
+	return bson.M{"$set": bson.M{
+		"status":     RolloutStatusHalted,
+		"haltReason": reason,
+		"finishedAt": now,
+		"updatedAt":  now,
+	}}
+}
+
+// isEnqueueRefusal reports whether err is Enqueue turning the task down for
+// good, rather than failing on the way to the database: the agent cannot run
+// the action, or is gone, or the action or its data no longer pass.
+func isEnqueueRefusal(err error) bool {
+	return errors.Is(err, ErrActionUnsupported) ||
+		errors.Is(err, ErrAgentTooOld) ||
+		errors.Is(err, ErrUnknownAction) ||
+		errors.Is(err, ErrInvalidPayload) ||
+		errors.Is(err, errForeignParent) ||
+		errors.Is(err, mongo.ErrNoDocuments)
+}
+
+// launchUpdate records the task ids a launch of wave enqueued, and with a
+// refusal, halts the rollout on it.
+func launchUpdate(wave int, taskIDs []bson.ObjectID, refused *BatchFailure, now time.Time) bson.M {
+	if refused == nil {
+		return bson.M{"$set": bson.M{
+			fmt.Sprintf("waves.%d.taskIds", wave): taskIDs,
+			"updatedAt":                           now,
+		}}
+	}
+
+	update := haltUpdate(fmt.Sprintf("wave %d: agent %s refused the task: %s", wave+1, refused.AgentID.Hex(), refused.Error), now)
+	update["$set"].(bson.M)[fmt.Sprintf("waves.%d.taskIds", wave)] = taskIDs
+	update["$push"] = bson.M{"failures": *refused}
+	return update
+}
+
+// launchWave enqueues the wave's task on each of its agents and records their
+// ids. It is idempotent: a task already enqueued for this rollout on an agent is
+// adopted through RolloutDedupeKey, whatever its status, so re-launching a wave
+// that crashed half way never runs the action twice on one agent.
+//
+// An agent Enqueue refuses halts the rollout there, as a failed task would:
+// trying again on the next sweep would only be refused again. Any other error
+// leaves the wave for the next sweep to finish.
+func launchWave(ctx context.Context, r *Rollout, wave int) error {
+	var data interface{}
+	if r.Data != "" {
+		data = json.RawMessage(r.Data)
+	}
+
+	dedupeKey := RolloutDedupeKey(r.ID)
+	taskIDs := make([]bson.ObjectID, 0, len(r.Waves[wave].AgentIDs))
+	var refused *BatchFailure
+
+	for _, agentID := range r.Waves[wave].AgentIDs {
+		existing, err := FindByDedupeKey(agentID, dedupeKey)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			taskIDs = append(taskIDs, existing.ID)
+			continue
+		}
+
+		id, err := Enqueue(agentID, r.AccountID, r.Action, data, dedupeKey, RolloutTrigger(r.ID), r.enqueueOpts())
+		if isEnqueueRefusal(err) {
+			refused = &BatchFailure{AgentID: agentID, Error: err.Error()}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		oid, err := bson.ObjectIDFromHex(id)
+		if err != nil {
+			return err
+		}
+		taskIDs = append(taskIDs, oid)
+	}
+
+	_, err := rolloutCollection().UpdateOne(ctx,
+		bson.M{"_id": r.ID, "status": RolloutStatusRunning, "currentWave": wave},
+		launchUpdate(wave, taskIDs, refused, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	if refused != nil {
+		logger.GetInfoLogger().Printf("halted rollout %s: wave %d: agent %s refused the task: %s", r.ID.Hex(), wave+1, refused.AgentID.Hex(), refused.Error)
+		return nil
+	}
+
+	logger.GetDebugLogger().Printf("rollout %s launched wave %d/%d (%d agents)", r.ID.Hex(), wave+1, len(r.Waves), len(taskIDs))
+	return nil
+}
+
+// rolloutStep is what reconcileRollout does next with a running rollout.
+type rolloutStep int
+
+const (
+	rolloutWait rolloutStep = iota
+	rolloutLaunch
+	rolloutAdvance
+	rolloutComplete
+	rolloutHalt
+)
+
+// waveProgress is how the tasks of the current wave stand.
+type waveProgress struct {
+	completed, failed, active, missing int
+}
+
+// nextRolloutStep is the whole of the rollout state machine, pure so it can be
+// tested without a database.
+//
+// A wave with tasks still to enqueue is launched first. After that any failed
+// task halts; so does a missing one, since a task that no longer exists (its
+// finished row expired) cannot be shown to have completed. Only a wave with
+// every task completed lets the rollout move on.
+func nextRolloutStep(r *Rollout, p waveProgress) rolloutStep {
+	wave := r.Waves[r.CurrentWave]
+
+	switch {
+	case len(wave.TaskIDs) < len(wave.AgentIDs):
+		return rolloutLaunch
+	case p.failed > 0 || p.missing > 0:
+		return rolloutHalt
+	case p.active > 0:
+		return rolloutWait
+	case r.CurrentWave == len(r.Waves)-1:
+		return rolloutComplete
+	default:
+		return rolloutAdvance
+	}
+}
+
+func currentWaveProgress(ctx context.Context, wave RolloutWave) (waveProgress, error) {
+	p := waveProgress{}
+	if len(wave.TaskIDs) == 0 {
+		return p, nil
+	}
+
+	cur, err := collection().Find(ctx, bson.M{"_id": bson.M{"$in": wave.TaskIDs}},
+		options.Find().SetProjection(bson.M{"status": 1}))
+	if err != nil {
+		return p, err
+	}
+
+	var tasks []struct {
+		Status string `bson:"status"`
+	}
+	if err := cur.All(ctx, &tasks); err != nil {
+		return p, err
+	}
+
+	for _, task := range tasks {
+		switch task.Status {
+		case v2.TaskStatusCompleted:
+			p.completed++
+		case v2.TaskStatusDead, v2.TaskStatusCancelled:
+			p.failed++
+		default:
+			p.active++
+		}
+	}
+	p.missing = len(wave.TaskIDs) - len(tasks)
+	return p, nil
+}
+
+// reconcileRollout takes one step of a running rollout. Every write is fenced on
+// the wave it read, so two replicas reconciling the same rollout (two tasks of
+// a wave finishing at once) advance it once.
+func reconcileRollout(ctx context.Context, r *Rollout) error {
+	wave := r.Waves[r.CurrentWave]
+
+	p, err := currentWaveProgress(ctx, wave)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	fence := bson.M{"_id": r.ID, "status": RolloutStatusRunning, "currentWave": r.CurrentWave}
+
+	switch nextRolloutStep(r, p) {
+	case rolloutLaunch:
+		return launchWave(ctx, r, r.CurrentWave)
+
+	case rolloutHalt:
+		reason := fmt.Sprintf("wave %d: %d task(s) failed", r.CurrentWave+1, p.failed+p.missing)
+		if _, err := rolloutCollection().UpdateOne(ctx, fence, haltUpdate(reason, now)); err != nil {
+			return err
+		}
+		logger.GetInfoLogger().Printf("halted rollout %s: %s", r.ID.Hex(), reason)
+		return nil
+
+	case rolloutComplete:
+		_, err := rolloutCollection().UpdateOne(ctx, fence, bson.M{"$set": bson.M{
+			"status":     RolloutStatusCompleted,
+			"finishedAt": now,
+			"updatedAt":  now,
+		}})
+		return err
+
+	case rolloutAdvance:
+		res, err := rolloutCollection().UpdateOne(ctx, fence, bson.M{"$set": bson.M{
+			"currentWave": r.CurrentWave + 1,
+			"updatedAt":   now,
+		}})
+		if err != nil || res.MatchedCount == 0 {
+			return err
+		}
+		r.CurrentWave++
+		return launchWave(ctx, r, r.CurrentWave)
+	}
+
+	return nil
+}
+
+// nudgeRollout is the cascade hook: when a task reaches a terminal state, the
+// running rollout it belongs to (if any) is marked for the next sweep. The
+// wave itself is launched there, not here: enqueueing a wave's tasks inside
+// the Complete or Fail that finished the last one would hold that call up for
+// as long as the whole wave takes to enqueue.
+func nudgeRollout(ctx context.Context, taskID bson.ObjectID) error {
+	_, err := rolloutCollection().UpdateOne(ctx,
+		bson.M{"status": RolloutStatusRunning, "waves.taskIds": taskID},
+		bson.M{"$set": bson.M{"nudgedAt": time.Now()}})
+	return err
+}
+
+// rolloutsDueFilter matches the running rollouts a sweep steps: those nudged
+// since their last step, and those that have gone quiet, which is the safety
+// net for a lost nudge or a replica that died half way through launching a
+// wave.
+func rolloutsDueFilter(now time.Time) bson.M {
+	return bson.M{
+		"status": RolloutStatusRunning,
+		"$or": bson.A{
+			bson.M{"nudgedAt": bson.M{"$exists": true}},
+			bson.M{"updatedAt": bson.M{"$lt": now.Add(-rolloutStaleAfter)}},
+		},
+	}
+}
+
+// ReconcileRollouts steps every running rollout that is due. It runs on its
+// own job (see InitAgentTaskService), which is where waves are launched.
+func ReconcileRollouts() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cur, err := rolloutCollection().Find(ctx, rolloutsDueFilter(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	due := make([]Rollout, 0)
+	if err := cur.All(ctx, &due); err != nil {
+		return err
+	}
+
+	for idx := range due {
+		r := &due[idx]
+
+		// Cleared before the step, and only as read, so a task that finishes
+		// while the step runs leaves its nudge for the next sweep.
+		if r.NudgedAt != nil {
+			if _, err := rolloutCollection().UpdateOne(ctx,
+				bson.M{"_id": r.ID, "nudgedAt": *r.NudgedAt},
+				bson.M{"$unset": bson.M{"nudgedAt": ""}}); err != nil {
+				logger.GetErrorLogger().Printf("error clearing the nudge on rollout %s: %s", r.ID.Hex(), err.Error())
+				continue
+			}
+		}
+
+		if err := reconcileRollout(ctx, r); err != nil {
+			logger.GetErrorLogger().Printf("error reconciling rollout %s: %s", r.ID.Hex(), err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package agenttask
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func agentIDs(n int) []bson.ObjectID {
+	ids := make([]bson.ObjectID, n)
+	for idx := range ids {
+		ids[idx] = bson.NewObjectID()
+	}
+	return ids
+}
+
+func waveSizes(waves []RolloutWave) []int {
+	sizes := make([]int, len(waves))
+	for idx, wave := range waves {
+		sizes[idx] = len(wave.AgentIDs)
+	}
+	return sizes
+}
+
+func TestPlanWavesCanaryThenQuarterThenRest(t *testing.T) {
+	ids := agentIDs(20)
+	waves := planWaves(ids, DefaultRolloutWaves)
+
+	got := waveSizes(waves)
+	if len(got) != 3 || got[0] != 1 || got[1] != 4 || got[2] != 15 {
+		t.Fatalf("expected waves of 1, 4 and 15 agents, got %v", got)
+	}
+	if waves[0].AgentIDs[0] != ids[0] {
+		t.Fatal("expected the first agent given to be the canary")
+	}
+}
+
+// Rounding must never produce an empty wave: a small fleet collapses waves
+// instead.
+func TestPlanWavesSkipsWavesTooSmallToAddAnAgent(t *testing.T) {
+	if got := waveSizes(planWaves(agentIDs(1), DefaultRolloutWaves)); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("expected a single canary wave for one agent, got %v", got)
+	}
+	if got := waveSizes(planWaves(agentIDs(3), DefaultRolloutWaves)); len(got) != 2 || got[1] != 2 {
+		t.Fatalf("expected the canary then the rest for three agents, got %v", got)
+	}
+}
+
+func TestRolloutInputRejectsNonIncreasingWaves(t *testing.T) {
+	in := RolloutInput{Action: "startsfserver", AgentIDs: agentIDs(2), WavePercents: []int{50, 25}}
+	if err := in.validate(); err == nil {
+		t.Fatal("expected falling wave percentages to be rejected")
+	}
+
+	in.WavePercents = []int{10, 50}
+	if err := in.validate(); err != nil {
+		t.Fatalf("expected rising wave percentages to be accepted, got %s", err)
+	}
+}
+
+func TestNextRolloutStep(t *testing.T) {
+	launched := RolloutWave{AgentIDs: agentIDs(2), TaskIDs: agentIDs(2)}
+	r := &Rollout{Waves: []RolloutWave{launched, {AgentIDs: agentIDs(3)}}}
+
+	cases := []struct {
+		name string
+		wave int
+		p    waveProgress
+		want rolloutStep
+	}{
+		{"still running", 0, waveProgress{completed: 1, active: 1}, rolloutWait},
+		{"one dead halts even with others running", 0, waveProgress{failed: 1, active: 1}, rolloutHalt},
+		{"an expired task halts", 0, waveProgress{completed: 1, missing: 1}, rolloutHalt},
+		{"all completed advances", 0, waveProgress{completed: 2}, rolloutAdvance},
+		{"an unlaunched wave is launched first", 1, waveProgress{}, rolloutLaunch},
+	}
+	for _, tc := range cases {
+		r.CurrentWave = tc.wave
+		if got := nextRolloutStep(r, tc.p); got != tc.want {
+			t.Errorf("%s: got step %d want %d", tc.name, got, tc.want)
+		}
+	}
+
+	r.Waves[1].TaskIDs = agentIDs(3)
+	r.CurrentWave = 1
+	if got := nextRolloutStep(r, waveProgress{completed: 3}); got != rolloutComplete {
+		t.Fatalf("expected the last wave completing to complete the rollout, got %d", got)
+	}
+}
+
+func TestIsEnqueueRefusal(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("%w: needs backuprestore", ErrActionUnsupported), true},
+		{fmt.Errorf("%w: needs 1.2.0", ErrAgentTooOld), true},
+		{mongo.ErrNoDocuments, true},
+		{errForeignParent, true},
+		{errors.New("connection reset"), false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if got := isEnqueueRefusal(c.err); got != c.want {
+			t.Fatalf("%v: expected %v, got %v", c.err, c.want, got)
+		}
+	}
+}
+
+// A refused agent halts the rollout with the failure on record, and keeps the
+// tasks the wave did enqueue before it.
+func TestLaunchUpdateHaltsOnARefusal(t *testing.T) {
+	enqueued := agentIDs(1)
+	refused := &BatchFailure{AgentID: bson.NewObjectID(), Error: "agent does not support this task action"}
+
+	update := launchUpdate(1, enqueued, refused, time.Now())
+
+	set := update["$set"].(bson.M)
+	if set["status"] != RolloutStatusHalted {
+		t.Fatalf("expected the rollout to halt, got %v", set["status"])
+	}
+	if ids, ok := set["waves.1.taskIds"].([]bson.ObjectID); !ok || len(ids) != 1 {
+		t.Fatalf("expected the wave's enqueued tasks to be kept, got %v", set["waves.1.taskIds"])
+	}
+	if pushed := update["$push"].(bson.M)["failures"]; pushed != *refused {
+		t.Fatalf("expected the refusal to be recorded, got %v", pushed)
+	}
+
+	if update := launchUpdate(1, enqueued, nil, time.Now()); update["$set"].(bson.M)["status"] != nil || update["$push"] != nil {
+		t.Fatalf("expected a clean launch to leave the rollout running, got %v", update)
+	}
+}
@@ -9,7 +9,12 @@ import (
 	"github.com/mrhid6/go-mongoose-lock/joblock"
 )
 
-var reaperJob *joblock.JobLockTask
+var (
+	reaperJob   *joblock.JobLockTask
+	scheduleJob *joblock.JobLockTask
+	rolloutJob  *joblock.JobLockTask
+	storageJob  *joblock.JobLockTask
+)
 
 // InitAgentTaskService creates the indexes before anything can dispatch. If the
 // indexes are missing, the queue's invariants are not enforced, so a failure here
@@ -18,6 +23,24 @@ func InitAgentTaskService() error {
 	if err := EnsureIndexes(); err != nil {
 		return err
 	}
+	if err := EnsureScheduleIndexes(); err != nil {
+		return err
+	}
+	if err := EnsureRolloutIndexes(); err != nil {
+		return err
+	}
+	if err := EnsureEventIndexes(); err != nil {
+		return err
+	}
+	if err := EnsurePolicyIndexes(); err != nil {
+		return err
+	}
+	if err := EnsureBatchIndexes(); err != nil {
+		return err
+	}
+	if err := EnsureSignalCollection(); err != nil {
+		return err
+	}
 
 	var err error
 	reaperJob, err = joblock.NewJobLockTask(
@@ -40,7 +63,75 @@ func InitAgentTaskService() error {
 		return err
 	}
 
+	scheduleJob, err = joblock.NewJobLockTask(
+		repositories.GetMongoClient(),
+		"materializeAgentTaskSchedulesJob",
+		func() {
+			if err := MaterializeDueSchedules(); err != nil {
+				logger.GetErrorLogger().Printf("error materializing task schedules: %s", err.Error())
+			}
+		},
+		15*time.Second,
+		30*time.Second,
+		false,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := scheduleJob.Run(context.Background()); err != nil {
+		return err
+	}
+
+	// Waves are launched here rather than in the cascade of the task that
+	// finished the wave before; see nudgeRollout.
+	rolloutJob, err = joblock.NewJobLockTask(
+		repositories.GetMongoClient(),
+		"advanceAgentTaskRolloutsJob",
+		func() {
+			if err := ReconcileRollouts(); err != nil {
+				logger.GetErrorLogger().Printf("error reconciling task rollouts: %s", err.Error())
+			}
+		},
+		5*time.Second,
+		30*time.Second,
+		false,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := rolloutJob.Run(context.Background()); err != nil {
+		return err
+	}
+
+	// The storage sweeps write to object storage, so they are kept off the
+	// reaper, which must not fall behind on leases.
+	storageJob, err = joblock.NewJobLockTask(
+		repositories.GetMongoClient(),
+		"agentTaskStorageSweepJob",
+		func() {
+			if err := exportExpiringDeadLetters(); err != nil {
+				logger.GetErrorLogger().Printf("error exporting dead tasks: %s", err.Error())
+			}
+			if err := deleteExpiringArtifacts(); err != nil {
+				logger.GetErrorLogger().Printf("error deleting expiring task artifacts: %s", err.Error())
+			}
+		},
+		time.Minute,
+		2*time.Minute,
+		false,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := storageJob.Run(context.Background()); err != nil {
+		return err
+	}
+
 	StartDispatcher()
+	startUpdateFeed()
 
 	logger.GetDebugLogger().Println("Initalized Agent Task Service")
 	return nil
@@ -48,6 +139,7 @@ func InitAgentTaskService() error {
 
 func ShutdownAgentTaskService() error {
 	StopDispatcher()
+	stopUpdateFeed()
 
 	if reaperJob != nil {
 		if err := reaperJob.UnLock(context.TODO()); err != nil {
@@ -55,6 +147,24 @@ func ShutdownAgentTaskService() error {
 		}
 	}
 
+	if scheduleJob != nil {
+		if err := scheduleJob.UnLock(context.TODO()); err != nil {
+			return err
+		}
+	}
+
+	if rolloutJob != nil {
+		if err := rolloutJob.UnLock(context.TODO()); err != nil {
+			return err
+		}
+	}
+
+	if storageJob != nil {
+		if err := storageJob.UnLock(context.TODO()); err != nil {
+			return err
+		}
+	}
+
 	logger.GetDebugLogger().Println("Shutdown Agent Task Service")
 	return nil
 }
@@ -0,0 +1,452 @@
+package agenttask
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	scheduleCollectionName = "agenttaskschedules"
+
+	// scheduleMissTolerance is how late a slot may be materialized and still
+	// fire. A replica outage that spans a 03:00 restart must not fire that
+	// restart at 14:00 when the backend comes back: a slot older than this is
+	// skipped and the schedule moves on to its next one.
+	scheduleMissTolerance = 10 * time.Minute
+
+	// maxSchedulePreview caps the "next runs" preview a caller may ask for.
+	maxSchedulePreview = 20
+)
+
+// Schedule is a recurring task on one agent. The materializer turns each due
+// slot into an ordinary agenttasks row through Enqueue, so a scheduled task is
+// gated, leased, retried and reaped exactly like any other.
+//
+// NextRunAt is the slot the materializer will fire next. It is unset while the
+// schedule is disabled, which is what keeps a disabled schedule out of the
+// due_schedules index scan entirely.
+type Schedule struct {
+	ID         bson.ObjectID `bson:"_id"`
+	AgentID    bson.ObjectID `bson:"agentId"`
+	AccountID  bson.ObjectID `bson:"accountId"`
+	Name       string        `bson:"name"`
+	Action     string        `bson:"action"`
+	Data       string        `bson:"data,omitempty"`
+	Cron       string        `bson:"cron"`
+	TimeZone   string        `bson:"timeZone,omitempty"`
+	Enabled    bool          `bson:"enabled"`
+	NextRunAt  *time.Time    `bson:"nextRunAt,omitempty"`
+	LastRunAt  *time.Time    `bson:"lastRunAt,omitempty"`
+	LastTaskID string        `bson:"lastTaskId,omitempty"`
+	LastError  string        `bson:"lastError,omitempty"`
+	// LastMissedAt is the latest slot that never fired: the backend was down
+	// through it, or its task could not be enqueued in time.
+	LastMissedAt *time.Time `bson:"lastMissedAt,omitempty"`
+	CreatedBy    string     `bson:"createdBy,omitempty"`
+	CreatedAt    time.Time  `bson:"createdAt"`
+	UpdatedAt    time.Time  `bson:"updatedAt"`
+}
+
+// ScheduleInput is the user-editable part of a Schedule. Data, when set, must
+// be a JSON document; it is stored verbatim and becomes the task payload.
+type ScheduleInput struct {
+	Name     string
+	Action   string
+	Data     string
+	Cron     string
+	TimeZone string
+	Enabled  bool
+}
+
+func scheduleCollection() *mongo.Collection {
+	return repositories.GetMongoClient().GetCollection(scheduleCollectionName)
+}
+
+// EnsureScheduleIndexes creates the indexes the materializer scans on.
+func EnsureScheduleIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "enabled", Value: 1}, {Key: "nextRunAt", Value: 1}},
+			Options: options.Index().SetName("due_schedules"),
+		},
+		{
+			Keys:    bson.D{{Key: "agentId", Value: 1}},
+			Options: options.Index().SetName("by_agent"),
+		},
+	}
+
+	if _, err := scheduleCollection().Indexes().CreateMany(ctx, indexes); err != nil {
+		return err
+	}
+
+	logger.GetDebugLogger().Println("Ensured agenttaskschedules indexes")
+	return nil
+}
+
+// validate parses the cron expression so a bad one is rejected when it is
+// saved, not minutes later when the materializer first reads it.
+func (in ScheduleInput) validate() (*CronSpec, error) {
+	if in.Action == "" {
+		return nil, errors.New("schedule action is required")
+	}
+	if in.Data != "" && !json.Valid([]byte(in.Data)) {
+		return nil, errors.New("schedule data must be valid JSON")
+	}
+	if _, err := checkAction(in.Action, in.Data); err != nil {
+		return nil, err
+	}
+	return ParseCron(in.Cron, in.TimeZone)
+}
+
+// nextRunFor is the NextRunAt a schedule should carry: its next slot after now,
+// or nil while it is disabled.
+func nextRunFor(spec *CronSpec, enabled bool, now time.Time) (*time.Time, error) {
+	if !enabled {
+		return nil, nil
+	}
+
+	next := spec.Next(now)
+	if next.IsZero() {
+		return nil, errors.New("cron expression never matches")
+	}
+	next = next.UTC()
+	return &next, nil
+}
+
+func CreateSchedule(agentID, accountID bson.ObjectID, createdBy string, in ScheduleInput) (*Schedule, error) {
+	spec, err := in.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	nextRunAt, err := nextRunFor(spec, in.Enabled, now)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Schedule{
+		ID:        bson.NewObjectID(),
+		AgentID:   agentID,
+		AccountID: accountID,
+		Name:      in.Name,
+		Action:    in.Action,
+		Data:      in.Data,
+		Cron:      in.Cron,
+		TimeZone:  in.TimeZone,
+		Enabled:   in.Enabled,
+		NextRunAt: nextRunAt,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := scheduleCollection().InsertOne(ctx, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// UpdateSchedule replaces the schedule's editable fields and recomputes its next
+// slot from now. Editing a schedule never fires a slot that has already passed.
+func UpdateSchedule(scheduleID string, in ScheduleInput) (*Schedule, error) {
+	oid, err := bson.ObjectIDFromHex(scheduleID)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := in.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	nextRunAt, err := nextRunFor(spec, in.Enabled, now)
+	if err != nil {
+		return nil, err
+	}
+
+	set := bson.M{
+		"name":      in.Name,
+		"action":    in.Action,
+		"data":      in.Data,
+		"cron":      in.Cron,
+		"timeZone":  in.TimeZone,
+		"enabled":   in.Enabled,
+		"updatedAt": now,
+	}
+	unset := bson.M{"lastError": ""}
+	if nextRunAt != nil {
+		set["nextRunAt"] = *nextRunAt
+	} else {
+		unset["nextRunAt"] = ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	s := &Schedule{}
+	err = scheduleCollection().FindOneAndUpdate(ctx,
+		bson.M{"_id": oid},
+		bson.M{"$set": set, "$unset": unset}, opts).Decode(s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("schedule not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func GetSchedule(scheduleID string) (*Schedule, error) {
+	oid, err := bson.ObjectIDFromHex(scheduleID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s := &Schedule{}
+	err = scheduleCollection().FindOne(ctx, bson.M{"_id": oid}).Decode(s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("schedule not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func ListSchedulesForAgent(agentID bson.ObjectID) ([]Schedule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+	cur, err := scheduleCollection().Find(ctx, bson.M{"agentId": agentID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	schedules := make([]Schedule, 0)
+	if err := cur.All(ctx, &schedules); err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// DeleteSchedule removes the schedule. Tasks it has already materialized are
+// ordinary tasks by then and are left alone.
+func DeleteSchedule(scheduleID string) error {
+	oid, err := bson.ObjectIDFromHex(scheduleID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = scheduleCollection().DeleteOne(ctx, bson.M{"_id": oid})
+	return err
+}
+
+// DeleteSchedulesForAgent is called when the agent itself is deleted, so the
+// materializer never enqueues onto an agent that no longer exists.
+func DeleteSchedulesForAgent(agentID bson.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := scheduleCollection().DeleteMany(ctx, bson.M{"agentId": agentID})
+	return err
+}
+
+// PreviewSchedule returns the next n slots of a cron expression without saving
+// anything, so the UI can show "next run" before the user commits.
+func PreviewSchedule(cron, tz string, n int) ([]time.Time, error) {
+	spec, err := ParseCron(cron, tz)
+	if err != nil {
+		return nil, err
+	}
+
+	if n <= 0 || n > maxSchedulePreview {
+		n = 5
+	}
+	return spec.NextN(time.Now(), n), nil
+}
+
+// MaterializeDueSchedules enqueues one task for every schedule whose slot is due.
+// It runs under a joblock, so only one replica materializes at a time, but it
+// does not rely on that: see materializeSchedule for why a slot fires once even
+// if two runs overlap.
+func MaterializeDueSchedules() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	cur, err := scheduleCollection().Find(ctx, bson.M{
+		"enabled":   true,
+		"nextRunAt": bson.M{"$lte": now},
+	})
+	if err != nil {
+		return err
+	}
+
+	due := make([]Schedule, 0)
+	if err := cur.All(ctx, &due); err != nil {
+		return err
+	}
+
+	for idx := range due {
+		if err := materializeSchedule(ctx, &due[idx], now); err != nil {
+			logger.GetErrorLogger().Printf("error materializing schedule %s: %s", due[idx].ID.Hex(), err.Error())
+		}
+	}
+
+	return nil
+}
+
+// materializeSchedule fires the schedule's due slot and advances it. A slot
+// whose task cannot be enqueued is not advanced past: it stays due and is tried
+// again on the next run, until it is older than scheduleMissTolerance and is
+// recorded as missed instead.
+//
+// A slot fires exactly once because the task is keyed on (schedule, slot):
+// FindByDedupeKey adopts a task from an earlier run that enqueued but crashed
+// before advancing, whatever its status, and Enqueue's dedupe adoption covers
+// two runs racing the same slot. The advance is fenced on the slot we read, so
+// a concurrent edit that moved nextRunAt is never overwritten with a stale one.
+//
+// The next slot is computed from now, not from the fired slot. Slots missed
+// while the backend was down collapse into the one that fires (or is skipped,
+// see scheduleMissTolerance) rather than replaying one task per missed slot.
+func materializeSchedule(ctx context.Context, s *Schedule, now time.Time) error {
+	if s.NextRunAt == nil {
+		return nil
+	}
+	slot := *s.NextRunAt
+
+	spec, err := ParseCron(s.Cron, s.TimeZone)
+	if err != nil {
+		// Only reachable for a row written before validation existed, or a zone
+		// the host's tzdata has since lost. Park it rather than failing every tick.
+		_, uerr := scheduleCollection().UpdateOne(ctx,
+			bson.M{"_id": s.ID, "nextRunAt": slot},
+			bson.M{
+				"$set":   bson.M{"enabled": false, "lastError": err.Error(), "updatedAt": now},
+				"$unset": bson.M{"nextRunAt": ""},
+			})
+		return errors.Join(err, uerr)
+	}
+
+	set := bson.M{"updatedAt": now}
+	unset := bson.M{}
+
+	if now.Sub(slot) <= scheduleMissTolerance {
+		taskID, err := fireScheduleSlot(s, slot)
+		if err != nil {
+			_, uerr := scheduleCollection().UpdateOne(ctx,
+				bson.M{"_id": s.ID, "nextRunAt": slot},
+				bson.M{"$set": bson.M{"lastError": err.Error(), "updatedAt": now}})
+			return errors.Join(err, uerr)
+		}
+		set["lastRunAt"] = slot
+		set["lastTaskId"] = taskID
+		unset["lastError"] = ""
+	} else {
+		logger.GetInfoLogger().Printf("skipping schedule %s slot %s: missed by more than %s", s.ID.Hex(), slot.Format(time.RFC3339), scheduleMissTolerance)
+		set["lastMissedAt"] = slot
+		set["lastError"] = missedSlotError(slot, s.LastError)
+	}
+
+	if next := spec.Next(now); next.IsZero() {
+		set["enabled"] = false
+		unset["nextRunAt"] = ""
+	} else {
+		set["nextRunAt"] = next.UTC()
+	}
+
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	_, err = scheduleCollection().UpdateOne(ctx, bson.M{"_id": s.ID, "nextRunAt": slot}, update)
+	return err
+}
+
+const missedSlotPrefix = "missed the run due at "
+
+// missedSlotError is the lastError a missed slot leaves, carrying the error
+// that kept it from firing when there was one. A lastError left by an earlier
+// missed slot is unwrapped first, so misses in a row keep the one root cause
+// rather than nesting it.
+func missedSlotError(slot time.Time, lastError string) string {
+	if rest, ok := strings.CutPrefix(lastError, missedSlotPrefix); ok {
+		_, lastError, _ = strings.Cut(rest, ": ")
+	}
+
+	msg := missedSlotPrefix + slot.Format(time.RFC3339)
+	if lastError != "" {
+		msg += ": " + lastError
+	}
+	return msg
+}
+
+// ScheduleTrigger is the TaskTrigger every task of a schedule is enqueued with.
+func ScheduleTrigger(scheduleID bson.ObjectID) v2.TaskTrigger {
+	return v2.TaskTrigger{Type: v2.TaskTriggerSystem, ExternalID: "schedule:" + scheduleID.Hex()}
+}
+
+// enqueueOpts are the options each of the schedule's tasks is enqueued with:
+// below what a person asks for right now, on behalf of whoever set it up.
+func (s *Schedule) enqueueOpts() EnqueueOpts {
+	return EnqueueOpts{Priority: PriorityScheduled, RequestedBy: s.CreatedBy}
+}
+
+func fireScheduleSlot(s *Schedule, slot time.Time) (string, error) {
+	dedupeKey := ScheduleDedupeKey(s.ID, slot)
+
+	existing, err := FindByDedupeKey(s.AgentID, dedupeKey)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return existing.ID.Hex(), nil
+	}
+
+	var data interface{}
+	if s.Data != "" {
+		data = json.RawMessage(s.Data)
+	}
+
+	taskID, err := Enqueue(
+		s.AgentID, s.AccountID, s.Action, data, dedupeKey,
+		ScheduleTrigger(s.ID),
+		s.enqueueOpts(),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	logger.GetDebugLogger().Printf("schedule %s enqueued task %s (%s) for slot %s", s.ID.Hex(), taskID, s.Action, slot.Format(time.RFC3339))
+	return taskID, nil
+}
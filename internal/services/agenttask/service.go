@@ -49,10 +49,46 @@ func EnsureIndexes() error {
 			Keys:    bson.D{{Key: "agentId", Value: 1}, {Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}},
 			Options: options.Index().SetName("dispatch_claim"),
 		},
+		{
+			// Claim's sort. Prefixed with the dispatch_claim equality keys so the
+			// sort is served from the index rather than in memory.
+			Keys: bson.D{
+				{Key: "agentId", Value: 1}, {Key: "status", Value: 1},
+				{Key: "priority", Value: -1}, {Key: "createdAt", Value: 1},
+			},
+			Options: options.Index().SetName("dispatch_claim_priority"),
+		},
 		{
 			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "leaseExpiresAt", Value: 1}},
 			Options: options.Index().SetName("reaper_sweep"),
 		},
+		{
+			// The cascade's lookups: every terminal transition asks "who is
+			// waiting on me?" through each gate field. Sparse, because almost
+			// no task is gated.
+			Keys:    bson.D{{Key: "dependsOn", Value: 1}},
+			Options: options.Index().SetName("cascade_depends_on").SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "dependsOnAll", Value: 1}},
+			Options: options.Index().SetName("cascade_depends_on_all").SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "dependsOnAny", Value: 1}},
+			Options: options.Index().SetName("cascade_depends_on_any").SetSparse(true),
+		},
+		{
+			// The approval expiry sweep. Sparse: only tasks awaiting approval
+			// carry an expiry.
+			Keys:    bson.D{{Key: "approvalExpiresAt", Value: 1}},
+			Options: options.Index().SetName("approval_sweep").SetSparse(true),
+		},
+		{
+			// The deadline sweep. Sparse: only tasks whose policy has a
+			// deadline carry one.
+			Keys:    bson.D{{Key: "deadlineAt", Value: 1}},
+			Options: options.Index().SetName("deadline_sweep").SetSparse(true),
+		},
 		{
 			Keys: bson.D{{Key: "agentId", Value: 1}},
 			Options: options.Index().
@@ -100,17 +136,54 @@ func EnsureIndexes() error {
 // ungated and older than the new one, which is the only ordering under which the
 // dispatcher's FIFO claim cannot run them backwards. If the insert then fails,
 // the caller must SetGate the stranded task back to claimable.
+//
+// DependsOn, DependsOnAll and DependsOnAny are the three parent gates; at most
+// one may be set (see gates.go for what each means).
+//
+// RequiresMaintenanceWindow holds the task until the agent is inside one of its
+// maintenance windows (see maintenance.go).
+//
+// RequiresApproval holds the task for a second account member. The task's
+// policy can require it too; either is enough.
+//
+// RequestedBy is the account member the task is on behalf of. Batches,
+// rollouts, schedules and workflows trigger tasks under their own id, so they
+// pass whoever created them; a user trigger defaults to its ExternalID.
+//
+// Priority is left at PriorityDefault by almost every caller; see priorityFor.
+// SetGate ignores it: re-gating a task never changes its place in line.
 type EnqueueOpts struct {
-	ID                    *bson.ObjectID
-	DependsOn             *bson.ObjectID
-	RequiresServerStopped bool
+	ID                        *bson.ObjectID
+	DependsOn                 *bson.ObjectID
+	DependsOnAll              []bson.ObjectID
+	DependsOnAny              []bson.ObjectID
+	RequiresServerStopped     bool
+	RequiresMaintenanceWindow bool
+	RequiresApproval          bool
+	RequestedBy               string
+	Priority                  TaskPriority
+	// Ungated says the caller has decided the task needs no gate, so the
+	// action's default gates are not laid over it either.
+	Ungated bool
 }
 
 // Enqueue creates a pending task. It is idempotent on dedupeKey: if an active
 // task with the same key already exists, its id is returned instead of an error.
 // This closes the window where a workflow step writes a task, crashes before
 // persisting the id, and re-enqueues on restart.
+//
+// The task's attempt budget, lease length and deadline are fixed here from
+// PolicyFor(accountID, action).
+//
+// The action must be registered (see actions.go) and data must fit its payload
+// schema; for now an unregistered action is still let through, see
+// enqueueSpec. A task the caller does not gate carries the action's default
+// gates, unless it says it is Ungated.
 func Enqueue(agentID, accountID bson.ObjectID, action string, data interface{}, dedupeKey string, trigger v2.TaskTrigger, opts EnqueueOpts) (string, error) {
+	if err := opts.validateGate(); err != nil {
+		return "", err
+	}
+
 	payload := ""
 	if data != nil {
 		b, err := json.Marshal(data)
@@ -120,6 +193,34 @@ func Enqueue(agentID, accountID bson.ObjectID, action string, data interface{},
 		payload = string(b)
 	}
 
+	spec, registered, err := enqueueSpec(action, payload)
+	if err != nil {
+		return "", err
+	}
+	if !registered {
+		logger.GetWarnLogger().Printf("enqueueing unregistered task action %q for agent %s; it will be refused in a future release", action, agentID.Hex())
+	}
+	opts = spec.applyDefaultGates(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	capabilities, err := Capabilities(ctx, agentID)
+	if err != nil {
+		return "", err
+	}
+	// An unregistered action is not checked: claimFilter only blocks the
+	// registered actions an agent cannot run, so refusing one here would refuse
+	// what the dispatcher would still hand out.
+	if registered {
+		if err := capabilities.check(spec); err != nil {
+			return "", err
+		}
+	}
+	if err := checkParentAccount(ctx, accountID, opts.parents()); err != nil {
+		return "", err
+	}
+
 	doc := v2.NewAgentTaskDoc(agentID, accountID, action, payload, dedupeKey, trigger, v2.AgentTaskOpts{
 		DependsOn:             opts.DependsOn,
 		RequiresServerStopped: opts.RequiresServerStopped,
@@ -128,11 +229,40 @@ func Enqueue(agentID, accountID bson.ObjectID, action string, data interface{},
 		doc.ID = *opts.ID
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	policy := PolicyFor(accountID, action)
+	doc.MaxAttempts = policy.MaxAttempts
+
+	row := taskDoc{
+		AgentTaskSchema:           doc,
+		Priority:                  priorityFor(opts.Priority, trigger),
+		DependsOnAll:              opts.DependsOnAll,
+		DependsOnAny:              opts.DependsOnAny,
+		LeaseSeconds:              int32(policy.Lease.Seconds()),
+		RequiresMaintenanceWindow: opts.RequiresMaintenanceWindow,
+		RequestedBy:               requesterFor(trigger, opts),
+	}
+	if opts.RequiresApproval || policy.RequiresApproval {
+		expires := doc.CreatedAt.Add(approvalTTL)
+		row.RequiresApproval = true
+		row.ApprovalExpiresAt = &expires
+	}
+	row.applyDeadline(policy.Deadline)
 
-	_, err := collection().InsertOne(ctx, doc)
+	_, err = collection().InsertOne(ctx, row)
 	if err == nil {
+		enqueuedTotal.Inc(action)
+		recordEvent(TaskEvent{
+			TaskID:  doc.ID,
+			Type:    EventEnqueued,
+			Message: fmt.Sprintf("triggered by %s %s", trigger.Type, trigger.ExternalID),
+		})
+		if err := settleFinishedParents(ctx, opts.parents()); err != nil {
+			logger.GetErrorLogger().Printf("error settling the parents of task %s: %s", doc.ID.Hex(), err.Error())
+		}
+		if row.RequiresApproval {
+			recordEvent(TaskEvent{TaskID: doc.ID, Type: EventAwaitingApproval})
+			runApprovalHooks(ApprovalEvent{Type: ApprovalRequired, TaskID: doc.ID, AgentID: agentID, AccountID: accountID, Action: action, Actor: row.RequestedBy})
+		}
 		notifyEnqueued(agentID)
 		return doc.ID.Hex(), nil
 	}
@@ -213,6 +343,13 @@ func ReplacePendingPayload(agentID bson.ObjectID, action string, data interface{
 // The zero EnqueueOpts releases the task. That is also how a caller un-strands a
 // task it gated onto a pre-assigned _id whose insert then failed.
 //
+// Approval is the exception: RequiresApproval adds the hold, but nothing here
+// lifts one. Only Approve and Reject do, or re-gating a task would be a way
+// around its second member.
+//
+// Re-gating restarts the task's policy deadline, which starts again once the
+// task can be claimed.
+//
 // The bool reports whether the task was still PENDING and so actually re-gated.
 // It is load-bearing, not diagnostic: false means the dispatcher has already
 // claimed the task and it is RUNNING RIGHT NOW. A caller re-gating a pre-existing
@@ -225,6 +362,9 @@ func SetGate(taskID string, opts EnqueueOpts) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	if err := opts.validateGate(); err != nil {
+		return false, err
+	}
 
 	set := bson.M{"updatedAt": time.Now()}
 	unset := bson.M{}
@@ -234,11 +374,33 @@ func SetGate(taskID string, opts EnqueueOpts) (bool, error) {
 	} else {
 		unset["dependsOn"] = ""
 	}
+	if len(opts.DependsOnAll) > 0 {
+		set["dependsOnAll"] = opts.DependsOnAll
+	} else {
+		unset["dependsOnAll"] = ""
+	}
+	if len(opts.DependsOnAny) > 0 {
+		set["dependsOnAny"] = opts.DependsOnAny
+	} else {
+		unset["dependsOnAny"] = ""
+	}
 	if opts.RequiresServerStopped {
 		set["requiresServerStopped"] = true
 	} else {
 		unset["requiresServerStopped"] = ""
 	}
+	if opts.RequiresMaintenanceWindow {
+		set["requiresMaintenanceWindow"] = true
+	} else {
+		unset["requiresMaintenanceWindow"] = ""
+	}
+	if opts.RequiresApproval {
+		set["requiresApproval"] = true
+		set["approvalExpiresAt"] = time.Now().Add(approvalTTL)
+	}
+	// The deadline runs from when the task can be claimed under its new gates;
+	// startDeadlines restarts it.
+	unset["deadlineAt"] = ""
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -249,7 +411,17 @@ func SetGate(taskID string, opts EnqueueOpts) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	return res.MatchedCount > 0, nil
+	if res.MatchedCount == 0 {
+		return false, nil
+	}
+
+	if err := settleFinishedParents(ctx, opts.parents()); err != nil {
+		logger.GetErrorLogger().Printf("error settling the parents of task %s: %s", taskID, err.Error())
+	}
+	if opts.RequiresApproval {
+		announceApproval(ctx, oid)
+	}
+	return true, nil
 }
 
 // FindByDedupeKey returns the newest task with this key whatever its status, or
@@ -370,37 +542,42 @@ func ListForAgent(agentID bson.ObjectID, limit int64) ([]v2.AgentTaskSchema, err
 	return tasks, nil
 }
 
-// Claim atomically moves the agent's oldest due task from pending to running and
-// mints a fencing token. It returns (nil, nil) when nothing is due.
+// Claim atomically moves the agent's highest-priority due task (oldest first
+// within a level, see claimSort) from pending to running and mints a fencing
+// token. It returns (nil, nil) when nothing is due.
 //
 // If the agent already has a running task, `uniq_running_per_agent` rejects the
 // write with E11000 and we report "busy" the same way as "nothing to do". Two
 // replicas racing for the same agent therefore need no coordination: one wins,
 // the other backs off.
-func Claim(agentID bson.ObjectID, serverRunning bool) (*v2.AgentTaskSchema, error) {
+func Claim(agentID bson.ObjectID, serverRunning, inWindow bool, blocked []string) (*v2.AgentTaskSchema, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	now := time.Now()
 	token := uuid.NewString()
 
-	update := bson.M{
-		"$set": bson.M{
-			"status":         v2.TaskStatusRunning,
-			"leaseToken":     token,
-			"leaseExpiresAt": now.Add(LeaseDuration),
-			"startedAt":      now,
-			"updatedAt":      now,
-		},
-		"$inc": bson.M{"attempts": 1},
-	}
+	// A pipeline update, so the lease can be read off the task being claimed,
+	// and claimableAt off the task as it was.
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"status":         v2.TaskStatusRunning,
+		"leaseToken":     token,
+		"leaseExpiresAt": leaseExpiry(now),
+		"startedAt":      now,
+		"updatedAt":      now,
+		"attempts":       bson.M{"$add": bson.A{"$attempts", 1}},
+		"claimableAt":    claimableAtExpr,
+	}}}}
 
 	opts := options.FindOneAndUpdate().
-		SetSort(bson.D{{Key: "createdAt", Value: 1}}).
+		SetSort(claimSort()).
 		SetReturnDocument(options.After)
 
 	task := &v2.AgentTaskSchema{}
-	err := collection().FindOneAndUpdate(ctx, claimFilter(agentID, now, serverRunning), update, opts).Decode(task)
+	raw, err := collection().FindOneAndUpdate(ctx, claimFilter(agentID, now, serverRunning, inWindow, blocked), update, opts).Raw()
+	if err == nil {
+		err = bson.Unmarshal(raw, task)
+	}
 
 	switch {
 	case errors.Is(err, mongo.ErrNoDocuments):
@@ -411,9 +588,28 @@ func Claim(agentID bson.ObjectID, serverRunning bool) (*v2.AgentTaskSchema, erro
 		return nil, err
 	}
 
+	recordEvent(TaskEvent{TaskID: task.ID, Type: EventClaimed, Attempt: task.Attempts, LeaseToken: token})
+	claimedTotal.Inc(task.Action)
+	if claimableAt, ok := raw.Lookup("claimableAt").TimeOK(); ok {
+		claimLatency.Observe(now.Sub(claimableAt).Seconds(), task.Action)
+	}
 	return task, nil
 }
 
+// claimableAtExpr is when the task being claimed could first have been: the
+// later of its nextAttemptAt and its last write, which for a task held on a
+// parent or an approval is the write that released it. A task gated on its
+// server being stopped or a maintenance window is left out, as the row does not
+// record when that came true; claimLatency would count the wait it asked for.
+var claimableAtExpr = bson.M{"$cond": bson.A{
+	bson.M{"$or": bson.A{
+		bson.M{"$eq": bson.A{"$requiresServerStopped", true}},
+		bson.M{"$eq": bson.A{"$requiresMaintenanceWindow", true}},
+	}},
+	"$$REMOVE",
+	bson.M{"$max": bson.A{"$nextAttemptAt", "$updatedAt"}},
+}}
+
 // fenced builds the filter every lease-holding write must use. A task whose
 // leaseToken has moved on will match nothing, so a zombie agent's report is a
 // no-op rather than a corruption.
@@ -425,11 +621,18 @@ func fenced(taskID, leaseToken string) (bson.M, error) {
 	return bson.M{"_id": oid, "leaseToken": leaseToken, "status": v2.TaskStatusRunning}, nil
 }
 
-func Complete(taskID, leaseToken string) error {
+// Complete finishes a task with an optional JSON result (see TaskOutput). A
+// result that fails validation is refused outright rather than dropped: the
+// agent can report again, and a workflow branching on the result must never see
+// a "completed" task that silently lost it.
+func Complete(taskID, leaseToken, result string) error {
 	oid, err := bson.ObjectIDFromHex(taskID)
 	if err != nil {
 		return err
 	}
+	if err := validateResult(result); err != nil {
+		return err
+	}
 
 	filter, err := fenced(taskID, leaseToken)
 	if err != nil {
@@ -441,8 +644,12 @@ func Complete(taskID, leaseToken string) error {
 	// message is the in-flight progress note ("installing"), so it must go with the
 	// lease. Leaving it set makes a finished task read as though it were still
 	// working.
+	set := bson.M{"status": v2.TaskStatusCompleted, "finishedAt": now, "updatedAt": now, "progress": int32(100)}
+	if result != "" {
+		set["result"] = result
+	}
 	update := bson.M{
-		"$set":   bson.M{"status": v2.TaskStatusCompleted, "finishedAt": now, "updatedAt": now, "progress": int32(100)},
+		"$set":   set,
 		"$unset": bson.M{"active": "", "leaseToken": "", "leaseExpiresAt": "", "message": ""},
 	}
 
@@ -460,6 +667,12 @@ func Complete(taskID, leaseToken string) error {
 		return err
 	}
 
+	recordEvent(TaskEvent{TaskID: oid, Type: EventCompleted, Attempt: task.Attempts, LeaseToken: leaseToken})
+	completedTotal.Inc(task.Action)
+	if task.StartedAt != nil {
+		runDuration.Observe(now.Sub(*task.StartedAt).Seconds(), task.Action)
+	}
+
 	if err := cascadeChildren(ctx, oid, v2.TaskStatusCompleted, task.AgentID); err != nil {
 		logger.GetErrorLogger().Printf("error cascading children of completed task %s: %s", taskID, err.Error())
 	}
@@ -488,14 +701,20 @@ func Fail(taskID, leaseToken, errMsg string) error {
 
 	now := time.Now()
 	var update bson.M
+	event := TaskEvent{TaskID: current.ID, Type: EventFailed, Attempt: current.Attempts, LeaseToken: leaseToken, Message: errMsg}
+	outcome := outcomeRetried
 
 	switch {
 	case current.CancelRequested:
+		event.Type = EventCancelled
+		outcome = outcomeCancelled
 		update = bson.M{
 			"$set":   bson.M{"status": v2.TaskStatusCancelled, "finishedAt": now, "updatedAt": now, "lastError": errMsg},
 			"$unset": bson.M{"active": "", "leaseToken": "", "leaseExpiresAt": "", "message": ""},
 		}
 	case current.Attempts >= current.MaxAttempts:
+		event.Type = EventDead
+		outcome = outcomeDead
 		update = bson.M{
 			"$set":   bson.M{"status": v2.TaskStatusDead, "finishedAt": now, "updatedAt": now, "lastError": errMsg},
 			"$unset": bson.M{"active": "", "leaseToken": "", "leaseExpiresAt": "", "message": ""},
@@ -504,7 +723,7 @@ func Fail(taskID, leaseToken, errMsg string) error {
 		update = bson.M{
 			"$set": bson.M{
 				"status":        v2.TaskStatusPending,
-				"nextAttemptAt": now.Add(BackoffFor(current.Attempts)),
+				"nextAttemptAt": now.Add(backoffFor(current.AccountID, current.Action, current.Attempts)),
 				"updatedAt":     now,
 				"lastError":     errMsg,
 			},
@@ -516,6 +735,10 @@ func Fail(taskID, leaseToken, errMsg string) error {
 	if err != nil {
 		return err
 	}
+	if res.MatchedCount > 0 {
+		recordEvent(event)
+		failedTotal.Inc(current.Action, outcome)
+	}
 
 	// The filter is still fenced on leaseToken+status=running from the FindOne above.
 	// If the reaper terminalised this task between our FindOne and this UpdateOne, the
@@ -552,9 +775,13 @@ func Release(taskID, leaseToken string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	if _, err := collection().UpdateOne(ctx, filter, update); err != nil {
+	res, err := collection().UpdateOne(ctx, filter, update)
+	if err != nil {
 		return err
 	}
+	if res.MatchedCount > 0 {
+		recordEventHex(taskID, TaskEvent{Type: EventReleased, LeaseToken: leaseToken, Message: "returned by the agent without spending an attempt"})
+	}
 	return nil
 }
 
@@ -567,7 +794,7 @@ func RenewLease(taskID, leaseToken string) (bool, bool, error) {
 	}
 
 	now := time.Now()
-	update := bson.M{"$set": bson.M{"leaseExpiresAt": now.Add(LeaseDuration), "updatedAt": now}}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{"leaseExpiresAt": leaseExpiry(now), "updatedAt": now}}}}
 	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -582,6 +809,7 @@ func RenewLease(taskID, leaseToken string) (bool, bool, error) {
 		return false, false, err
 	}
 
+	recordEvent(TaskEvent{TaskID: task.ID, Type: EventLeaseRenewed, Attempt: task.Attempts, LeaseToken: leaseToken})
 	return true, task.CancelRequested, nil
 }
 
@@ -595,14 +823,20 @@ func ReportProgress(taskID, leaseToken string, pct int32, msg string) error {
 	defer cancel()
 
 	update := bson.M{"$set": bson.M{"progress": pct, "message": msg, "updatedAt": time.Now()}}
-	_, err = collection().UpdateOne(ctx, filter, update)
-	return err
+	res, err := collection().UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		recordEventHex(taskID, TaskEvent{Type: EventProgress, LeaseToken: leaseToken, Message: fmt.Sprintf("%d%% %s", pct, msg)})
+	}
+	return nil
 }
 
 // Cancel takes a pending task straight to terminal. A running task cannot be
 // yanked from under the agent, so it is flagged instead; the agent picks the flag
-// up on its next lease renewal and unwinds.
-func Cancel(taskID string) error {
+// up on its next lease renewal and unwinds. actor is who asked, for the timeline.
+func Cancel(taskID, actor string) error {
 	oid, err := bson.ObjectIDFromHex(taskID)
 	if err != nil {
 		return err
@@ -622,6 +856,8 @@ func Cancel(taskID string) error {
 			"$unset": bson.M{"active": ""},
 		}, opts).Decode(task)
 	if err == nil {
+		recordEvent(TaskEvent{TaskID: oid, Type: EventCancelled, Attempt: task.Attempts, Actor: actor})
+
 		// The recovery-exempt startsfserver release (see cascadeChildren) needs the
 		// real agentID to wake the dispatcher; without it the wake is silently
 		// dropped and the recovery start waits for the next tick instead.
@@ -643,13 +879,16 @@ func Cancel(taskID string) error {
 	if res.MatchedCount == 0 {
 		return fmt.Errorf("task %s is not cancellable", taskID)
 	}
+
+	recordEvent(TaskEvent{TaskID: oid, Type: EventCancelRequested, Actor: actor})
 	return nil
 }
 
 // Retry resurrects a dead task with a fresh attempt budget. If an identical
 // action is already active, uniq_active_dedupe rejects the write and the caller
-// gets a usable message rather than a second install.
-func Retry(taskID string) error {
+// gets a usable message rather than a second install. actor is who asked, for
+// the timeline.
+func Retry(taskID, actor string) error {
 	oid, err := bson.ObjectIDFromHex(taskID)
 	if err != nil {
 		return err
@@ -660,18 +899,35 @@ func Retry(taskID string) error {
 
 	now := time.Now()
 
+	// A pipeline update, so a task with a policy deadline gets the same span
+	// again from now; otherwise the deadline sweep would kill the retry at once.
+	// A row written before deadlineSeconds was stored has its span recovered
+	// from when it was enqueued.
 	res, err := collection().UpdateOne(ctx,
 		bson.M{"_id": oid, "status": v2.TaskStatusDead},
-		bson.M{
-			"$set": bson.M{
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
 				"status":          v2.TaskStatusPending,
 				"active":          true,
 				"attempts":        0,
 				"nextAttemptAt":   now,
 				"cancelRequested": false,
 				"updatedAt":       now,
-			},
-			"$unset": bson.M{"leaseToken": "", "leaseExpiresAt": "", "startedAt": "", "finishedAt": "", "lastError": ""},
+				"deadlineAt": bson.M{"$switch": bson.M{
+					"branches": bson.A{
+						bson.M{
+							"case": bson.M{"$gt": bson.A{"$deadlineSeconds", 0}},
+							"then": bson.M{"$add": bson.A{now, bson.M{"$multiply": bson.A{"$deadlineSeconds", 1000}}}},
+						},
+						bson.M{
+							"case": bson.M{"$eq": bson.A{bson.M{"$type": "$deadlineAt"}, "missing"}},
+							"then": "$$REMOVE",
+						},
+					},
+					"default": bson.M{"$add": bson.A{now, bson.M{"$subtract": bson.A{"$deadlineAt", "$createdAt"}}}},
+				}},
+			}}},
+			{{Key: "$unset", Value: bson.A{"leaseToken", "leaseExpiresAt", "startedAt", "finishedAt", "lastError", "exportedAt", "exportUrl", "eventsExpireAt"}}},
 		})
 
 	if mongo.IsDuplicateKeyError(err) {
@@ -684,6 +940,9 @@ func Retry(taskID string) error {
 		return fmt.Errorf("task %s is not dead, cannot retry", taskID)
 	}
 
+	keepTimeline(ctx, oid)
+	recordEvent(TaskEvent{TaskID: oid, Type: EventRetried, Actor: actor})
+
 	task, err := Get(taskID)
 	if err != nil {
 		return err
@@ -709,58 +968,129 @@ const recoveryExemptAction = "startsfserver"
 // terminal state. cascadeChildren does nothing but execute what this returns,
 // so there is exactly one place the rule can drift from what is tested.
 //
-// Completed parents simply lift the gate on every child. Dead/cancelled
-// parents cancel every gated child EXCEPT recoveryExemptAction, which is
-// released instead so it becomes claimable and can bring the server back up
-// — see the comment on that constant for why.
+// Completed parents lift the gate they satisfy: a dependsOn or dependsOnAny
+// child is released outright, and a dependsOnAll child loses this parent from
+// its set, which releases it once the set is empty.
+//
+// Dead/cancelled parents cancel every gated child EXCEPT recoveryExemptAction,
+// which is never cancelled — see the comment on that constant for why. A
+// single-parent start is released; a start waiting on a set just loses the
+// failed parent, as though it had completed, so it still waits for the rest
+// and is released by the last of them whatever they end in. Either way it is
+// raised to PrioritySystemRecovery: the server may be down until it runs, so it
+// must not queue behind anything else the agent has pending. Every other
+// dependsOn or dependsOnAll child is cancelled, since a parent it needed will
+// now never complete. A dependsOnAny child is only cancelled once the failed
+// parent was the last one it had left; until then another parent may still
+// complete and release it.
 //
 // ORDER MATTERS for the dead/cancelled case, and cascadeChildren executes
-// these ordered: the recovery release must be write [0] and the cancellation
-// of the rest must be write [1]. BulkWrite applies ordered writes in slice
-// order, so a crash between them leaves the recovery start claimable (the
-// server recovers) rather than leaving it gated behind a parent that will
-// never unblock it again (the server stays down). Do not reorder this slice.
+// these ordered: the recovery writes must be [0] and [1] and the
+// cancellations must follow. BulkWrite applies ordered writes in slice order,
+// so a crash between them leaves the recovery start claimable (the server
+// recovers) rather than leaving it gated behind a parent that will never
+// unblock it again (the server stays down). Do not reorder this slice.
 func cascadeWrites(parentID bson.ObjectID, parentStatus string, now time.Time) []mongo.WriteModel {
 	if parentStatus == v2.TaskStatusCompleted {
 		return []mongo.WriteModel{
 			mongo.NewUpdateManyModel().
 				SetFilter(bson.M{"dependsOn": parentID}).
 				SetUpdate(bson.M{"$unset": bson.M{"dependsOn": ""}, "$set": bson.M{"updatedAt": now}}),
+			mongo.NewUpdateManyModel().
+				SetFilter(bson.M{"dependsOnAll": parentID}).
+				SetUpdate(mongo.Pipeline{
+					{{Key: "$set", Value: bson.M{"dependsOnAll": withoutParent("dependsOnAll", parentID), "updatedAt": now}}},
+				}),
+			mongo.NewUpdateManyModel().
+				SetFilter(bson.M{"dependsOnAny": parentID}).
+				SetUpdate(bson.M{"$unset": bson.M{"dependsOnAny": ""}, "$set": bson.M{"updatedAt": now}}),
 		}
 	}
 
+	active := bson.M{"$exists": true}
+	notExempt := bson.M{"$ne": recoveryExemptAction}
+	// An any-of child with no parent left once this one is removed.
+	anyExhausted := bson.M{"$eq": bson.A{bson.M{"$type": "$dependsOnAny"}, "missing"}}
+
 	return []mongo.WriteModel{
-		// [0] MUST run first: release the recovery-exempt child.
+		// [0] MUST run first: release the single-parent recovery-exempt child.
 		mongo.NewUpdateManyModel().
-			SetFilter(bson.M{"dependsOn": parentID, "active": bson.M{"$exists": true}, "action": recoveryExemptAction}).
-			SetUpdate(bson.M{"$unset": bson.M{"dependsOn": ""}, "$set": bson.M{"updatedAt": now}}),
-		// [1] MUST run second: cancel everything else.
+			SetFilter(bson.M{"dependsOn": parentID, "active": active, "action": recoveryExemptAction}).
+			SetUpdate(bson.M{"$unset": bson.M{"dependsOn": ""}, "$set": bson.M{"updatedAt": now, "priority": PrioritySystemRecovery}}),
+		// [1] MUST run before any cancellation: drop this parent from a
+		// recovery-exempt child's set.
 		mongo.NewUpdateManyModel().
-			SetFilter(bson.M{"dependsOn": parentID, "active": bson.M{"$exists": true}, "action": bson.M{"$ne": recoveryExemptAction}}).
+			SetFilter(bson.M{"$or": gatedOn(parentID, "dependsOnAll", "dependsOnAny"), "active": active, "action": recoveryExemptAction}).
+			SetUpdate(mongo.Pipeline{
+				{{Key: "$set", Value: bson.M{
+					"dependsOnAll": withoutParent("dependsOnAll", parentID),
+					"dependsOnAny": withoutParent("dependsOnAny", parentID),
+					"updatedAt":    now,
+					"priority":     PrioritySystemRecovery,
+				}}},
+			}),
+		// [2] Cancel everything else that needed this parent.
+		mongo.NewUpdateManyModel().
+			SetFilter(bson.M{"$or": gatedOn(parentID, "dependsOn", "dependsOnAll"), "active": active, "action": notExempt}).
 			SetUpdate(bson.M{
 				"$set":   bson.M{"status": v2.TaskStatusCancelled, "finishedAt": now, "updatedAt": now, "lastError": "cancelled with its parent task"},
-				"$unset": bson.M{"active": "", "dependsOn": "", "leaseToken": "", "leaseExpiresAt": "", "message": ""},
+				"$unset": bson.M{"active": "", "dependsOn": "", "dependsOnAll": "", "leaseToken": "", "leaseExpiresAt": "", "message": ""},
+			}),
+		// [3] Any-of children lose this parent, and are cancelled only if it
+		// was their last.
+		mongo.NewUpdateManyModel().
+			SetFilter(bson.M{"dependsOnAny": parentID, "active": active, "action": notExempt}).
+			SetUpdate(mongo.Pipeline{
+				{{Key: "$set", Value: bson.M{"dependsOnAny": withoutParent("dependsOnAny", parentID), "updatedAt": now}}},
+				{{Key: "$set", Value: bson.M{
+					"status":     bson.M{"$cond": bson.A{anyExhausted, v2.TaskStatusCancelled, "$status"}},
+					"finishedAt": bson.M{"$cond": bson.A{anyExhausted, now, "$finishedAt"}},
+					"lastError":  bson.M{"$cond": bson.A{anyExhausted, "cancelled with its parent tasks", "$lastError"}},
+					"active":     bson.M{"$cond": bson.A{anyExhausted, "$$REMOVE", "$active"}},
+				}}},
 			}),
 	}
 }
 
 // cascadeChildren resolves the tasks gated behind a task that has just reached
-// a terminal state. It only executes cascadeWrites and wakes the dispatcher;
-// the rule itself lives in exactly one place, cascadeWrites, so it can be
-// unit-tested without a database.
+// a terminal state. It only executes cascadeWrites, wakes the dispatcher and
+// nudges a rollout the task belongs to; the rule itself lives in exactly
+// one place, cascadeWrites, so it can be unit-tested without a database.
 func cascadeChildren(ctx context.Context, parentID bson.ObjectID, parentStatus string, agentID bson.ObjectID) error {
+	if err := nudgeRollout(ctx, parentID); err != nil {
+		logger.GetErrorLogger().Printf("error nudging the rollout of task %s: %s", parentID.Hex(), err.Error())
+	}
+
+	// Read before the writes: a released child no longer matches gatedOn.
+	children, err := gatedChildren(ctx, parentID)
+	if err != nil {
+		return err
+	}
+
 	writes := cascadeWrites(parentID, parentStatus, time.Now())
 
-	// Ordered (the default): mongo.BulkWrite applies writes[0] before writes[1].
+	// Ordered (the default): mongo.BulkWrite applies the writes in slice order.
 	// See the ordering comment on cascadeWrites — do not set unordered here.
 	if _, err := collection().BulkWrite(ctx, writes); err != nil {
 		return err
 	}
 
-	// A child may now be claimable (gate lifted or recovery start released).
+	// A child may now be claimable (gate lifted or recovery start released),
+	// on this agent or on any other agent whose tasks were gated on it.
 	// Waking on every cascade, even one that matched nothing, is a harmless
 	// no-op: notifyEnqueued only nudges a dispatcher that already owns the
 	// agent's connection, and dispatchFor is a no-op when nothing is due.
 	notifyEnqueued(agentID)
+	for _, child := range children {
+		recordEvent(TaskEvent{
+			TaskID:   child.ID,
+			Type:     EventCascaded,
+			ParentID: &parentID,
+			Message:  "parent task " + parentStatus,
+		})
+		if child.AgentID != agentID {
+			notifyEnqueued(child.AgentID)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,235 @@
+package agenttask
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	signalCollectionName = "agenttasksignals"
+
+	// signalCollectionBytes caps the signal collection. A signal is read within
+	// moments of being written, so the cap only has to outlast a burst.
+	signalCollectionBytes = 4 << 20
+
+	// signalReopenDelay keeps a listener whose cursor keeps dying from spinning.
+	signalReopenDelay = time.Second
+)
+
+// replicaID identifies this process in agent.connectedTo and on the signals
+// addressed to it. It only needs to be unique per running replica, not stable
+// across restarts.
+var replicaID = bson.NewObjectID().Hex()
+
+// ReplicaID is this process's id, as recorded against the agents whose task
+// streams it holds.
+func ReplicaID() string {
+	return replicaID
+}
+
+// taskSignal tells one replica that an agent whose stream it holds has work.
+// A seed carries no replica; see listenForSignals.
+type taskSignal struct {
+	ID      bson.ObjectID `bson:"_id"`
+	Replica string        `bson:"replica,omitempty"`
+	AgentID bson.ObjectID `bson:"agentId,omitempty"`
+	At      time.Time     `bson:"at"`
+}
+
+func signalCollection() *mongo.Collection {
+	return repositories.GetMongoClient().GetCollection(signalCollectionName)
+}
+
+// EnsureSignalCollection creates the signal collection as a capped one, which
+// is what lets every replica tail it without a replica set.
+func EnsureSignalCollection() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := signalCollection().Database().CreateCollection(ctx, signalCollectionName,
+		options.CreateCollection().SetCapped(true).SetSizeInBytes(signalCollectionBytes))
+
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceExists") {
+		return err
+	}
+
+	logger.GetDebugLogger().Println("Ensured agenttasksignals collection")
+	return nil
+}
+
+// connectedReplica is the replica holding the agent's task stream, or "" when
+// none does.
+func connectedReplica(ctx context.Context, agentID bson.ObjectID) (string, error) {
+	var doc struct {
+		ConnectedTo string `bson:"connectedTo"`
+	}
+
+	err := repositories.GetMongoClient().
+		GetCollection("agents").
+		FindOne(ctx, bson.M{"_id": agentID}, options.FindOne().SetProjection(bson.M{"connectedTo": 1})).
+		Decode(&doc)
+	if err != nil {
+		return "", err
+	}
+	return doc.ConnectedTo, nil
+}
+
+// signalOwner wakes the replica holding the agent's stream. A failure costs
+// nothing but latency: the owner's tick finds the task anyway.
+func signalOwner(agentID bson.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	replica, err := connectedReplica(ctx, agentID)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			logger.GetErrorLogger().Printf("error finding the replica for agent %s: %s", agentID.Hex(), err.Error())
+		}
+		return
+	}
+	if replica == "" || replica == replicaID {
+		return
+	}
+
+	if _, err := signalCollection().InsertOne(ctx, taskSignal{
+		ID:      bson.NewObjectID(),
+		Replica: replica,
+		AgentID: agentID,
+		At:      time.Now(),
+	}); err != nil {
+		logger.GetErrorLogger().Printf("error signalling replica %s for agent %s: %s", replica, agentID.Hex(), err.Error())
+	}
+}
+
+// listenForSignals tails the signal collection and wakes the agents the
+// signals addressed to this replica name.
+//
+// A tailable cursor dies at once when its query matches nothing, so every
+// (re)open first writes a seed to be sure the collection holds something.
+// Signals for other replicas are skipped here rather than filtered out in the
+// query for the same reason.
+//
+// Where the listener resumes is tracked by position, not by id: ids are minted
+// on whichever replica wrote the signal, so a signal written after the last
+// one read can still carry a lower id. See signalTail.
+func listenForSignals(done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	tail := &signalTail{}
+	for {
+		if err := tailSignals(ctx, tail); err != nil && ctx.Err() == nil {
+			logger.GetErrorLogger().Printf("agent task signals unavailable, relying on the tick: %s", err.Error())
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(signalReopenDelay):
+		}
+	}
+}
+
+func tailSignals(ctx context.Context, tail *signalTail) error {
+	seed := taskSignal{ID: bson.NewObjectID(), At: time.Now()}
+	if _, err := signalCollection().InsertOne(ctx, seed); err != nil {
+		return err
+	}
+	tail.reopen(seed.ID)
+
+	cur, err := signalCollection().Find(ctx, bson.M{},
+		options.Find().SetCursorType(options.TailableAwait).SetMaxAwaitTime(5*time.Second))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.Background())
+
+	for cur.Next(ctx) {
+		var s taskSignal
+		if err := cur.Decode(&s); err != nil {
+			logger.GetErrorLogger().Printf("error decoding agent task signal: %s", err.Error())
+			continue
+		}
+		if tail.fresh(s.ID) && s.Replica == replicaID {
+			wakeLocal(s.AgentID)
+		}
+	}
+	return cur.Err()
+}
+
+// signalTail is where a listener stands in the signal collection. A capped
+// collection hands documents back in the order they were written, so a
+// reopened cursor replays from the oldest one kept and everything up to the
+// last signal read is skipped. A listener that has read nothing yet, or whose
+// last signal the cap has since dropped, starts at its seed instead; what was
+// written between the old cursor dying and the seed is then left to the tick.
+type signalTail struct {
+	last   bson.ObjectID
+	seed   bson.ObjectID
+	caught bool
+}
+
+func (t *signalTail) reopen(seed bson.ObjectID) {
+	t.seed = seed
+	t.caught = false
+}
+
+// fresh reports whether the signal came after the last one read, and moves
+// the tail past it.
+func (t *signalTail) fresh(id bson.ObjectID) bool {
+	if t.caught {
+		t.last = id
+		return true
+	}
+	if (!t.last.IsZero() && id == t.last) || id == t.seed {
+		t.last = id
+		t.caught = true
+	}
+	return false
+}
+
+// AgentConnection is one agent's task stream and the replica holding it.
+type AgentConnection struct {
+	AgentID      bson.ObjectID `bson:"_id"`
+	AgentName    string        `bson:"agentName"`
+	Replica      string        `bson:"connectedTo"`
+	ConnectionID string        `bson:"connectionId"`
+}
+
+// AgentConnections lists the agents with a task stream open, narrowed to one
+// replica unless replica is "".
+func AgentConnections(replica string) ([]AgentConnection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"connectedTo": bson.M{"$exists": true}}
+	if replica != "" {
+		filter["connectedTo"] = replica
+	}
+
+	cur, err := repositories.GetMongoClient().GetCollection("agents").Find(ctx, filter,
+		options.Find().
+			SetProjection(bson.M{"agentName": 1, "connectedTo": 1, "connectionId": 1}).
+			SetSort(bson.D{{Key: "connectedTo", Value: 1}, {Key: "agentName", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	conns := make([]AgentConnection, 0)
+	if err := cur.All(ctx, &conns); err != nil {
+		return nil, err
+	}
+	return conns, nil
+}
@@ -0,0 +1,50 @@
+package agenttask
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// A signal written after the last one read counts even when its id, minted on
+// a slower clock, sorts below it.
+func TestSignalTailResumesByPositionNotId(t *testing.T) {
+	now := time.Now()
+	old := bson.NewObjectIDFromTimestamp(now.Add(-time.Hour))
+	last := bson.NewObjectIDFromTimestamp(now)
+	behind := bson.NewObjectIDFromTimestamp(now.Add(-time.Minute))
+	seed := bson.NewObjectIDFromTimestamp(now.Add(-2 * time.Minute))
+
+	tail := &signalTail{last: last}
+	tail.reopen(seed)
+
+	for _, id := range []bson.ObjectID{old, last} {
+		if tail.fresh(id) {
+			t.Fatalf("expected %s, read before, to be skipped", id.Hex())
+		}
+	}
+	if !tail.fresh(behind) {
+		t.Fatal("expected a signal after the last one read to count despite its lower id")
+	}
+	if !tail.fresh(seed) || tail.last != seed {
+		t.Fatalf("expected the tail to move on to the seed, got %s", tail.last.Hex())
+	}
+}
+
+// A first open, or one whose last signal the cap dropped, starts at the seed.
+func TestSignalTailStartsAtTheSeed(t *testing.T) {
+	earlier := bson.NewObjectID()
+	seed := bson.NewObjectID()
+	later := bson.NewObjectID()
+
+	tail := &signalTail{}
+	tail.reopen(seed)
+
+	if tail.fresh(earlier) || tail.fresh(seed) {
+		t.Fatal("expected everything up to and including the seed to be skipped")
+	}
+	if !tail.fresh(later) {
+		t.Fatal("expected the signal after the seed to count")
+	}
+}
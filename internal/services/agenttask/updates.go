@@ -0,0 +1,353 @@
+package agenttask
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	// updatePollInterval is how often the polling feed looks for task writes.
+	updatePollInterval = 2 * time.Second
+
+	// updatePollLimit bounds one poll. A burst larger than this is picked up on
+	// the next one, since the cursor only advances past what was delivered.
+	// The cursor is a (updatedAt, _id) pair, so a burst of writes sharing one
+	// updatedAt (a cascade stamps every child with the same now) is paged
+	// through rather than skipped past at the limit.
+	updatePollLimit = 500
+
+	// updateBuffer is how many updates a subscriber may fall behind by before
+	// it starts missing them.
+	updateBuffer = 64
+)
+
+// TaskUpdate is a task's state after one write to it: a state transition or a
+// progress report. It is decoded straight from the task row.
+type TaskUpdate struct {
+	TaskID    bson.ObjectID `bson:"_id"`
+	AgentID   bson.ObjectID `bson:"agentId"`
+	AccountID bson.ObjectID `bson:"accountId"`
+	Action    string        `bson:"action"`
+	Status    string        `bson:"status"`
+	Progress  int32         `bson:"progress"`
+	Message   string        `bson:"message"`
+	UpdatedAt time.Time     `bson:"updatedAt"`
+}
+
+var updateProjection = bson.M{
+	"_id": 1, "agentId": 1, "accountId": 1, "action": 1,
+	"status": 1, "progress": 1, "message": 1, "updatedAt": 1,
+}
+
+// UpdateFeed delivers every replica's task writes to this one. Progress is
+// reported to whichever replica the agent's RPC lands on, and the browser
+// watching it may be connected to any other, so a feed must see the whole
+// collection, not just this process's writes.
+//
+// Run blocks until done closes, calling publish for each update.
+type UpdateFeed interface {
+	Run(done <-chan struct{}, publish func(TaskUpdate))
+}
+
+var updateFeed UpdateFeed
+
+// SetUpdateFeed replaces the built-in feed, for a deployment that already runs
+// a pub/sub. It must be called before InitAgentTaskService. Without it the
+// feed is the task collection's change stream when change streams are enabled
+// (see changeStreamEnv), and a poll of it otherwise.
+func SetUpdateFeed(f UpdateFeed) {
+	updateFeed = f
+}
+
+type updateSub struct {
+	accountID bson.ObjectID
+	agentID   bson.ObjectID
+	ch        chan TaskUpdate
+}
+
+// wants reports whether the update belongs to what the subscriber watches:
+// one agent, or the whole account when agentID is zero.
+func (s *updateSub) wants(u TaskUpdate) bool {
+	if u.AccountID != s.accountID {
+		return false
+	}
+	return s.agentID.IsZero() || u.AgentID == s.agentID
+}
+
+var (
+	updateSubsMu sync.RWMutex
+	updateSubs   = map[*updateSub]struct{}{}
+)
+
+// SubscribeUpdates returns the updates to the account's tasks, narrowed to one
+// agent unless agentID is zero, plus an unsubscribe func.
+//
+// A subscriber that falls updateBuffer behind misses updates rather than
+// holding up every other: the stream is a live view, and a client that needs
+// the full picture reads GetAgentTasks when it (re)connects.
+func SubscribeUpdates(accountID, agentID bson.ObjectID) (<-chan TaskUpdate, func()) {
+	sub := &updateSub{accountID: accountID, agentID: agentID, ch: make(chan TaskUpdate, updateBuffer)}
+
+	updateSubsMu.Lock()
+	updateSubs[sub] = struct{}{}
+	updateSubsMu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			updateSubsMu.Lock()
+			delete(updateSubs, sub)
+			updateSubsMu.Unlock()
+		})
+	}
+}
+
+func publishUpdate(u TaskUpdate) {
+	updateSubsMu.RLock()
+	defer updateSubsMu.RUnlock()
+
+	for sub := range updateSubs {
+		if !sub.wants(u) {
+			continue
+		}
+		select {
+		case sub.ch <- u:
+		default:
+		}
+	}
+}
+
+// subscribedAccounts is what the polling feed has to look at.
+func subscribedAccounts() []bson.ObjectID {
+	updateSubsMu.RLock()
+	defer updateSubsMu.RUnlock()
+
+	seen := make(map[bson.ObjectID]bool)
+	out := make([]bson.ObjectID, 0, len(updateSubs))
+	for sub := range updateSubs {
+		if !seen[sub.accountID] {
+			seen[sub.accountID] = true
+			out = append(out, sub.accountID)
+		}
+	}
+	return out
+}
+
+var (
+	updatesMu   sync.Mutex
+	updatesDone chan struct{}
+)
+
+func startUpdateFeed() {
+	updatesMu.Lock()
+	defer updatesMu.Unlock()
+
+	if updatesDone != nil {
+		return
+	}
+	updatesDone = make(chan struct{})
+
+	feed := updateFeed
+	if feed == nil {
+		if changeStreamsEnabled() {
+			feed = &changeStreamFeed{}
+		} else {
+			feed = &pollFeed{}
+		}
+	}
+	go feed.Run(updatesDone, publishUpdate)
+}
+
+func stopUpdateFeed() {
+	updatesMu.Lock()
+	defer updatesMu.Unlock()
+
+	if updatesDone != nil {
+		close(updatesDone)
+		updatesDone = nil
+	}
+}
+
+// pollFeed finds task writes by updatedAt, which every write to a task sets.
+// It only reads the accounts someone on this replica is watching, and reads
+// nothing at all while nobody is.
+type pollFeed struct {
+	cursor pollCursor
+}
+
+// pollCursor is the last update a poll delivered. Updates are read in
+// (updatedAt, _id) order, so the pair says exactly where to pick up.
+type pollCursor struct {
+	at time.Time
+	id bson.ObjectID
+}
+
+// pollCursorAt starts the feed at t, past every write before it.
+func pollCursorAt(t time.Time) pollCursor {
+	return pollCursor{at: t}
+}
+
+func (c pollCursor) isZero() bool {
+	return c.at.IsZero()
+}
+
+// after matches the writes that come after the cursor.
+func (c pollCursor) after() bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"updatedAt": bson.M{"$gt": c.at}},
+		bson.M{"updatedAt": c.at, "_id": bson.M{"$gt": c.id}},
+	}}
+}
+
+func (p *pollFeed) Run(done <-chan struct{}, publish func(TaskUpdate)) {
+	p.runFor(done, publish, 0)
+}
+
+// runFor polls until done closes or, when d is positive, until d has passed.
+func (p *pollFeed) runFor(done <-chan struct{}, publish func(TaskUpdate), d time.Duration) {
+	ticker := time.NewTicker(updatePollInterval)
+	defer ticker.Stop()
+
+	var until <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		until = timer.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-until:
+			return
+		case <-ticker.C:
+			if err := p.poll(publish); err != nil {
+				logger.GetErrorLogger().Printf("error polling agent task updates: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (p *pollFeed) poll(publish func(TaskUpdate)) error {
+	accounts := subscribedAccounts()
+	if len(accounts) == 0 || p.cursor.isZero() {
+		// Nobody to tell, so there is no backlog worth replaying to whoever
+		// subscribes next.
+		p.cursor = pollCursorAt(time.Now())
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := p.cursor.after()
+	filter["accountId"] = bson.M{"$in": accounts}
+
+	cur, err := collection().Find(ctx, filter,
+		options.Find().
+			SetProjection(updateProjection).
+			SetSort(bson.D{{Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}}).
+			SetLimit(updatePollLimit))
+	if err != nil {
+		return err
+	}
+
+	updates := make([]TaskUpdate, 0)
+	if err := cur.All(ctx, &updates); err != nil {
+		return err
+	}
+	for _, u := range updates {
+		publish(u)
+		p.cursor = pollCursor{at: u.UpdatedAt, id: u.TaskID}
+	}
+	return nil
+}
+
+// updateStreamPipeline selects the writes a watcher sees: a new task, and any
+// change to a task's status or progress.
+func updateStreamPipeline() mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"operationType": "insert"},
+			bson.M{"operationType": "update", "updateDescription.updatedFields.status": bson.M{"$exists": true}},
+			bson.M{"operationType": "update", "updateDescription.updatedFields.progress": bson.M{"$exists": true}},
+			bson.M{"operationType": "update", "updateDescription.updatedFields.message": bson.M{"$exists": true}},
+		}}}},
+		{{Key: "$project", Value: fullDocumentProjection()}},
+	}
+}
+
+func fullDocumentProjection() bson.M {
+	out := make(bson.M, len(updateProjection))
+	for field := range updateProjection {
+		out["fullDocument."+field] = 1
+	}
+	return out
+}
+
+// changeStreamFeed watches the task collection. While the stream is down it
+// polls, so watchers keep hearing about progress through a failover.
+type changeStreamFeed struct {
+	poll pollFeed
+}
+
+func (c *changeStreamFeed) Run(done <-chan struct{}, publish func(TaskUpdate)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	var resumeToken bson.Raw
+	for {
+		opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+		if resumeToken != nil {
+			opts.SetResumeAfter(resumeToken)
+		}
+
+		cs, err := collection().Watch(ctx, updateStreamPipeline(), opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.GetErrorLogger().Printf("agent task update stream unavailable, polling: %s", err.Error())
+			resumeToken = nil
+		} else {
+			for cs.Next(ctx) {
+				var change struct {
+					FullDocument *TaskUpdate `bson:"fullDocument"`
+				}
+				if err := cs.Decode(&change); err != nil {
+					logger.GetErrorLogger().Printf("error decoding agent task update: %s", err.Error())
+					continue
+				}
+				// A task deleted before the lookup has no document left to show.
+				if change.FullDocument != nil {
+					publish(*change.FullDocument)
+				}
+			}
+
+			resumeToken = cs.ResumeToken()
+			if err := cs.Err(); err != nil && ctx.Err() == nil {
+				logger.GetErrorLogger().Printf("agent task update stream failed, polling: %s", err.Error())
+			}
+			_ = cs.Close(context.Background())
+		}
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+		c.poll.cursor = pollCursorAt(time.Now())
+		c.poll.runFor(done, publish, streamRetryInterval)
+	}
+}
@@ -0,0 +1,88 @@
+package agenttask
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestUpdatesReachOnlyTheirWatchers(t *testing.T) {
+	accountID, agentID := bson.NewObjectID(), bson.NewObjectID()
+
+	agentCh, unsubAgent := SubscribeUpdates(accountID, agentID)
+	defer unsubAgent()
+	accountCh, unsubAccount := SubscribeUpdates(accountID, bson.ObjectID{})
+	defer unsubAccount()
+	otherCh, unsubOther := SubscribeUpdates(bson.NewObjectID(), bson.ObjectID{})
+	defer unsubOther()
+
+	publishUpdate(TaskUpdate{TaskID: bson.NewObjectID(), AccountID: accountID, AgentID: agentID, Status: "running"})
+	publishUpdate(TaskUpdate{TaskID: bson.NewObjectID(), AccountID: accountID, AgentID: bson.NewObjectID(), Status: "pending"})
+
+	if len(agentCh) != 1 {
+		t.Fatalf("expected the agent watcher to see its agent's update only, got %d", len(agentCh))
+	}
+	if len(accountCh) != 2 {
+		t.Fatalf("expected the account watcher to see both updates, got %d", len(accountCh))
+	}
+	if len(otherCh) != 0 {
+		t.Fatalf("expected another account's watcher to see nothing, got %d", len(otherCh))
+	}
+}
+
+// A watcher that stops reading must not hold up the feed.
+func TestPublishDropsUpdatesForASlowWatcher(t *testing.T) {
+	accountID := bson.NewObjectID()
+	ch, unsub := SubscribeUpdates(accountID, bson.ObjectID{})
+	defer unsub()
+
+	for i := 0; i < updateBuffer+10; i++ {
+		publishUpdate(TaskUpdate{AccountID: accountID})
+	}
+	if len(ch) != updateBuffer {
+		t.Fatalf("expected the buffer to fill and the rest to drop, got %d", len(ch))
+	}
+}
+
+func TestUnsubscribedAccountsAreNotPolled(t *testing.T) {
+	accountID := bson.NewObjectID()
+	_, unsub := SubscribeUpdates(accountID, bson.ObjectID{})
+
+	if !containsID(subscribedAccounts(), accountID) {
+		t.Fatal("expected a watched account to be polled")
+	}
+	unsub()
+	unsub()
+	if containsID(subscribedAccounts(), accountID) {
+		t.Fatal("expected an unwatched account to drop out of the poll")
+	}
+}
+
+// Writes sharing the cursor's updatedAt are still ahead of it when their _id
+// is, so a poll that stopped at the limit mid-burst picks the rest up.
+func TestPollCursorPagesThroughWritesSharingATime(t *testing.T) {
+	at := time.Now().Truncate(time.Millisecond)
+	id := bson.NewObjectID()
+
+	or, ok := pollCursor{at: at, id: id}.after()["$or"].(bson.A)
+	if !ok || len(or) != 2 {
+		t.Fatalf("expected a later-time and a same-time branch, got %v", or)
+	}
+	sameTime, ok := or[1].(bson.M)
+	if !ok || sameTime["updatedAt"] != at {
+		t.Fatalf("expected the second branch to hold the cursor's time, got %v", or[1])
+	}
+	if gt, ok := sameTime["_id"].(bson.M); !ok || gt["$gt"] != id {
+		t.Fatalf("expected the second branch to page on _id, got %v", sameTime["_id"])
+	}
+}
+
+func containsID(ids []bson.ObjectID, id bson.ObjectID) bool {
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package agenttemplate
+
+import (
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agent"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agentmod"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+)
+
+// CloneFromAgent starts a workflow that creates newAgent as a copy of source:
+// its server and backup settings, its mods as they resolve now and, with
+// latestSave, its most recent save.
+func CloneFromAgent(theAccount *v2.AccountSchema, source *v2.AgentSchema, newAgent *v2.CreateAgentWorkflowData, latestSave bool, createdBy string) (string, error) {
+	mods, err := agentmod.Resolve(source.ID)
+	if err != nil {
+		return "", err
+	}
+
+	return agent.NewWorkflow_CloneAgent(theAccount, newAgent, agent.CloneSpec{
+		Source:           source,
+		ServerConfig:     source.ServerConfig,
+		BackupInterval:   source.Config.BackupInterval,
+		BackupKeepAmount: source.Config.BackupKeepAmount,
+		Mods:             &mods,
+		LatestSave:       latestSave,
+	}, createdBy)
+}
+
+// CloneFromTemplate starts a workflow that creates newAgent from one of the
+// account's agent templates.
+func CloneFromTemplate(theAccount *v2.AccountSchema, name string, newAgent *v2.CreateAgentWorkflowData, createdBy string) (string, error) {
+	t, err := FindTemplate(theAccount.ID, name)
+	if err != nil {
+		return "", err
+	}
+
+	return agent.NewWorkflow_CloneAgent(theAccount, newAgent, agent.CloneSpec{
+		Template:         t.Name,
+		ServerConfig:     t.ServerConfig,
+		BackupInterval:   t.BackupInterval,
+		BackupKeepAmount: t.BackupKeepAmount,
+		Mods:             &t.Mods,
+	}, createdBy)
+}
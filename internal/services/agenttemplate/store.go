@@ -0,0 +1,152 @@
+// Package agenttemplate keeps agents' settings and mods as named templates,
+// and creates new agents as copies of an existing agent or of a template.
+package agenttemplate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agentmod"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const collectionName = "agenttemplates"
+
+var (
+	ErrTemplateNotFound = errors.New("agent template not found")
+	ErrInvalidTemplate  = errors.New("invalid agent template")
+)
+
+// AgentTemplate is what an agent was configured with when it was saved as a
+// template. Mods is its resolved lockfile; a clone re-resolves the direct mods
+// for its own platform.
+type AgentTemplate struct {
+	ID               bson.ObjectID        `bson:"_id"`
+	AccountID        bson.ObjectID        `bson:"accountId"`
+	Name             string               `bson:"name"`
+	SourceAgentName  string               `bson:"sourceAgentName,omitempty"`
+	ServerConfig     v2.AgentServerConfig `bson:"serverConfig"`
+	BackupInterval   float32              `bson:"backupInterval"`
+	BackupKeepAmount int                  `bson:"backupKeepAmount"`
+	Mods             v2.Lockfile          `bson:"mods"`
+	CreatedBy        string               `bson:"createdBy,omitempty"`
+	CreatedAt        time.Time            `bson:"createdAt"`
+	UpdatedAt        time.Time            `bson:"updatedAt"`
+}
+
+func collection() *mongo.Collection {
+	return repositories.GetMongoClient().GetCollection(collectionName)
+}
+
+// Init ensures the collection's indexes. Call it once during boot.
+func Init() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "accountId", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetName("account_name").SetUnique(true),
+	}); err != nil {
+		return err
+	}
+
+	logger.GetDebugLogger().Println("Ensured agenttemplates indexes")
+	return nil
+}
+
+// SaveFromAgent stores the agent's settings and mods as a template on the
+// account, replacing the account's template of the same name.
+func SaveFromAgent(theAccount *v2.AccountSchema, theAgent *v2.AgentSchema, name, createdBy string) (*AgentTemplate, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("%w: a template needs a name", ErrInvalidTemplate)
+	}
+
+	mods, err := agentmod.Resolve(theAgent.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	saved := &AgentTemplate{}
+	err = collection().FindOneAndUpdate(ctx,
+		bson.M{"accountId": theAccount.ID, "name": name},
+		bson.M{
+			"$set": bson.M{
+				"sourceAgentName":  theAgent.AgentName,
+				"serverConfig":     theAgent.ServerConfig,
+				"backupInterval":   theAgent.Config.BackupInterval,
+				"backupKeepAmount": theAgent.Config.BackupKeepAmount,
+				"mods":             mods,
+				"updatedAt":        now,
+			},
+			"$setOnInsert": bson.M{
+				"_id":       bson.NewObjectID(),
+				"createdBy": createdBy,
+				"createdAt": now,
+			},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(saved)
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+func DeleteTemplate(accountID bson.ObjectID, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := collection().DeleteOne(ctx, bson.M{"accountId": accountID, "name": name})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("%w: %q", ErrTemplateNotFound, name)
+	}
+	return nil
+}
+
+func FindTemplate(accountID bson.ObjectID, name string) (*AgentTemplate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t := &AgentTemplate{}
+	err := collection().FindOne(ctx, bson.M{"accountId": accountID, "name": name}).Decode(t)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("%w: %q", ErrTemplateNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ListTemplates returns the account's agent templates, sorted by name.
+func ListTemplates(accountID bson.ObjectID) ([]AgentTemplate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := collection().Find(ctx, bson.M{"accountId": accountID},
+		options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make([]AgentTemplate, 0)
+	if err := cur.All(ctx, &templates); err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
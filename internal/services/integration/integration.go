@@ -14,6 +14,7 @@ import (
 
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/metrics"
 	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
 	"github.com/gtuk/discordwebhook"
 	"github.com/mrhid6/go-mongoose-lock/joblock"
@@ -29,6 +30,13 @@ var (
 	podName, _             = os.Hostname()
 )
 
+var (
+	eventsProcessedTotal = metrics.NewCounterVec("integration_events_processed_total",
+		"Integration event deliveries attempted, by outcome.", "outcome")
+	eventDeliverySeconds = metrics.NewHistogramVec("integration_event_delivery_seconds",
+		"Time taken to deliver an integration event, failed or not.", nil, "outcome")
+)
+
 func InitIntegrationService() error {
 
 	processIntegrationsJob, _ = joblock.NewJobLockTask(
@@ -231,11 +239,19 @@ func processAllIntegrationEvents() error {
 		return err
 	}
 
+	start := time.Now()
+	outcome := "sent"
 	if err := processEvent(ev); err != nil {
+		outcome = "retry"
+		if ev.Attempts >= maxAttempts {
+			outcome = "failed"
+		}
 		markFailed(ev, err)
 	} else {
 		markSent(ev)
 	}
+	eventsProcessedTotal.Inc(outcome)
+	eventDeliverySeconds.Observe(time.Since(start).Seconds(), outcome)
 	return nil
 }
 
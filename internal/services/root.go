@@ -5,6 +5,7 @@ import (
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agent"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agentmod"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttemplate"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/integration"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/mod"
 	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/storage"
@@ -26,6 +27,10 @@ func InitAllServices() {
 	if err := agenttask.InitAgentTaskService(); err != nil {
 		panic(err)
 	}
+
+	if err := agenttemplate.Init(); err != nil {
+		panic(err)
+	}
 	account.InitAccountService()
 
 	mod.InitModService()
@@ -0,0 +1,55 @@
+package workflow
+
+import (
+	"fmt"
+
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// CloneAgentWorkflowType creates an agent that starts out as a copy of another
+// agent or of a saved agent template.
+const CloneAgentWorkflowType = "cloneagent"
+
+// ActionTypeCopySave is the clone step that copies one of the source agent's
+// saves to the new agent in storage. It is the agent package's, which
+// registers it; see agent.CopySaveAction.
+const ActionTypeCopySave = "copysave"
+
+// CloneAgentData is the Data of a clone-agent workflow: the agent to create,
+// and the settings it is created with. SourceId is the agent it was cloned
+// from, the RoleSource of the step that copies its save; it is unset for a
+// clone of a template.
+type CloneAgentData struct {
+	v2.CreateAgentWorkflowData `bson:",inline"`
+	SourceId                   bson.ObjectID        `bson:"sourceId,omitempty" json:"sourceId,omitempty"`
+	Template                   string               `bson:"template,omitempty" json:"template,omitempty"`
+	ServerConfig               v2.AgentServerConfig `bson:"serverConfig" json:"serverConfig"`
+	BackupInterval             float32              `bson:"backupInterval" json:"backupInterval"`
+	BackupKeepAmount           int                  `bson:"backupKeepAmount" json:"backupKeepAmount"`
+}
+
+func (d *CloneAgentData) Account() bson.ObjectID {
+	return d.AccountId
+}
+
+func (d *CloneAgentData) Agent() (*v2.AgentSchema, error) {
+	return agentByAPIKey(d.APIKey)
+}
+
+func (d *CloneAgentData) AgentForRole(role string) (*v2.AgentSchema, error) {
+	if role != RoleSource || d.SourceId.IsZero() {
+		return nil, fmt.Errorf("workflow has no agent role %q", role)
+	}
+	return agentByID(d.SourceId)
+}
+
+// newAgent creates the agent with the settings it inherits already in place,
+// so it has them from the first time it asks for its config.
+func (d *CloneAgentData) newAgent() *v2.AgentSchema {
+	theAgent := v2.NewAgent(d.AgentName, d.Port, d.Memory, d.APIKey)
+	theAgent.ServerConfig = d.ServerConfig
+	theAgent.Config.BackupInterval = d.BackupInterval
+	theAgent.Config.BackupKeepAmount = d.BackupKeepAmount
+	return theAgent
+}
@@ -0,0 +1,150 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+)
+
+// A step's When is a condition on the steps before it and on the agent:
+//
+//	steps.download == completed && !agent.running
+//
+// Terms are joined with && and each may be negated with !. A term is one of
+//
+//	agent.online, agent.running, agent.installed
+//	steps.<name>                  the named step completed
+//	steps.<name> == <status>      completed, failed or skipped (!= too)
+//
+// A step whose condition is false is skipped, which later conditions can test
+// for in turn. The agent terms are about the agent the step acts on, which for
+// a step with a Role is the role's.
+
+var agentConditions = map[string]func(*v2.AgentSchema) bool{
+	"agent.online":    func(a *v2.AgentSchema) bool { return a.Status.Online },
+	"agent.running":   func(a *v2.AgentSchema) bool { return a.Status.Running },
+	"agent.installed": func(a *v2.AgentSchema) bool { return a.Status.Installed },
+}
+
+var conditionStatuses = map[string]bool{
+	"completed": true,
+	"failed":    true,
+	"skipped":   true,
+}
+
+type conditionTerm struct {
+	negate bool
+	// Exactly one of agent and step is set.
+	agent  string
+	step   string
+	status string
+	equal  bool
+}
+
+type condition []conditionTerm
+
+// parseCondition reads a When expression. An empty expression always holds.
+func parseCondition(expr string) (condition, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, nil
+	}
+
+	cond := condition{}
+	for _, part := range strings.Split(expr, "&&") {
+		term, err := parseConditionTerm(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		cond = append(cond, term)
+	}
+	return cond, nil
+}
+
+func parseConditionTerm(s string) (conditionTerm, error) {
+	term := conditionTerm{equal: true, status: "completed"}
+
+	if strings.HasPrefix(s, "!") {
+		term.negate = true
+		s = strings.TrimSpace(s[1:])
+	}
+
+	operand := s
+	if op := strings.Index(s, "=="); op >= 0 {
+		operand, term.status = s[:op], s[op+2:]
+	} else if op := strings.Index(s, "!="); op >= 0 {
+		operand, term.status, term.equal = s[:op], s[op+2:], false
+	}
+	operand = strings.TrimSpace(operand)
+	term.status = strings.TrimSpace(term.status)
+
+	if operand == "" {
+		return term, errors.New("empty condition")
+	}
+
+	if _, ok := agentConditions[operand]; ok {
+		if operand != s {
+			return term, fmt.Errorf("%s cannot be compared, use it or !%s", operand, operand)
+		}
+		term.agent = operand
+		return term, nil
+	}
+
+	name, ok := strings.CutPrefix(operand, "steps.")
+	if !ok || name == "" {
+		return term, fmt.Errorf("unknown condition %q", operand)
+	}
+	if !conditionStatuses[term.status] {
+		return term, fmt.Errorf("%q is not a step status", term.status)
+	}
+	term.step = name
+	return term, nil
+}
+
+// steps are the names of the steps the condition tests.
+func (c condition) steps() []string {
+	names := make([]string, 0)
+	for _, term := range c {
+		if term.step != "" {
+			names = append(names, term.step)
+		}
+	}
+	return names
+}
+
+func (c condition) needsAgent() bool {
+	for _, term := range c {
+		if term.agent != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// eval checks the condition against the workflow's actions and the agent,
+// which may be nil when the condition does not need it.
+func (c condition) eval(actions []v2.WorkflowAction, theAgent *v2.AgentSchema) bool {
+	for _, term := range c {
+		var holds bool
+		if term.agent != "" {
+			holds = agentConditions[term.agent](theAgent)
+		} else {
+			holds = (stepStatus(actions, term.step) == term.status) == term.equal
+		}
+		if holds == term.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func stepStatus(actions []v2.WorkflowAction, name string) string {
+	for idx := range actions {
+		if actions[idx].Name == name {
+			return actions[idx].Status
+		}
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+package workflow
+
+import (
+	"slices"
+	"testing"
+
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+)
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    condition
+		wantErr bool
+	}{
+		{expr: "", want: nil},
+		{expr: "  ", want: nil},
+		{expr: "agent.online", want: condition{{agent: "agent.online", equal: true, status: "completed"}}},
+		{expr: "!agent.running", want: condition{{negate: true, agent: "agent.running", equal: true, status: "completed"}}},
+		{expr: "steps.download", want: condition{{step: "download", equal: true, status: "completed"}}},
+		{expr: "steps.download == failed", want: condition{{step: "download", equal: true, status: "failed"}}},
+		{expr: "steps.download != skipped", want: condition{{step: "download", equal: false, status: "skipped"}}},
+		{expr: "steps.a && !agent.online", want: condition{
+			{step: "a", equal: true, status: "completed"},
+			{negate: true, agent: "agent.online", equal: true, status: "completed"},
+		}},
+		{expr: "agent.online == completed", wantErr: true},
+		{expr: "steps.a == running", wantErr: true},
+		{expr: "steps.", wantErr: true},
+		{expr: "server.up", wantErr: true},
+		{expr: "steps.a &&", wantErr: true},
+		{expr: "!", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := parseCondition(tt.expr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected %q to be refused, got %+v", tt.expr, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error parsing %q: %s", tt.expr, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConditionEval(t *testing.T) {
+	actions := []v2.WorkflowAction{
+		{Name: "download", Status: "completed"},
+		{Name: "verify", Status: "skipped"},
+	}
+	online := &v2.AgentSchema{}
+	online.Status.Online = true
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"steps.download", true},
+		{"steps.verify", false},
+		{"steps.verify == skipped", true},
+		{"steps.verify != skipped", false},
+		{"!steps.verify", true},
+		{"steps.missing != completed", true},
+		{"agent.online && !agent.running", true},
+		{"agent.online && steps.verify", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			cond, err := parseCondition(tt.expr)
+			if err != nil {
+				t.Fatalf("error parsing %q: %s", tt.expr, err)
+			}
+			if got := cond.eval(actions, online); got != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
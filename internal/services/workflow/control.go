@@ -0,0 +1,270 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/audit"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+var (
+	ErrWorkflowNotFound = errors.New("workflow not found")
+	ErrWorkflowState    = errors.New("workflow cannot do that in its current state")
+)
+
+// A workflow is running while its status is "". Paused and cancelled are set
+// only from outside, through the functions below; the processor only picks up
+// running workflows, so a paused one simply stops being processed. Errored is
+// the processor giving up on a workflow it cannot step; see
+// recordWorkflowError.
+const (
+	statusPaused    = "paused"
+	statusCancelled = "cancelled"
+	statusErrored   = "errored"
+)
+
+// GetForAccount returns the workflow if it runs for the account. "Not found"
+// and "not yours" read the same.
+func GetForAccount(accountID, workflowID bson.ObjectID) (*v2.WorkflowSchema, error) {
+	WorkflowModel, err := repositories.GetMongoClient().GetModel("Workflow")
+	if err != nil {
+		return nil, err
+	}
+
+	theWorkflow := &v2.WorkflowSchema{}
+	if err := WorkflowModel.FindOneById(theWorkflow, workflowID); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrWorkflowNotFound
+		}
+		return nil, err
+	}
+
+	workflowData, err := decodeWorkflowData(theWorkflow)
+	if err != nil || workflowData.Account() != accountID {
+		return nil, ErrWorkflowNotFound
+	}
+	return theWorkflow, nil
+}
+
+// transition moves the workflow from one of the from statuses to to, recording
+// it in the workflow's history. set carries any other fields the same write
+// changes. It fails with ErrWorkflowState when the workflow has moved on since
+// the caller read it.
+func transition(workflowID bson.ObjectID, from []string, to string, filter, set bson.M, entry v2.WorkflowTransition) (*v2.WorkflowSchema, error) {
+	WorkflowModel, err := repositories.GetMongoClient().GetModel("Workflow")
+	if err != nil {
+		return nil, err
+	}
+
+	filter, update := transitionUpdate(workflowID, from, to, filter, set, entry, time.Now())
+
+	theWorkflow := &v2.WorkflowSchema{}
+	err = WorkflowModel.FindOneAndUpdate(theWorkflow, filter, update)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrWorkflowState
+	}
+	if err != nil {
+		return nil, err
+	}
+	return theWorkflow, nil
+}
+
+// transitionUpdate is the filter and update transition writes with: the
+// caller's filter guarded on the workflow being in one of the from statuses.
+func transitionUpdate(workflowID bson.ObjectID, from []string, to string, filter, set bson.M, entry v2.WorkflowTransition, now time.Time) (bson.M, bson.M) {
+	if filter == nil {
+		filter = bson.M{}
+	}
+	filter["_id"] = workflowID
+	filter["status"] = bson.M{"$in": from}
+
+	if set == nil {
+		set = bson.M{}
+	}
+	set["status"] = to
+
+	entry.To = to
+	entry.At = now
+
+	return filter, bson.M{
+		"$set":  set,
+		"$push": bson.M{"history": entry},
+	}
+}
+
+// Cancel stops a running or paused workflow for good. The task of every step
+// still in flight is cancelled with it; compensations do not run, since the
+// user asked for the workflow to stop, not to be undone.
+func Cancel(theAccount *v2.AccountSchema, workflowID bson.ObjectID, actor, reason string) (*v2.WorkflowSchema, error) {
+	current, err := GetForAccount(theAccount.ID, workflowID)
+	if err != nil {
+		return nil, err
+	}
+
+	theWorkflow, err := transition(workflowID, []string{"", statusPaused}, statusCancelled, nil, nil,
+		v2.WorkflowTransition{From: current.Status, Actor: actor, Reason: reason})
+	if err != nil {
+		return nil, err
+	}
+
+	cancelInFlightTasks(theWorkflow, actor)
+
+	if err := audit.AddAccountAudit(theAccount,
+		v2.AuditType_WorkflowCancelled,
+		fmt.Sprintf("Workflow %s (%s) was cancelled", workflowID.Hex(), theWorkflow.Type),
+	); err != nil {
+		return nil, err
+	}
+	return theWorkflow, nil
+}
+
+// cancelInFlightTasks cancels the task of every step that has not finished. A
+// task that finished in the meantime refuses, which is fine.
+func cancelInFlightTasks(theWorkflow *v2.WorkflowSchema, actor string) {
+	for idx := range theWorkflow.Actions {
+		action := &theWorkflow.Actions[idx]
+		if action.Compensation != nil && action.Compensation.TaskID != "" && action.Compensation.Status == "" {
+			cancelStepTask(theWorkflow, action.Compensation.TaskID, actor)
+		}
+		if action.TaskID != "" && action.Status == "" {
+			cancelStepTask(theWorkflow, action.TaskID, actor)
+		}
+	}
+}
+
+func cancelStepTask(theWorkflow *v2.WorkflowSchema, taskID, actor string) {
+	if err := agenttask.Cancel(taskID, actor); err != nil {
+		logger.GetInfoLogger().Printf("workflow %s: task %s was not cancelled: %s", theWorkflow.ID.Hex(), taskID, err.Error())
+	}
+}
+
+// Pause stops the processor from starting or polling the workflow's steps. A
+// task already running on the agent carries on; its result is picked up on
+// resume.
+func Pause(theAccount *v2.AccountSchema, workflowID bson.ObjectID, actor string) (*v2.WorkflowSchema, error) {
+	if _, err := GetForAccount(theAccount.ID, workflowID); err != nil {
+		return nil, err
+	}
+
+	theWorkflow, err := transition(workflowID, []string{""}, statusPaused, nil, nil,
+		v2.WorkflowTransition{From: "", Actor: actor})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := audit.AddAccountAudit(theAccount,
+		v2.AuditType_WorkflowPaused,
+		fmt.Sprintf("Workflow %s (%s) was paused", workflowID.Hex(), theWorkflow.Type),
+	); err != nil {
+		return nil, err
+	}
+	return theWorkflow, nil
+}
+
+func Resume(theAccount *v2.AccountSchema, workflowID bson.ObjectID, actor string) (*v2.WorkflowSchema, error) {
+	if _, err := GetForAccount(theAccount.ID, workflowID); err != nil {
+		return nil, err
+	}
+
+	theWorkflow, err := transition(workflowID, []string{statusPaused}, "", nil, nil,
+		v2.WorkflowTransition{From: statusPaused, Actor: actor})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := audit.AddAccountAudit(theAccount,
+		v2.AuditType_WorkflowResumed,
+		fmt.Sprintf("Workflow %s (%s) was resumed", workflowID.Hex(), theWorkflow.Type),
+	); err != nil {
+		return nil, err
+	}
+	return theWorkflow, nil
+}
+
+// RetryStep runs a failed step of a failed workflow again and sets the workflow
+// running. The step starts a fresh attempt, so it gets a new task rather than
+// adopting the one that failed. A workflow whose completed steps were already
+// compensated cannot be retried: there is nothing left for the step to build
+// on.
+func RetryStep(theAccount *v2.AccountSchema, workflowID bson.ObjectID, actionIdx int, actor string) (*v2.WorkflowSchema, error) {
+	current, err := GetForAccount(theAccount.ID, workflowID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRetry(current, actionIdx); err != nil {
+		return nil, err
+	}
+	action := current.Actions[actionIdx]
+
+	prefix := fmt.Sprintf("actions.%d.", actionIdx)
+	theWorkflow, err := transition(workflowID, []string{"failed"}, "",
+		bson.M{prefix + "status": "failed"},
+		bson.M{
+			prefix + "status":       "",
+			prefix + "errorMessage": "",
+			prefix + "taskId":       "",
+			prefix + "retryCount":   0,
+			prefix + "attempts":     action.Attempts + 1,
+		},
+		v2.WorkflowTransition{From: "failed", ActionIdx: &actionIdx, Actor: actor, Reason: action.ErrorMessage})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := audit.AddAccountAudit(theAccount,
+		v2.AuditType_WorkflowStepRetried,
+		fmt.Sprintf("Step %d of workflow %s (%s) was retried", actionIdx+1, workflowID.Hex(), theWorkflow.Type),
+	); err != nil {
+		return nil, err
+	}
+	return theWorkflow, nil
+}
+
+// checkRetry refuses a retry of anything but a failed step of a failed
+// workflow that has not been rolled back.
+func checkRetry(theWorkflow *v2.WorkflowSchema, actionIdx int) error {
+	if actionIdx < 0 || actionIdx >= len(theWorkflow.Actions) {
+		return fmt.Errorf("%w: no step %d", ErrWorkflowState, actionIdx)
+	}
+	if theWorkflow.Status != "failed" || theWorkflow.Actions[actionIdx].Status != "failed" {
+		return fmt.Errorf("%w: only a failed step of a failed workflow can be retried", ErrWorkflowState)
+	}
+	for idx := range theWorkflow.Actions {
+		if c := theWorkflow.Actions[idx].Compensation; c != nil && c.Status != "" {
+			return fmt.Errorf("%w: the workflow has already been rolled back", ErrWorkflowState)
+		}
+	}
+	return nil
+}
+
+// CancelForAgent cancels the agent's running and paused workflows, for when
+// the agent goes away and nothing they wait on can happen any more.
+func CancelForAgent(theAccount *v2.AccountSchema, agentID bson.ObjectID, reason string) error {
+	WorkflowModel, err := repositories.GetMongoClient().GetModel("Workflow")
+	if err != nil {
+		return err
+	}
+
+	workflows := make([]v2.WorkflowSchema, 0)
+	if err := WorkflowModel.FindAll(&workflows, bson.M{
+		"agentId": agentID,
+		"status":  bson.M{"$in": bson.A{"", statusPaused}},
+	}); err != nil {
+		return err
+	}
+
+	for idx := range workflows {
+		if _, err := Cancel(theAccount, workflows[idx].ID, "system", reason); err != nil && !errors.Is(err, ErrWorkflowState) {
+			return err
+		}
+	}
+	return nil
+}
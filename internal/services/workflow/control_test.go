@@ -0,0 +1,83 @@
+package workflow
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// The write only matches a workflow still in one of the from statuses, so a
+// pause racing a cancel loses rather than overwriting it.
+func TestTransitionGuardsOnTheFromStatuses(t *testing.T) {
+	workflowID := bson.NewObjectID()
+	now := time.Now()
+
+	filter, update := transitionUpdate(workflowID, []string{"", statusPaused}, statusCancelled,
+		bson.M{"actions.0.status": "failed"}, bson.M{"errorMessage": ""},
+		v2.WorkflowTransition{From: statusPaused, Actor: "user"}, now)
+
+	if filter["_id"] != workflowID {
+		t.Fatalf("expected the filter to match the workflow, got %v", filter["_id"])
+	}
+	in, ok := filter["status"].(bson.M)["$in"].([]string)
+	if !ok || len(in) != 2 || in[0] != "" || in[1] != statusPaused {
+		t.Fatalf("expected the filter to guard on the from statuses, got %v", filter["status"])
+	}
+	if filter["actions.0.status"] != "failed" {
+		t.Fatal("expected the caller's filter to be kept")
+	}
+
+	set := update["$set"].(bson.M)
+	if set["status"] != statusCancelled || set["errorMessage"] != "" {
+		t.Fatalf("expected the new status alongside the caller's fields, got %v", set)
+	}
+	entry := update["$push"].(bson.M)["history"].(v2.WorkflowTransition)
+	if entry.From != statusPaused || entry.To != statusCancelled || entry.Actor != "user" || !entry.At.Equal(now) {
+		t.Fatalf("expected the history entry to record the move, got %+v", entry)
+	}
+}
+
+func TestCheckRetry(t *testing.T) {
+	failed := func() *v2.WorkflowSchema {
+		return &v2.WorkflowSchema{Status: "failed", Actions: []v2.WorkflowAction{
+			{Status: "completed", Compensation: &v2.WorkflowAction{}},
+			{Status: "failed"},
+		}}
+	}
+
+	tests := []struct {
+		name      string
+		workflow  func() *v2.WorkflowSchema
+		actionIdx int
+		wantErr   bool
+	}{
+		{"failed step of a failed workflow", failed, 1, false},
+		{"no such step", failed, 2, true},
+		{"negative step", failed, -1, true},
+		{"step that completed", failed, 0, true},
+		{"workflow still running", func() *v2.WorkflowSchema {
+			w := failed()
+			w.Status = ""
+			return w
+		}, 1, true},
+		{"workflow rolled back", func() *v2.WorkflowSchema {
+			w := failed()
+			w.Actions[0].Compensation.Status = "completed"
+			return w
+		}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRetry(tt.workflow(), tt.actionIdx)
+			if tt.wantErr && !errors.Is(err, ErrWorkflowState) {
+				t.Fatalf("expected ErrWorkflowState, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("expected the retry to be allowed, got %s", err)
+			}
+		})
+	}
+}
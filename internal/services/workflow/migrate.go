@@ -0,0 +1,65 @@
+package workflow
+
+import (
+	"fmt"
+
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// MigrateServerWorkflowType moves a server from one agent to another.
+const MigrateServerWorkflowType = "migrateserver"
+
+// RoleSource is the Role of a migration step that acts on the agent being
+// migrated from. The workflow's own agent is the target.
+const RoleSource = "source"
+
+// The migration steps that run in the backend rather than on an agent, or whose
+// task is only known once the step runs. Copying and pushing the server is the
+// agent package's and copying the mods agentmod's, which register their
+// handlers; see agent.CopyServerAction, agent.PushSaveAction,
+// agentmod.CopyModsAction and agent.DecommissionAction.
+const (
+	ActionTypeCopyServer   = "copyserver"
+	ActionTypePushSave     = "pushsave"
+	ActionTypeCopyMods     = "copymods"
+	ActionTypeDecommission = "decommission"
+)
+
+// MigrateServerData is the Data of a migrate-server workflow. The target is
+// either an agent that exists, TargetId, or one the workflow creates first,
+// NewTarget, found again afterwards by its API key.
+type MigrateServerData struct {
+	AccountId    bson.ObjectID               `bson:"accountId" json:"accountId"`
+	SourceId     bson.ObjectID               `bson:"sourceId" json:"sourceId"`
+	TargetId     bson.ObjectID               `bson:"targetId,omitempty" json:"targetId,omitempty"`
+	NewTarget    *v2.CreateAgentWorkflowData `bson:"newTarget,omitempty" json:"newTarget,omitempty"`
+	Decommission bool                        `bson:"decommission" json:"decommission"`
+}
+
+func (d *MigrateServerData) Account() bson.ObjectID {
+	return d.AccountId
+}
+
+func (d *MigrateServerData) Agent() (*v2.AgentSchema, error) {
+	if d.NewTarget != nil {
+		return agentByAPIKey(d.NewTarget.APIKey)
+	}
+	return agentByID(d.TargetId)
+}
+
+func (d *MigrateServerData) AgentForRole(role string) (*v2.AgentSchema, error) {
+	if role != RoleSource {
+		return nil, fmt.Errorf("workflow has no agent role %q", role)
+	}
+	return agentByID(d.SourceId)
+}
+
+// newAgent makes a migration to a new agent an agentCreator. It is nil for one
+// to an agent that exists, which has no create step.
+func (d *MigrateServerData) newAgent() *v2.AgentSchema {
+	if d.NewTarget == nil {
+		return nil
+	}
+	return v2.NewAgent(d.NewTarget.AgentName, d.NewTarget.Port, d.NewTarget.Memory, d.NewTarget.APIKey)
+}
@@ -0,0 +1,254 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	// workflowLeaseTime is how long a claim keeps other passes off a
+	// workflow. The pass renews it while it runs (see keepWorkflowLease); one
+	// that stops renewing, because its replica died or lost the claim, loses
+	// the workflow to the next claimant and its result is not saved.
+	workflowLeaseTime = 30 * time.Second
+
+	// workflowPassInterval is how soon a processed workflow is due again. It
+	// matches the job's interval, so a workflow is stepped once per run.
+	workflowPassInterval = 5 * time.Second
+
+	// workflowConcurrency bounds how many workflows one pass steps at once.
+	workflowConcurrency = 8
+
+	// maxWorkflowErrors is how many passes in a row may fail before the
+	// workflow is given up on as errored.
+	maxWorkflowErrors = 5
+)
+
+// errWorkflowBroken is a failure no retry can fix, such as the workflow's
+// account having been deleted. The workflow errors on the first one.
+var errWorkflowBroken = errors.New("workflow cannot be processed")
+
+// EnsureWorkflowIndexes creates the index claimWorkflow scans on.
+func EnsureWorkflowIndexes() error {
+	WorkflowModel, err := repositories.GetMongoClient().GetModel("Workflow")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := repositories.GetMongoClient().GetCollection(WorkflowModel.CollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "status", Value: 1}, {Key: "nextRunAt", Value: 1}},
+		Options: options.Index().SetName("due_workflows"),
+	}); err != nil {
+		return err
+	}
+
+	logger.GetDebugLogger().Println("Ensured workflows indexes")
+	return nil
+}
+
+// ProcessWorkflows steps every due workflow once. Workflows are claimed one at
+// a time under a lease, so replicas and workers never step the same one, and a
+// workflow that fails only counts against itself.
+func ProcessWorkflows() error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	for i := 0; i < workflowConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				workflow, leaseToken, err := claimWorkflow()
+				if errors.Is(err, mongo.ErrNoDocuments) {
+					return
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+
+				release := keepWorkflowLease(workflow.ID, leaseToken)
+				err = ProcessWorkflow(workflow, leaseToken)
+				release()
+
+				if err != nil {
+					recordWorkflowError(workflow, leaseToken, err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// claimWorkflow leases the next due workflow to this pass. A workflow is due
+// once its nextRunAt has passed, which is what keeps a pass from stepping the
+// same workflow twice.
+//
+// The lease is fenced by a token of its own, as agenttask fences a task's lease
+// by its leaseToken: a replica's id would let a later pass on the same replica
+// save over the workflow while an earlier one that lost the lease still ran.
+func claimWorkflow() (*v2.WorkflowSchema, string, error) {
+	WorkflowModel, err := repositories.GetMongoClient().GetModel("Workflow")
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().UTC()
+	filter := bson.M{
+		"status": "",
+		"$and": []bson.M{
+			{"$or": []bson.M{
+				{"nextRunAt": bson.M{"$exists": false}},
+				{"nextRunAt": bson.M{"$lte": now}},
+			}},
+			{"$or": []bson.M{
+				{"processingUntil": bson.M{"$exists": false}},
+				{"processingUntil": bson.M{"$lte": now}},
+			}},
+		},
+	}
+	leaseToken := bson.NewObjectID().Hex()
+	update := bson.M{
+		"$set": bson.M{
+			"processingBy":    leaseToken,
+			"processingUntil": now.Add(workflowLeaseTime),
+		},
+	}
+
+	workflow := &v2.WorkflowSchema{}
+	if err := WorkflowModel.FindOneAndUpdate(workflow, filter, update); err != nil {
+		return nil, "", err
+	}
+	return workflow, leaseToken, nil
+}
+
+// keepWorkflowLease renews the pass's lease on the workflow until the returned
+// func is called, so a step that outlasts workflowLeaseTime, such as a
+// migration's storage copies, does not lose the workflow to another pass
+// midway. Renewing stops once the lease is found lost.
+func keepWorkflowLease(workflowID bson.ObjectID, leaseToken string) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(workflowLeaseTime / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !renewWorkflowLease(workflowID, leaseToken) {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// renewWorkflowLease extends the lease while leaseToken still holds it. An
+// error keeps renewing: the lease may well still be held.
+func renewWorkflowLease(workflowID bson.ObjectID, leaseToken string) bool {
+	WorkflowModel, err := repositories.GetMongoClient().GetModel("Workflow")
+	if err != nil {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := repositories.GetMongoClient().GetCollection(WorkflowModel.CollectionName).UpdateOne(ctx,
+		bson.M{"_id": workflowID, "processingBy": leaseToken},
+		bson.M{"$set": bson.M{"processingUntil": time.Now().UTC().Add(workflowLeaseTime)}})
+	if err != nil {
+		logger.GetErrorLogger().Printf("error renewing the lease on workflow %s: %s", workflowID.Hex(), err.Error())
+		return true
+	}
+	return res.MatchedCount > 0
+}
+
+// givesUp reports whether a pass that failed with err, the errorCount-th in a
+// row, errors the workflow rather than leaving it for the next pass.
+func givesUp(errorCount int, err error) bool {
+	return errorCount >= maxWorkflowErrors || errors.Is(err, errWorkflowBroken)
+}
+
+// recordWorkflowError keeps the error on the workflow and releases it for the
+// next pass. Once it has failed maxWorkflowErrors passes in a row, or hit an
+// error no retry can fix, it is errored instead: taken out of processing with
+// the reason, and the tasks of its unfinished steps cancelled.
+func recordWorkflowError(workflow *v2.WorkflowSchema, leaseToken string, err error) {
+	logger.GetErrorLogger().Printf("error processing workflow %s with error: %s", workflow.ID.Hex(), err.Error())
+
+	WorkflowModel, modelErr := repositories.GetMongoClient().GetModel("Workflow")
+	if modelErr != nil {
+		return
+	}
+
+	errorCount := workflow.ErrorCount + 1
+	filter := bson.M{"_id": workflow.ID, "status": "", "processingBy": leaseToken}
+	now := time.Now()
+
+	if !givesUp(errorCount, err) {
+		if updateErr := WorkflowModel.FindOneAndUpdate(&v2.WorkflowSchema{}, filter, bson.M{
+			"$set": bson.M{
+				"errorCount":   errorCount,
+				"errorMessage": err.Error(),
+				"nextRunAt":    now.Add(workflowPassInterval),
+			},
+			"$unset": bson.M{"processingBy": "", "processingUntil": ""},
+		}); updateErr != nil && !errors.Is(updateErr, mongo.ErrNoDocuments) {
+			logger.GetErrorLogger().Printf("error recording workflow %s error: %s", workflow.ID.Hex(), updateErr.Error())
+		}
+		return
+	}
+
+	updated := &v2.WorkflowSchema{}
+	updateErr := WorkflowModel.FindOneAndUpdate(updated, filter, bson.M{
+		"$set": bson.M{
+			"status":       statusErrored,
+			"errorCount":   errorCount,
+			"errorMessage": err.Error(),
+		},
+		"$unset": bson.M{"processingBy": "", "processingUntil": ""},
+		"$push": bson.M{"history": v2.WorkflowTransition{
+			From:   "",
+			To:     statusErrored,
+			Actor:  "system",
+			Reason: err.Error(),
+			At:     now,
+		}},
+	})
+	if updateErr != nil {
+		if !errors.Is(updateErr, mongo.ErrNoDocuments) {
+			logger.GetErrorLogger().Printf("error marking workflow %s errored: %s", workflow.ID.Hex(), updateErr.Error())
+		}
+		return
+	}
+
+	logger.GetErrorLogger().Printf("workflow %s errored: %s", workflow.ID.Hex(), err.Error())
+	cancelInFlightTasks(updated, "system")
+}
@@ -0,0 +1,31 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestGivesUp(t *testing.T) {
+	transient := errors.New("connection reset")
+	broken := fmt.Errorf("%w: the workflow's account no longer exists", errWorkflowBroken)
+
+	tests := []struct {
+		name       string
+		errorCount int
+		err        error
+		want       bool
+	}{
+		{"first transient error", 1, transient, false},
+		{"one short of the limit", maxWorkflowErrors - 1, transient, false},
+		{"at the limit", maxWorkflowErrors, transient, true},
+		{"broken on the first pass", 1, broken, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := givesUp(tt.errorCount, tt.err); got != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
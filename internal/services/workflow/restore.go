@@ -0,0 +1,18 @@
+package workflow
+
+// RestoreBackupWorkflowType puts a stored backup or save back on its agent.
+const RestoreBackupWorkflowType = "restorebackup"
+
+// ActionTypeRestoreMods is the restore step that makes the backup's mods the
+// agent's selection again and syncs them. Resolving them needs agentmod, which
+// registers the handler; see agentmod.RestoreModsAction.
+const ActionTypeRestoreMods = "restoremods"
+
+// RestoreBackupData is the Data of a restore-backup workflow. Kind is "backup"
+// or "save", the same as the restore tasks' payload.
+type RestoreBackupData struct {
+	AgentWorkflowData `bson:",inline"`
+	FileName          string `bson:"fileName" json:"fileName"`
+	Kind              string `bson:"kind" json:"kind"`
+	RestoreMods       bool   `bson:"restoreMods" json:"restoreMods"`
+}
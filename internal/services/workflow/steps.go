@@ -0,0 +1,83 @@
+package workflow
+
+import (
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+)
+
+// frontier is the steps that run on this pass: the first unfinished step and,
+// when it belongs to a group, the rest of that group. A group is a run of
+// consecutive steps sharing a Group name; its steps run side by side and the
+// workflow moves on once all of them have finished.
+func frontier(actions []v2.WorkflowAction) []int {
+	first := -1
+	for idx := range actions {
+		if actions[idx].Status == "" {
+			first = idx
+			break
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+
+	group := actions[first].Group
+	if group == "" {
+		return []int{first}
+	}
+
+	// Walk back too: a sibling before first may have finished already.
+	start := first
+	for start > 0 && actions[start-1].Group == group {
+		start--
+	}
+
+	steps := make([]int, 0)
+	for idx := start; idx < len(actions) && actions[idx].Group == group; idx++ {
+		if actions[idx].Status == "" {
+			steps = append(steps, idx)
+		}
+	}
+	return steps
+}
+
+// failedStep is the first step whose failure fails the workflow, or -1. A
+// step that continues on error can fail without stopping anything.
+func failedStep(actions []v2.WorkflowAction) int {
+	for idx := range actions {
+		if actions[idx].Status == "failed" && !actions[idx].ContinueOnError {
+			return idx
+		}
+	}
+	return -1
+}
+
+// inFlightSiblings reports whether steps of the failed step's group are still
+// running. They are left to finish before anything is rolled back, so a
+// compensation never races the step it undoes.
+func inFlightSiblings(actions []v2.WorkflowAction, failed int) bool {
+	group := actions[failed].Group
+	if group == "" {
+		return false
+	}
+	for _, idx := range frontier(actions) {
+		if actions[idx].Group == group {
+			return true
+		}
+	}
+	return false
+}
+
+// nextCompensation is the completed step whose compensation runs next, or -1.
+// Compensations undo in reverse, the last completed step first, one at a time.
+func nextCompensation(actions []v2.WorkflowAction) int {
+	for idx := len(actions) - 1; idx >= 0; idx-- {
+		action := &actions[idx]
+		if action.Status != "completed" || action.Compensation == nil {
+			continue
+		}
+		if action.Compensation.Status == "" {
+			return idx
+		}
+	}
+	return -1
+}
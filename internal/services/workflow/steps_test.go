@@ -0,0 +1,131 @@
+package workflow
+
+import (
+	"slices"
+	"testing"
+
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+)
+
+func step(status, group string) v2.WorkflowAction {
+	return v2.WorkflowAction{Status: status, Group: group}
+}
+
+func compensated(status, compensation string) v2.WorkflowAction {
+	return v2.WorkflowAction{Status: status, Compensation: &v2.WorkflowAction{Status: compensation}}
+}
+
+func TestFrontier(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []v2.WorkflowAction
+		want    []int
+	}{
+		{"empty", nil, nil},
+		{"all finished", []v2.WorkflowAction{step("completed", ""), step("skipped", "")}, nil},
+		{"first unfinished", []v2.WorkflowAction{step("completed", ""), step("", ""), step("", "")}, []int{1}},
+		{"whole group", []v2.WorkflowAction{step("completed", ""), step("", "g"), step("", "g"), step("", "")}, []int{1, 2}},
+		{"finished sibling left out", []v2.WorkflowAction{step("completed", "g"), step("", "g"), step("", "g")}, []int{1, 2}},
+		{"stops at the group's end", []v2.WorkflowAction{step("", "a"), step("", "b")}, []int{0}},
+		{"failed step counts as finished", []v2.WorkflowAction{step("failed", ""), step("", "")}, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := frontier(tt.actions); !slices.Equal(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFailedStep(t *testing.T) {
+	continued := step("failed", "")
+	continued.ContinueOnError = true
+
+	tests := []struct {
+		name    string
+		actions []v2.WorkflowAction
+		want    int
+	}{
+		{"none failed", []v2.WorkflowAction{step("completed", ""), step("", "")}, -1},
+		{"first failure", []v2.WorkflowAction{step("completed", ""), step("failed", ""), step("failed", "")}, 1},
+		{"continue on error", []v2.WorkflowAction{continued, step("completed", "")}, -1},
+		{"past a continued failure", []v2.WorkflowAction{continued, step("failed", "")}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failedStep(tt.actions); got != tt.want {
+				t.Fatalf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestInFlightSiblings(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []v2.WorkflowAction
+		failed  int
+		want    bool
+	}{
+		{"not in a group", []v2.WorkflowAction{step("failed", ""), step("", "")}, 0, false},
+		{"sibling running", []v2.WorkflowAction{step("failed", "g"), step("", "g")}, 0, true},
+		{"siblings finished", []v2.WorkflowAction{step("failed", "g"), step("completed", "g"), step("", "")}, 0, false},
+		{"next group is not a sibling", []v2.WorkflowAction{step("failed", "a"), step("", "b")}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inFlightSiblings(tt.actions, tt.failed); got != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNextCompensation(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []v2.WorkflowAction
+		want    int
+	}{
+		{"nothing to undo", []v2.WorkflowAction{step("completed", ""), step("failed", "")}, -1},
+		{"last completed first", []v2.WorkflowAction{compensated("completed", ""), compensated("completed", ""), step("failed", "")}, 1},
+		{"past an undone step", []v2.WorkflowAction{compensated("completed", ""), compensated("completed", "completed"), step("failed", "")}, 0},
+		{"failed compensation is not rerun", []v2.WorkflowAction{compensated("completed", "failed"), step("failed", "")}, -1},
+		{"only completed steps", []v2.WorkflowAction{compensated("skipped", ""), compensated("failed", "")}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextCompensation(tt.actions); got != tt.want {
+				t.Fatalf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+// A failed workflow only settles once its group is done and its rollback has
+// run.
+func TestValidateStatusWaitsForRollback(t *testing.T) {
+	w := &v2.WorkflowSchema{Actions: []v2.WorkflowAction{
+		compensated("completed", ""),
+		step("failed", "g"),
+		step("", "g"),
+	}}
+
+	ValidateStatus(w)
+	if w.Status != "" {
+		t.Fatalf("expected the workflow to wait for its sibling, got %q", w.Status)
+	}
+
+	w.Actions[2].Status = "completed"
+	ValidateStatus(w)
+	if w.Status != "" {
+		t.Fatalf("expected the workflow to wait for its compensation, got %q", w.Status)
+	}
+
+	w.Actions[0].Compensation.Status = "completed"
+	ValidateStatus(w)
+	if w.Status != "failed" {
+		t.Fatalf("expected the workflow to fail, got %q", w.Status)
+	}
+}
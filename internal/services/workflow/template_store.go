@@ -0,0 +1,225 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/config"
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/utils/logger"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const templateCollectionName = "workflowtemplates"
+
+// StoredTemplate is an account's workflow template. The definition is kept as
+// the JSON it was written in, so what the editor reads back is what was saved.
+type StoredTemplate struct {
+	ID         bson.ObjectID `bson:"_id"`
+	AccountID  bson.ObjectID `bson:"accountId"`
+	Name       string        `bson:"name"`
+	Definition string        `bson:"definition"`
+	CreatedBy  string        `bson:"createdBy,omitempty"`
+	CreatedAt  time.Time     `bson:"createdAt"`
+	UpdatedAt  time.Time     `bson:"updatedAt"`
+}
+
+// TemplateSummary is one template an account can see. Error is set, and
+// Definition nil, for a stored template that no longer validates.
+type TemplateSummary struct {
+	Name       string
+	Definition *TemplateDefinition
+	Source     string
+	Global     bool
+	Error      string
+}
+
+var (
+	globalTemplatesMu sync.RWMutex
+	globalTemplates   = map[string]TemplateSummary{}
+)
+
+func templateCollection() *mongo.Collection {
+	return repositories.GetMongoClient().GetCollection(templateCollectionName)
+}
+
+// EnsureTemplateIndexes makes a template name unique within its account.
+func EnsureTemplateIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := templateCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "accountId", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetName("account_name").SetUnique(true),
+	}); err != nil {
+		return err
+	}
+
+	logger.GetDebugLogger().Println("Ensured workflowtemplates indexes")
+	return nil
+}
+
+// LoadGlobalTemplates reads the templates every account can use from the
+// workflows directory under the data dir, one JSON file each. A file that does
+// not parse is logged and left out rather than stopping the backend.
+func LoadGlobalTemplates() error {
+	dir := filepath.Join(config.DataDir, "workflows")
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]TemplateSummary, len(files))
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			logger.GetErrorLogger().Printf("error reading workflow template %s: %s", file, err.Error())
+			continue
+		}
+
+		def, err := ParseTemplate(b)
+		if err != nil {
+			logger.GetErrorLogger().Printf("skipping workflow template %s: %s", file, err.Error())
+			continue
+		}
+		if _, ok := loaded[def.Name]; ok {
+			logger.GetErrorLogger().Printf("skipping workflow template %s: %q is already defined", file, def.Name)
+			continue
+		}
+
+		loaded[def.Name] = TemplateSummary{Name: def.Name, Definition: def, Source: string(b), Global: true}
+	}
+
+	globalTemplatesMu.Lock()
+	globalTemplates = loaded
+	globalTemplatesMu.Unlock()
+
+	logger.GetDebugLogger().Printf("Loaded %d global workflow templates from %s", len(loaded), dir)
+	return nil
+}
+
+func globalTemplate(name string) (TemplateSummary, bool) {
+	globalTemplatesMu.RLock()
+	defer globalTemplatesMu.RUnlock()
+
+	t, ok := globalTemplates[name]
+	return t, ok
+}
+
+// SaveTemplate validates a definition and stores it on the account, replacing
+// the account's template of the same name.
+func SaveTemplate(accountID bson.ObjectID, createdBy, definition string) (*TemplateDefinition, error) {
+	def, err := ParseTemplate([]byte(definition))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	_, err = templateCollection().UpdateOne(ctx,
+		bson.M{"accountId": accountID, "name": def.Name},
+		bson.M{
+			"$set": bson.M{"definition": definition, "updatedAt": now},
+			"$setOnInsert": bson.M{
+				"_id":       bson.NewObjectID(),
+				"createdBy": createdBy,
+				"createdAt": now,
+			},
+		},
+		options.UpdateOne().SetUpsert(true))
+	if err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+// DeleteTemplate removes one of the account's templates. Global templates live
+// on disk and cannot be deleted this way.
+func DeleteTemplate(accountID bson.ObjectID, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := templateCollection().DeleteOne(ctx, bson.M{"accountId": accountID, "name": name})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
+
+// FindTemplate returns the template the account means by name. A stored
+// template is validated again as it is read: an action it names may have been
+// removed since it was saved.
+func FindTemplate(accountID bson.ObjectID, name string) (*TemplateDefinition, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stored := &StoredTemplate{}
+	err := templateCollection().FindOne(ctx, bson.M{"accountId": accountID, "name": name}).Decode(stored)
+	if err == nil {
+		return ParseTemplate([]byte(stored.Definition))
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+
+	if t, ok := globalTemplate(name); ok {
+		return t.Definition, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrTemplateNotFound, name)
+}
+
+// ListTemplates returns the account's templates and the global ones it does
+// not shadow, sorted by name. A stored template that no longer validates is
+// still listed so it can be fixed or deleted.
+func ListTemplates(accountID bson.ObjectID) ([]TemplateSummary, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := templateCollection().Find(ctx, bson.M{"accountId": accountID})
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make([]StoredTemplate, 0)
+	if err := cur.All(ctx, &stored); err != nil {
+		return nil, err
+	}
+
+	out := make([]TemplateSummary, 0, len(stored))
+	shadowed := make(map[string]bool, len(stored))
+	for _, t := range stored {
+		shadowed[t.Name] = true
+		summary := TemplateSummary{Name: t.Name, Source: t.Definition}
+		if def, err := ParseTemplate([]byte(t.Definition)); err != nil {
+			summary.Error = err.Error()
+		} else {
+			summary.Definition = def
+		}
+		out = append(out, summary)
+	}
+
+	globalTemplatesMu.RLock()
+	for name, t := range globalTemplates {
+		if !shadowed[name] {
+			out = append(out, t)
+		}
+	}
+	globalTemplatesMu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
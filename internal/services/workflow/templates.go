@@ -0,0 +1,379 @@
+package workflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/services/agenttask"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// TemplateWorkflowType is the workflow type every template instantiates to.
+// Which template it came from is on its Data.
+const TemplateWorkflowType = "template"
+
+const (
+	// maxTemplateSteps and maxStepRetries keep a template from describing a
+	// workflow that runs for days.
+	maxTemplateSteps = 50
+	maxStepRetries   = 10
+)
+
+var (
+	ErrInvalidTemplate  = errors.New("invalid workflow template")
+	ErrTemplateNotFound = errors.New("workflow template not found")
+	ErrInvalidParams    = errors.New("invalid workflow template parameters")
+)
+
+var (
+	paramNamePattern   = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+	placeholderPattern = regexp.MustCompile(`{{\s*([A-Za-z][A-Za-z0-9_]*)\s*}}`)
+)
+
+// TemplateParam is a value the caller supplies when instantiating a template,
+// referenced in step data as {{name}}.
+type TemplateParam struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+	Default     string `json:"default,omitempty"`
+}
+
+// TemplateStep is one step of a template. Type is a registered workflow action
+// type, and may be left out of a step that names a task Action. Data is the
+// task payload, with {{name}} placeholders in its strings; Timeout is a Go
+// duration such as "10m".
+//
+// Consecutive steps with the same Group run in parallel. When is a condition
+// on earlier steps and the agent (see conditions.go); Name is what conditions
+// call a step. A step that fails the workflow is not the end of it: Compensate
+// on every step that completed before it runs, last first, to roll it back,
+// unless the step is ContinueOnError and its failure is just recorded.
+type TemplateStep struct {
+	Name            string          `json:"name,omitempty"`
+	Type            string          `json:"type,omitempty"`
+	Action          string          `json:"action,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	Timeout         string          `json:"timeout,omitempty"`
+	Retries         int             `json:"retries,omitempty"`
+	Group           string          `json:"group,omitempty"`
+	When            string          `json:"when,omitempty"`
+	ContinueOnError bool            `json:"continueOnError,omitempty"`
+	Compensate      *TemplateStep   `json:"compensate,omitempty"`
+}
+
+// TemplateDefinition is the JSON a workflow template is written in:
+//
+//	{
+//	  "name": "weekly-maintenance",
+//	  "description": "Stop, update and start the server",
+//	  "params": [{"name": "branch", "default": "public"}],
+//	  "steps": [
+//	    {"action": "stopsfserver", "timeout": "10m"},
+//	    {"action": "updatesfserver", "timeout": "30m", "retries": 2},
+//	    {"action": "startsfserver", "timeout": "10m"}
+//	  ]
+//	}
+type TemplateDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Params      []TemplateParam `json:"params,omitempty"`
+	Steps       []TemplateStep  `json:"steps"`
+}
+
+// TemplateWorkflowData is the Data of a workflow instantiated from a template.
+type TemplateWorkflowData struct {
+	AgentWorkflowData `bson:",inline"`
+	Template          string            `bson:"template" json:"template"`
+	Params            map[string]string `bson:"params,omitempty" json:"params,omitempty"`
+}
+
+// ParseTemplate reads and validates a template definition. Unknown keys are
+// refused rather than ignored, so a misspelt "retries" is not silently lost.
+func ParseTemplate(definition []byte) (*TemplateDefinition, error) {
+	dec := json.NewDecoder(bytes.NewReader(definition))
+	dec.DisallowUnknownFields()
+
+	def := &TemplateDefinition{}
+	if err := dec.Decode(def); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTemplate, err.Error())
+	}
+	if err := def.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTemplate, err.Error())
+	}
+	return def, nil
+}
+
+func (def *TemplateDefinition) validate() error {
+	def.Name = strings.TrimSpace(def.Name)
+	if def.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(def.Steps) == 0 {
+		return errors.New("at least one step is required")
+	}
+	if len(def.Steps) > maxTemplateSteps {
+		return fmt.Errorf("at most %d steps are allowed", maxTemplateSteps)
+	}
+
+	declared := make(map[string]bool, len(def.Params))
+	for _, p := range def.Params {
+		if !paramNamePattern.MatchString(p.Name) {
+			return fmt.Errorf("parameter name %q must be a letter followed by letters, digits or _", p.Name)
+		}
+		if declared[p.Name] {
+			return fmt.Errorf("parameter %q is declared twice", p.Name)
+		}
+		declared[p.Name] = true
+	}
+
+	// named maps each step name to its index, for conditions to look back on.
+	named := make(map[string]int, len(def.Steps))
+	groupEnded := make(map[string]bool)
+
+	for idx := range def.Steps {
+		step := &def.Steps[idx]
+		if err := step.validate(declared); err != nil {
+			return fmt.Errorf("step %d: %s", idx+1, err.Error())
+		}
+
+		if step.Name != "" {
+			if !paramNamePattern.MatchString(step.Name) {
+				return fmt.Errorf("step %d: name %q must be a letter followed by letters, digits or _", idx+1, step.Name)
+			}
+			if _, ok := named[step.Name]; ok {
+				return fmt.Errorf("step %d: name %q is used twice", idx+1, step.Name)
+			}
+			named[step.Name] = idx
+		}
+
+		if idx > 0 && def.Steps[idx-1].Group != "" && def.Steps[idx-1].Group != step.Group {
+			groupEnded[def.Steps[idx-1].Group] = true
+		}
+		if step.Group != "" && groupEnded[step.Group] {
+			return fmt.Errorf("step %d: the steps of group %q must be next to each other", idx+1, step.Group)
+		}
+
+		cond, err := parseCondition(step.When)
+		if err != nil {
+			return fmt.Errorf("step %d: %s", idx+1, err.Error())
+		}
+		for _, name := range cond.steps() {
+			ref, ok := named[name]
+			if !ok || ref == idx {
+				return fmt.Errorf("step %d: condition refers to %q, which is not an earlier step", idx+1, name)
+			}
+			// A sibling runs alongside this step, so its result is not known
+			// when this one starts.
+			if step.Group != "" && def.Steps[ref].Group == step.Group {
+				return fmt.Errorf("step %d: condition refers to %q, which runs in the same group", idx+1, name)
+			}
+		}
+	}
+	return nil
+}
+
+func (step *TemplateStep) validate(declared map[string]bool) error {
+	if step.Type == "" && step.Action != "" {
+		step.Type = v2.WorkflowActionType_AgentTask
+	}
+	if step.Type == "" {
+		return errors.New("type or action is required")
+	}
+	if _, ok := workflowActionRegistry[step.Type]; !ok {
+		return fmt.Errorf("unknown step type %q", step.Type)
+	}
+	// A template runs against an agent that already exists; creating one needs
+	// the data only the create-agent flow collects.
+	if step.Type == v2.WorkflowActionType_CreateAgent {
+		return errors.New("templates cannot create agents")
+	}
+
+	if step.Type == v2.WorkflowActionType_AgentTask {
+		if _, ok := agenttask.LookupAction(step.Action); !ok {
+			return fmt.Errorf("%w %q", agenttask.ErrUnknownAction, step.Action)
+		}
+	} else if step.Action != "" || len(step.Data) > 0 {
+		return fmt.Errorf("a %s step takes no action or data", step.Type)
+	}
+
+	if len(step.Data) > 0 {
+		var data interface{}
+		if err := json.Unmarshal(step.Data, &data); err != nil {
+			return errors.New("data must be valid JSON")
+		}
+		for _, match := range placeholderPattern.FindAllStringSubmatch(string(step.Data), -1) {
+			if !declared[match[1]] {
+				return fmt.Errorf("data uses undeclared parameter %q", match[1])
+			}
+		}
+	}
+
+	if step.Timeout != "" {
+		timeout, err := time.ParseDuration(step.Timeout)
+		if err != nil || timeout < 0 {
+			return fmt.Errorf("timeout %q is not a duration", step.Timeout)
+		}
+	}
+	if step.Retries < 0 || step.Retries > maxStepRetries {
+		return fmt.Errorf("retries must be between 0 and %d", maxStepRetries)
+	}
+
+	if c := step.Compensate; c != nil {
+		if c.Name != "" || c.Group != "" || c.When != "" || c.ContinueOnError || c.Compensate != nil {
+			return errors.New("compensate takes only type, action, data, timeout and retries")
+		}
+		if err := c.validate(declared); err != nil {
+			return fmt.Errorf("compensate: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// resolveParams fills in defaults and checks the caller's values against what
+// the template declares.
+func (def *TemplateDefinition) resolveParams(given map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string, len(def.Params))
+	declared := make(map[string]bool, len(def.Params))
+
+	for _, p := range def.Params {
+		declared[p.Name] = true
+		value, ok := given[p.Name]
+		if !ok || value == "" {
+			value = p.Default
+		}
+		if value == "" && p.Required {
+			return nil, fmt.Errorf("%w: %q is required", ErrInvalidParams, p.Name)
+		}
+		resolved[p.Name] = value
+	}
+
+	for name := range given {
+		if !declared[name] {
+			return nil, fmt.Errorf("%w: the template has no parameter %q", ErrInvalidParams, name)
+		}
+	}
+	return resolved, nil
+}
+
+// substitute replaces placeholders in every string of a decoded JSON value.
+// Working on the decoded value, not the raw text, means a parameter can never
+// break out of the string it is placed in.
+func substitute(value interface{}, params map[string]string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return placeholderPattern.ReplaceAllStringFunc(v, func(match string) string {
+			return params[placeholderPattern.FindStringSubmatch(match)[1]]
+		})
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = substitute(item, params)
+		}
+		return v
+	case []interface{}:
+		for idx, item := range v {
+			v[idx] = substitute(item, params)
+		}
+		return v
+	}
+	return value
+}
+
+// buildActions turns the template into the workflow's actions for one set of
+// parameter values. Task payloads are checked here, once their placeholders are
+// filled, so a bad value fails the instantiation instead of a step part-way in.
+func (def *TemplateDefinition) buildActions(params map[string]string) ([]v2.WorkflowAction, error) {
+	actions := make([]v2.WorkflowAction, 0, len(def.Steps))
+
+	for idx, step := range def.Steps {
+		action, err := step.buildAction(params)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", idx+1, err)
+		}
+
+		action.Name = step.Name
+		action.Group = step.Group
+		action.When = step.When
+		action.ContinueOnError = step.ContinueOnError
+
+		if step.Compensate != nil {
+			compensation, err := step.Compensate.buildAction(params)
+			if err != nil {
+				return nil, fmt.Errorf("step %d compensate: %w", idx+1, err)
+			}
+			action.Compensation = &compensation
+		}
+
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+func (step *TemplateStep) buildAction(params map[string]string) (v2.WorkflowAction, error) {
+	action := v2.WorkflowAction{
+		Type:       step.Type,
+		TaskAction: step.Action,
+		MaxRetries: step.Retries,
+	}
+
+	if step.Timeout != "" {
+		action.Timeout, _ = time.ParseDuration(step.Timeout)
+	}
+
+	if len(step.Data) > 0 {
+		var data interface{}
+		if err := json.Unmarshal(step.Data, &data); err != nil {
+			return action, err
+		}
+		action.TaskData = substitute(data, params)
+	}
+
+	if step.Type == v2.WorkflowActionType_AgentTask {
+		payload := ""
+		if action.TaskData != nil {
+			b, err := json.Marshal(action.TaskData)
+			if err != nil {
+				return action, err
+			}
+			payload = string(b)
+		}
+		if err := agenttask.ValidateAction(step.Action, payload); err != nil {
+			return action, err
+		}
+	}
+	return action, nil
+}
+
+// InstantiateTemplate starts a workflow from the named template on one of the
+// account's agents. An account's own template wins over a global one of the
+// same name.
+func InstantiateTemplate(accountID, agentID bson.ObjectID, name string, params map[string]string, createdBy string) (bson.ObjectID, error) {
+	def, err := FindTemplate(accountID, name)
+	if err != nil {
+		return bson.ObjectID{}, err
+	}
+
+	resolved, err := def.resolveParams(params)
+	if err != nil {
+		return bson.ObjectID{}, err
+	}
+
+	actions, err := def.buildActions(resolved)
+	if err != nil {
+		return bson.ObjectID{}, err
+	}
+
+	data := &TemplateWorkflowData{
+		AgentWorkflowData: AgentWorkflowData{AccountId: accountID, AgentId: agentID},
+		Template:          def.Name,
+		Params:            resolved,
+	}
+
+	return Create(TemplateWorkflowType, data, actions, createdBy)
+}
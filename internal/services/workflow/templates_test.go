@@ -0,0 +1,119 @@
+package workflow
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+)
+
+func parseTestTemplate(t *testing.T, definition string) (*TemplateDefinition, error) {
+	t.Helper()
+	RegisterWorkflowAction(v2.WorkflowActionType_AgentTask, AgentTaskAction{})
+	RegisterWorkflowAction(v2.WorkflowActionType_WaitForOnline, WaitForOnlineAction{})
+	return ParseTemplate([]byte(definition))
+}
+
+func TestTemplateValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   string
+		wantErr string
+	}{
+		{
+			name:  "a group of consecutive steps",
+			steps: `{"action": "stopsfserver", "group": "g"}, {"action": "startsfserver", "group": "g"}, {"action": "startsfserver"}`,
+		},
+		{
+			name:    "a group split in two",
+			steps:   `{"action": "stopsfserver", "group": "g"}, {"action": "startsfserver"}, {"action": "stopsfserver", "group": "g"}`,
+			wantErr: "must be next to each other",
+		},
+		{
+			name:  "a condition on an earlier step",
+			steps: `{"name": "stop", "action": "stopsfserver"}, {"action": "startsfserver", "when": "steps.stop == failed"}`,
+		},
+		{
+			name:    "a condition on a later step",
+			steps:   `{"action": "startsfserver", "when": "steps.stop"}, {"name": "stop", "action": "stopsfserver"}`,
+			wantErr: "not an earlier step",
+		},
+		{
+			name:    "a condition on itself",
+			steps:   `{"name": "stop", "action": "stopsfserver", "when": "steps.stop"}`,
+			wantErr: "not an earlier step",
+		},
+		{
+			name:    "a condition on a sibling",
+			steps:   `{"name": "stop", "action": "stopsfserver", "group": "g"}, {"action": "startsfserver", "group": "g", "when": "steps.stop"}`,
+			wantErr: "runs in the same group",
+		},
+		{
+			name:    "a bad condition",
+			steps:   `{"action": "stopsfserver", "when": "agent.online == completed"}`,
+			wantErr: "cannot be compared",
+		},
+		{
+			name:    "a step name used twice",
+			steps:   `{"name": "stop", "action": "stopsfserver"}, {"name": "stop", "action": "stopsfserver"}`,
+			wantErr: "used twice",
+		},
+		{
+			name:  "a compensation",
+			steps: `{"action": "stopsfserver", "compensate": {"action": "startsfserver", "timeout": "10m"}}`,
+		},
+		{
+			name:    "a compensation with a condition",
+			steps:   `{"action": "stopsfserver", "compensate": {"action": "startsfserver", "when": "agent.online"}}`,
+			wantErr: "compensate takes only",
+		},
+		{
+			name:    "data on a non-task step",
+			steps:   `{"type": "` + v2.WorkflowActionType_WaitForOnline + `", "data": {}}`,
+			wantErr: "takes no action or data",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTestTemplate(t, `{"name": "test", "steps": [`+tt.steps+`]}`)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected the template to be accepted, got %s", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidTemplate) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an invalid template error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTemplateBuildsGroupsAndConditions(t *testing.T) {
+	def, err := parseTestTemplate(t, `{"name": "test", "steps": [
+		{"name": "stop", "action": "stopsfserver", "group": "g", "continueOnError": true},
+		{"action": "stopsfserver", "group": "g"},
+		{"action": "startsfserver", "when": "steps.stop", "compensate": {"action": "stopsfserver"}}
+	]}`)
+	if err != nil {
+		t.Fatalf("error parsing template: %s", err)
+	}
+
+	actions, err := def.buildActions(nil)
+	if err != nil {
+		t.Fatalf("error building actions: %s", err)
+	}
+	if len(actions) != 3 {
+		t.Fatalf("expected three actions, got %d", len(actions))
+	}
+	if actions[0].Name != "stop" || actions[0].Group != "g" || !actions[0].ContinueOnError {
+		t.Fatalf("expected the first step's name, group and continueOnError to carry over, got %+v", actions[0])
+	}
+	if actions[2].When != "steps.stop" {
+		t.Fatalf("expected the condition to carry over, got %q", actions[2].When)
+	}
+	if c := actions[2].Compensation; c == nil || c.TaskAction != "stopsfserver" {
+		t.Fatalf("expected a stopsfserver compensation, got %+v", c)
+	}
+}
@@ -0,0 +1,185 @@
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/SatisfactoryServerManager/ssmcloud-backend/internal/repositories"
+	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// WorkflowData is a workflow's stored Data, decoded into the type its workflow
+// type registered. Every action handler is given it in place of the raw Data.
+type WorkflowData interface {
+	// Account is the account the workflow runs for.
+	Account() bson.ObjectID
+	// Agent is the agent the workflow acts on. For a workflow that creates its
+	// agent, it is an error until the create step has run.
+	Agent() (*v2.AgentSchema, error)
+}
+
+// agentCreator is WorkflowData for a workflow whose CreateAgent step makes
+// the agent it then acts on.
+type agentCreator interface {
+	WorkflowData
+	newAgent() *v2.AgentSchema
+}
+
+// AgentRoles is WorkflowData for a workflow whose steps act on more than one
+// agent. A step's Role names the agent it acts on; a step without one acts on
+// the workflow's own agent, the one Agent returns.
+type AgentRoles interface {
+	WorkflowData
+	AgentForRole(role string) (*v2.AgentSchema, error)
+}
+
+// roleData is a workflow's Data as a step with a Role sees it: Agent is the
+// role's agent, so the action handlers need not know about roles.
+type roleData struct {
+	AgentRoles
+	role string
+}
+
+func (d roleData) Agent() (*v2.AgentSchema, error) {
+	return d.AgentForRole(d.role)
+}
+
+// dataForRole is the Data a step with the given Role is run with.
+func dataForRole(d WorkflowData, role string) (WorkflowData, error) {
+	if role == "" {
+		return d, nil
+	}
+	roles, ok := d.(AgentRoles)
+	if !ok {
+		return nil, fmt.Errorf("workflow has no agent role %q", role)
+	}
+	return roleData{AgentRoles: roles, role: role}, nil
+}
+
+// WorkflowType is one kind of workflow the engine can run. The steps are the
+// workflow's own actions; the type only knows how to read its Data.
+type WorkflowType struct {
+	// NewData returns an empty value for the stored Data to decode into.
+	NewData func() WorkflowData
+}
+
+var workflowTypeRegistry = map[string]WorkflowType{}
+
+// RegisterWorkflowType makes a workflow type runnable. Like
+// RegisterWorkflowAction, a later registration of the same name replaces the
+// earlier one.
+func RegisterWorkflowType(name string, t WorkflowType) {
+	if workflowTypeRegistry == nil {
+		workflowTypeRegistry = map[string]WorkflowType{}
+	}
+	workflowTypeRegistry[name] = t
+}
+
+// decodeWorkflowData reads the workflow's Data into its type's value. Data is
+// whatever the driver decoded from Mongo, so it goes through JSON, the same way
+// ProcessWorkflow always read it.
+func decodeWorkflowData(workflow *v2.WorkflowSchema) (WorkflowData, error) {
+	t, ok := workflowTypeRegistry[workflow.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown workflow type: %s", workflow.Type)
+	}
+
+	data := t.NewData()
+
+	bodyBytes, err := json.Marshal(workflow.Data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading workflow data with error: %s", err.Error())
+	}
+	if err := json.Unmarshal(bodyBytes, data); err != nil {
+		return nil, fmt.Errorf("error reading workflow data with error: %s", err.Error())
+	}
+
+	return data, nil
+}
+
+// Create stores a new workflow of a registered type. The processor picks it up
+// on its next run. createdBy is the account member who started it; the tasks
+// its steps enqueue are on their behalf.
+func Create(workflowType string, data interface{}, actions []v2.WorkflowAction, createdBy string) (bson.ObjectID, error) {
+	if _, ok := workflowTypeRegistry[workflowType]; !ok {
+		return bson.ObjectID{}, fmt.Errorf("unknown workflow type: %s", workflowType)
+	}
+
+	WorkflowModel, err := repositories.GetMongoClient().GetModel("Workflow")
+	if err != nil {
+		return bson.ObjectID{}, fmt.Errorf("error getting workflow model with error: %s", err.Error())
+	}
+
+	workflow := v2.WorkflowSchema{
+		ID:        bson.NewObjectID(),
+		Type:      workflowType,
+		Data:      data,
+		Actions:   actions,
+		CreatedBy: createdBy,
+	}
+
+	if err := WorkflowModel.Create(workflow); err != nil {
+		return bson.ObjectID{}, err
+	}
+	return workflow.ID, nil
+}
+
+// CreateAgentData is the Data of a CreateAgent workflow: the agent to make,
+// found again afterwards by its API key.
+type CreateAgentData struct {
+	v2.CreateAgentWorkflowData
+}
+
+func (d *CreateAgentData) Account() bson.ObjectID {
+	return d.AccountId
+}
+
+func (d *CreateAgentData) Agent() (*v2.AgentSchema, error) {
+	return agentByAPIKey(d.APIKey)
+}
+
+func (d *CreateAgentData) newAgent() *v2.AgentSchema {
+	return v2.NewAgent(d.AgentName, d.Port, d.Memory, d.APIKey)
+}
+
+// AgentWorkflowData is the Data of a workflow that acts on an agent that
+// already exists.
+type AgentWorkflowData struct {
+	AccountId bson.ObjectID `bson:"accountId" json:"accountId"`
+	AgentId   bson.ObjectID `bson:"agentId" json:"agentId"`
+}
+
+func (d *AgentWorkflowData) Account() bson.ObjectID {
+	return d.AccountId
+}
+
+func (d *AgentWorkflowData) Agent() (*v2.AgentSchema, error) {
+	return agentByID(d.AgentId)
+}
+
+func agentByAPIKey(apiKey string) (*v2.AgentSchema, error) {
+	AgentModel, err := repositories.GetMongoClient().GetModel("Agent")
+	if err != nil {
+		return nil, err
+	}
+
+	theAgent := &v2.AgentSchema{}
+	if err := AgentModel.FindOne(theAgent, bson.M{"apiKey": apiKey}); err != nil {
+		return nil, err
+	}
+	return theAgent, nil
+}
+
+func agentByID(agentID bson.ObjectID) (*v2.AgentSchema, error) {
+	AgentModel, err := repositories.GetMongoClient().GetModel("Agent")
+	if err != nil {
+		return nil, err
+	}
+
+	theAgent := &v2.AgentSchema{}
+	if err := AgentModel.FindOneById(theAgent, agentID); err != nil {
+		return nil, err
+	}
+	return theAgent, nil
+}
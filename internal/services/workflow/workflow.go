@@ -2,7 +2,6 @@ package workflow
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
@@ -14,6 +13,7 @@ import (
 	v2 "github.com/SatisfactoryServerManager/ssmcloud-resources/models/v2"
 	"github.com/mrhid6/go-mongoose-lock/joblock"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
 var workflowActionRegistry = map[string]v2.IWorkflowAction{}
@@ -32,6 +32,36 @@ func InitWorkflowService() {
 	RegisterWorkflowAction(v2.WorkflowActionType_WaitForOnline, WaitForOnlineAction{})
 	RegisterWorkflowAction(v2.WorkflowActionType_AgentTask, AgentTaskAction{})
 
+	RegisterWorkflowType(v2.WorkflowType_CreateAgent, WorkflowType{
+		NewData: func() WorkflowData { return &CreateAgentData{} },
+	})
+	RegisterWorkflowType(TemplateWorkflowType, WorkflowType{
+		NewData: func() WorkflowData { return &TemplateWorkflowData{} },
+	})
+	RegisterWorkflowType(RestoreBackupWorkflowType, WorkflowType{
+		NewData: func() WorkflowData { return &RestoreBackupData{} },
+	})
+	RegisterWorkflowType(MigrateServerWorkflowType, WorkflowType{
+		NewData: func() WorkflowData { return &MigrateServerData{} },
+	})
+	RegisterWorkflowType(CloneAgentWorkflowType, WorkflowType{
+		NewData: func() WorkflowData { return &CloneAgentData{} },
+	})
+
+	if err := EnsureWorkflowIndexes(); err != nil {
+		logger.GetErrorLogger().Printf("error ensuring workflow indexes with error: %s", err.Error())
+	}
+
+	if err := EnsureTemplateIndexes(); err != nil {
+		logger.GetErrorLogger().Printf("error ensuring workflow template indexes with error: %s", err.Error())
+	}
+
+	// Templates are validated against the registered actions, so they load
+	// after them.
+	if err := LoadGlobalTemplates(); err != nil {
+		logger.GetErrorLogger().Printf("error loading global workflow templates with error: %s", err.Error())
+	}
+
 	processWorkflowsJob, _ = joblock.NewJobLockTask(
 		repositories.GetMongoClient(),
 		"processWorkflowsJob", func() {
@@ -67,68 +97,29 @@ func RegisterWorkflowAction(name string, handler v2.IWorkflowAction) {
 	workflowActionRegistry[name] = handler
 }
 
-func ProcessWorkflows() error {
-
-	WorkflowModel, err := repositories.GetMongoClient().GetModel("Workflow")
-	if err != nil {
-		return err
-	}
-
-	workflows := make([]v2.WorkflowSchema, 0)
-
-	if err := WorkflowModel.FindAll(&workflows, bson.M{"status": ""}); err != nil {
-		return err
-	}
-
-	if len(workflows) == 0 {
-		return nil
-	}
-
-	logger.GetInfoLogger().Println("Processing Workflows")
-
-	for idx := range workflows {
-		workflow := &workflows[idx]
-
-		ValidateStatus(workflow)
-		if workflow.Status != "" {
-			continue
-		}
-
-		if err := ProcessWorkflow(workflow); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
+// ValidateStatus settles the workflow's status from its steps. A workflow with
+// a failed step only fails once the failed step's group has finished and every
+// compensation has run; until then it is still being processed.
 func ValidateStatus(obj *v2.WorkflowSchema) {
-	completed := true
-	failed := false
-
-	for actionIdx := range obj.Actions {
-		action := &obj.Actions[actionIdx]
-		if action.Status == "" {
-			completed = false
-			break
-		} else if action.Status == "failed" {
-			failed = true
-			break
+	if failed := failedStep(obj.Actions); failed >= 0 {
+		if inFlightSiblings(obj.Actions, failed) || nextCompensation(obj.Actions) >= 0 {
+			return
 		}
-	}
-
-	if completed {
-		obj.Status = "completed"
+		obj.Status = "failed"
 		return
 	}
 
-	if failed {
-		obj.Status = "failed"
-		return
+	for actionIdx := range obj.Actions {
+		if obj.Actions[actionIdx].Status == "" {
+			return
+		}
 	}
+	obj.Status = "completed"
 }
 
-func ProcessWorkflow(workflow *v2.WorkflowSchema) error {
+// ProcessWorkflow steps the workflow once and saves it, provided leaseToken
+// still holds its lease; see claimWorkflow.
+func ProcessWorkflow(workflow *v2.WorkflowSchema, leaseToken string) error {
 
 	AccountModel, err := repositories.GetMongoClient().GetModel("Account")
 	if err != nil {
@@ -140,13 +131,17 @@ func ProcessWorkflow(workflow *v2.WorkflowSchema) error {
 		return err
 	}
 
-	workflowData := v2.BaseWorkflowData{}
-	bodyBytes, _ := json.Marshal(workflow.Data)
-	json.Unmarshal(bodyBytes, &workflowData)
+	workflowData, err := decodeWorkflowData(workflow)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errWorkflowBroken, err.Error())
+	}
 
 	theAccount := &v2.AccountSchema{}
 
-	if err := AccountModel.FindOne(theAccount, bson.M{"_id": workflowData.AccountId}); err != nil {
+	if err := AccountModel.FindOne(theAccount, bson.M{"_id": workflowData.Account()}); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("%w: the workflow's account no longer exists", errWorkflowBroken)
+		}
 		return fmt.Errorf("error finding account from workflow with error %s", err.Error())
 	}
 
@@ -154,73 +149,141 @@ func ProcessWorkflow(workflow *v2.WorkflowSchema) error {
 		return fmt.Errorf("error failed to populate agents from workflow with error %s", err.Error())
 	}
 
-	switch workflow.Type {
-	case v2.WorkflowType_CreateAgent:
-		processWorkflow_CreateAgent(workflow, theAccount)
-	default:
-		return errors.New("unknown workflow type")
-	}
-
 	ValidateStatus(workflow)
-
-	dbUpdate := bson.M{
-		"status":  workflow.Status,
-		"actions": workflow.Actions,
-		"agentId": workflow.AgentId,
+	if workflow.Status == "" {
+		processWorkflowSteps(workflow, workflowData, theAccount)
+		ValidateStatus(workflow)
 	}
 
-	if err := WorkflowModel.UpdateData(workflow, dbUpdate); err != nil {
+	// The write only lands while the workflow is still running and this pass
+	// still holds its lease. A cancel or pause that came in during this
+	// pass wins; see saveLost.
+	updated := &v2.WorkflowSchema{}
+	err = WorkflowModel.FindOneAndUpdate(updated,
+		bson.M{"_id": workflow.ID, "status": "", "processingBy": leaseToken},
+		bson.M{
+			"$set": bson.M{
+				"status":     workflow.Status,
+				"actions":    workflow.Actions,
+				"agentId":    workflow.AgentId,
+				"nextRunAt":  time.Now().Add(workflowPassInterval),
+				"errorCount": 0,
+			},
+			"$unset": bson.M{"processingBy": "", "processingUntil": "", "errorMessage": ""},
+		})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		saveLost(workflow)
+		return nil
+	}
+	if err != nil {
 		return fmt.Errorf("error updating workflow with error: %s", err.Error())
 	}
 
 	return nil
 }
 
-func processWorkflow_CreateAgent(workflow *v2.WorkflowSchema, theAccount *v2.AccountSchema) {
-
-	workflowData := v2.CreateAgentWorkflowData{}
-	bodyBytes, _ := json.Marshal(workflow.Data)
-	json.Unmarshal(bodyBytes, &workflowData)
+// saveLost tidies up after a pass whose result was not saved because the
+// workflow was paused or cancelled meanwhile, or its lease ran out. Tasks the pass enqueued are not on
+// the stored workflow: a paused one adopts them by dedupe key when it resumes,
+// but a cancelled one never looks again, so they are cancelled here.
+func saveLost(workflow *v2.WorkflowSchema) {
+	WorkflowModel, err := repositories.GetMongoClient().GetModel("Workflow")
+	if err != nil {
+		return
+	}
 
-	currentActionIndex := 0
+	current := &v2.WorkflowSchema{}
+	if err := WorkflowModel.FindOneById(current, workflow.ID); err != nil {
+		return
+	}
+	if current.Status == statusCancelled {
+		cancelInFlightTasks(workflow, "system")
+	}
+}
 
-	for idx := range workflow.Actions {
-		action := &workflow.Actions[idx]
+// processWorkflowSteps runs the workflow's current steps. It is the same for
+// every workflow type; only the Data the actions read differs.
+//
+// Each step's handler only starts or polls its work, so running a whole group
+// on one pass is what runs the group in parallel. Once a step has failed the
+// workflow, no new steps start: the rest of its group is seen through, then the
+// completed steps are compensated.
+func processWorkflowSteps(workflow *v2.WorkflowSchema, workflowData WorkflowData, theAccount *v2.AccountSchema) {
+
+	if failed := failedStep(workflow.Actions); failed >= 0 && !inFlightSiblings(workflow.Actions, failed) {
+		if idx := nextCompensation(workflow.Actions); idx >= 0 {
+			compensation := workflow.Actions[idx].Compensation
+
+			// A compensation undoes its step, so it acts on the step's agent.
+			stepData, err := dataForRole(workflowData, workflow.Actions[idx].Role)
+			if err != nil {
+				compensation.Status = "failed"
+				compensation.ErrorMessage = err.Error()
+				return
+			}
 
-		if action.Status == "" {
-			currentActionIndex = idx
-			break
+			wctx := v2.WorkflowContext{WorkflowID: workflow.ID, ActionIdx: idx, Compensation: true, RequestedBy: workflow.CreatedBy}
+			executeWorkflowAction(compensation, stepData, theAccount, wctx)
 		}
+		return
 	}
 
-	action := &workflow.Actions[currentActionIndex]
+	agents := map[string]*v2.AgentSchema{}
 
-	wctx := v2.WorkflowContext{WorkflowID: workflow.ID, ActionIdx: currentActionIndex}
+	for _, idx := range frontier(workflow.Actions) {
+		action := &workflow.Actions[idx]
 
-	executeWorkflowAction(action, &workflowData, theAccount, wctx)
+		stepData, err := dataForRole(workflowData, action.Role)
+		if err != nil {
+			action.Status = "failed"
+			action.ErrorMessage = err.Error()
+			continue
+		}
 
-	// The agent only exists once the create-agent action has run. Link it to the
-	// workflow so the server page can find the workflow it was created by.
+		run, err := shouldRunStep(workflow, idx, stepData, agents)
+		if err != nil {
+			action.Status = "failed"
+			action.ErrorMessage = err.Error()
+			continue
+		}
+		if !run {
+			action.Status = "skipped"
+			continue
+		}
+
+		wctx := v2.WorkflowContext{WorkflowID: workflow.ID, ActionIdx: idx, RequestedBy: workflow.CreatedBy}
+		executeWorkflowAction(action, stepData, theAccount, wctx)
+	}
+
+	// A workflow that creates its agent only has one once that action has run.
+	// Link it to the workflow so the server page can find the workflow it was
+	// created by.
 	if workflow.AgentId.IsZero() {
-		if agentId, err := findAgentIdByAPIKey(workflowData.APIKey); err == nil {
-			workflow.AgentId = agentId
+		if linked, err := workflowData.Agent(); err == nil {
+			workflow.AgentId = linked.ID
 		}
 	}
 }
 
-func findAgentIdByAPIKey(apiKey string) (bson.ObjectID, error) {
-	AgentModel, err := repositories.GetMongoClient().GetModel("Agent")
+// shouldRunStep evaluates the step's When, whose agent terms are about the
+// step's own agent. Each role's agent is looked up once per pass, and only when
+// a condition asks about it.
+func shouldRunStep(workflow *v2.WorkflowSchema, idx int, stepData WorkflowData, agents map[string]*v2.AgentSchema) (bool, error) {
+	action := &workflow.Actions[idx]
+	cond, err := parseCondition(action.When)
 	if err != nil {
-		return bson.ObjectID{}, err
+		return false, err
 	}
 
-	theAgent := &v2.AgentSchema{}
-
-	if err := AgentModel.FindOne(theAgent, bson.M{"apiKey": apiKey}); err != nil {
-		return bson.ObjectID{}, err
+	theAgent := agents[action.Role]
+	if cond.needsAgent() && theAgent == nil {
+		theAgent, err = stepData.Agent()
+		if err != nil {
+			return false, err
+		}
+		agents[action.Role] = theAgent
 	}
-
-	return theAgent.ID, nil
+	return cond.eval(workflow.Actions, theAgent), nil
 }
 
 func executeWorkflowAction(action *v2.WorkflowAction, d interface{}, theAccount *v2.AccountSchema, wctx v2.WorkflowContext) {
@@ -235,15 +298,31 @@ func executeWorkflowAction(action *v2.WorkflowAction, d interface{}, theAccount
 	}
 
 	err := handler.Execute(action, d, theAccount, wctx)
-	if err != nil {
-		action.Status = "failed"
+	if err == nil {
+		return
+	}
+
+	// A step with retries left runs again from scratch on the next pass. The
+	// error stays on it so the UI can show why it is on another attempt.
+	if action.Attempts < action.MaxRetries {
+		action.Attempts += 1
+		action.Status = ""
+		action.TaskID = ""
+		action.RetryCount = 0
 		action.ErrorMessage = err.Error()
+		return
 	}
+
+	action.Status = "failed"
+	action.ErrorMessage = err.Error()
 }
 
 func (a CreateAgentAction) Execute(action *v2.WorkflowAction, d interface{}, theAccount *v2.AccountSchema, _ v2.WorkflowContext) error {
 
-	workflowData := d.(*v2.CreateAgentWorkflowData)
+	workflowData, ok := d.(agentCreator)
+	if !ok {
+		return errors.New("workflow does not describe an agent to create")
+	}
 
 	AgentModel, err := repositories.GetMongoClient().GetModel("Agent")
 	if err != nil {
@@ -255,7 +334,10 @@ func (a CreateAgentAction) Execute(action *v2.WorkflowAction, d interface{}, the
 		return err
 	}
 
-	newAgent := v2.NewAgent(workflowData.AgentName, workflowData.Port, workflowData.Memory, workflowData.APIKey)
+	newAgent := workflowData.newAgent()
+	if newAgent == nil {
+		return errors.New("workflow does not describe an agent to create")
+	}
 
 	if err := AgentModel.Create(newAgent); err != nil {
 		return fmt.Errorf("error inserting new agent with error: %s", err.Error())
@@ -285,19 +367,11 @@ func (a CreateAgentAction) Execute(action *v2.WorkflowAction, d interface{}, the
 
 func (a WaitForOnlineAction) Execute(action *v2.WorkflowAction, d interface{}, theAccount *v2.AccountSchema, _ v2.WorkflowContext) error {
 
-	workflowData := d.(*v2.CreateAgentWorkflowData)
-
-	AgentModel, err := repositories.GetMongoClient().GetModel("Agent")
+	theAgent, err := d.(WorkflowData).Agent()
 	if err != nil {
 		return err
 	}
 
-	theAgent := &v2.AgentSchema{}
-
-	if err := AgentModel.FindOne(theAgent, bson.M{"apiKey": workflowData.APIKey}); err != nil {
-		return err
-	}
-
 	logger.GetInfoLogger().Printf("waiting for agent: %s to be online", theAgent.AgentName)
 
 	if !theAgent.Status.Online {
@@ -320,20 +394,16 @@ func (a WaitForOnlineAction) Execute(action *v2.WorkflowAction, d interface{}, t
 // it, every pass through this function appended a fresh task. The dedupe key is
 // the backstop for the window where the id is lost before it is persisted.
 func (a AgentTaskAction) Execute(action *v2.WorkflowAction, d interface{}, theAccount *v2.AccountSchema, wctx v2.WorkflowContext) error {
-	workflowData := d.(*v2.CreateAgentWorkflowData)
-
-	AgentModel, err := repositories.GetMongoClient().GetModel("Agent")
+	theAgent, err := d.(WorkflowData).Agent()
 	if err != nil {
 		return err
 	}
 
-	theAgent := &v2.AgentSchema{}
-	if err := AgentModel.FindOne(theAgent, bson.M{"apiKey": workflowData.APIKey}); err != nil {
-		return err
-	}
-
 	if action.TaskID == "" {
-		dedupeKey := agenttask.WorkflowDedupeKey(wctx.WorkflowID, wctx.ActionIdx)
+		dedupeKey := agenttask.WorkflowAttemptDedupeKey(wctx.WorkflowID, wctx.ActionIdx, action.Attempts)
+		if wctx.Compensation {
+			dedupeKey += ":compensation"
+		}
 
 		// The id can be lost between Enqueue returning and this workflow doc
 		// being persisted. Enqueue alone would only recover it while the task is
@@ -354,7 +424,7 @@ func (a AgentTaskAction) Execute(action *v2.WorkflowAction, d interface{}, theAc
 				action.TaskData,
 				dedupeKey,
 				v2.TaskTrigger{Type: v2.TaskTriggerWorkflow, WorkflowID: &wctx.WorkflowID},
-				agenttask.EnqueueOpts{},
+				agenttask.EnqueueOpts{RequestedBy: wctx.RequestedBy},
 			)
 			if err != nil {
 				return err
@@ -379,6 +449,11 @@ func (a AgentTaskAction) Execute(action *v2.WorkflowAction, d interface{}, theAc
 		return fmt.Errorf("task %s failed: %s", theTask.Action, theTask.LastError)
 	default:
 		if action.Timeout > 0 && time.Since(theTask.CreatedAt) > action.Timeout {
+			// The step gives up on the task, so the agent must too: left queued,
+			// it would still run after the step was retried or compensated.
+			if err := agenttask.Cancel(action.TaskID, "system"); err != nil {
+				logger.GetErrorLogger().Printf("error cancelling timed out task %s: %s", action.TaskID, err.Error())
+			}
 			return fmt.Errorf("timeout awaiting task %s", theTask.Action)
 		}
 		return nil
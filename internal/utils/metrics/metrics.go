@@ -0,0 +1,177 @@
+// Package metrics keeps the backend's counters, histograms and gauges in a
+// Prometheus registry of its own and serves it for scraping.
+//
+// Every series carries a replica label, so one replica's stuck dispatcher is
+// visible next to its healthy peers.
+package metrics
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultBuckets suit latencies from a few milliseconds to several minutes,
+// which covers both a claim and a mod install.
+var DefaultBuckets = []float64{0.005, 0.025, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// gaugeCacheTTL is how long a GaugeFunc's samples are served before it reads
+// them again. The gauges aggregate over whole collections, so each scraper
+// and each replica scraping at its own pace must not mean a query apiece.
+const gaugeCacheTTL = 15 * time.Second
+
+var replica = func() string {
+	name, _ := os.Hostname()
+	return name
+}()
+
+var registry = prometheus.NewRegistry()
+
+func constLabels() prometheus.Labels {
+	return prometheus.Labels{"replica": replica}
+}
+
+// CounterVec is a family of counters partitioned by labels.
+type CounterVec struct {
+	vec *prometheus.CounterVec
+}
+
+func newCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{vec: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        name,
+		Help:        help,
+		ConstLabels: constLabels(),
+	}, labels)}
+}
+
+// NewCounterVec registers a counter family. name should end in _total.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := newCounterVec(name, help, labels...)
+	registry.MustRegister(c.vec)
+	return c
+}
+
+// Inc adds one to the series with these label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.vec.WithLabelValues(values...).Inc()
+}
+
+// Add adds v to the series with these label values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	c.vec.WithLabelValues(values...).Add(v)
+}
+
+// HistogramVec is a family of histograms partitioned by labels.
+type HistogramVec struct {
+	vec *prometheus.HistogramVec
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	return &HistogramVec{vec: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        name,
+		Help:        help,
+		ConstLabels: constLabels(),
+		Buckets:     buckets,
+	}, labels)}
+}
+
+// NewHistogramVec registers a histogram family over the given upper bounds,
+// which must be sorted. A nil buckets means DefaultBuckets.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := newHistogramVec(name, help, buckets, labels...)
+	registry.MustRegister(h.vec)
+	return h
+}
+
+// Observe records v in the series with these label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.vec.WithLabelValues(values...).Observe(v)
+}
+
+// Sample is one gauge reading: label values in the family's order, and the
+// value.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// GaugeFunc is a gauge family for values that live in the database rather than
+// in this process. Its samples are read on a scrape and kept for
+// gaugeCacheTTL.
+type GaugeFunc struct {
+	desc    *prometheus.Desc
+	labels  int
+	collect func() ([]Sample, error)
+
+	mu      sync.Mutex
+	samples []Sample
+	readAt  time.Time
+}
+
+func newGaugeFunc(name, help string, collect func() ([]Sample, error), labels ...string) *GaugeFunc {
+	return &GaugeFunc{
+		desc:    prometheus.NewDesc(name, help, labels, constLabels()),
+		labels:  len(labels),
+		collect: collect,
+	}
+}
+
+// NewGaugeFunc registers a gauge family whose samples collect returns. A
+// collect error leaves the family out of that scrape rather than failing it.
+func NewGaugeFunc(name, help string, collect func() ([]Sample, error), labels ...string) *GaugeFunc {
+	g := newGaugeFunc(name, help, collect, labels...)
+	registry.MustRegister(g)
+	return g
+}
+
+// read returns the cached samples, collecting them again once they are older
+// than gaugeCacheTTL. Scrapes that arrive together wait on one collect. A
+// failed collect is not cached, so the next scrape tries again.
+func (g *GaugeFunc) read(now time.Time) []Sample {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.readAt.IsZero() && now.Sub(g.readAt) < gaugeCacheTTL {
+		return g.samples
+	}
+
+	samples, err := g.collect()
+	if err != nil {
+		return nil
+	}
+	g.samples = samples
+	g.readAt = now
+	return samples
+}
+
+// Describe implements prometheus.Collector.
+func (g *GaugeFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+// Collect implements prometheus.Collector.
+func (g *GaugeFunc) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range g.read(time.Now()) {
+		if len(s.Labels) != g.labels {
+			continue
+		}
+		m, err := prometheus.NewConstMetric(g.desc, prometheus.GaugeValue, s.Value, s.Labels...)
+		if err != nil {
+			continue
+		}
+		ch <- m
+	}
+}
+
+// Handler serves the registry. It is meant for the internal metrics listener,
+// not the public router: see cmd/backend.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
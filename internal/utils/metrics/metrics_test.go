@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+func render(t *testing.T, c prometheus.Collector) string {
+	t.Helper()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("error gathering: %s", err)
+	}
+
+	var b strings.Builder
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(&b, mf); err != nil {
+			t.Fatalf("error rendering: %s", err)
+		}
+	}
+	return b.String()
+}
+
+func TestCounterRendersOneSeriesPerLabelSet(t *testing.T) {
+	c := newCounterVec("jobs_total", "Jobs.", "action")
+	c.Inc("install")
+	c.Inc("install")
+	c.Add(3, "start")
+
+	out := render(t, c.vec)
+	for _, want := range []string{
+		"# TYPE jobs_total counter\n",
+		`jobs_total{action="install",replica="` + replica + `"} 2` + "\n",
+		`jobs_total{action="start",replica="` + replica + `"} 3` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in\n%s", want, out)
+		}
+	}
+}
+
+// Buckets are cumulative, and +Inf is the total count.
+func TestHistogramBucketsAreCumulative(t *testing.T) {
+	h := newHistogramVec("wait_seconds", "Wait.", []float64{1, 5})
+	h.Observe(0.5)
+	h.Observe(1)
+	h.Observe(3)
+	h.Observe(60)
+
+	out := render(t, h.vec)
+	labels := `replica="` + replica + `"`
+	for _, want := range []string{
+		"wait_seconds_bucket{" + labels + `,le="1"} 2`,
+		"wait_seconds_bucket{" + labels + `,le="5"} 3`,
+		"wait_seconds_bucket{" + labels + `,le="+Inf"} 4`,
+		"wait_seconds_sum{" + labels + "} 64.5",
+		"wait_seconds_count{" + labels + "} 4",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in\n%s", want, out)
+		}
+	}
+}
+
+func TestLabelValuesAreEscaped(t *testing.T) {
+	c := newCounterVec("errors_total", "Errors.", "error")
+	c.Inc("say \"hi\"\n")
+
+	if out := render(t, c.vec); !strings.Contains(out, `error="say \"hi\"\n"`) {
+		t.Fatalf("expected the value to be escaped, got %s", out)
+	}
+}
+
+func TestWrongLabelCountPanics(t *testing.T) {
+	c := newCounterVec("x_total", "X.", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a label count mismatch to panic")
+		}
+	}()
+	c.Inc("only-one")
+}
+
+// Scrapes inside the TTL are served from the last read; a failed read is not
+// kept, so the next scrape reads again.
+func TestGaugeFuncCachesItsSamples(t *testing.T) {
+	reads := 0
+	fail := false
+	g := newGaugeFunc("depth", "Depth.", func() ([]Sample, error) {
+		reads++
+		if fail {
+			return nil, errors.New("no database")
+		}
+		return []Sample{{Labels: []string{"install"}, Value: float64(reads)}}, nil
+	}, "action")
+
+	now := time.Now()
+	g.read(now)
+	g.read(now.Add(gaugeCacheTTL / 2))
+	if reads != 1 {
+		t.Fatalf("expected one read inside the TTL, got %d", reads)
+	}
+
+	fail = true
+	if got := g.read(now.Add(gaugeCacheTTL)); got != nil {
+		t.Fatalf("expected a failed read to leave the family out, got %v", got)
+	}
+	fail = false
+	if got := g.read(now.Add(gaugeCacheTTL + time.Second)); len(got) != 1 || got[0].Value != 3 {
+		t.Fatalf("expected the read after a failure to go to the database, got %v", got)
+	}
+}